@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 会签节点：节点的approvalOrgs不为空时，流程到达该节点后需要其中approvalQuorum个机构同意，
+// 达到数量后由链码自动流转到下一节点，下一节点的拥有人为会签节点的拥有人
+
+// =============================================================================
+// 是否为会签节点
+// =============================================================================
+func IsApprovalNode(node WorkflowNode) bool {
+	return len(node.ApprovalOrgs) > 0
+}
+
+// =============================================================================
+// 会签通过需要的同意机构数，未设置时需要全部会签机构同意
+// =============================================================================
+func GetApprovalQuorum(node WorkflowNode) int {
+	if node.ApprovalQuorum == 0 {
+		return len(node.ApprovalOrgs)
+	}
+	return node.ApprovalQuorum
+}
+
+// =============================================================================
+// 流程到达节点时的待会签机构，非会签节点返回nil
+// =============================================================================
+func GetPendingApprovers(node WorkflowNode) []string {
+	if !IsApprovalNode(node) {
+		return nil
+	}
+	return append([]string{}, node.ApprovalOrgs...)
+}
+
+// =============================================================================
+// 校验会签节点的设置
+// 会签节点不能并行分支，自动流转时只能有一个下一节点或按路由条件选择下一节点
+// =============================================================================
+func ValidateApprovalNode(node WorkflowNode, nextCount int, conditional bool) error {
+	if !IsApprovalNode(node) {
+		if node.ApprovalQuorum != 0 {
+			return errors.New("Approval quorum requires approvalOrgs - " + node.Id)
+		}
+		return nil
+	}
+	if len(RemoveRepStringByMap(node.ApprovalOrgs)) != len(node.ApprovalOrgs) {
+		return errors.New("Duplicate approval orgs of node - " + node.Id)
+	}
+	if node.ApprovalQuorum < 0 || node.ApprovalQuorum > len(node.ApprovalOrgs) {
+		return errors.New("Approval quorum must be between 1 and the number of approval orgs - " + node.Id)
+	}
+	if node.SplitType == "parallel" {
+		return errors.New("Approval node can not split into parallel branches - " + node.Id)
+	}
+	if nextCount > 1 && !conditional {
+		return errors.New("Approval node must have a single next node or routes - " + node.Id)
+	}
+	return nil
+}
+
+// =============================================================================
+// 查找提交机构待会签的分支
+// 指定了节点ID时按节点查找，否则查找提交机构待会签的唯一分支
+// =============================================================================
+func FindApprovalBranch(branches []ProcessBranch, orgName string, nodeId string) (int, error) {
+	found := -1
+	for i := 0; i < len(branches); i++ {
+		if branches[i].Waiting || (nodeId != "" && branches[i].NodeId != nodeId) {
+			continue
+		}
+		if ContainsString(branches[i].ApprovedOrgs, orgName) {
+			if nodeId != "" {
+				return -1, errors.New("The process has been approved by " + orgName)
+			}
+			continue
+		}
+		if !ContainsString(branches[i].PendingApprovers, orgName) {
+			continue
+		}
+		if found != -1 {
+			return -1, errors.New("More than one branch is waiting for approval of " + orgName + ", please specify the node id")
+		}
+		found = i
+	}
+	if found == -1 {
+		return -1, errors.New("You are not allowed to approve the process - " + orgName)
+	}
+	return found, nil
+}
+
+// =============================================================================
+// 会签同意
+// 参数：流程实例ID、意见、业务日期、并行时的分支节点ID（可选）
+// 同意机构数达到要求时自动流转到下一节点，最后一个节点时结束流程
+// =============================================================================
+func approve_process(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting approve_process")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	processId := args[0]
+	remark := args[1]
+	businessDate := args[2]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	branchNodeId := ""
+	if len(args) == 4 {
+		branchNodeId = args[3]
+	}
+
+	process, err := GetProcessById(stub, processId)
+	if err != nil {
+		fmt.Println("This process does not exists - " + processId)
+		return shim.Error("This process does not exists - " + processId)
+	}
+	if process.Canceled {
+		fmt.Println("This process has been canceled - " + processId)
+		return shim.Error("This process has been canceled - " + processId)
+	}
+	if process.Finished {
+		fmt.Println("This process has been finished - " + processId)
+		return shim.Error("This process has been finished - " + processId)
+	}
+
+	// 提交机构可以代理委托机构会签，优先以本机构会签
+	actingOrgs, err := GetActingOrgs(stub, submitterOrgName, process.WorkflowId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// find the branch to approve
+	branches := GetProcessBranches(process)
+	branchIndex, err := FindApprovalBranch(branches, submitterOrgName, branchNodeId)
+	approverOrgName := submitterOrgName
+	for _, orgName := range actingOrgs[1:] {
+		if branchIndex != -1 {
+			break
+		}
+		if index, findErr := FindApprovalBranch(branches, orgName, branchNodeId); findErr == nil {
+			branchIndex, approverOrgName, err = index, orgName, nil
+		}
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	branch := branches[branchIndex]
+
+	currentNode, err := GetWorkflowNodeById(stub, branch.NodeId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check submitter's role of current node
+	err = CheckSubmitterRole(stub, currentNode.AccessRoles)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// 记录同意的机构
+	var pendingApprovers []string
+	for _, org := range branch.PendingApprovers {
+		if org != approverOrgName {
+			pendingApprovers = append(pendingApprovers, org)
+		}
+	}
+	branch.PendingApprovers = pendingApprovers
+	branch.ApprovedOrgs = append(branch.ApprovedOrgs, approverOrgName)
+	branches[branchIndex] = branch
+
+	var logs []ProcessLog
+	logs = append(logs, ProcessLog{
+		ProcessId:    processId,
+		FromNodeId:   currentNode.Id,
+		FromNodeName: currentNode.NodeName,
+		FromOrg:      approverOrgName,
+		ToNodeId:     currentNode.Id,
+		ToNodeName:   currentNode.NodeName,
+		ToOrg:        branch.Owner,
+		Operation:    "ApproveProcess",
+		Remark:       remark,
+		BusinessDate: businessDate,
+	})
+
+	quorum := GetApprovalQuorum(currentNode)
+	if len(branch.ApprovedOrgs) >= quorum {
+		// 会签通过，自动流转
+		log := ProcessLog{
+			ProcessId:    processId,
+			FromNodeId:   currentNode.Id,
+			FromNodeName: currentNode.NodeName,
+			FromOrg:      branch.Owner,
+			Operation:    "TransferProcess",
+			Remark:       "会签通过 " + strconv.Itoa(len(branch.ApprovedOrgs)) + "/" + strconv.Itoa(len(currentNode.ApprovalOrgs)) + "：" + strings.Join(branch.ApprovedOrgs, ","),
+			BusinessDate: businessDate,
+		}
+		err = AutoTransferBranch(stub, &process, branches, branchIndex, currentNode, &log, txTime)
+		if err != nil {
+			fmt.Println(err.Error())
+			return shim.Error(err.Error())
+		}
+		logs = append(logs, log)
+	} else {
+		SetProcessBranches(&process, branches)
+	}
+
+	process.LastModifier = submitter
+	process.ModifyTime = modifyTime
+	process.BusinessDate = businessDate
+	if !ContainsString(process.Participants, submitterOrgName) {
+		process.Participants = append(process.Participants, submitterOrgName)
+	}
+
+	// 会签通过后到达子流程节点时启动子流程
+	err = StartSubProcesses(stub, &process, submitter, businessDate)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	err = PutProcess(stub, process)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// store logs
+	err = SaveProcessLogs(stub, false, logs...)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 子流程办结时继续处理父流程
+	if process.Finished {
+		err = CompleteSubProcess(stub, process, submitter, modifyTime, businessDate)
+		if err != nil {
+			fmt.Println(err.Error())
+			return shim.Error(err.Error())
+		}
+	}
+
+	fmt.Println("- end approve_process")
+	return shim.Success(nil)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 创建一个带会签节点的线性工作流：3个机构中2个同意即通过
+func MockCreateApprovalWorkflow(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_linear_workflow"),
+		[]byte(`{"id":"test_approval_workflow-001","workflowName":"测试会签流程001","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`{"nodeName":"发起行","accessOrgs":["@org1.example.com"]}`),
+		[]byte(`{"nodeName":"联合确认","accessOrgs":["@org1.example.com"],"approvalOrgs":["@org1.example.com","@org2.example.com","@org3.example.com"],"approvalQuorum":2}`),
+		[]byte(`{"nodeName":"发行机构","accessOrgs":["@org1.example.com"]}`),
+	})
+	return response
+}
+
+// mock 以指定机构的身份会签
+func MockApproveProcess(t *testing.T, stub *shim.MockStub, submitter string) pb.Response {
+	name := mockSubmitterName
+	mockSubmitterName = submitter
+	defer func() { mockSubmitterName = name }()
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("approve_process"),
+		[]byte("test_process_006"),
+		[]byte("同意"),
+		[]byte("2018-03-16 15:54:00"),
+	})
+	return response
+}
+
+// 测试会签节点的设置
+func Test_ValidateApprovalNode(t *testing.T) {
+	node := WorkflowNode{Id: "node", ApprovalOrgs: []string{"@org1.example.com", "@org2.example.com"}}
+	if ValidateApprovalNode(node, 1, false) != nil || GetApprovalQuorum(node) != 2 {
+		fmt.Println("未设置数量时需要全部机构同意")
+		t.FailNow()
+	}
+	node.ApprovalQuorum = 3
+	if ValidateApprovalNode(node, 1, false) == nil {
+		fmt.Println("同意数量超过会签机构数应报错")
+		t.FailNow()
+	}
+	node.ApprovalQuorum = 1
+	if ValidateApprovalNode(node, 2, false) == nil {
+		fmt.Println("会签节点有多个下一节点且没有路由时应报错")
+		t.FailNow()
+	}
+	node.SplitType = "parallel"
+	if ValidateApprovalNode(node, 1, false) == nil {
+		fmt.Println("会签节点并行分支应报错")
+		t.FailNow()
+	}
+}
+
+// 测试会签
+func Test_ApproveProcess(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	response := MockCreateApprovalWorkflow(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	MockCreateProject2(t, stub)
+	stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("start_process"),
+		[]byte(`{"id":"test_process_006","workflowId":"test_approval_workflow-001","attachDocType":"project","attachDocId":"project-bankcomm-000002","createTime":"2018-3-19 09:43:02"}`),
+	})
+	transferArgs := [][]byte{
+		[]byte("transfer_process"),
+		[]byte("test_process_006"),
+		[]byte("test_approval_workflow-001:node-2"),
+		[]byte("@org1.example.com"),
+		[]byte("2018-03-16 15:54:00"),
+	}
+	response = stub.MockInvoke(GetTestTxID(), transferArgs)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var process Process
+	json.Unmarshal(stub.State["test_process_006"], &process)
+	if len(process.PendingApprovers) != 3 {
+		fmt.Println("应有3个待会签机构")
+		t.FailNow()
+	}
+
+	// 会签节点不能直接流转
+	transferArgs[2] = []byte("test_approval_workflow-001:node-3")
+	response = stub.MockInvoke(GetTestTxID(), transferArgs)
+	if response.Status != shim.ERROR {
+		fmt.Println("会签节点不能直接流转")
+		t.FailNow()
+	}
+
+	// 待会签机构的待办中可以查到
+	name := mockSubmitterName
+	mockSubmitterName = "Test@org2.example.com"
+	response = MockQueryTodoProcess(t, stub)
+	mockSubmitterName = name
+	var todos []Process
+	json.Unmarshal(response.Payload, &todos)
+	if len(todos) != 1 || !ContainsString(todos[0].PendingApprovers, "@org2.example.com") {
+		fmt.Println("待会签机构的待办应包含流程")
+		t.FailNow()
+	}
+
+	// 非会签机构不能会签
+	response = MockApproveProcess(t, stub, "Test@org4.example.com")
+	if response.Status != shim.ERROR {
+		fmt.Println("非会签机构不能会签")
+		t.FailNow()
+	}
+	response = MockApproveProcess(t, stub, "Test@org2.example.com")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	// 不能重复会签
+	response = MockApproveProcess(t, stub, "Test@org2.example.com")
+	if response.Status != shim.ERROR {
+		fmt.Println("不能重复会签")
+		t.FailNow()
+	}
+	json.Unmarshal(stub.State["test_process_006"], &process)
+	if process.CurrentNodeId != "test_approval_workflow-001:node-2" || len(process.PendingApprovers) != 2 || len(process.ApprovedOrgs) != 1 {
+		fmt.Println("未达到同意数量时应停留在会签节点")
+		t.FailNow()
+	}
+
+	// 达到同意数量后自动流转
+	response = MockApproveProcess(t, stub, "Test@org3.example.com")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	process = Process{}
+	json.Unmarshal(stub.State["test_process_006"], &process)
+	if process.CurrentNodeId != "test_approval_workflow-001:node-3" || process.CurrentOwner != "@org1.example.com" || len(process.PendingApprovers) != 0 {
+		fmt.Println("会签通过后应流转到下一节点")
+		t.FailNow()
+	}
+	operations := []string{"InitProcess", "TransferProcess", "ApproveProcess", "ApproveProcess", "TransferProcess"}
+	for seq, operation := range operations {
+		var log ProcessLog
+		json.Unmarshal(stub.State["processLog-test_process_006-"+IndexSeq(seq)], &log)
+		if log.Seq != seq || log.Operation != operation {
+			fmt.Println("日志不正确 - " + IndexSeq(seq))
+			t.FailNow()
+		}
+	}
+
+	// 退回到会签节点时重新会签
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("return_process"),
+		[]byte("test_process_006"),
+		[]byte("2018-03-16 15:54:00"),
+	})
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	process = Process{}
+	json.Unmarshal(stub.State["test_process_006"], &process)
+	if process.CurrentNodeId != "test_approval_workflow-001:node-2" || len(process.PendingApprovers) != 3 || len(process.ApprovedOrgs) != 0 {
+		fmt.Println("退回后应重新会签")
+		t.FailNow()
+	}
+}
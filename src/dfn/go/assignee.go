@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 流程认领：流程的拥有人是机构，机构内的用户（证书的CN）可以认领流程，
+// 认领后只有认领人可以流转和退回；流程进入新的节点或更换拥有机构时清空认领人
+
+// 待办的认领过滤条件
+var assigneeFilters = []string{"mine", "unassigned", "all"}
+
+// =============================================================================
+// 认领流程
+// 参数：流程ID、业务日期、分支所在节点ID（可选，有多个分支时指定）
+// =============================================================================
+func claim_process(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting claim_process")
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	branchNodeId := ""
+	if len(args) == 3 {
+		branchNodeId = args[2]
+	}
+
+	err = ChangeProcessAssignee(stub, "ClaimProcess", args[0], submitter, args[1], branchNodeId)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end claim_process")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 取消认领，只有认领人可以取消
+// 参数：流程ID、业务日期、分支所在节点ID（可选，有多个分支时指定）
+// =============================================================================
+func unclaim_process(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting unclaim_process")
+
+	if len(args) != 2 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	branchNodeId := ""
+	if len(args) == 3 {
+		branchNodeId = args[2]
+	}
+
+	err = ChangeProcessAssignee(stub, "UnclaimProcess", args[0], "", args[1], branchNodeId)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end unclaim_process")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 转派流程给拥有机构内的其他用户
+// 参数：流程ID、认领人（证书的CN）、业务日期、分支所在节点ID（可选，有多个分支时指定）
+// =============================================================================
+func reassign_process(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting reassign_process")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	branchNodeId := ""
+	if len(args) == 4 {
+		branchNodeId = args[3]
+	}
+
+	err = ChangeProcessAssignee(stub, "ReassignProcess", args[0], args[1], args[2], branchNodeId)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end reassign_process")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 修改分支的认领人并记录日志，节点和拥有机构不变
+// 提交者机构必须是分支的拥有机构或代理拥有机构，认领人的机构同样如此，认领时还需具备节点的角色
+// =============================================================================
+func ChangeProcessAssignee(stub shim.ChaincodeStubInterface, operation string, processId string, assignee string, businessDate string, branchNodeId string) error {
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return err
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return err
+	}
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return err
+	}
+
+	process, err := GetProcessById(stub, processId)
+	if err != nil {
+		return errors.New("This process does not exists - " + processId)
+	}
+	if process.Canceled {
+		return errors.New("This process has been canceled - " + processId)
+	}
+	if process.Finished {
+		return errors.New("This process has been finished - " + processId)
+	}
+
+	actingOrgs, err := GetActingOrgs(stub, submitterOrgName, process.WorkflowId)
+	if err != nil {
+		return err
+	}
+	branches := GetProcessBranches(process)
+	branchIndex, err := FindProcessBranch(branches, actingOrgs, branchNodeId)
+	if err != nil {
+		return err
+	}
+	branch := branches[branchIndex]
+	if !ContainsString(actingOrgs, branch.Owner) {
+		return errors.New("You are not allowed to assign the process - " + submitterOrgName)
+	}
+
+	remark := ""
+	switch operation {
+	case "ClaimProcess":
+		if branch.Assignee != "" {
+			return errors.New("This process has been claimed by - " + branch.Assignee)
+		}
+		// 认领人需要具备节点的角色，与流转时的要求一致
+		node, err := GetWorkflowNodeById(stub, branch.NodeId)
+		if err != nil {
+			return err
+		}
+		err = CheckSubmitterRole(stub, node.AccessRoles)
+		if err != nil {
+			return err
+		}
+		remark = "认领：" + assignee
+	case "UnclaimProcess":
+		if branch.Assignee != submitter {
+			return errors.New("You have not claimed the process - " + processId)
+		}
+		remark = "取消认领：" + submitter
+	case "ReassignProcess":
+		if assignee == "" || assignee == branch.Assignee {
+			return errors.New("Assignee must be another user - " + assignee)
+		}
+		assigneeOrgName, err := GetOrgFromCertCommonName(assignee)
+		if err != nil {
+			return err
+		}
+		assigneeActingOrgs, err := GetActingOrgs(stub, assigneeOrgName, process.WorkflowId)
+		if err != nil {
+			return err
+		}
+		if !ContainsString(assigneeActingOrgs, branch.Owner) {
+			return errors.New("Assignee is not allowed to handle the process - " + assignee)
+		}
+		remark = "转派：" + branch.Assignee + " -> " + assignee
+	default:
+		return errors.New("Received unknown operation - " + operation)
+	}
+
+	branch.Assignee = assignee
+	branches[branchIndex] = branch
+	SetProcessBranches(&process, branches)
+	process.LastModifier = submitter
+	process.ModifyTime = modifyTime
+	process.BusinessDate = businessDate
+
+	err = PutProcess(stub, process)
+	if err != nil {
+		return err
+	}
+	return StoreProcessLog(stub, false, process.Id, branch.NodeId, branch.NodeName, branch.Owner, branch.NodeId, branch.NodeName, branch.Owner, operation, remark, businessDate)
+}
+
+// =============================================================================
+// 按认领人过滤待办
+// mine：提交者认领的；unassigned：未被认领的，包括待会签；all：不过滤
+// orgNames为提交者机构及其代理的机构
+// =============================================================================
+func FilterProcessesByAssignee(processes []Process, submitter string, orgNames []string, filter string) []Process {
+	if filter == "all" {
+		return processes
+	}
+	results := []Process{}
+	for _, process := range processes {
+		for _, branch := range GetProcessBranches(process) {
+			if branch.Waiting || branch.Blocked {
+				continue
+			}
+			owned := ContainsString(orgNames, branch.Owner)
+			if filter == "mine" && owned && branch.Assignee == submitter ||
+				filter == "unassigned" && (owned && branch.Assignee == "" || ContainsAnyString(branch.PendingApprovers, orgNames)) {
+				results = append(results, process)
+				break
+			}
+		}
+	}
+	return results
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 以指定用户的身份调用方法
+func MockInvokeAsUser(t *testing.T, stub *shim.MockStub, submitter string, function string, args ...string) pb.Response {
+	name := mockSubmitterName
+	mockSubmitterName = submitter
+	defer func() { mockSubmitterName = name }()
+	invokeArgs := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		invokeArgs = append(invokeArgs, []byte(arg))
+	}
+	return stub.MockInvoke(GetTestTxID(), invokeArgs)
+}
+
+// mock 以指定用户的身份按认领人查询待办
+func MockQueryTodoByAssignee(t *testing.T, stub *shim.MockStub, submitter string, filter string) []Process {
+	response := MockInvokeAsUser(t, stub, submitter, "query_todo_process", filter)
+	var processes []Process
+	json.Unmarshal(response.Payload, &processes)
+	return processes
+}
+
+// 测试机构内用户认领、转派流程
+func Test_ClaimProcess(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateLinearWorkflow1(t, stub)
+	MockCreateProject2(t, stub)
+	MockStartProcess1(t, stub)
+	processId := "test_process_002:test_linear_workflow-001"
+
+	if len(MockQueryTodoByAssignee(t, stub, "Alice@org1.example.com", "unassigned")) != 1 || len(MockQueryTodoByAssignee(t, stub, "Alice@org1.example.com", "mine")) != 0 {
+		fmt.Println("未认领的流程应在未认领待办中")
+		t.FailNow()
+	}
+
+	response := MockInvokeAsUser(t, stub, "Alice@org1.example.com", "claim_process", processId, "2018-03-16 15:54:00")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var process Process
+	json.Unmarshal(stub.State[processId], &process)
+	if process.Assignee != "Alice@org1.example.com" {
+		fmt.Println("认领人应为Alice")
+		t.FailNow()
+	}
+	var log ProcessLog
+	json.Unmarshal(stub.State["processLog-"+processId+"-"+IndexSeq(1)], &log)
+	if log.Operation != "ClaimProcess" || log.Actor != "Alice@org1.example.com" || log.ToOrg != "@org1.example.com" {
+		fmt.Println("应记录认领日志和操作用户")
+		t.FailNow()
+	}
+	if len(MockQueryTodoByAssignee(t, stub, "Alice@org1.example.com", "mine")) != 1 || len(MockQueryTodoByAssignee(t, stub, "Bob@org1.example.com", "mine")) != 0 ||
+		len(MockQueryTodoByAssignee(t, stub, "Bob@org1.example.com", "unassigned")) != 0 || len(MockQueryTodoByAssignee(t, stub, "Bob@org1.example.com", "all")) != 1 {
+		fmt.Println("已认领的流程只在认领人的待办中")
+		t.FailNow()
+	}
+
+	// 其他用户不能重复认领、取消认领或流转
+	response = MockInvokeAsUser(t, stub, "Bob@org1.example.com", "claim_process", processId, "2018-03-16 15:54:00")
+	if response.Status != shim.ERROR {
+		fmt.Println("已认领的流程不能重复认领")
+		t.FailNow()
+	}
+	response = MockInvokeAsUser(t, stub, "Bob@org1.example.com", "unclaim_process", processId, "2018-03-16 15:54:00")
+	if response.Status != shim.ERROR {
+		fmt.Println("只有认领人可以取消认领")
+		t.FailNow()
+	}
+	response = MockInvokeAsUser(t, stub, "Bob@org1.example.com", "transfer_process", processId, "test_linear_workflow-001:node-2", "@org1.example.com", "2018-03-16 15:54:00")
+	if response.Status != shim.ERROR {
+		fmt.Println("只有认领人可以流转")
+		t.FailNow()
+	}
+
+	// 只能转派给拥有机构内的用户
+	response = MockInvokeAsUser(t, stub, "Alice@org1.example.com", "reassign_process", processId, "Carol@org2.example.com", "2018-03-16 15:54:00")
+	if response.Status != shim.ERROR {
+		fmt.Println("不能转派给其他机构的用户")
+		t.FailNow()
+	}
+	response = MockInvokeAsUser(t, stub, "Alice@org1.example.com", "reassign_process", processId, "Bob@org1.example.com", "2018-03-16 15:54:00")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	response = MockInvokeAsUser(t, stub, "Bob@org1.example.com", "transfer_process", processId, "test_linear_workflow-001:node-2", "@org1.example.com", "2018-03-16 15:54:00")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	process = Process{}
+	json.Unmarshal(stub.State[processId], &process)
+	json.Unmarshal(stub.State["processLog-"+processId+"-"+IndexSeq(3)], &log)
+	if process.Assignee != "" || log.Operation != "TransferProcess" || log.Actor != "Bob@org1.example.com" {
+		fmt.Println("流转到新节点后应清空认领人")
+		t.FailNow()
+	}
+}
+
+// 测试认领时检查节点的角色
+func Test_ClaimProcessRole(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateRoleWorkflow(t, stub)
+	process := Process{
+		DocType:         "process",
+		Id:              "test_process_005:test_role_workflow-001",
+		WorkflowId:      "test_role_workflow-001",
+		CurrentNodeId:   "test_role_workflow-001:node-2",
+		CurrentNodeName: "信贷审批",
+		CurrentOwner:    "@org1.example.com",
+		Creator:         "Test@org1.example.com",
+	}
+	processAsBytes, _ := json.Marshal(process)
+	stub.MockTransactionStart(GetTestTxID())
+	stub.PutState(process.Id, processAsBytes)
+	stub.MockTransactionEnd(GetTestTxID())
+
+	response := MockInvokeAsUser(t, stub, "Alice@org1.example.com", "claim_process", process.Id, "2018-03-16 15:54:00")
+	if response.Status != shim.ERROR {
+		fmt.Println("缺少节点的角色时不能认领")
+		t.FailNow()
+	}
+
+	roles := mockSubmitterRoles
+	mockSubmitterRoles = append([]string{"credit-committee"}, roles...)
+	defer func() { mockSubmitterRoles = roles }()
+	response = MockInvokeAsUser(t, stub, "Alice@org1.example.com", "claim_process", process.Id, "2018-03-16 15:54:00")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+}
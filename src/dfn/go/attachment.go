@@ -1,12 +1,354 @@
 package main
 
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
 // ----- Attachment ----- //
+// 链下文件的登记：链上只保存文件的SHA-256，用于核验文件是否被篡改
 type Attachment struct {
-	DocType       string `json:"docType"`
-	Id            string `json:"id"`
-	FileName      string `json:"fileName"`
-	FileHash      string `json:"fileHash"`     // 文件Hash值
-	FileType      string `json:"fileType"`     // 文件类型
-	Creator       string `json:"creator"`      // 创建人
-	LastModifiers string `json:"lastModifier"` // 最后修改人
+	DocType      string `json:"docType"`
+	Id           string `json:"id"`
+	FileName     string `json:"fileName"`
+	FileHash     string `json:"fileHash"`     // 文件Hash值，SHA-256的十六进制小写字符串
+	FileType     string `json:"fileType"`     // 文件类型
+	LinkDocType  string `json:"linkDocType"`  // 关联的文档类型：project、process 或 processLog
+	LinkDocId    string `json:"linkDocId"`    // 关联的文档ID
+	Creator      string `json:"creator"`      // 创建人
+	LastModifier string `json:"lastModifier"` // 最后修改人
+	CreateTime   string `json:"createTime"`   // 创建时间
+	ModifyTime   string `json:"modifyTime"`   // 修改时间
+	BusinessDate string `json:"businessDate"` // 业务日期，客户端传入
+}
+
+// 文件Hash的核验结果
+type AttachmentVerification struct {
+	FileHash    string       `json:"fileHash"`
+	Matched     bool         `json:"matched"`     // 是否有登记的附件与文件Hash一致
+	Attachments []Attachment `json:"attachments"` // 文件Hash一致的附件
+}
+
+// =============================================================================
+// 登记附件
+// 登记后不能修改，同一文件关联多个文档时分别登记
+// =============================================================================
+func register_attachment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	var attachment Attachment
+	fmt.Println("starting register_attachment")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	err = json.Unmarshal([]byte(args[0]), &attachment)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	creator, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	creatorOrgName, err := GetOrgFromCertCommonName(creator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//check if attachment id already exists, including keys of other documents
+	exists, err := KeyExists(stub, attachment.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if exists {
+		fmt.Println("This attachment already exists - " + attachment.Id)
+		return shim.Error("This attachment already exists - " + attachment.Id)
+	}
+
+	attachment.FileHash = strings.ToLower(attachment.FileHash)
+	err = ValidateAttachment(attachment)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// 只能关联到本机构可见的文档
+	visible, err := CanOrgSeeLinkDoc(stub, attachment.LinkDocType, attachment.LinkDocId, creatorOrgName)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	if !visible {
+		fmt.Println("You are not allowed to attach to the document - " + attachment.LinkDocId)
+		return shim.Error("You are not allowed to attach to the document - " + attachment.LinkDocId)
+	}
+
+	// 客户端传入的创建时间作为业务日期
+	if attachment.BusinessDate == "" {
+		attachment.BusinessDate = attachment.CreateTime
+	}
+	createTime, err := GetModifyTime(stub, attachment.BusinessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	attachment.DocType = "attachment"
+	attachment.Creator = creator
+	attachment.LastModifier = creator
+	attachment.CreateTime = createTime
+	attachment.ModifyTime = createTime
+
+	attachmentAsBytes, _ := json.Marshal(attachment)
+	err = stub.PutState(attachment.Id, attachmentAsBytes) //store with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = UpdateIndexes(stub, nil, []IndexEntry{
+		{Name: DocTypeIndex, Attributes: []string{"attachment", attachment.Id}},
+		{Name: AttachmentDocIndex, Attributes: []string{attachment.LinkDocType, attachment.LinkDocId, attachment.Id}},
+		{Name: AttachmentHashIndex, Attributes: []string{attachment.FileHash, attachment.Id}},
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end register_attachment")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 校验附件，文件Hash为SHA-256的十六进制字符串
+// =============================================================================
+func ValidateAttachment(attachment Attachment) error {
+	if attachment.Id == "" {
+		return errors.New("Attachment id is required")
+	}
+	if attachment.FileName == "" {
+		return errors.New("File name of attachment is required")
+	}
+	if err := ValidateFileHash(attachment.FileHash); err != nil {
+		return err
+	}
+	if attachment.LinkDocId == "" {
+		return errors.New("LinkDocId of attachment is required")
+	}
+	return nil
+}
+
+// 文件Hash必须是SHA-256的十六进制字符串
+func ValidateFileHash(fileHash string) error {
+	hash, err := hex.DecodeString(fileHash)
+	if err != nil || len(hash) != 32 {
+		return errors.New("File hash must be a SHA-256 hex string - " + fileHash)
+	}
+	return nil
+}
+
+// =============================================================================
+// 判断机构是否可见附件关联的文档
+// =============================================================================
+func CanOrgSeeLinkDoc(stub shim.ChaincodeStubInterface, linkDocType string, linkDocId string, orgName string) (bool, error) {
+	switch linkDocType {
+	case "project":
+		project, err := GetProjectById(stub, linkDocId)
+		if err != nil {
+			return false, err
+		}
+		return CanOrgSeeProject(stub, project, orgName)
+	case "process":
+		process, err := GetProcessById(stub, linkDocId)
+		if err != nil {
+			return false, err
+		}
+		return CanOrgSeeProcess(process, orgName), nil
+	case "processLog":
+		var log ProcessLog
+		logAsBytes, err := stub.GetState(linkDocId)
+		if err != nil {
+			return false, err
+		}
+		json.Unmarshal(logAsBytes, &log)
+		if log.Id != linkDocId || log.DocType != "processLog" {
+			return false, errors.New("Process log does not exist - " + linkDocId)
+		}
+		process, err := GetProcessById(stub, log.ProcessId)
+		if err != nil {
+			return false, err
+		}
+		return CanOrgSeeProcess(process, orgName), nil
+	default:
+		return false, errors.New("Received unknown DocType - " + linkDocType)
+	}
+}
+
+// =============================================================================
+// Get Attachment By id
+// =============================================================================
+func GetAttachmentById(stub shim.ChaincodeStubInterface, id string) (Attachment, error) {
+	var data Attachment
+	dataAsBytes, err := stub.GetState(id) //getState retreives a key/value from the ledger
+	if err != nil {                       //this seems to always succeed, even if key didn't exist
+		return data, errors.New("Failed to find attachment - " + id)
+	}
+	json.Unmarshal(dataAsBytes, &data) //un stringify it aka JSON.parse()
+
+	if data.Id != id || data.DocType != "attachment" {
+		return data, errors.New("Attachment does not exist - " + id)
+	}
+
+	return data, nil
+}
+
+// =============================================================================
+// 附件详情
+// =============================================================================
+func get_attachment_by_id(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting get_attachment_by_id")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	id := args[0]
+	attachment, err := GetAttachmentById(stub, id)
+	if err != nil {
+		fmt.Println("This attachment does not exist - " + id)
+		return shim.Error("This attachment does not exist - " + id)
+	}
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	visible, err := CanOrgSeeLinkDoc(stub, attachment.LinkDocType, attachment.LinkDocId, submitterOrgName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !visible {
+		fmt.Println("You are not allowed to see the attachment - " + id)
+		return shim.Error("You are not allowed to see the attachment - " + id)
+	}
+
+	attachmentAsBytes, _ := json.Marshal(attachment)
+
+	fmt.Println("- end get_attachment_by_id")
+	return shim.Success(attachmentAsBytes)
+}
+
+// =============================================================================
+// 查询文档的附件
+// 参数：关联的文档类型、文档ID、分页参数pageSize和bookmark（可选）
+// =============================================================================
+func query_attachments_by_doc(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting query_attachments_by_doc")
+
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 to 4")
+	}
+
+	linkDocType := args[0]
+	linkDocId := args[1]
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[2:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	visible, err := CanOrgSeeLinkDoc(stub, linkDocType, linkDocId, submitterOrgName)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	if !visible {
+		fmt.Println("You are not allowed to see the document - " + linkDocId)
+		return shim.Error("You are not allowed to see the document - " + linkDocId)
+	}
+
+	result, err := GetPagingQueryResult(stub, GetAttachmentsQueryByDoc(linkDocType, linkDocId), pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end query_attachments_by_doc")
+	return shim.Success(result)
+}
+
+// 文档的附件的查询语句
+func GetAttachmentsQueryByDoc(linkDocType string, linkDocId string) *Query {
+	return NewQuery("attachment").Eq("linkDocType", linkDocType).Eq("linkDocId", linkDocId).
+		UseIndex("indexAttachmentsByDoc").ScanIndex(AttachmentDocIndex, linkDocType, linkDocId)
+}
+
+// 文件Hash一致的附件的查询语句
+func GetAttachmentsQueryByHash(fileHash string) *Query {
+	return NewQuery("attachment").Eq("fileHash", fileHash).
+		UseIndex("indexAttachmentsByHash").ScanIndex(AttachmentHashIndex, fileHash)
+}
+
+// =============================================================================
+// 核验文件Hash
+// 参数：文件Hash、关联的文档类型和文档ID（可选，只核验该文档的附件）
+// 只返回提交者机构可见的附件
+// =============================================================================
+func verify_attachment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting verify_attachment")
+
+	if len(args) != 1 && len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 3")
+	}
+
+	fileHash := strings.ToLower(args[0])
+	err = ValidateFileHash(fileHash)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultAsBytes, err := ExecuteQuery(stub, GetAttachmentsQueryByHash(fileHash))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var attachments []Attachment
+	err = json.Unmarshal(resultAsBytes, &attachments)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	verification := AttachmentVerification{FileHash: fileHash, Attachments: []Attachment{}}
+	for _, attachment := range attachments {
+		if len(args) == 3 && (attachment.LinkDocType != args[1] || attachment.LinkDocId != args[2]) {
+			continue
+		}
+		visible, err := CanOrgSeeLinkDoc(stub, attachment.LinkDocType, attachment.LinkDocId, submitterOrgName)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if visible {
+			verification.Attachments = append(verification.Attachments, attachment)
+		}
+	}
+	verification.Matched = len(verification.Attachments) > 0
+
+	verificationAsBytes, _ := json.Marshal(verification)
+
+	fmt.Println("- end verify_attachment")
+	return shim.Success(verificationAsBytes)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 测试文件的SHA-256
+const testFileHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+// mock 以指定机构的身份登记附件
+func MockRegisterAttachment(t *testing.T, stub *shim.MockStub, submitter string, attachment string) pb.Response {
+	name := mockSubmitterName
+	mockSubmitterName = submitter
+	defer func() { mockSubmitterName = name }()
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("register_attachment"),
+		[]byte(attachment),
+	})
+	return response
+}
+
+// mock 以指定机构的身份核验文件Hash
+func MockVerifyAttachment(t *testing.T, stub *shim.MockStub, submitter string, args ...string) AttachmentVerification {
+	name := mockSubmitterName
+	mockSubmitterName = submitter
+	defer func() { mockSubmitterName = name }()
+	invokeArgs := [][]byte{[]byte("verify_attachment")}
+	for _, arg := range args {
+		invokeArgs = append(invokeArgs, []byte(arg))
+	}
+	response := stub.MockInvoke(GetTestTxID(), invokeArgs)
+	var verification AttachmentVerification
+	json.Unmarshal(response.Payload, &verification)
+	return verification
+}
+
+// 测试附件的登记、查询和核验
+func Test_Attachment(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateLinearWorkflow1(t, stub)
+	MockCreateProject2(t, stub)
+	MockStartProcess1(t, stub)
+
+	response := MockRegisterAttachment(t, stub, "Test@org1.example.com", `{"id":"attachment-001","fileName":"募集说明书.pdf","fileHash":"`+strings.ToUpper(testFileHash)+`","fileType":"prospectus","linkDocType":"project","linkDocId":"project-bankcomm-000002","createTime":"2018-3-16 16:08:51"}`)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var attachment Attachment
+	json.Unmarshal(stub.State["attachment-001"], &attachment)
+	if attachment.FileHash != testFileHash || attachment.Creator != "Test@org1.example.com" {
+		fmt.Println("文件Hash应转为小写保存")
+		t.FailNow()
+	}
+
+	// 重复登记、Hash格式不正确、关联不可见的文档都应报错
+	response = MockRegisterAttachment(t, stub, "Test@org1.example.com", `{"id":"attachment-001","fileName":"募集说明书.pdf","fileHash":"`+testFileHash+`","linkDocType":"project","linkDocId":"project-bankcomm-000002"}`)
+	if response.Status != shim.ERROR {
+		fmt.Println("附件ID不能重复")
+		t.FailNow()
+	}
+	response = MockRegisterAttachment(t, stub, "Test@org1.example.com", `{"id":"test_process_002:test_linear_workflow-001","fileName":"募集说明书.pdf","fileHash":"`+testFileHash+`","linkDocType":"project","linkDocId":"project-bankcomm-000002"}`)
+	var process Process
+	json.Unmarshal(stub.State["test_process_002:test_linear_workflow-001"], &process)
+	if response.Status != shim.ERROR || process.DocType != "process" {
+		fmt.Println("附件ID不能与其他文档的ID相同")
+		t.FailNow()
+	}
+	response = MockRegisterAttachment(t, stub, "Test@org1.example.com", `{"id":"attachment-002","fileName":"评级报告.pdf","fileHash":"abc","linkDocType":"project","linkDocId":"project-bankcomm-000002"}`)
+	if response.Status != shim.ERROR {
+		fmt.Println("文件Hash必须是SHA-256")
+		t.FailNow()
+	}
+	response = MockRegisterAttachment(t, stub, "Test@org3.example.com", `{"id":"attachment-002","fileName":"评级报告.pdf","fileHash":"`+testFileHash+`","linkDocType":"project","linkDocId":"project-bankcomm-000002"}`)
+	if response.Status != shim.ERROR {
+		fmt.Println("不能关联到不可见的文档")
+		t.FailNow()
+	}
+
+	// 关联到流程日志
+	response = MockRegisterAttachment(t, stub, "Test@org1.example.com", `{"id":"attachment-003","fileName":"法律意见书.pdf","fileHash":"`+testFileHash+`","fileType":"legalOpinion","linkDocType":"processLog","linkDocId":"processLog-test_process_002:test_linear_workflow-001-`+IndexSeq(0)+`"}`)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("query_attachments_by_doc"),
+		[]byte("project"),
+		[]byte("project-bankcomm-000002"),
+	})
+	var attachments []Attachment
+	json.Unmarshal(response.Payload, &attachments)
+	if len(attachments) != 1 || attachments[0].Id != "attachment-001" {
+		fmt.Println("应查到项目的1个附件")
+		t.FailNow()
+	}
+
+	verification := MockVerifyAttachment(t, stub, "Test@org1.example.com", testFileHash)
+	if !verification.Matched || len(verification.Attachments) != 2 {
+		fmt.Println("文件Hash应与2个附件一致")
+		t.FailNow()
+	}
+	verification = MockVerifyAttachment(t, stub, "Test@org1.example.com", testFileHash, "project", "project-bankcomm-000002")
+	if !verification.Matched || len(verification.Attachments) != 1 {
+		fmt.Println("文件Hash应与项目的附件一致")
+		t.FailNow()
+	}
+	verification = MockVerifyAttachment(t, stub, "Test@org1.example.com", strings.Repeat("0", 64))
+	if verification.Matched {
+		fmt.Println("未登记的文件Hash不应核验通过")
+		t.FailNow()
+	}
+	verification = MockVerifyAttachment(t, stub, "Test@org3.example.com", testFileHash)
+	if verification.Matched {
+		fmt.Println("不可见的附件不应返回")
+		t.FailNow()
+	}
+}
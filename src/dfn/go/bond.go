@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 日期格式
+const DateLayout = "2006-01-02"
+
+// ----- Bond ----- //
+type Bond struct {
+	DocType              string             `json:"docType"`
+	Id                   string             `json:"id"`
+	ProjectId            string             `json:"projectId"`         // 关联项目
+	ApprovalProcessId    string             `json:"approvalProcessId"` // 已完成的发行审批流程
+	BondName             string             `json:"bondName"`
+	Tranche              string             `json:"tranche"`              // 档次，如优先A档
+	Currency             string             `json:"currency"`             // 币种，如CNY
+	FaceValue            int64              `json:"faceValue"`            // 每份面值，以最小货币单位计
+	CouponRate           int64              `json:"couponRate"`           // 票面利率，以基点计（1bp = 0.01%）
+	IssueDate            string             `json:"issueDate"`            // 发行日，yyyy-MM-dd
+	MaturityDate         string             `json:"maturityDate"`         // 到期日，yyyy-MM-dd
+	TotalSupply          int64              `json:"totalSupply"`          // 发行份数
+	CouponFrequency      int                `json:"couponFrequency"`      // 每年付息次数：1、2、4或12，默认为1
+	RecordDays           int                `json:"recordDays"`           // 债权登记日在兑付日之前的天数
+	Amortization         []BondAmortization `json:"amortization"`         // 摊还计划，到期日偿还剩余本金
+	OutstandingSupply    int64              `json:"outstandingSupply"`    // 存续份数
+	PlacedSupply         int64              `json:"placedSupply"`         // 已配售给投资机构的份数
+	ReservedSupply       int64              `json:"reservedSupply"`       // 簿记中的发售份数，簿记结束时释放
+	WrittenDownPrincipal int64              `json:"writtenDownPrincipal"` // 巨灾触发后每份累计减记的本金
+	Status               string             `json:"status"`               // issued 或 retired
+	Issuer               string             `json:"issuer"`               // 发行机构
+	Creator              string             `json:"creator"`              // 创建人
+	LastModifier         string             `json:"lastModifier"`         // 最后修改人
+	CreateTime           string             `json:"createTime"`           // 创建时间
+	ModifyTime           string             `json:"modifyTime"`           // 修改时间
+	BusinessDate         string             `json:"businessDate"`         // 业务日期，客户端传入
+}
+
+// =============================================================================
+// 发行债券
+// 只有项目的发行审批流程已完成后才能发行
+// =============================================================================
+func issue_bond(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	var bond Bond
+	fmt.Println("starting issue_bond")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	err = json.Unmarshal([]byte(args[0]), &bond)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	creator, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	creatorOrgName, err := GetOrgFromCertCommonName(creator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//check if bond id already exists, including keys of other documents
+	exists, err := KeyExists(stub, bond.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if exists {
+		fmt.Println("This bond already exists - " + bond.Id)
+		return shim.Error("This bond already exists - " + bond.Id)
+	}
+
+	err = ValidateBond(bond)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	//check if project exists
+	project, err := GetProjectById(stub, bond.ProjectId)
+	if err != nil {
+		fmt.Println("This project does not exist - " + bond.ProjectId)
+		return shim.Error("This project does not exist - " + bond.ProjectId)
+	}
+	if project.ApprovalWorkflowId == "" {
+		fmt.Println("The project has no designated approval workflow - " + bond.ProjectId)
+		return shim.Error("The project has no designated approval workflow - " + bond.ProjectId)
+	}
+
+	//check if approval process is finished
+	process, err := GetProcessById(stub, bond.ApprovalProcessId)
+	if err != nil {
+		fmt.Println("This process does not exist - " + bond.ApprovalProcessId)
+		return shim.Error("This process does not exist - " + bond.ApprovalProcessId)
+	}
+	if process.AttachDocType != "project" || process.AttachDocId != bond.ProjectId {
+		fmt.Println("The process is not attached to the project - " + bond.ApprovalProcessId)
+		return shim.Error("The process is not attached to the project - " + bond.ApprovalProcessId)
+	}
+	// 只认可项目指定的发行审批工作流（任一版本）
+	workflowDef, err := GetWorkflowDefById(stub, process.WorkflowId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if workflowDef.Id != project.ApprovalWorkflowId && workflowDef.BaseId != project.ApprovalWorkflowId {
+		fmt.Println("The process does not use the designated approval workflow - " + project.ApprovalWorkflowId)
+		return shim.Error("The process does not use the designated approval workflow - " + project.ApprovalWorkflowId)
+	}
+	if !process.Finished || process.Canceled {
+		fmt.Println("The approval process is not finished - " + bond.ApprovalProcessId)
+		return shim.Error("The approval process is not finished - " + bond.ApprovalProcessId)
+	}
+	if !ContainsString(process.Participants, creatorOrgName) {
+		fmt.Println("Only participants of the approval process can issue the bond - " + creatorOrgName)
+		return shim.Error("Only participants of the approval process can issue the bond - " + creatorOrgName)
+	}
+
+	// 生成兑付计划
+	payments, err := GenerateBondPayments(bond)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// 客户端传入的创建时间作为业务日期
+	if bond.BusinessDate == "" {
+		bond.BusinessDate = bond.CreateTime
+	}
+	createTime, err := GetModifyTime(stub, bond.BusinessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bond.DocType = "bond"
+	if bond.CouponFrequency == 0 {
+		bond.CouponFrequency = 1
+	}
+	bond.OutstandingSupply = bond.TotalSupply
+	bond.PlacedSupply = 0
+	bond.ReservedSupply = 0
+	bond.Status = "issued"
+	bond.Issuer = creatorOrgName
+	bond.Creator = creator
+	bond.LastModifier = creator
+	bond.CreateTime = createTime
+	bond.ModifyTime = createTime
+
+	err = PutBondPayments(stub, payments)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//store bond
+	bondAsBytes, _ := json.Marshal(bond)
+	err = PutState(stub, bond.Id, bondAsBytes) //store with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = PutIndex(stub, BondProjectIndex, bond.ProjectId, bond.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end issue_bond")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 校验债券要素
+// =============================================================================
+func ValidateBond(bond Bond) error {
+	if bond.Id == "" {
+		return errors.New("Bond id is required")
+	}
+	if bond.Currency == "" {
+		return errors.New("Currency is required")
+	}
+	if bond.FaceValue <= 0 {
+		return errors.New("Face value must be a positive integer")
+	}
+	if bond.CouponRate < 0 {
+		return errors.New("Coupon rate must be a positive integer or a zero")
+	}
+	if bond.TotalSupply <= 0 {
+		return errors.New("Total supply must be a positive integer")
+	}
+	issueDate, err := time.Parse(DateLayout, bond.IssueDate)
+	if err != nil {
+		return errors.New("Issue date must be in format yyyy-MM-dd - " + bond.IssueDate)
+	}
+	maturityDate, err := time.Parse(DateLayout, bond.MaturityDate)
+	if err != nil {
+		return errors.New("Maturity date must be in format yyyy-MM-dd - " + bond.MaturityDate)
+	}
+	if !maturityDate.After(issueDate) {
+		return errors.New("Maturity date must be after issue date")
+	}
+	return nil
+}
+
+// =============================================================================
+// Get Bond By id
+// =============================================================================
+func GetBondById(stub shim.ChaincodeStubInterface, id string) (Bond, error) {
+	var data Bond
+	dataAsBytes, err := stub.GetState(id) //getState retreives a key/value from the ledger
+	if err != nil {                       //this seems to always succeed, even if key didn't exist
+		return data, errors.New("Failed to find bond - " + id)
+	}
+	json.Unmarshal(dataAsBytes, &data) //un stringify it aka JSON.parse()
+
+	if data.Id != id || data.DocType != "bond" {
+		return data, errors.New("Bond does not exist - " + id)
+	}
+
+	return data, nil
+}
+
+// =============================================================================
+// 债券详情
+// =============================================================================
+func get_bond_by_id(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting get_bond_by_id")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	id := args[0]
+
+	bond, err := GetBondById(stub, id)
+	if err != nil {
+		fmt.Println("This bond does not exist - " + id)
+		return shim.Error("This bond does not exist - " + id)
+	}
+
+	bondAsBytes, _ := json.Marshal(bond)
+
+	fmt.Println("- end get_bond_by_id")
+	return shim.Success(bondAsBytes)
+}
+
+// ========================================================
+// 查询项目下的全部债券
+// ========================================================
+func query_bonds_by_project(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting query_bonds_by_project")
+
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	projectId := args[0]
+
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, err := GetPagingQueryResult(stub, GetBondsQueryByProjectId(projectId), pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("end query_bonds_by_project")
+
+	return shim.Success(result)
+}
+
+// 项目下全部债券的查询语句
+func GetBondsQueryByProjectId(projectId string) *Query {
+	return NewQuery("bond").Eq("projectId", projectId).UseIndex("indexBondsByProject").ScanIndex(BondProjectIndex, projectId)
+}
+
+// =============================================================================
+// 注销债券
+// 注销指定份数，存续份数为0时债券状态变为retired
+// =============================================================================
+func retire_bond(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting retire_bond")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	id := args[0]
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || amount <= 0 {
+		return shim.Error("Amount must be a positive integer - " + args[1])
+	}
+	businessDate := args[2]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bond, err := GetBondById(stub, id)
+	if err != nil {
+		fmt.Println("This bond does not exist - " + id)
+		return shim.Error("This bond does not exist - " + id)
+	}
+
+	if bond.Issuer != submitterOrgName {
+		fmt.Println("Only issuer can retire the bond - " + id)
+		return shim.Error("Only issuer can retire the bond - " + id)
+	}
+
+	if bond.Status == "retired" {
+		fmt.Println("This bond has been retired - " + id)
+		return shim.Error("This bond has been retired - " + id)
+	}
+
+	// 已配售的份数需要从持有机构处兑付后才能注销，簿记中的份数不能注销
+	if amount > GetAvailableSupply(bond) {
+		fmt.Println("Amount exceeds unplaced outstanding supply - " + id)
+		return shim.Error("Amount exceeds unplaced outstanding supply - " + id)
+	}
+
+	bond.OutstandingSupply = bond.OutstandingSupply - amount
+	if bond.OutstandingSupply == 0 {
+		bond.Status = "retired"
+	}
+	bond.LastModifier = submitter
+	bond.ModifyTime = modifyTime
+	bond.BusinessDate = businessDate
+
+	//store bond
+	bondAsBytes, _ := json.Marshal(bond)
+	err = PutState(stub, id, bondAsBytes) //store with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end retire_bond")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 可供注销或簿记发售的份数：存续份数减去已配售和簿记中的份数
+// =============================================================================
+func GetAvailableSupply(bond Bond) int64 {
+	return bond.OutstandingSupply - bond.PlacedSupply - bond.ReservedSupply
+}
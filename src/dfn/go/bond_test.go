@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 使用项目指定的发行审批工作流发起审批流程，finished为true时流转至办结
+func MockRunApprovalProcess(t *testing.T, stub *shim.MockStub, finished bool) {
+	processId := "test_process_approval:project-bankcomm-000002"
+	if stub.State[processId] == nil {
+		if stub.State["test_linear_workflow-001"] == nil {
+			MockCreateLinearWorkflow1(t, stub)
+		}
+		stub.MockInvoke(GetTestTxID(), [][]byte{
+			[]byte("start_process"),
+			[]byte(`{"id":"` + processId + `","workflowId":"test_linear_workflow-001","attachDocType":"project","attachDocId":"project-bankcomm-000002","createTime":"2018-3-19 09:43:02"}`),
+		})
+	}
+	if !finished {
+		return
+	}
+	for _, nodeId := range []string{"test_linear_workflow-001:node-2", "test_linear_workflow-001:node-3", ""} {
+		response := MockTransferTo(t, stub, processId, nodeId)
+		if response.Status != shim.OK {
+			fmt.Println(response.GetMessage())
+			t.FailNow()
+		}
+	}
+}
+
+// mock 发行一只债券
+func MockIssueBond1(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("issue_bond"),
+		[]byte(`{"id":"bond-bankcomm-000002-A","projectId":"project-bankcomm-000002","approvalProcessId":"test_process_approval:project-bankcomm-000002","bondName":"测试交行项目000002号优先A档","tranche":"A","currency":"CNY","faceValue":10000,"couponRate":450,"issueDate":"2018-04-01","maturityDate":"2021-04-01","totalSupply":50000,"createTime":"2018-3-20 10:00:00"}`),
+	})
+	return response
+}
+
+// mock 注销债券
+func MockRetireBond(t *testing.T, stub *shim.MockStub, amount string) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("retire_bond"),
+		[]byte("bond-bankcomm-000002-A"),
+		[]byte(amount),
+		[]byte("2021-04-01 10:00:00"),
+	})
+	return response
+}
+
+// 测试发行债券
+func Test_IssueBond(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	// 项目不存在
+	response := MockIssueBond1(t, stub)
+	if response.Status != shim.ERROR {
+		fmt.Println("项目不存在，应该失败。")
+		t.FailNow()
+	}
+	MockCreateProject2(t, stub)
+	// 审批流程未完成
+	MockRunApprovalProcess(t, stub, false)
+	response = MockIssueBond1(t, stub)
+	if response.Status != shim.ERROR {
+		fmt.Println("审批流程未完成，应该失败。")
+		t.FailNow()
+	}
+	MockRunApprovalProcess(t, stub, true)
+
+	// 只有一个节点的其他工作流办结后不能用于发行
+	stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_linear_workflow"),
+		[]byte(`{"id":"test_oneshot_workflow-001","workflowName":"一步办结","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`{"nodeName":"发起行","accessOrgs":["@org1.example.com"]}`),
+	})
+	stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("start_process"),
+		[]byte(`{"id":"test_process_oneshot","workflowId":"test_oneshot_workflow-001","attachDocType":"project","attachDocId":"project-bankcomm-000002","createTime":"2018-3-19 09:43:02"}`),
+	})
+	MockTransferTo(t, stub, "test_process_oneshot", "")
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("issue_bond"),
+		[]byte(`{"id":"bond-bankcomm-000002-B","projectId":"project-bankcomm-000002","approvalProcessId":"test_process_oneshot","currency":"CNY","faceValue":10000,"issueDate":"2018-04-01","maturityDate":"2021-04-01","totalSupply":50000}`),
+	})
+	if response.Status != shim.ERROR {
+		fmt.Println("非指定的发行审批工作流不能用于发行")
+		t.FailNow()
+	}
+
+	// 债券ID不能与其他文档的ID相同
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("issue_bond"),
+		[]byte(`{"id":"project-bankcomm-000002","projectId":"project-bankcomm-000002","approvalProcessId":"test_process_approval:project-bankcomm-000002","currency":"CNY","faceValue":10000,"issueDate":"2018-04-01","maturityDate":"2021-04-01","totalSupply":50000}`),
+	})
+	var project Project
+	json.Unmarshal(stub.State["project-bankcomm-000002"], &project)
+	if response.Status != shim.ERROR || project.DocType != "project" {
+		fmt.Println("不能覆盖已有的项目")
+		t.FailNow()
+	}
+
+	response = MockIssueBond1(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var bond Bond
+	json.Unmarshal(stub.State["bond-bankcomm-000002-A"], &bond)
+	if bond.OutstandingSupply != 50000 || bond.Issuer != "@org1.example.com" {
+		fmt.Println("债券要素不正确")
+		t.FailNow()
+	}
+	// 重复id将报错
+	response = MockIssueBond1(t, stub)
+	if response.Status != shim.ERROR {
+		fmt.Println("应该不可重复添加ID")
+		t.FailNow()
+	}
+}
+
+// 测试注销债券
+func Test_RetireBond(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateProject2(t, stub)
+	MockRunApprovalProcess(t, stub, true)
+	MockIssueBond1(t, stub)
+	response := MockRetireBond(t, stub, "60000")
+	if response.Status != shim.ERROR {
+		fmt.Println("超过存续份数，应该失败。")
+		t.FailNow()
+	}
+	response = MockRetireBond(t, stub, "50000")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var bond Bond
+	json.Unmarshal(stub.State["bond-bankcomm-000002-A"], &bond)
+	if bond.OutstandingSupply != 0 || bond.Status != "retired" {
+		fmt.Println("债券应已注销")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- CatBondTrigger ----- //
+// 巨灾债券的参数触发条件，以 债券ID:trigger 为键存储
+type CatBondTrigger struct {
+	DocType      string         `json:"docType"`
+	Id           string         `json:"id"`
+	BondId       string         `json:"bondId"`
+	Peril        string         `json:"peril"`       // 灾害类型，与灾害事件的peril一致
+	MinLatitude  float64        `json:"minLatitude"` // 地理范围
+	MaxLatitude  float64        `json:"maxLatitude"`
+	MinLongitude float64        `json:"minLongitude"`
+	MaxLongitude float64        `json:"maxLongitude"`
+	Ladder       []TriggerLevel `json:"ladder"`       // 赔付阶梯
+	Sponsor      string         `json:"sponsor"`      // 赔付受益机构（发起机构）
+	Creator      string         `json:"creator"`      // 创建人
+	LastModifier string         `json:"lastModifier"` // 最后修改人
+	CreateTime   string         `json:"createTime"`   // 创建时间
+	ModifyTime   string         `json:"modifyTime"`   // 修改时间
+	BusinessDate string         `json:"businessDate"` // 业务日期，客户端传入
+}
+
+// 赔付阶梯的一级：震级或强度达到阈值时按比例减记本金
+type TriggerLevel struct {
+	Magnitude float64 `json:"magnitude"` // 阈值，事件震级或强度不低于此值时触发
+	WriteDown int64   `json:"writeDown"` // 减记比例，以面值的基点计（10000表示100%）
+}
+
+// ----- TriggerEvaluation ----- //
+// 一次触发评估的审计记录，以 债券ID:evaluation:事件ID 为键存储
+type TriggerEvaluation struct {
+	DocType          string             `json:"docType"`
+	Id               string             `json:"id"`
+	BondId           string             `json:"bondId"`
+	TriggerId        string             `json:"triggerId"`
+	EventId          string             `json:"eventId"`
+	Event            DisasterEvent      `json:"event"`            // 评估时的灾害事件
+	Triggered        bool               `json:"triggered"`        // 是否触发
+	Checks           []string           `json:"checks"`           // 逐项检查结果
+	Level            int                `json:"level"`            // 触发的阶梯序号，从1开始，未触发为0
+	WriteDownRate    int64              `json:"writeDownRate"`    // 减记比例，基点
+	WriteDown        int64              `json:"writeDown"`        // 每份减记的本金
+	RemainingBefore  int64              `json:"remainingBefore"`  // 减记前每份剩余本金
+	TotalPayout      int64              `json:"totalPayout"`      // 赔付给发起机构的总额
+	Sponsor          string             `json:"sponsor"`          // 赔付受益机构
+	Allocations      []PayoutAllocation `json:"allocations"`      // 按事件发生时持仓分摊的减记金额
+	AdjustedPayments []string           `json:"adjustedPayments"` // 因减记调整的兑付ID
+	Evaluator        string             `json:"evaluator"`        // 评估人
+	TxId             string             `json:"txId"`
+	EvaluateTime     string             `json:"evaluateTime"` // 评估时间，取交易时间
+}
+
+// 持有机构分摊的减记金额
+type PayoutAllocation struct {
+	Holder string `json:"holder"`
+	Units  int64  `json:"units"`  // 事件发生时持有份数
+	Amount int64  `json:"amount"` // 减记金额
+}
+
+// 巨灾债券触发条件的ID
+func GetCatBondTriggerId(bondId string) string {
+	return bondId + ":trigger"
+}
+
+// =============================================================================
+// 设置巨灾债券的触发条件
+// =============================================================================
+func set_cat_bond_trigger(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	var trigger CatBondTrigger
+	fmt.Println("starting set_cat_bond_trigger")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	err = json.Unmarshal([]byte(args[0]), &trigger)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bond, err := GetBondById(stub, trigger.BondId)
+	if err != nil {
+		fmt.Println("This bond does not exist - " + trigger.BondId)
+		return shim.Error("This bond does not exist - " + trigger.BondId)
+	}
+	if bond.Issuer != submitterOrgName {
+		fmt.Println("Only issuer can set the trigger - " + submitterOrgName)
+		return shim.Error("Only issuer can set the trigger - " + submitterOrgName)
+	}
+	if bond.WrittenDownPrincipal > 0 {
+		fmt.Println("The trigger has been fired - " + trigger.BondId)
+		return shim.Error("The trigger has been fired - " + trigger.BondId)
+	}
+	// 投资机构按簿记时的触发条件申购，开始簿记后触发条件不能再修改
+	if bond.PlacedSupply > 0 || bond.ReservedSupply > 0 {
+		fmt.Println("The trigger is frozen after the bond is offered - " + trigger.BondId)
+		return shim.Error("The trigger is frozen after the bond is offered - " + trigger.BondId)
+	}
+
+	err = ValidateCatBondTrigger(trigger)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// 客户端传入的创建时间作为业务日期
+	if trigger.BusinessDate == "" {
+		trigger.BusinessDate = trigger.CreateTime
+	}
+	createTime, err := GetModifyTime(stub, trigger.BusinessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	trigger.DocType = "catBondTrigger"
+	trigger.Id = GetCatBondTriggerId(trigger.BondId)
+	old, err := GetCatBondTrigger(stub, trigger.BondId)
+	if err == nil {
+		trigger.Creator = old.Creator
+		trigger.CreateTime = old.CreateTime
+	} else {
+		trigger.Creator = submitter
+		trigger.CreateTime = createTime
+	}
+	trigger.LastModifier = submitter
+	trigger.ModifyTime = createTime
+
+	triggerAsBytes, _ := json.Marshal(trigger)
+	err = PutState(stub, trigger.Id, triggerAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end set_cat_bond_trigger")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 校验触发条件
+// =============================================================================
+func ValidateCatBondTrigger(trigger CatBondTrigger) error {
+	if trigger.Peril == "" {
+		return errors.New("Peril is required")
+	}
+	if trigger.MinLatitude > trigger.MaxLatitude || trigger.MinLatitude < -90 || trigger.MaxLatitude > 90 {
+		return errors.New("Latitude range is invalid")
+	}
+	if trigger.MinLongitude > trigger.MaxLongitude || trigger.MinLongitude < -180 || trigger.MaxLongitude > 180 {
+		return errors.New("Longitude range is invalid")
+	}
+	_, err := GetOrgFromCertCommonName(trigger.Sponsor)
+	if err != nil {
+		return errors.New("Sponsor must be an org name like @org1.example.com - " + trigger.Sponsor)
+	}
+	if len(trigger.Ladder) == 0 {
+		return errors.New("Ladder is required")
+	}
+	for i, level := range trigger.Ladder {
+		if level.WriteDown <= 0 || level.WriteDown > 10000 {
+			return errors.New("Write down must be between 1 and 10000 - level " + strconv.Itoa(i+1))
+		}
+		if i > 0 && (level.Magnitude <= trigger.Ladder[i-1].Magnitude || level.WriteDown < trigger.Ladder[i-1].WriteDown) {
+			return errors.New("Ladder must be in ascending order of magnitude and write down - level " + strconv.Itoa(i+1))
+		}
+	}
+	return nil
+}
+
+// =============================================================================
+// 获取巨灾债券的触发条件
+// =============================================================================
+func GetCatBondTrigger(stub shim.ChaincodeStubInterface, bondId string) (CatBondTrigger, error) {
+	var data CatBondTrigger
+	id := GetCatBondTriggerId(bondId)
+	dataAsBytes, err := stub.GetState(id)
+	if err != nil {
+		return data, errors.New("Failed to find trigger - " + id)
+	}
+	json.Unmarshal(dataAsBytes, &data)
+
+	if data.Id != id || data.DocType != "catBondTrigger" {
+		return data, errors.New("Trigger does not exist - " + id)
+	}
+	return data, nil
+}
+
+// =============================================================================
+// 巨灾债券的触发条件
+// =============================================================================
+func get_cat_bond_trigger(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting get_cat_bond_trigger")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	trigger, err := GetCatBondTrigger(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	triggerAsBytes, _ := json.Marshal(trigger)
+
+	fmt.Println("- end get_cat_bond_trigger")
+	return shim.Success(triggerAsBytes)
+}
+
+// =============================================================================
+// 评估灾害事件是否满足触发条件，返回触发的阶梯序号（从1开始，未触发为0）和逐项检查结果
+// =============================================================================
+func EvaluateCatBondTrigger(trigger CatBondTrigger, bond Bond, event DisasterEvent) (int, []string) {
+	var checks []string
+	passed := true
+	check := func(ok bool, format string, a ...interface{}) {
+		checks = append(checks, fmt.Sprintf(format, a...)+fmt.Sprintf(" => %t", ok))
+		passed = passed && ok
+	}
+
+	check(event.Peril == trigger.Peril, "peril %s eq %s", event.Peril, trigger.Peril)
+	check(event.Latitude >= trigger.MinLatitude && event.Latitude <= trigger.MaxLatitude,
+		"latitude %v in [%v, %v]", event.Latitude, trigger.MinLatitude, trigger.MaxLatitude)
+	check(event.Longitude >= trigger.MinLongitude && event.Longitude <= trigger.MaxLongitude,
+		"longitude %v in [%v, %v]", event.Longitude, trigger.MinLongitude, trigger.MaxLongitude)
+
+	// 风险期为发行日至到期日（UTC）
+	eventTime, _ := time.Parse(time.RFC3339, event.EventTime)
+	issueDate, _ := time.Parse(DateLayout, bond.IssueDate)
+	maturityDate, _ := time.Parse(DateLayout, bond.MaturityDate)
+	check(!eventTime.Before(issueDate) && eventTime.Before(maturityDate),
+		"eventTime %s in [%s, %s)", event.EventTime, bond.IssueDate, bond.MaturityDate)
+
+	level := 0
+	for i, l := range trigger.Ladder {
+		if event.Magnitude >= l.Magnitude {
+			level = i + 1
+		}
+	}
+	check(level > 0, "magnitude %v gte %v", event.Magnitude, trigger.Ladder[0].Magnitude)
+
+	if !passed {
+		return 0, checks
+	}
+	return level, checks
+}
+
+// 兑付日已到或已登记支付结果的兑付不再调整
+func isPaymentSettled(payment BondPayment, date string) bool {
+	return payment.PaymentDate <= date || payment.Status != "scheduled"
+}
+
+// =============================================================================
+// 计算每份剩余本金：面值减去不再调整的各期本金和已减记的本金
+// =============================================================================
+func GetRemainingPrincipal(bond Bond, payments []BondPayment, date string) int64 {
+	remaining := bond.FaceValue - bond.WrittenDownPrincipal
+	for _, payment := range payments {
+		if isPaymentSettled(payment, date) {
+			remaining = remaining - payment.Principal
+		}
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// =============================================================================
+// 减记本金后调整未到期的兑付
+// 依次扣减剩余各期的本金，利息按调整后的期初剩余本金重新计算
+// =============================================================================
+func ApplyPrincipalWriteDown(bond Bond, payments []BondPayment, date string, writeDown int64) []BondPayment {
+	frequency := int64(bond.CouponFrequency)
+	if frequency == 0 {
+		frequency = 1
+	}
+	var adjusted []BondPayment
+	remaining := GetRemainingPrincipal(bond, payments, date) - writeDown
+	pending := writeDown
+	// 减记从最后一期本金开始扣减
+	sort.SliceStable(payments, func(i, j int) bool { return payments[i].Seq < payments[j].Seq })
+	for i := len(payments) - 1; i >= 0 && pending > 0; i-- {
+		if isPaymentSettled(payments[i], date) {
+			continue
+		}
+		deduct := payments[i].Principal
+		if deduct > pending {
+			deduct = pending
+		}
+		payments[i].Principal = payments[i].Principal - deduct
+		pending = pending - deduct
+	}
+	for i := 0; i < len(payments); i++ {
+		if isPaymentSettled(payments[i], date) {
+			continue
+		}
+		payments[i].Coupon = remaining * bond.CouponRate / 10000 / frequency
+		remaining = remaining - payments[i].Principal
+		adjusted = append(adjusted, payments[i])
+	}
+	return adjusted
+}
+
+// =============================================================================
+// 评估已确认的灾害事件并记录减记和赔付分摊
+// 同一债券对同一事件只能评估一次，未触发时也记录评估结果
+// 与设置触发条件相同，只有发行机构可以评估
+// =============================================================================
+func evaluate_cat_bond_trigger(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting evaluate_cat_bond_trigger")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	bondId := args[0]
+	eventId := args[1]
+	businessDate := args[2]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bond, err := GetBondById(stub, bondId)
+	if err != nil {
+		fmt.Println("This bond does not exist - " + bondId)
+		return shim.Error("This bond does not exist - " + bondId)
+	}
+	if bond.Issuer != submitterOrgName {
+		fmt.Println("Only issuer can evaluate the trigger - " + submitterOrgName)
+		return shim.Error("Only issuer can evaluate the trigger - " + submitterOrgName)
+	}
+	trigger, err := GetCatBondTrigger(stub, bondId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	event, err := GetConfirmedDisasterEvent(stub, eventId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	evaluationId := bondId + ":evaluation:" + eventId
+	evaluationAsBytes, err := stub.GetState(evaluationId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if evaluationAsBytes != nil {
+		fmt.Println("This event has been evaluated - " + evaluationId)
+		return shim.Error("This event has been evaluated - " + evaluationId)
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var evaluation = TriggerEvaluation{}
+	evaluation.DocType = "triggerEvaluation"
+	evaluation.Id = evaluationId
+	evaluation.BondId = bondId
+	evaluation.TriggerId = trigger.Id
+	evaluation.EventId = eventId
+	evaluation.Event = event
+	evaluation.Sponsor = trigger.Sponsor
+	evaluation.Allocations = []PayoutAllocation{}
+	evaluation.AdjustedPayments = []string{}
+	evaluation.Evaluator = submitter
+	evaluation.TxId = stub.GetTxID()
+	evaluation.EvaluateTime = txTime.Format(time.RFC3339)
+	evaluation.Level, evaluation.Checks = EvaluateCatBondTrigger(trigger, bond, event)
+
+	if evaluation.Level > 0 {
+		payments, err := GetBondPayments(stub, bondId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		eventTime, _ := time.Parse(time.RFC3339, event.EventTime)
+		today := txTime.Format(DateLayout)
+
+		evaluation.WriteDownRate = trigger.Ladder[evaluation.Level-1].WriteDown
+		evaluation.RemainingBefore = GetRemainingPrincipal(bond, payments, today)
+		evaluation.WriteDown = bond.FaceValue * evaluation.WriteDownRate / 10000
+		if evaluation.WriteDown > evaluation.RemainingBefore {
+			evaluation.WriteDown = evaluation.RemainingBefore
+		}
+		evaluation.Triggered = evaluation.WriteDown > 0
+		evaluation.Checks = append(evaluation.Checks, fmt.Sprintf("level %d writeDown %d bp of faceValue %d, remaining %d => %d",
+			evaluation.Level, evaluation.WriteDownRate, bond.FaceValue, evaluation.RemainingBefore, evaluation.WriteDown))
+
+		if evaluation.Triggered {
+			// 按事件发生时的持仓分摊
+			holdings, err := GetHoldingsAsOf(stub, bondId, eventTime)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			for _, holding := range holdings {
+				allocation := PayoutAllocation{Holder: holding.Holder, Units: holding.Balance, Amount: holding.Balance * evaluation.WriteDown}
+				evaluation.Allocations = append(evaluation.Allocations, allocation)
+				evaluation.TotalPayout = evaluation.TotalPayout + allocation.Amount
+			}
+
+			for _, payment := range ApplyPrincipalWriteDown(bond, payments, today, evaluation.WriteDown) {
+				paymentAsBytes, _ := json.Marshal(payment)
+				err = stub.PutState(payment.Id, paymentAsBytes)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				evaluation.AdjustedPayments = append(evaluation.AdjustedPayments, payment.Id)
+			}
+
+			bond.WrittenDownPrincipal = bond.WrittenDownPrincipal + evaluation.WriteDown
+			bond.LastModifier = submitter
+			bond.ModifyTime = modifyTime
+			bond.BusinessDate = businessDate
+			bondAsBytes, _ := json.Marshal(bond)
+			err = stub.PutState(bond.Id, bondAsBytes)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+
+	evaluationAsBytes, _ = json.Marshal(evaluation)
+	err = stub.PutState(evaluation.Id, evaluationAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = PutIndex(stub, TriggerEvaluationBondIndex, evaluation.BondId, evaluation.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	SendEvent(stub, "CatBondTriggerEvaluated", evaluationAsBytes)
+
+	fmt.Println("- end evaluate_cat_bond_trigger")
+	return shim.Success(evaluationAsBytes)
+}
+
+// =============================================================================
+// 查询债券的全部触发评估记录
+// =============================================================================
+func query_trigger_evaluations(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting query_trigger_evaluations")
+
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, err := GetPagingQueryResult(stub, GetTriggerEvaluationsQueryByBondId(args[0]), pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end query_trigger_evaluations")
+	return shim.Success(result)
+}
+
+// 债券全部触发评估记录的查询语句
+func GetTriggerEvaluationsQueryByBondId(bondId string) *Query {
+	return NewQuery("triggerEvaluation").Eq("bondId", bondId).UseIndex("indexTriggerEvaluations").ScanIndex(TriggerEvaluationBondIndex, bondId)
+}
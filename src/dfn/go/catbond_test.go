@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 发行一只巨灾债券，发行日为半年前，期限3年
+func MockIssueCatBond(t *testing.T, stub *shim.MockStub) time.Time {
+	issueDate := time.Now().UTC().AddDate(0, -6, 0)
+	issueDate = time.Date(issueDate.Year(), issueDate.Month(), 1, 0, 0, 0, 0, time.UTC)
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("issue_bond"),
+		[]byte(`{"id":"bond-bankcomm-000002-A","projectId":"project-bankcomm-000002","approvalProcessId":"test_process_approval:project-bankcomm-000002","bondName":"测试巨灾债券","currency":"CNY","faceValue":10000,"couponRate":450,"issueDate":"` + issueDate.Format(DateLayout) + `","maturityDate":"` + issueDate.AddDate(3, 0, 0).Format(DateLayout) + `","totalSupply":50000,"createTime":"2018-3-20 10:00:00"}`),
+	})
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	return issueDate
+}
+
+// mock 设置地震触发条件
+func MockSetCatBondTrigger(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("set_cat_bond_trigger"),
+		[]byte(`{"bondId":"bond-bankcomm-000002-A","peril":"earthquake","minLatitude":26,"maxLatitude":34,"minLongitude":97,"maxLongitude":108,"ladder":[{"magnitude":7.0,"writeDown":2500},{"magnitude":8.0,"writeDown":5000}],"sponsor":"@org3.example.com","createTime":"2018-3-20 10:00:00"}`),
+	})
+	return response
+}
+
+// mock 直接写入一个已确认的灾害事件
+func MockPutConfirmedDisasterEvent(t *testing.T, stub *shim.MockStub, id string, latitude float64, eventTime time.Time) {
+	event := DisasterEvent{
+		DocType:   "disasterEvent",
+		Id:        id,
+		Peril:     "earthquake",
+		Region:    "四川",
+		Latitude:  latitude,
+		Longitude: 103.4,
+		Magnitude: 8.0,
+		EventTime: eventTime.Format(time.RFC3339),
+		Status:    "confirmed",
+	}
+	eventAsBytes, _ := json.Marshal(event)
+	stub.MockTransactionStart(GetTestTxID())
+	stub.PutState(event.Id, eventAsBytes)
+	stub.MockTransactionEnd(GetTestTxID())
+}
+
+// mock 评估触发条件
+func MockEvaluateCatBondTrigger(t *testing.T, stub *shim.MockStub, eventId string) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("evaluate_cat_bond_trigger"),
+		[]byte("bond-bankcomm-000002-A"),
+		[]byte(eventId),
+		[]byte("2018-5-20 10:00:00"),
+	})
+	return response
+}
+
+// 测试触发条件校验
+func Test_ValidateCatBondTrigger(t *testing.T) {
+	trigger := CatBondTrigger{
+		Peril:        "earthquake",
+		MinLatitude:  26,
+		MaxLatitude:  34,
+		MinLongitude: 97,
+		MaxLongitude: 108,
+		Sponsor:      "@org3.example.com",
+		Ladder:       []TriggerLevel{{Magnitude: 8.0, WriteDown: 5000}, {Magnitude: 7.0, WriteDown: 2500}},
+	}
+	if ValidateCatBondTrigger(trigger) == nil {
+		fmt.Println("赔付阶梯必须按震级升序")
+		t.FailNow()
+	}
+	trigger.Ladder = []TriggerLevel{{Magnitude: 7.0, WriteDown: 2500}, {Magnitude: 8.0, WriteDown: 5000}}
+	if ValidateCatBondTrigger(trigger) != nil {
+		fmt.Println("触发条件应该有效")
+		t.FailNow()
+	}
+}
+
+// 测试巨灾债券触发减记
+func Test_EvaluateCatBondTrigger(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateProject2(t, stub)
+	MockRunApprovalProcess(t, stub, true)
+	issueDate := MockIssueCatBond(t, stub)
+	response := MockSetCatBondTrigger(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	MockPutHoldingHistory(t, stub, "@org1.example.com", 100, issueDate.AddDate(0, 0, 1).Format(time.RFC3339))
+	MockPutHoldingHistory(t, stub, "@org2.example.com", 200, issueDate.AddDate(0, 0, 1).Format(time.RFC3339))
+	// 事件发生后转让的持仓不参与分摊
+	MockPutHoldingHistory(t, stub, "@org2.example.com", 0, issueDate.AddDate(0, 0, 40).Format(time.RFC3339))
+
+	// 已配售的债券不能修改触发条件
+	var bond Bond
+	json.Unmarshal(stub.State["bond-bankcomm-000002-A"], &bond)
+	bond.PlacedSupply = 300
+	bondAsBytes, _ := json.Marshal(bond)
+	stub.MockTransactionStart(GetTestTxID())
+	stub.PutState(bond.Id, bondAsBytes)
+	stub.MockTransactionEnd(GetTestTxID())
+	response = MockSetCatBondTrigger(t, stub)
+	if response.Status != shim.ERROR {
+		fmt.Println("已配售的债券不能修改触发条件")
+		t.FailNow()
+	}
+
+	// 不在地理范围内
+	MockPutConfirmedDisasterEvent(t, stub, "disaster-eq-outside", 40.0, issueDate.AddDate(0, 0, 30))
+	// 只有发行机构可以评估
+	response = MockInvokeAsUser(t, stub, "Test@org2.example.com", "evaluate_cat_bond_trigger", "bond-bankcomm-000002-A", "disaster-eq-outside", "2018-5-20 10:00:00")
+	if response.Status != shim.ERROR {
+		fmt.Println("非发行机构不能评估触发条件")
+		t.FailNow()
+	}
+	response = MockEvaluateCatBondTrigger(t, stub, "disaster-eq-outside")
+	var evaluation TriggerEvaluation
+	json.Unmarshal(response.Payload, &evaluation)
+	if response.Status != shim.OK || evaluation.Triggered {
+		fmt.Println("不在地理范围内，不应触发", response.GetMessage())
+		t.FailNow()
+	}
+	response = MockEvaluateCatBondTrigger(t, stub, "disaster-eq-outside")
+	if response.Status != shim.ERROR {
+		fmt.Println("同一事件不能重复评估")
+		t.FailNow()
+	}
+
+	MockPutConfirmedDisasterEvent(t, stub, "disaster-eq-inside", 31.0, issueDate.AddDate(0, 0, 30))
+	response = MockEvaluateCatBondTrigger(t, stub, "disaster-eq-inside")
+	json.Unmarshal(response.Payload, &evaluation)
+	if !evaluation.Triggered || evaluation.Level != 2 || evaluation.WriteDown != 5000 || evaluation.TotalPayout != 1500000 || len(evaluation.Allocations) != 2 {
+		fmt.Println("触发减记结果不正确", evaluation)
+		t.FailNow()
+	}
+	bond = Bond{}
+	json.Unmarshal(stub.State["bond-bankcomm-000002-A"], &bond)
+	if bond.WrittenDownPrincipal != 5000 {
+		fmt.Println("债券减记本金不正确")
+		t.FailNow()
+	}
+	payment, _ := GetBondPaymentById(stub, GetBondPaymentId("bond-bankcomm-000002-A", 3))
+	if payment.Principal != 5000 || payment.Coupon != 225 || len(evaluation.AdjustedPayments) != 3 {
+		fmt.Println("兑付计划调整不正确", payment)
+		t.FailNow()
+	}
+	response = MockSetCatBondTrigger(t, stub)
+	if response.Status != shim.ERROR {
+		fmt.Println("已触发的债券不能修改触发条件")
+		t.FailNow()
+	}
+}
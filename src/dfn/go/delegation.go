@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- Delegation ----- //
+// 流程代理：委托机构在有效期内委托受托机构处理其流程
+type Delegation struct {
+	DocType      string `json:"docType"`
+	Id           string `json:"id"`
+	FromOrg      string `json:"fromOrg"`      // 委托机构，为创建人所在机构
+	ToOrg        string `json:"toOrg"`        // 受托机构
+	WorkflowId   string `json:"workflowId"`   // 委托的工作流ID，为空时委托全部工作流
+	StartTime    string `json:"startTime"`    // 委托开始时间，RFC3339
+	EndTime      string `json:"endTime"`      // 委托结束时间，RFC3339
+	Revoked      bool   `json:"revoked"`      // 是否已撤销
+	Creator      string `json:"creator"`      // 创建人
+	LastModifier string `json:"lastModifier"` // 最后修改人
+	CreateTime   string `json:"createTime"`   // 创建时间
+	ModifyTime   string `json:"modifyTime"`   // 修改时间
+	BusinessDate string `json:"businessDate"` // 业务日期，客户端传入
+}
+
+// =============================================================================
+// 创建代理委托
+// =============================================================================
+func create_delegation(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	var delegation Delegation
+	fmt.Println("starting create_delegation")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	err = json.Unmarshal([]byte(args[0]), &delegation)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	creator, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	creatorOrgName, err := GetOrgFromCertCommonName(creator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//check if delegation id already exists
+	exists, err := KeyExists(stub, delegation.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if exists {
+		fmt.Println("This delegation already exists - " + delegation.Id)
+		return shim.Error("This delegation already exists - " + delegation.Id)
+	}
+
+	// 只能委托本机构的流程
+	delegation.FromOrg = creatorOrgName
+	err = ValidateDelegation(delegation)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// 按工作流委托时适用于工作流的全部版本
+	if delegation.WorkflowId != "" {
+		workflowDef, err := GetWorkflowDefById(stub, delegation.WorkflowId)
+		if err != nil {
+			fmt.Println("Workflow does not exist - " + delegation.WorkflowId)
+			return shim.Error("Workflow does not exist - " + delegation.WorkflowId)
+		}
+		delegation.WorkflowId = workflowDef.BaseId
+	}
+
+	// 客户端传入的创建时间作为业务日期
+	if delegation.BusinessDate == "" {
+		delegation.BusinessDate = delegation.CreateTime
+	}
+	createTime, err := GetModifyTime(stub, delegation.BusinessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	delegation.DocType = "delegation"
+	delegation.Revoked = false
+	delegation.Creator = creator
+	delegation.LastModifier = creator
+	delegation.CreateTime = createTime
+	delegation.ModifyTime = createTime
+
+	err = PutDelegation(stub, delegation)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end create_delegation")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 校验代理委托
+// =============================================================================
+func ValidateDelegation(delegation Delegation) error {
+	if delegation.Id == "" {
+		return errors.New("Delegation id is required")
+	}
+	if delegation.ToOrg == "" {
+		return errors.New("ToOrg of delegation is required")
+	}
+	if delegation.ToOrg == delegation.FromOrg {
+		return errors.New("Can not delegate to the same org - " + delegation.ToOrg)
+	}
+	startTime, err := time.Parse(time.RFC3339, delegation.StartTime)
+	if err != nil {
+		return errors.New("Start time must be in RFC3339 format - " + delegation.StartTime)
+	}
+	endTime, err := time.Parse(time.RFC3339, delegation.EndTime)
+	if err != nil {
+		return errors.New("End time must be in RFC3339 format - " + delegation.EndTime)
+	}
+	if !endTime.After(startTime) {
+		return errors.New("End time must be after start time")
+	}
+	return nil
+}
+
+// =============================================================================
+// 撤销代理委托，只有委托机构可以撤销
+// =============================================================================
+func revoke_delegation(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting revoke_delegation")
+
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	id := args[0]
+	businessDate := args[1]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	delegation, err := GetDelegationById(stub, id)
+	if err != nil {
+		fmt.Println("This delegation does not exist - " + id)
+		return shim.Error("This delegation does not exist - " + id)
+	}
+	if delegation.FromOrg != submitterOrgName {
+		fmt.Println("Only delegating org can revoke the delegation - " + submitterOrgName)
+		return shim.Error("Only delegating org can revoke the delegation - " + submitterOrgName)
+	}
+	if delegation.Revoked {
+		fmt.Println("This delegation has been revoked - " + id)
+		return shim.Error("This delegation has been revoked - " + id)
+	}
+
+	delegation.Revoked = true
+	delegation.LastModifier = submitter
+	delegation.ModifyTime = modifyTime
+	delegation.BusinessDate = businessDate
+
+	err = PutDelegation(stub, delegation)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end revoke_delegation")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 存储代理委托，委托机构和受托机构都写入索引
+// =============================================================================
+func PutDelegation(stub shim.ChaincodeStubInterface, delegation Delegation) error {
+	delegationAsBytes, _ := json.Marshal(delegation)
+	err := stub.PutState(delegation.Id, delegationAsBytes) //store with id as key
+	if err != nil {
+		return err
+	}
+	return UpdateIndexes(stub, nil, []IndexEntry{
+		{Name: DocTypeIndex, Attributes: []string{"delegation", delegation.Id}},
+		{Name: DelegationOrgIndex, Attributes: []string{delegation.FromOrg, delegation.Id}},
+		{Name: DelegationOrgIndex, Attributes: []string{delegation.ToOrg, delegation.Id}},
+	})
+}
+
+// =============================================================================
+// Get Delegation By id
+// =============================================================================
+func GetDelegationById(stub shim.ChaincodeStubInterface, id string) (Delegation, error) {
+	var data Delegation
+	dataAsBytes, err := stub.GetState(id) //getState retreives a key/value from the ledger
+	if err != nil {                       //this seems to always succeed, even if key didn't exist
+		return data, errors.New("Failed to find delegation - " + id)
+	}
+	json.Unmarshal(dataAsBytes, &data) //un stringify it aka JSON.parse()
+
+	if data.Id != id || data.DocType != "delegation" {
+		return data, errors.New("Delegation does not exist - " + id)
+	}
+
+	return data, nil
+}
+
+// =============================================================================
+// 查询本机构的代理委托
+// 第一个参数为from（本机构委托出去的）或to（委托给本机构的），之后为可选的分页参数
+// =============================================================================
+func query_my_delegations(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting query_my_delegations")
+
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var query *Query
+	switch args[0] {
+	case "from":
+		query = GetDelegationsQueryByFromOrg(submitterOrgName)
+	case "to":
+		query = GetDelegationsQueryByToOrg(submitterOrgName)
+	default:
+		return shim.Error("Direction must be from or to - " + args[0])
+	}
+
+	result, err := GetPagingQueryResult(stub, query, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end query_my_delegations")
+	return shim.Success(result)
+}
+
+// 机构委托出去的代理委托的查询语句
+func GetDelegationsQueryByFromOrg(orgName string) *Query {
+	return NewQuery("delegation").Eq("fromOrg", orgName).UseIndex("indexDelegationsByFromOrg").ScanIndex(DelegationOrgIndex, orgName)
+}
+
+// 委托给机构的代理委托的查询语句
+func GetDelegationsQueryByToOrg(orgName string) *Query {
+	return NewQuery("delegation").Eq("toOrg", orgName).UseIndex("indexDelegationsByToOrg").ScanIndex(DelegationOrgIndex, orgName)
+}
+
+// =============================================================================
+// 查询交易时间在有效期内、未撤销的委托给机构的代理委托
+// 在写交易中调用，富查询的结果提交时不会重新校验，按复合键索引范围查询
+// =============================================================================
+func GetActiveDelegations(stub shim.ChaincodeStubInterface, toOrg string) ([]Delegation, error) {
+	delegationIds, err := GetIdsByIndex(stub, DelegationOrgIndex, []string{toOrg})
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	var results []Delegation
+	for _, delegationId := range delegationIds {
+		// 索引中同时包含委托出去和委托给机构的代理委托
+		delegation, err := GetDelegationById(stub, delegationId)
+		if err != nil || delegation.ToOrg != toOrg {
+			continue
+		}
+		startTime, _ := time.Parse(time.RFC3339, delegation.StartTime)
+		endTime, _ := time.Parse(time.RFC3339, delegation.EndTime)
+		if delegation.Revoked || txTime.Before(startTime) || !txTime.Before(endTime) {
+			continue
+		}
+		results = append(results, delegation)
+	}
+	return results, nil
+}
+
+// =============================================================================
+// 代理委托中覆盖工作流的委托机构，workflowBaseId为空时返回全部委托机构
+// =============================================================================
+func GetDelegatingOrgs(delegations []Delegation, workflowBaseId string) []string {
+	var orgs []string
+	for _, delegation := range delegations {
+		if workflowBaseId != "" && delegation.WorkflowId != "" && delegation.WorkflowId != workflowBaseId {
+			continue
+		}
+		if !ContainsString(orgs, delegation.FromOrg) {
+			orgs = append(orgs, delegation.FromOrg)
+		}
+	}
+	return orgs
+}
+
+// =============================================================================
+// 机构在工作流中可以代表的机构：机构本身，以及当前委托给该机构的委托机构
+// =============================================================================
+func GetActingOrgs(stub shim.ChaincodeStubInterface, orgName string, workflowId string) ([]string, error) {
+	delegations, err := GetActiveDelegations(stub, orgName)
+	if err != nil {
+		return nil, err
+	}
+	if len(delegations) == 0 {
+		return []string{orgName}, nil
+	}
+	workflowDef, err := GetWorkflowDefById(stub, workflowId)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{orgName}, GetDelegatingOrgs(delegations, workflowDef.BaseId)...), nil
+}
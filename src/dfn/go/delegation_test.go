@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 以指定机构的身份创建代理委托
+func MockCreateDelegation(t *testing.T, stub *shim.MockStub, submitter string, delegation string) pb.Response {
+	name := mockSubmitterName
+	mockSubmitterName = submitter
+	defer func() { mockSubmitterName = name }()
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_delegation"),
+		[]byte(delegation),
+	})
+	return response
+}
+
+// mock 以指定机构的身份撤销代理委托
+func MockRevokeDelegation(t *testing.T, stub *shim.MockStub, submitter string, id string) pb.Response {
+	name := mockSubmitterName
+	mockSubmitterName = submitter
+	defer func() { mockSubmitterName = name }()
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("revoke_delegation"),
+		[]byte(id),
+		[]byte("2018-03-16 15:54:00"),
+	})
+	return response
+}
+
+// 测试代理委托的校验
+func Test_ValidateDelegation(t *testing.T) {
+	delegation := Delegation{Id: "delegation-001", FromOrg: "@pwccn.com", ToOrg: "@org1.example.com", StartTime: "2018-01-01T00:00:00Z", EndTime: "2099-01-01T00:00:00Z"}
+	if ValidateDelegation(delegation) != nil {
+		fmt.Println("代理委托应校验通过")
+		t.FailNow()
+	}
+	delegation.ToOrg = delegation.FromOrg
+	if ValidateDelegation(delegation) == nil {
+		fmt.Println("不能委托给本机构")
+		t.FailNow()
+	}
+	delegation.ToOrg = "@org1.example.com"
+	delegation.EndTime = "2017-01-01T00:00:00Z"
+	if ValidateDelegation(delegation) == nil {
+		fmt.Println("结束时间应晚于开始时间")
+		t.FailNow()
+	}
+	delegation.EndTime = "2099-01-01"
+	if ValidateDelegation(delegation) == nil {
+		fmt.Println("时间应为RFC3339格式")
+		t.FailNow()
+	}
+}
+
+// 测试代理委托下的流转、退回和待办
+func Test_DelegateProcess(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateLinearWorkflow1(t, stub)
+	MockCreateLinearWorkflow2(t, stub)
+	MockCreateProject2(t, stub)
+	MockStartProcess1(t, stub)
+	transferArgs := [][]byte{
+		[]byte("transfer_process"),
+		[]byte("test_process_002:test_linear_workflow-001"),
+		[]byte("test_linear_workflow-001:node-2"),
+		[]byte("@pwccn.com"),
+		[]byte("2018-03-16 15:54:00"),
+	}
+	response := stub.MockInvoke(GetTestTxID(), transferArgs)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+
+	// 没有委托时不能处理其他机构的流程
+	transferArgs[2] = []byte("test_linear_workflow-001:node-3")
+	transferArgs[3] = []byte("@org1.example.com")
+	response = stub.MockInvoke(GetTestTxID(), transferArgs)
+	if response.Status != shim.ERROR {
+		fmt.Println("没有委托时不能流转")
+		t.FailNow()
+	}
+
+	// 委托ID不能使用其他文档的ID
+	response = MockCreateDelegation(t, stub, "Test@pwccn.com", `{"id":"project-bankcomm-000002","toOrg":"@org1.example.com","startTime":"2018-01-01T00:00:00Z","endTime":"2099-01-01T00:00:00Z","createTime":"2018-3-16 16:08:51"}`)
+	project, _ := GetProjectById(stub, "project-bankcomm-000002")
+	if response.Status != shim.ERROR || project.DocType != "project" {
+		fmt.Println("委托ID被其他文档占用时应该失败")
+		t.FailNow()
+	}
+
+	// 过期的委托和其他工作流的委托不能使用
+	response = MockCreateDelegation(t, stub, "Test@pwccn.com", `{"id":"delegation-expired","toOrg":"@org1.example.com","startTime":"2018-01-01T00:00:00Z","endTime":"2018-02-01T00:00:00Z","createTime":"2018-3-16 16:08:51"}`)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	response = MockCreateDelegation(t, stub, "Test@pwccn.com", `{"id":"delegation-other","toOrg":"@org1.example.com","workflowId":"test_linear_workflow-002","startTime":"2018-01-01T00:00:00Z","endTime":"2099-01-01T00:00:00Z","createTime":"2018-3-16 16:08:51"}`)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	response = stub.MockInvoke(GetTestTxID(), transferArgs)
+	if response.Status != shim.ERROR {
+		fmt.Println("过期或其他工作流的委托不能流转")
+		t.FailNow()
+	}
+	response = MockQueryTodoProcess(t, stub)
+	var todos []Process
+	json.Unmarshal(response.Payload, &todos)
+	if len(todos) != 0 {
+		fmt.Println("其他工作流的委托不应出现在待办中")
+		t.FailNow()
+	}
+
+	response = MockCreateDelegation(t, stub, "Test@pwccn.com", `{"id":"delegation-001","toOrg":"@org1.example.com","workflowId":"test_linear_workflow-001","startTime":"2018-01-01T00:00:00Z","endTime":"2099-01-01T00:00:00Z","createTime":"2018-3-16 16:08:51"}`)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("query_my_delegations"),
+		[]byte("to"),
+	})
+	var delegations []Delegation
+	json.Unmarshal(response.Payload, &delegations)
+	if len(delegations) != 3 {
+		fmt.Println("应查到3个委托给本机构的代理委托")
+		t.FailNow()
+	}
+
+	// 受托机构的待办中可以查到委托机构的流程
+	response = MockQueryTodoProcess(t, stub)
+	todos = nil
+	json.Unmarshal(response.Payload, &todos)
+	if len(todos) != 1 || todos[0].CurrentOwner != "@pwccn.com" {
+		fmt.Println("受托机构的待办应包含委托机构的流程")
+		t.FailNow()
+	}
+
+	// 代理流转，日志记录委托机构和实际操作的机构
+	response = stub.MockInvoke(GetTestTxID(), transferArgs)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var log ProcessLog
+	json.Unmarshal(stub.State["processLog-test_process_002:test_linear_workflow-001-"+IndexSeq(2)], &log)
+	if log.FromOrg != "@pwccn.com" || log.ActingOrg != "@org1.example.com" {
+		fmt.Println("代理流转的日志应记录委托机构和实际操作的机构")
+		t.FailNow()
+	}
+
+	// 只有委托机构可以撤销
+	response = MockRevokeDelegation(t, stub, "Test@org1.example.com", "delegation-001")
+	if response.Status != shim.ERROR {
+		fmt.Println("受托机构不能撤销委托")
+		t.FailNow()
+	}
+	response = MockRevokeDelegation(t, stub, "Test@pwccn.com", "delegation-001")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+
+	// 退回给委托机构后，委托已撤销，不能再代理退回
+	returnArgs := [][]byte{
+		[]byte("return_process"),
+		[]byte("test_process_002:test_linear_workflow-001"),
+		[]byte("2018-03-16 15:54:00"),
+	}
+	response = stub.MockInvoke(GetTestTxID(), returnArgs)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	response = stub.MockInvoke(GetTestTxID(), returnArgs)
+	if response.Status != shim.ERROR {
+		fmt.Println("撤销委托后不能代理退回")
+		t.FailNow()
+	}
+}
@@ -49,8 +49,8 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("  GetFunctionAndParameters() args count:", len(args))
 	fmt.Println("  GetFunctionAndParameters() args found:", args)
 
-	// expecting 1 arg for instantiate or upgrade
-	if len(args) == 1 {
+	// expecting 1 arg for instantiate or upgrade, the optional 2nd arg is the oracle config
+	if len(args) == 1 || len(args) == 2 {
 		fmt.Println("  GetFunctionAndParameters() arg[0] length", len(args[0]))
 
 		// expecting arg[0] to be length 0 for upgrade
@@ -74,6 +74,14 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		}
 	}
 
+	// 预言机配置只能在实例化或升级时设置，需要满足链码生命周期的背书策略
+	if len(args) == 2 {
+		err = InitOracleConfig(stub, args[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
 	// showing the alternative argument shim function
 	alt := stub.GetStringArgs()
 	fmt.Println("  GetStringArgs() args count:", len(alt))
@@ -116,6 +124,8 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return modify_project(stub, args)
 	case "create_linear_workflow":
 		return create_linear_workflow(stub, args)
+	case "create_graph_workflow":
+		return create_graph_workflow(stub, args)
 	case "get_workflow_by_id":
 		return get_workflow_by_id(stub, args)
 	case "query_all_workflows":
@@ -124,6 +134,8 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return enable_or_disable_workflow(stub, args)
 	case "modify_workflow_def":
 		return modify_workflow_def(stub, args)
+	case "query_workflow_versions":
+		return query_workflow_versions(stub, args)
 	case "query_accessable_workflows":
 		return query_accessable_workflows(stub, args)
 	case "start_process":
@@ -138,12 +150,104 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return return_process(stub, args)
 	case "withdraw_process":
 		return withdraw_process(stub, args)
+	case "approve_process":
+		return approve_process(stub, args)
 	case "cancel_process":
 		return cancel_process(stub, args)
+	case "migrate_process":
+		return migrate_process(stub, args)
 	case "query_todo_process":
 		return query_todo_process(stub, args)
 	case "query_done_process":
 		return query_done_process(stub, args)
+	case "query_overdue_process":
+		return query_overdue_process(stub, args)
+	case "escalate_process":
+		return escalate_process(stub, args)
+	case "check_process_readiness":
+		return check_process_readiness(stub, args)
+	case "claim_process":
+		return claim_process(stub, args)
+	case "unclaim_process":
+		return unclaim_process(stub, args)
+	case "reassign_process":
+		return reassign_process(stub, args)
+	case "create_delegation":
+		return create_delegation(stub, args)
+	case "revoke_delegation":
+		return revoke_delegation(stub, args)
+	case "query_my_delegations":
+		return query_my_delegations(stub, args)
+	case "register_attachment":
+		return register_attachment(stub, args)
+	case "get_attachment_by_id":
+		return get_attachment_by_id(stub, args)
+	case "query_attachments_by_doc":
+		return query_attachments_by_doc(stub, args)
+	case "verify_attachment":
+		return verify_attachment(stub, args)
+	case "issue_bond":
+		return issue_bond(stub, args)
+	case "get_bond_by_id":
+		return get_bond_by_id(stub, args)
+	case "query_bonds_by_project":
+		return query_bonds_by_project(stub, args)
+	case "retire_bond":
+		return retire_bond(stub, args)
+	case "create_offering":
+		return create_offering(stub, args)
+	case "get_offering_by_id":
+		return get_offering_by_id(stub, args)
+	case "submit_subscription":
+		return submit_subscription(stub, args)
+	case "close_offering":
+		return close_offering(stub, args)
+	case "query_subscriptions_by_offering":
+		return query_subscriptions_by_offering(stub, args)
+	case "query_my_subscriptions":
+		return query_my_subscriptions(stub, args)
+	case "transfer_holding":
+		return transfer_holding(stub, args)
+	case "get_balance":
+		return get_balance(stub, args)
+	case "query_holders":
+		return query_holders(stub, args)
+	case "record_payment":
+		return record_payment(stub, args)
+	case "query_payment_schedule":
+		return query_payment_schedule(stub, args)
+	case "query_upcoming_payments":
+		return query_upcoming_payments(stub, args)
+	case "query_overdue_payments":
+		return query_overdue_payments(stub, args)
+	case "get_oracle_config":
+		return get_oracle_config(stub, args)
+	case "submit_disaster_report":
+		return submit_disaster_report(stub, args)
+	case "get_disaster_event_by_id":
+		return get_disaster_event_by_id(stub, args)
+	case "query_disaster_events":
+		return query_disaster_events(stub, args)
+	case "set_cat_bond_trigger":
+		return set_cat_bond_trigger(stub, args)
+	case "get_cat_bond_trigger":
+		return get_cat_bond_trigger(stub, args)
+	case "evaluate_cat_bond_trigger":
+		return evaluate_cat_bond_trigger(stub, args)
+	case "query_trigger_evaluations":
+		return query_trigger_evaluations(stub, args)
+	case "read":
+		return read(stub, args)
+	case "get_history":
+		return get_history(stub, args)
+	case "get_project_history":
+		return get_project_history(stub, args)
+	case "get_process_history":
+		return get_process_history(stub, args)
+	case "get_workflow_history":
+		return get_workflow_history(stub, args)
+	case "rich_query":
+		return rich_query(stub, args)
 	case "save_org_public_key":
 		return save_org_public_key(stub, args)
 	case "encrypt_data":
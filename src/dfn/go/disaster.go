@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- OracleConfig ----- //
+// 灾害事件预言机配置，以 oracleConfig 为键存储
+// 只能在链码实例化或升级时通过Init设置，受通道的链码生命周期背书策略保护，单个机构无法修改
+type OracleConfig struct {
+	DocType      string   `json:"docType"`
+	Orgs         []string `json:"orgs"`         // 授权的预言机机构
+	Quorum       int      `json:"quorum"`       // 确认事件所需的一致报告数
+	LastModifier string   `json:"lastModifier"` // 最后修改人
+	ModifyTime   string   `json:"modifyTime"`   // 修改时间
+	BusinessDate string   `json:"businessDate"` // 业务日期，客户端传入
+}
+
+// 预言机配置的键
+const OracleConfigKey = "oracleConfig"
+
+// ----- DisasterEvent ----- //
+// 灾害事件，由预言机机构报告，达到法定数量的一致报告后确认
+type DisasterEvent struct {
+	DocType     string           `json:"docType"`
+	Id          string           `json:"id"`
+	Peril       string           `json:"peril"`       // 灾害类型，如earthquake、typhoon、flood
+	Region      string           `json:"region"`      // 地区
+	Latitude    float64          `json:"latitude"`    // 纬度
+	Longitude   float64          `json:"longitude"`   // 经度
+	Magnitude   float64          `json:"magnitude"`   // 震级或强度
+	EventTime   string           `json:"eventTime"`   // 发生时间，RFC3339
+	Status      string           `json:"status"`      // reported 或 confirmed
+	Oracles     []string         `json:"oracles"`     // 首次报告时的预言机机构，配置变更不影响已报告的事件
+	Quorum      int              `json:"quorum"`      // 首次报告时的法定数量
+	ConfirmedBy []string         `json:"confirmedBy"` // 报告一致参数的预言机机构
+	ConfirmTime string           `json:"confirmTime"` // 确认时间，取交易时间
+	Reports     []DisasterReport `json:"reports"`     // 全部报告
+}
+
+// 预言机机构的一次报告
+type DisasterReport struct {
+	Oracle     string  `json:"oracle"`   // 预言机机构
+	Reporter   string  `json:"reporter"` // 报告人
+	Source     string  `json:"source"`   // 数据来源，如中国地震台网
+	Peril      string  `json:"peril"`
+	Region     string  `json:"region"`
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	Magnitude  float64 `json:"magnitude"`
+	EventTime  string  `json:"eventTime"`
+	TxId       string  `json:"txId"`
+	SubmitTime string  `json:"submitTime"` // 提交时间，取交易时间
+}
+
+// =============================================================================
+// 链码实例化或升级时设置预言机配置
+// 参数为描述预言机配置的JSON字符串，为空时保留原配置
+// =============================================================================
+func InitOracleConfig(stub shim.ChaincodeStubInterface, configJSON string) error {
+	var config OracleConfig
+	if configJSON == "" {
+		return nil
+	}
+
+	err := json.Unmarshal([]byte(configJSON), &config)
+	if err != nil {
+		return errors.New("Expecting JSON of oracle config - " + err.Error())
+	}
+	err = ValidateOracleConfig(&config)
+	if err != nil {
+		return err
+	}
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return err
+	}
+	modifyTime, err := GetTxTimeString(stub)
+	if err != nil {
+		return err
+	}
+
+	config.DocType = "oracleConfig"
+	config.LastModifier = submitter
+	config.ModifyTime = modifyTime
+	config.BusinessDate = ""
+
+	configAsBytes, _ := json.Marshal(config)
+	return PutState(stub, OracleConfigKey, configAsBytes)
+}
+
+// =============================================================================
+// 校验预言机配置，去掉重复的机构
+// =============================================================================
+func ValidateOracleConfig(config *OracleConfig) error {
+	config.Orgs = RemoveRepStringByMap(config.Orgs)
+	for _, org := range config.Orgs {
+		_, err := GetOrgFromCertCommonName(org)
+		if err != nil {
+			return errors.New("Oracle must be an org name like @org1.example.com - " + org)
+		}
+	}
+	if config.Quorum <= 0 || config.Quorum > len(config.Orgs) {
+		return errors.New("Quorum must be between 1 and the number of oracle orgs")
+	}
+	return nil
+}
+
+// =============================================================================
+// 获取预言机配置
+// =============================================================================
+func GetOracleConfig(stub shim.ChaincodeStubInterface) (OracleConfig, error) {
+	var config OracleConfig
+	configAsBytes, err := stub.GetState(OracleConfigKey)
+	if err != nil {
+		return config, errors.New("Failed to find oracle config")
+	}
+	if configAsBytes == nil {
+		return config, errors.New("Oracle config has not been set")
+	}
+	json.Unmarshal(configAsBytes, &config)
+	return config, nil
+}
+
+// =============================================================================
+// 预言机配置
+// =============================================================================
+func get_oracle_config(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting get_oracle_config")
+
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	config, err := GetOracleConfig(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	configAsBytes, _ := json.Marshal(config)
+
+	fmt.Println("- end get_oracle_config")
+	return shim.Success(configAsBytes)
+}
+
+// =============================================================================
+// 校验灾害报告
+// =============================================================================
+func ValidateDisasterReport(report DisasterReport) error {
+	if report.Peril == "" {
+		return errors.New("Peril is required")
+	}
+	if report.Region == "" {
+		return errors.New("Region is required")
+	}
+	if report.Latitude < -90 || report.Latitude > 90 {
+		return errors.New("Latitude must be between -90 and 90")
+	}
+	if report.Longitude < -180 || report.Longitude > 180 {
+		return errors.New("Longitude must be between -180 and 180")
+	}
+	if report.Magnitude < 0 {
+		return errors.New("Magnitude must be a positive number or a zero")
+	}
+	if report.Source == "" {
+		return errors.New("Source is required")
+	}
+	_, err := time.Parse(time.RFC3339, report.EventTime)
+	if err != nil {
+		return errors.New("Event time must be in RFC3339 format - " + report.EventTime)
+	}
+	return nil
+}
+
+// 判断两次报告的参数是否一致，来源不参与比较
+func IsDisasterReportMatched(a DisasterReport, b DisasterReport) bool {
+	timeA, _ := time.Parse(time.RFC3339, a.EventTime)
+	timeB, _ := time.Parse(time.RFC3339, b.EventTime)
+	return a.Peril == b.Peril &&
+		a.Region == b.Region &&
+		a.Latitude == b.Latitude &&
+		a.Longitude == b.Longitude &&
+		a.Magnitude == b.Magnitude &&
+		timeA.Equal(timeB)
+}
+
+// =============================================================================
+// 查找参数一致的报告数达到法定数量的一组报告
+// 多组同时达到时取先报告的一组
+// =============================================================================
+func FindQuorumReports(reports []DisasterReport, quorum int) []DisasterReport {
+	for i := 0; i < len(reports); i++ {
+		matched := []DisasterReport{reports[i]}
+		for j := 0; j < len(reports); j++ {
+			if j != i && IsDisasterReportMatched(reports[i], reports[j]) {
+				matched = append(matched, reports[j])
+			}
+		}
+		if len(matched) >= quorum {
+			return matched
+		}
+	}
+	return nil
+}
+
+// =============================================================================
+// 预言机机构提交灾害报告
+// 同一机构对同一事件重复报告时，未确认前以最后一次为准
+// =============================================================================
+func submit_disaster_report(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	var input struct {
+		Id string `json:"id"`
+		DisasterReport
+	}
+	fmt.Println("starting submit_disaster_report")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	err = json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	if input.Id == "" {
+		return shim.Error("Disaster event id is required")
+	}
+	report := input.DisasterReport
+	err = ValidateDisasterReport(report)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	report.Oracle = submitterOrgName
+	report.Reporter = submitter
+	report.TxId = stub.GetTxID()
+	report.SubmitTime = txTime.Format(time.RFC3339)
+
+	// 只有key未被占用时才新建事件，key被其他类型的文档占用时报错
+	event, err := GetDisasterEventById(stub, input.Id)
+	if err != nil {
+		exists, err := KeyExists(stub, input.Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if exists {
+			fmt.Println("This id is used by another document - " + input.Id)
+			return shim.Error("This id is used by another document - " + input.Id)
+		}
+		event = DisasterEvent{DocType: "disasterEvent", Id: input.Id, Status: "reported", Reports: []DisasterReport{}}
+	}
+
+	// 事件首次报告时记录当时的预言机配置，之后的报告按事件记录的配置判断
+	if len(event.Oracles) == 0 {
+		config, err := GetOracleConfig(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		event.Oracles = config.Orgs
+		event.Quorum = config.Quorum
+	}
+	if !ContainsString(event.Oracles, submitterOrgName) {
+		fmt.Println("Submitter is not an authorised oracle - " + submitterOrgName)
+		return shim.Error("Submitter is not an authorised oracle - " + submitterOrgName)
+	}
+
+	confirmed := false
+	if event.Status == "confirmed" {
+		// 确认后的报告只做记录
+		event.Reports = append(event.Reports, report)
+	} else {
+		var reports []DisasterReport
+		for _, r := range event.Reports {
+			if r.Oracle != submitterOrgName {
+				reports = append(reports, r)
+			}
+		}
+		event.Reports = append(reports, report)
+		setDisasterEventParams(&event, report)
+
+		matched := FindQuorumReports(event.Reports, event.Quorum)
+		if matched != nil {
+			setDisasterEventParams(&event, matched[0])
+			event.Status = "confirmed"
+			confirmed = true
+			event.ConfirmTime = txTime.Format(time.RFC3339)
+			event.ConfirmedBy = []string{}
+			for _, r := range matched {
+				event.ConfirmedBy = append(event.ConfirmedBy, r.Oracle)
+			}
+		}
+	}
+
+	eventAsBytes, _ := json.Marshal(event)
+	err = PutState(stub, event.Id, eventAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = PutIndex(stub, DocTypeIndex, "disasterEvent", event.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if confirmed {
+		SendEvent(stub, "DisasterConfirmed", eventAsBytes)
+	}
+
+	fmt.Println("- end submit_disaster_report")
+	return shim.Success(eventAsBytes)
+}
+
+// 使用报告的参数设置事件参数
+func setDisasterEventParams(event *DisasterEvent, report DisasterReport) {
+	event.Peril = report.Peril
+	event.Region = report.Region
+	event.Latitude = report.Latitude
+	event.Longitude = report.Longitude
+	event.Magnitude = report.Magnitude
+	event.EventTime = report.EventTime
+}
+
+// =============================================================================
+// Get DisasterEvent By id
+// =============================================================================
+func GetDisasterEventById(stub shim.ChaincodeStubInterface, id string) (DisasterEvent, error) {
+	var data DisasterEvent
+	dataAsBytes, err := stub.GetState(id) //getState retreives a key/value from the ledger
+	if err != nil {                       //this seems to always succeed, even if key didn't exist
+		return data, errors.New("Failed to find disaster event - " + id)
+	}
+	json.Unmarshal(dataAsBytes, &data) //un stringify it aka JSON.parse()
+
+	if data.Id != id || data.DocType != "disasterEvent" {
+		return data, errors.New("Disaster event does not exist - " + id)
+	}
+
+	return data, nil
+}
+
+// =============================================================================
+// 获取已确认的灾害事件，供其他合约引用
+// =============================================================================
+func GetConfirmedDisasterEvent(stub shim.ChaincodeStubInterface, id string) (DisasterEvent, error) {
+	event, err := GetDisasterEventById(stub, id)
+	if err != nil {
+		return event, err
+	}
+	if event.Status != "confirmed" {
+		return event, errors.New("Disaster event is not confirmed - " + id)
+	}
+	return event, nil
+}
+
+// =============================================================================
+// 灾害事件详情
+// =============================================================================
+func get_disaster_event_by_id(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting get_disaster_event_by_id")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	id := args[0]
+
+	event, err := GetDisasterEventById(stub, id)
+	if err != nil {
+		fmt.Println("This disaster event does not exist - " + id)
+		return shim.Error("This disaster event does not exist - " + id)
+	}
+	eventAsBytes, _ := json.Marshal(event)
+
+	fmt.Println("- end get_disaster_event_by_id")
+	return shim.Success(eventAsBytes)
+}
+
+// ========================================================
+// 按灾害类型和状态查询灾害事件
+// ========================================================
+func query_disaster_events(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting query_disaster_events")
+
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 to 4")
+	}
+
+	peril := args[0]
+	status := args[1]
+
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[2:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, err := GetPagingQueryResult(stub, GetDisasterEventsQuery(peril, status), pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end query_disaster_events")
+	return shim.Success(result)
+}
+
+// 灾害事件的查询语句，peril或status为空时不按该字段过滤
+func GetDisasterEventsQuery(peril string, status string) *Query {
+	query := NewQuery("disasterEvent").ScanIndex(DocTypeIndex, "disasterEvent")
+	switch {
+	case peril != "" && status != "":
+		query.Eq("peril", peril).Eq("status", status).UseIndex("indexDisasterEvents")
+	case peril != "":
+		query.Eq("peril", peril).UseIndex("indexDisasterEventsByPeril")
+	case status != "":
+		query.Eq("status", status).UseIndex("indexDisasterEventsByStatus")
+	default:
+		query.UseIndex("indexDocType")
+	}
+	return query
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 实例化时设置预言机配置：3个预言机机构中2个一致即确认
+func MockSetOracleConfig(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInit(GetTestTxID(), [][]byte{
+		[]byte("init"),
+		[]byte("1"),
+		[]byte(`{"orgs":["@org1.example.com","@org2.example.com","@org3.example.com"],"quorum":2}`),
+	})
+	return response
+}
+
+// mock 以指定机构的身份提交灾害报告
+func MockSubmitDisasterReport(t *testing.T, stub *shim.MockStub, submitter string, magnitude string) pb.Response {
+	name := mockSubmitterName
+	mockSubmitterName = submitter
+	defer func() { mockSubmitterName = name }()
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("submit_disaster_report"),
+		[]byte(`{"id":"disaster-eq-20180512","peril":"earthquake","region":"四川汶川","latitude":31.0,"longitude":103.4,"magnitude":` + magnitude + `,"eventTime":"2018-05-12T14:28:04+08:00","source":"中国地震台网"}`),
+	})
+	return response
+}
+
+// 测试预言机配置只能在实例化或升级时设置
+func Test_InitOracleConfig(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("set_oracle_config"),
+		[]byte(`{"orgs":["@org1.example.com"],"quorum":1}`),
+		[]byte("2018-3-20 10:00:00"),
+	})
+	if response.Status != shim.ERROR {
+		fmt.Println("不能通过Invoke修改预言机配置")
+		t.FailNow()
+	}
+	response = stub.MockInit(GetTestTxID(), [][]byte{[]byte("init"), []byte("1"), []byte(`{"orgs":["@org1.example.com"],"quorum":2}`)})
+	if response.Status != shim.ERROR {
+		fmt.Println("法定数量超过预言机机构数，应该失败。")
+		t.FailNow()
+	}
+	response = MockSetOracleConfig(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	// 升级时不传配置则保留原配置
+	MockInit(t, stub)
+	config, err := GetOracleConfig(stub)
+	if err != nil || config.Quorum != 2 || len(config.Orgs) != 3 {
+		fmt.Println("预言机配置不正确", config)
+		t.FailNow()
+	}
+}
+
+// 测试灾害事件法定数量确认
+func Test_SubmitDisasterReport(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockSetOracleConfig(t, stub)
+
+	response := MockSubmitDisasterReport(t, stub, "Oracle@org4.example.com", "8.0")
+	if response.Status != shim.ERROR {
+		fmt.Println("未授权的预言机机构，应该失败。")
+		t.FailNow()
+	}
+	response = MockSubmitDisasterReport(t, stub, "Oracle@org1.example.com", "8.0")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	// 配置变更不影响已报告的事件
+	stub.MockInit(GetTestTxID(), [][]byte{[]byte("init"), []byte("1"), []byte(`{"orgs":["@org1.example.com","@org3.example.com"],"quorum":1}`)})
+	// 参数不一致，不确认
+	MockSubmitDisasterReport(t, stub, "Oracle@org2.example.com", "7.9")
+	event, _ := GetDisasterEventById(stub, "disaster-eq-20180512")
+	if event.Status != "reported" || len(event.Reports) != 2 || event.Quorum != 2 || len(event.Oracles) != 3 {
+		fmt.Println("参数不一致时不应确认")
+		t.FailNow()
+	}
+	_, err := GetConfirmedDisasterEvent(stub, "disaster-eq-20180512")
+	if err == nil {
+		fmt.Println("未确认的事件不能被引用")
+		t.FailNow()
+	}
+	// 同一机构更正报告后达到法定数量
+	response = MockSubmitDisasterReport(t, stub, "Oracle@org2.example.com", "8.0")
+	json.Unmarshal(response.Payload, &event)
+	if event.Status != "confirmed" || event.Magnitude != 8.0 || len(event.Reports) != 2 || len(event.ConfirmedBy) != 2 {
+		fmt.Println("应该已确认", event)
+		t.FailNow()
+	}
+	// 确认后的报告只做记录
+	MockSubmitDisasterReport(t, stub, "Oracle@org3.example.com", "7.8")
+	event, _ = GetConfirmedDisasterEvent(stub, "disaster-eq-20180512")
+	if event.Magnitude != 8.0 || len(event.Reports) != 3 {
+		fmt.Println("确认后的事件参数不应改变", event)
+		t.FailNow()
+	}
+	// 事件ID不能使用其他文档的ID
+	MockCreateProject2(t, stub)
+	mockSubmitterName = "Oracle@org1.example.com"
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("submit_disaster_report"),
+		[]byte(`{"id":"project-bankcomm-000002","peril":"earthquake","region":"四川汶川","latitude":31.0,"longitude":103.4,"magnitude":8.0,"eventTime":"2018-05-12T14:28:04+08:00","source":"中国地震台网"}`),
+	})
+	mockSubmitterName = "Test@org1.example.com"
+	project, _ := GetProjectById(stub, "project-bankcomm-000002")
+	if response.Status != shim.ERROR || project.DocType != "project" {
+		fmt.Println("事件ID被其他文档占用时应该失败")
+		t.FailNow()
+	}
+}
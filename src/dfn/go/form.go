@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 节点表单：节点的formSchema为JSON Schema的子集，流转或退回时提交的表单数据按其校验，
+// 校验通过后保存为流程变量，每次修改变量的版本号加1；路由条件和前置条件可以使用"variables.变量名"引用流程变量
+
+// 表单的JSON Schema，只支持顶层为object
+type FormSchema struct {
+	Type                 string                  `json:"type"` // 为空或object
+	Properties           map[string]FormProperty `json:"properties"`
+	Required             []string                `json:"required"`
+	AdditionalProperties *bool                   `json:"additionalProperties"` // 为false时不允许提交未声明的字段
+}
+
+// 表单字段
+type FormProperty struct {
+	Type      string        `json:"type"` // string、number、integer、boolean、array 或 object
+	Title     string        `json:"title"`
+	Enum      []interface{} `json:"enum"`
+	Minimum   *float64      `json:"minimum"`
+	Maximum   *float64      `json:"maximum"`
+	MinLength *int          `json:"minLength"`
+	MaxLength *int          `json:"maxLength"`
+	Pattern   string        `json:"pattern"`
+}
+
+// 流程变量
+type ProcessVariable struct {
+	Value      interface{} `json:"value"`
+	Version    int         `json:"version"`    // 版本号，从1开始，每次修改加1
+	NodeId     string      `json:"nodeId"`     // 提交表单的节点
+	Modifier   string      `json:"modifier"`   // 提交表单的用户
+	ModifyTime string      `json:"modifyTime"` // 提交时间
+}
+
+// 支持的字段类型
+var formPropertyTypes = []string{"string", "number", "integer", "boolean", "array", "object"}
+
+// =============================================================================
+// 校验节点表单的设置
+// =============================================================================
+func ValidateFormSchema(node WorkflowNode) error {
+	schema := node.FormSchema
+	if schema == nil {
+		return nil
+	}
+	if schema.Type != "" && schema.Type != "object" {
+		return errors.New("Type of form schema must be object - " + node.Id)
+	}
+	var names []string
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property := schema.Properties[name]
+		if !ContainsString(formPropertyTypes, property.Type) {
+			return errors.New("Unknown type of form property - " + name)
+		}
+		if property.Minimum != nil && property.Maximum != nil && *property.Minimum > *property.Maximum {
+			return errors.New("Minimum of form property is greater than maximum - " + name)
+		}
+		if property.MinLength != nil && property.MaxLength != nil && *property.MinLength > *property.MaxLength {
+			return errors.New("MinLength of form property is greater than maxLength - " + name)
+		}
+		if property.Pattern != "" {
+			if _, err := regexp.Compile(property.Pattern); err != nil {
+				return errors.New("Pattern of form property is invalid - " + name)
+			}
+		}
+	}
+	for _, name := range schema.Required {
+		if _, ok := schema.Properties[name]; !ok {
+			return errors.New("Required form property is not declared - " + name)
+		}
+	}
+	return nil
+}
+
+// =============================================================================
+// 解析并校验节点提交的表单数据
+// 参数为空字符串时视为没有提交表单；节点有表单时仍需校验必填字段
+// =============================================================================
+func ParseFormData(node WorkflowNode, formData string) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if formData != "" {
+		err := json.Unmarshal([]byte(formData), &data)
+		if err != nil {
+			return nil, errors.New("Expecting JSON object of form data - " + err.Error())
+		}
+	}
+	if node.FormSchema == nil {
+		if len(data) > 0 {
+			return nil, errors.New("The node does not declare a form - " + node.Id)
+		}
+		return nil, nil
+	}
+	err := ValidateFormData(*node.FormSchema, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// =============================================================================
+// 按表单的JSON Schema校验表单数据，返回全部不符合的字段
+// =============================================================================
+func ValidateFormData(schema FormSchema, data map[string]interface{}) error {
+	var problems []string
+	for _, name := range schema.Required {
+		if value, ok := data[name]; !ok || value == nil {
+			problems = append(problems, name+": is required")
+		}
+	}
+
+	// 按字段名排序，使错误信息在各节点上一致
+	var names []string
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property, ok := schema.Properties[name]
+		if !ok {
+			if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				problems = append(problems, name+": is not declared")
+			}
+			continue
+		}
+		if data[name] == nil {
+			continue
+		}
+		if err := validateFormValue(property, data[name]); err != nil {
+			problems = append(problems, name+": "+err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Form data is invalid - " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// 校验一个字段的值
+func validateFormValue(property FormProperty, value interface{}) error {
+	switch property.Type {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return errors.New("must be a string")
+		}
+		length := utf8.RuneCountInString(str)
+		if property.MinLength != nil && length < *property.MinLength {
+			return errors.New("is shorter than " + strconv.Itoa(*property.MinLength))
+		}
+		if property.MaxLength != nil && length > *property.MaxLength {
+			return errors.New("is longer than " + strconv.Itoa(*property.MaxLength))
+		}
+		if property.Pattern != "" {
+			if matched, _ := regexp.MatchString(property.Pattern, str); !matched {
+				return errors.New("does not match " + property.Pattern)
+			}
+		}
+	case "number", "integer":
+		number, ok := value.(float64)
+		if !ok {
+			return errors.New("must be a number")
+		}
+		if property.Type == "integer" && number != math.Trunc(number) {
+			return errors.New("must be an integer")
+		}
+		if property.Minimum != nil && number < *property.Minimum {
+			return fmt.Errorf("is less than %v", *property.Minimum)
+		}
+		if property.Maximum != nil && number > *property.Maximum {
+			return fmt.Errorf("is greater than %v", *property.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return errors.New("must be a boolean")
+		}
+	case "array":
+		if _, ok := value.([]interface{}); !ok {
+			return errors.New("must be an array")
+		}
+	case "object":
+		if _, ok := value.(map[string]interface{}); !ok {
+			return errors.New("must be an object")
+		}
+	}
+	if len(property.Enum) > 0 {
+		valueAsBytes, _ := json.Marshal(value)
+		for _, option := range property.Enum {
+			optionAsBytes, _ := json.Marshal(option)
+			if string(optionAsBytes) == string(valueAsBytes) {
+				return nil
+			}
+		}
+		return errors.New("is not one of the enum values")
+	}
+	return nil
+}
+
+// =============================================================================
+// 将表单数据保存为流程变量，值有变化的变量版本号加1
+// =============================================================================
+func SetProcessVariables(process *Process, nodeId string, data map[string]interface{}, modifier string, modifyTime string) {
+	if len(data) == 0 {
+		return
+	}
+	if process.Variables == nil {
+		process.Variables = map[string]ProcessVariable{}
+	}
+	for name, value := range data {
+		variable, exists := process.Variables[name]
+		if exists {
+			oldAsBytes, _ := json.Marshal(variable.Value)
+			newAsBytes, _ := json.Marshal(value)
+			if string(oldAsBytes) == string(newAsBytes) {
+				continue
+			}
+		}
+		process.Variables[name] = ProcessVariable{
+			Value:      value,
+			Version:    variable.Version + 1,
+			NodeId:     nodeId,
+			Modifier:   modifier,
+			ModifyTime: modifyTime,
+		}
+	}
+}
+
+// =============================================================================
+// 流程变量的当前值
+// =============================================================================
+func GetVariableValues(process Process) map[string]interface{} {
+	values := map[string]interface{}{}
+	for name, variable := range process.Variables {
+		values[name] = variable.Value
+	}
+	return values
+}
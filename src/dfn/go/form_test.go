@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 测试使用的节点表单
+const testFormSchema = `{"type":"object","properties":{"decision":{"type":"string","enum":["approve","reject"]},"amount":{"type":"number","minimum":0}},"required":["decision"],"additionalProperties":false}`
+
+// mock 创建按流程变量路由的图工作流
+func MockCreateFormWorkflow(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_graph_workflow"),
+		[]byte(`{"id":"test_form_workflow-001","workflowName":"测试表单流程001","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`[{"id":"start","nodeName":"发起行","formSchema":` + testFormSchema + `},{"id":"committee","nodeName":"信贷审批委员会"},{"id":"trustee","nodeName":"受托机构"}]`),
+		[]byte(`[{"from":"start","to":"committee","condition":{"field":"variables.amount","operator":"gt","value":"1亿"}},{"from":"start","to":"trustee"},{"from":"committee","to":"trustee"}]`),
+	})
+	return response
+}
+
+// mock 提交表单并流转，下一节点由路由规则选择
+func MockTransferWithForm(t *testing.T, stub *shim.MockStub, processId string, formData string, remark string) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("transfer_process"),
+		[]byte(processId),
+		[]byte(""),
+		[]byte("@org1.example.com"),
+		[]byte("2018-03-16 15:54:00"),
+		[]byte(""),
+		[]byte(formData),
+		[]byte(remark),
+	})
+	return response
+}
+
+// 测试表单数据的校验
+func Test_ValidateFormData(t *testing.T) {
+	var schema FormSchema
+	json.Unmarshal([]byte(testFormSchema), &schema)
+	if ValidateFormSchema(WorkflowNode{Id: "node", FormSchema: &schema}) != nil {
+		fmt.Println("表单应校验通过")
+		t.FailNow()
+	}
+	if ValidateFormSchema(WorkflowNode{Id: "node", FormSchema: &FormSchema{Required: []string{"decision"}}}) == nil {
+		fmt.Println("必填字段必须声明")
+		t.FailNow()
+	}
+
+	cases := map[string]bool{
+		`{"decision":"approve","amount":100}`: true,
+		`{"decision":"approve"}`:              true,
+		`{"amount":100}`:                      false,
+		`{"decision":"pending"}`:              false,
+		`{"decision":"approve","amount":-1}`:  false,
+		`{"decision":"approve","amount":"1"}`: false,
+		`{"decision":"approve","other":1}`:    false,
+	}
+	for formData, valid := range cases {
+		var data map[string]interface{}
+		json.Unmarshal([]byte(formData), &data)
+		if (ValidateFormData(schema, data) == nil) != valid {
+			fmt.Println("表单数据校验不正确 - " + formData)
+			t.FailNow()
+		}
+	}
+}
+
+// 测试流转时提交表单，表单数据保存为流程变量并用于路由
+func Test_ProcessForm(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateProject2(t, stub)
+	response := MockCreateFormWorkflow(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("start_process"),
+		[]byte(`{"id":"test_process_012","workflowId":"test_form_workflow-001","attachDocType":"project","attachDocId":"project-bankcomm-000002","createTime":"2018-3-19 09:43:02"}`),
+	})
+
+	response = MockTransferWithForm(t, stub, "test_process_012", "", "")
+	if response.Status != shim.ERROR {
+		fmt.Println("未填写必填字段时不能流转")
+		t.FailNow()
+	}
+
+	// 金额大于1亿时提交到信贷审批委员会
+	response = MockTransferWithForm(t, stub, "test_process_012", `{"decision":"approve","amount":200000000}`, "同意发行")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var process Process
+	json.Unmarshal(stub.State["test_process_012"], &process)
+	if process.CurrentNodeId != "test_form_workflow-001:node-committee" || process.Variables["amount"].Version != 1 || process.Variables["decision"].Value != "approve" {
+		fmt.Println("表单数据应保存为流程变量并用于路由")
+		t.FailNow()
+	}
+	var log ProcessLog
+	json.Unmarshal(stub.State["processLog-test_process_012-"+IndexSeq(1)], &log)
+	if log.Remark != "同意发行" || log.FormData["decision"] != "approve" {
+		fmt.Println("日志应记录备注和表单数据")
+		t.FailNow()
+	}
+
+	// 没有表单的节点不能提交表单，退回时可以只填写备注
+	returnArgs := [][]byte{
+		[]byte("return_process"),
+		[]byte("test_process_012"),
+		[]byte("2018-03-16 15:54:00"),
+		[]byte(`{"decision":"reject"}`),
+		[]byte("金额有误"),
+	}
+	response = stub.MockInvoke(GetTestTxID(), returnArgs)
+	if response.Status != shim.ERROR {
+		fmt.Println("节点没有表单时不能提交表单数据")
+		t.FailNow()
+	}
+	returnArgs[3] = []byte("")
+	response = stub.MockInvoke(GetTestTxID(), returnArgs)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+
+	// 修改金额后流转到受托机构，只有变化的变量版本号增加
+	response = MockTransferWithForm(t, stub, "test_process_012", `{"decision":"approve","amount":5000000}`, "")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("get_process_by_id"),
+		[]byte("test_process_012"),
+	})
+	process = Process{}
+	json.Unmarshal(response.Payload, &process)
+	if process.CurrentNodeId != "test_form_workflow-001:node-trustee" || process.Variables["amount"].Version != 2 || process.Variables["decision"].Version != 1 {
+		fmt.Println("流程变量的版本号不正确")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- Holding ----- //
+// 机构持有的资产份数，以 holding~资产ID~持有机构 的复合键存储
+type Holding struct {
+	DocType string `json:"docType"`
+	AssetId string `json:"assetId"`
+	Holder  string `json:"holder"`
+	Balance int64  `json:"balance"`
+}
+
+// 持仓变动，Amount为正数时增加，负数时减少
+type HoldingChange struct {
+	AssetId string `json:"assetId"`
+	Holder  string `json:"holder"`
+	Amount  int64  `json:"amount"`
+	Balance int64  `json:"balance"` // 变动后的余额
+}
+
+// 持仓变动事件
+type HoldingEvent struct {
+	Operation string          `json:"operation"` // 引起变动的操作，如allocate、transfer
+	Changes   []HoldingChange `json:"changes"`
+}
+
+// 持仓历史，以 holdingHistory~资产ID~持有机构~交易时间 的复合键存储，用于计算登记日持仓
+type HoldingHistory struct {
+	Balance int64  `json:"balance"`
+	TxId    string `json:"txId"`
+}
+
+// 持仓历史的时间格式，UTC定长以便按字符串排序
+const HoldingHistoryTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// 生成持仓的复合键
+func GetHoldingKey(stub shim.ChaincodeStubInterface, assetId string, holder string) (string, error) {
+	return stub.CreateCompositeKey("holding", []string{assetId, holder})
+}
+
+// =============================================================================
+// 获取持仓，不存在时返回余额为0的持仓
+// =============================================================================
+func GetHolding(stub shim.ChaincodeStubInterface, assetId string, holder string) (Holding, error) {
+	holding := Holding{DocType: "holding", AssetId: assetId, Holder: holder}
+	key, err := GetHoldingKey(stub, assetId, holder)
+	if err != nil {
+		return holding, err
+	}
+	holdingAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return holding, errors.New("Failed to find holding - " + assetId + " " + holder)
+	}
+	if holdingAsBytes != nil {
+		json.Unmarshal(holdingAsBytes, &holding)
+	}
+	return holding, nil
+}
+
+// =============================================================================
+// 变更持仓并发送一个持仓变动事件
+// 同一交易中只能读到变更前的状态，因此同一持仓的多次变动先合并再写入；
+// Fabric每个交易只保留最后一个事件，因此应在交易的最后调用
+// =============================================================================
+func UpdateHoldings(stub shim.ChaincodeStubInterface, operation string, changes []HoldingChange) error {
+	var merged []HoldingChange
+	indexes := map[string]int{}
+	for _, change := range changes {
+		if change.Amount == 0 {
+			continue
+		}
+		key := change.AssetId + "\x00" + change.Holder
+		if i, exists := indexes[key]; exists {
+			merged[i].Amount = merged[i].Amount + change.Amount
+			continue
+		}
+		indexes[key] = len(merged)
+		merged = append(merged, HoldingChange{AssetId: change.AssetId, Holder: change.Holder, Amount: change.Amount})
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(merged); i++ {
+		holding, err := GetHolding(stub, merged[i].AssetId, merged[i].Holder)
+		if err != nil {
+			return err
+		}
+		holding.Balance = holding.Balance + merged[i].Amount
+		if holding.Balance < 0 {
+			return errors.New("Insufficient balance - " + merged[i].AssetId + " " + merged[i].Holder)
+		}
+		merged[i].Balance = holding.Balance
+		err = putHolding(stub, holding)
+		if err != nil {
+			return err
+		}
+		err = putHoldingHistory(stub, holding, txTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(merged) > 0 {
+		eventAsBytes, _ := json.Marshal(HoldingEvent{Operation: operation, Changes: merged})
+		SendEvent(stub, "HoldingChanged", eventAsBytes)
+	}
+	return nil
+}
+
+// 存储持仓，余额为0时删除
+func putHolding(stub shim.ChaincodeStubInterface, holding Holding) error {
+	key, err := GetHoldingKey(stub, holding.AssetId, holding.Holder)
+	if err != nil {
+		return err
+	}
+	if holding.Balance == 0 {
+		return stub.DelState(key)
+	}
+	holdingAsBytes, _ := json.Marshal(holding)
+	return stub.PutState(key, holdingAsBytes)
+}
+
+// 存储持仓历史
+func putHoldingHistory(stub shim.ChaincodeStubInterface, holding Holding, txTime time.Time) error {
+	key, err := stub.CreateCompositeKey("holdingHistory", []string{holding.AssetId, holding.Holder, txTime.UTC().Format(HoldingHistoryTimeLayout)})
+	if err != nil {
+		return err
+	}
+	historyAsBytes, _ := json.Marshal(HoldingHistory{Balance: holding.Balance, TxId: stub.GetTxID()})
+	return stub.PutState(key, historyAsBytes)
+}
+
+// =============================================================================
+// 获取截至某一时间（不含）的全部持仓，即该时间之前每个机构最后一次变动后的余额
+// 只指定资产ID时返回全部持有机构
+// =============================================================================
+func getHoldingsAsOf(stub shim.ChaincodeStubInterface, keys []string, cutoff time.Time) ([]Holding, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("holdingHistory", keys)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	cutoffStr := cutoff.UTC().Format(HoldingHistoryTimeLayout)
+	var holders []string
+	balances := map[string]int64{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil {
+			return nil, err
+		}
+		// 同一机构的历史按时间升序返回
+		if keyParts[2] >= cutoffStr {
+			continue
+		}
+		var history HoldingHistory
+		err = json.Unmarshal(aKeyValue.Value, &history)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := balances[keyParts[1]]; !exists {
+			holders = append(holders, keyParts[1])
+		}
+		balances[keyParts[1]] = history.Balance
+	}
+
+	holdings := []Holding{}
+	for _, holder := range holders {
+		if balances[holder] > 0 {
+			holdings = append(holdings, Holding{DocType: "holding", AssetId: keys[0], Holder: holder, Balance: balances[holder]})
+		}
+	}
+	return holdings, nil
+}
+
+// 获取资产截至某一时间的全部持仓
+func GetHoldingsAsOf(stub shim.ChaincodeStubInterface, assetId string, cutoff time.Time) ([]Holding, error) {
+	return getHoldingsAsOf(stub, []string{assetId}, cutoff)
+}
+
+// 获取机构截至某一时间的持仓
+func GetHoldingAsOf(stub shim.ChaincodeStubInterface, assetId string, holder string, cutoff time.Time) (Holding, error) {
+	holdings, err := getHoldingsAsOf(stub, []string{assetId, holder}, cutoff)
+	if err != nil || len(holdings) == 0 {
+		return Holding{DocType: "holding", AssetId: assetId, Holder: holder}, err
+	}
+	return holdings[0], nil
+}
+
+// =============================================================================
+// 转让持仓
+// 转出机构为提交者证书中的机构
+// =============================================================================
+func transfer_holding(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting transfer_holding")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	assetId := args[0]
+	receiver := args[1]
+	amount, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || amount <= 0 {
+		return shim.Error("Amount must be a positive integer - " + args[2])
+	}
+
+	sender, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, err = GetOrgFromCertCommonName(receiver)
+	if err != nil {
+		return shim.Error("Receiver must be an org name like @org1.example.com - " + receiver)
+	}
+	if receiver == sender {
+		return shim.Error("Can not transfer to yourself - " + receiver)
+	}
+
+	holding, err := GetHolding(stub, assetId, sender)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if holding.Balance < amount {
+		fmt.Println("Insufficient balance - " + assetId + " " + sender)
+		return shim.Error("Insufficient balance - " + assetId + " " + sender)
+	}
+
+	err = UpdateHoldings(stub, "transfer", []HoldingChange{
+		{AssetId: assetId, Holder: sender, Amount: -amount},
+		{AssetId: assetId, Holder: receiver, Amount: amount},
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end transfer_holding")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 查询持仓余额
+// 不指定机构时查询提交者所在机构
+// =============================================================================
+func get_balance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting get_balance")
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	assetId := args[0]
+	var holder string
+	if len(args) == 2 && args[1] != "" {
+		holder = args[1]
+	} else {
+		holder, err = GetOrgFromCert(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	holding, err := GetHolding(stub, assetId, holder)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	holdingAsBytes, _ := json.Marshal(holding)
+
+	fmt.Println("- end get_balance")
+	return shim.Success(holdingAsBytes)
+}
+
+// =============================================================================
+// 查询资产的全部持有机构
+// =============================================================================
+func GetHoldersByAssetId(stub shim.ChaincodeStubInterface, assetId string) ([]Holding, error) {
+	holdings, _, err := GetPagingHoldersByAssetId(stub, assetId, 0, "")
+	return holdings, err
+}
+
+// 分页查询资产的持有机构，pageSize为0时不分页
+func GetPagingHoldersByAssetId(stub shim.ChaincodeStubInterface, assetId string, pageSize int32, bookmark string) ([]Holding, *pb.QueryResponseMetadata, error) {
+	resultsIterator, metadata, err := GetStateByPartialCompositeKey(stub, "holding", []string{assetId}, pageSize, bookmark)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+
+	holdings := []Holding{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		var holding Holding
+		err = json.Unmarshal(aKeyValue.Value, &holding)
+		if err != nil {
+			return nil, nil, err
+		}
+		holdings = append(holdings, holding)
+	}
+	return holdings, metadata, nil
+}
+
+// ========================================================
+// 查询资产的持有机构列表
+// ========================================================
+func query_holders(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting query_holders")
+
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	holdings, metadata, err := GetPagingHoldersByAssetId(stub, args[0], pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, _ := json.Marshal(holdings)
+	result, err = MarshalPageResult(result, metadata)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end query_holders")
+	return shim.Success(result)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 直接写入本机构的持仓
+func MockPutHolding(t *testing.T, stub *shim.MockStub, amount int64) {
+	stub.MockTransactionStart(GetTestTxID())
+	err := UpdateHoldings(stub, "allocate", []HoldingChange{
+		{AssetId: "bond-bankcomm-000002-A", Holder: "@org1.example.com", Amount: amount},
+	})
+	stub.MockTransactionEnd(GetTestTxID())
+	if err != nil {
+		fmt.Println(err.Error())
+		t.FailNow()
+	}
+}
+
+// mock 转让持仓
+func MockTransferHolding(t *testing.T, stub *shim.MockStub, receiver string, amount string) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("transfer_holding"),
+		[]byte("bond-bankcomm-000002-A"),
+		[]byte(receiver),
+		[]byte(amount),
+	})
+	return response
+}
+
+// 测试转让持仓
+func Test_TransferHolding(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockPutHolding(t, stub, 1000)
+	response := MockTransferHolding(t, stub, "@org2.example.com", "1001")
+	if response.Status != shim.ERROR {
+		fmt.Println("超过持仓余额，应该失败。")
+		t.FailNow()
+	}
+	response = MockTransferHolding(t, stub, "@org1.example.com", "100")
+	if response.Status != shim.ERROR {
+		fmt.Println("不能转让给自己，应该失败。")
+		t.FailNow()
+	}
+	response = MockTransferHolding(t, stub, "@org2.example.com", "400")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("get_balance"),
+		[]byte("bond-bankcomm-000002-A"),
+		[]byte("@org2.example.com"),
+	})
+	var holding Holding
+	json.Unmarshal(response.Payload, &holding)
+	if holding.Balance != 400 {
+		fmt.Println("接收机构余额不正确")
+		t.FailNow()
+	}
+
+	// 全部转出后不再是持有机构
+	MockTransferHolding(t, stub, "@org2.example.com", "600")
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("query_holders"),
+		[]byte("bond-bankcomm-000002-A"),
+	})
+	var holdings []Holding
+	json.Unmarshal(response.Payload, &holdings)
+	if len(holdings) != 1 || holdings[0].Holder != "@org2.example.com" || holdings[0].Balance != 1000 {
+		fmt.Println("持有机构列表不正确", holdings)
+		t.FailNow()
+	}
+}
+
+// 测试持仓变动合并
+func Test_UpdateHoldings(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	stub.MockTransactionStart(GetTestTxID())
+	err := UpdateHoldings(stub, "allocate", []HoldingChange{
+		{AssetId: "bond-bankcomm-000002-A", Holder: "@org1.example.com", Amount: 100},
+		{AssetId: "bond-bankcomm-000002-A", Holder: "@org1.example.com", Amount: 200},
+	})
+	stub.MockTransactionEnd(GetTestTxID())
+	if err != nil {
+		fmt.Println(err.Error())
+		t.FailNow()
+	}
+	holding, _ := GetHolding(stub, "bond-bankcomm-000002-A", "@org1.example.com")
+	if holding.Balance != 300 {
+		fmt.Println("同一持仓的变动应合并", holding.Balance)
+		t.FailNow()
+	}
+	stub.MockTransactionStart(GetTestTxID())
+	err = UpdateHoldings(stub, "transfer", []HoldingChange{
+		{AssetId: "bond-bankcomm-000002-A", Holder: "@org1.example.com", Amount: -301},
+	})
+	stub.MockTransactionEnd(GetTestTxID())
+	if err == nil {
+		fmt.Println("余额不能为负数")
+		t.FailNow()
+	}
+}
+
+// 测试按书签分页查询持有机构
+func Test_QueryHoldersWithPagination(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	stub.MockTransactionStart(GetTestTxID())
+	UpdateHoldings(stub, "allocate", []HoldingChange{
+		{AssetId: "bond-bankcomm-000002-A", Holder: "@org1.example.com", Amount: 100},
+		{AssetId: "bond-bankcomm-000002-A", Holder: "@org2.example.com", Amount: 200},
+		{AssetId: "bond-bankcomm-000002-A", Holder: "@org3.example.com", Amount: 300},
+	})
+	stub.MockTransactionEnd(GetTestTxID())
+
+	pagingStub := &pagingMockStub{stub}
+	response := query_holders(pagingStub, []string{"bond-bankcomm-000002-A", "2"})
+	var page PageResult
+	var holdings []Holding
+	json.Unmarshal(response.Payload, &page)
+	json.Unmarshal(page.Records, &holdings)
+	if response.Status != shim.OK || page.FetchedCount != 2 || len(holdings) != 2 || page.Bookmark == "" {
+		fmt.Println("第一页结果不正确", string(response.Payload))
+		t.FailNow()
+	}
+
+	response = query_holders(pagingStub, []string{"bond-bankcomm-000002-A", "2", page.Bookmark})
+	page = PageResult{}
+	json.Unmarshal(response.Payload, &page)
+	json.Unmarshal(page.Records, &holdings)
+	if page.FetchedCount != 1 || len(holdings) != 1 || holdings[0].Holder != "@org3.example.com" || page.Bookmark != "" {
+		fmt.Println("第二页结果不正确", string(response.Payload))
+		t.FailNow()
+	}
+
+	// 不传分页参数时返回全部记录
+	response = query_holders(pagingStub, []string{"bond-bankcomm-000002-A"})
+	json.Unmarshal(response.Payload, &holdings)
+	if len(holdings) != 3 {
+		fmt.Println("不分页时应返回全部持有机构", string(response.Payload))
+		t.FailNow()
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 复合键二级索引
+// LevelDB状态库和mock引擎不支持富查询，此时按索引前缀范围查询候选文档，再按查询条件过滤和排序
+// 索引名按“文档类型~索引字段~文档ID”命名，复合键最后一部分为文档ID，值为空字节
+// 候选文档都会按查询条件重新校验，残留的过期索引项只影响效率，不影响结果
+const (
+	DocTypeIndex               = "docType~id"
+	ProcessOwnerIndex          = "process~owner~id"
+	ProcessParticipantIndex    = "process~participant~id"
+	ProcessAttachIndex         = "process~attach~id"
+	ProcessLogIndex            = "processLog~process~seq"
+	WorkflowNodeIndex          = "workflowNode~workflow~seq"
+	WorkflowVersionIndex       = "workflowVersion~base~version"
+	EncryptedDataIndex         = "encryptedData~state~org"
+	BondProjectIndex           = "bond~project~id"
+	SubscriptionInvestorIndex  = "subscriptionOrder~investor~id"
+	TriggerEvaluationBondIndex = "triggerEvaluation~bond~id"
+	DelegationOrgIndex         = "delegation~org~id"
+	AttachmentDocIndex         = "attachment~doc~id"
+	AttachmentHashIndex        = "attachment~hash~id"
+)
+
+// 分页查询在mock引擎中返回空结果时使用的错误
+var ErrPagingQueryUnsupported = errors.New("Paging query is not supported")
+
+// ----- IndexEntry ----- //
+// 一个索引项，Attributes的最后一个为文档ID
+type IndexEntry struct {
+	Name       string
+	Attributes []string
+}
+
+// 索引序号补零，保证按字符串排序与数值顺序一致
+func IndexSeq(seq int) string {
+	return fmt.Sprintf("%08d", seq)
+}
+
+// ========================================================
+// 判断错误是否因为状态库不支持富查询
+// ========================================================
+func IsRichQueryUnsupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	return message == "not implemented" || message == ErrPagingQueryUnsupported.Error() ||
+		strings.Contains(message, "not supported for leveldb")
+}
+
+// 写入索引项
+func PutIndex(stub shim.ChaincodeStubInterface, indexName string, attributes ...string) error {
+	indexKey, err := stub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte{0x00})
+}
+
+// 删除索引项
+func DelIndex(stub shim.ChaincodeStubInterface, indexName string, attributes ...string) error {
+	indexKey, err := stub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(indexKey)
+}
+
+// ========================================================
+// 按新旧索引项的差异更新索引
+// ========================================================
+func UpdateIndexes(stub shim.ChaincodeStubInterface, oldEntries []IndexEntry, newEntries []IndexEntry) error {
+	newKeys := map[string]bool{}
+	for _, entry := range newEntries {
+		indexKey, err := stub.CreateCompositeKey(entry.Name, entry.Attributes)
+		if err != nil {
+			return err
+		}
+		newKeys[indexKey] = true
+	}
+	for _, entry := range oldEntries {
+		indexKey, err := stub.CreateCompositeKey(entry.Name, entry.Attributes)
+		if err != nil {
+			return err
+		}
+		if !newKeys[indexKey] {
+			err = stub.DelState(indexKey)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for indexKey := range newKeys {
+		err := stub.PutState(indexKey, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ========================================================
+// 按索引前缀查询文档ID，按复合键顺序返回并去重
+// ========================================================
+func GetIdsByIndex(stub shim.ChaincodeStubInterface, indexName string, keys []string) ([]string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	ids := []string{}
+	found := map[string]bool{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(keyParts) == 0 {
+			continue
+		}
+		id := keyParts[len(keyParts)-1]
+		if !found[id] {
+			found[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// ========================================================
+// 按索引查询并在内存中执行查询条件和排序，返回满足条件的文档
+// ========================================================
+func GetDocumentsByIndex(stub shim.ChaincodeStubInterface, query *Query) ([]json.RawMessage, error) {
+	if query.indexName == "" {
+		return nil, errors.New("No index for query - " + query.String())
+	}
+	fmt.Println("scan index " + query.indexName + " for query :" + query.String())
+
+	// 将查询条件序列化后再解析，与文档的值类型保持一致
+	var selector map[string]interface{}
+	selectorAsBytes, _ := json.Marshal(query.Selector)
+	json.Unmarshal(selectorAsBytes, &selector)
+
+	var ids []string
+	scanned := map[string]bool{}
+	for _, keys := range query.indexScans {
+		scanIds, err := GetIdsByIndex(stub, query.indexName, keys)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range scanIds {
+			if !scanned[id] {
+				scanned[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	documents := []json.RawMessage{}
+	values := []map[string]interface{}{}
+	for _, id := range ids {
+		docAsBytes, err := stub.GetState(id)
+		if err != nil {
+			return nil, err
+		}
+		if docAsBytes == nil {
+			continue
+		}
+		var doc map[string]interface{}
+		if json.Unmarshal(docAsBytes, &doc) != nil {
+			continue
+		}
+		if MatchSelector(selector, doc) {
+			documents = append(documents, json.RawMessage(docAsBytes))
+			values = append(values, doc)
+		}
+	}
+
+	if len(query.Sort) > 0 {
+		indexes := make([]int, len(documents))
+		for i := range indexes {
+			indexes[i] = i
+		}
+		sort.SliceStable(indexes, func(i, j int) bool {
+			for _, sortField := range query.Sort {
+				for field, direction := range sortField {
+					result := CompareQueryValues(values[indexes[i]][field], values[indexes[j]][field])
+					if result != 0 {
+						return (result < 0) == (direction != "desc")
+					}
+				}
+			}
+			return false
+		})
+		sorted := make([]json.RawMessage, len(documents))
+		for i, index := range indexes {
+			sorted[i] = documents[index]
+		}
+		documents = sorted
+	}
+	return documents, nil
+}
+
+// ========================================================
+// 按索引查询，返回JSON数组
+// ========================================================
+func GetQueryResultByIndex(stub shim.ChaincodeStubInterface, query *Query) ([]byte, error) {
+	documents, err := GetDocumentsByIndex(stub, query)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(documents)
+}
+
+// ========================================================
+// 按索引分页查询，书签为下一页的起始位置
+// ========================================================
+func GetQueryResultByIndexWithPagination(stub shim.ChaincodeStubInterface, query *Query, pageSize int32, bookmark string) ([]byte, *pb.QueryResponseMetadata, error) {
+	documents, err := GetDocumentsByIndex(stub, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	start := 0
+	if bookmark != "" {
+		start, err = strconv.Atoi(bookmark)
+		if err != nil || start < 0 {
+			return nil, nil, errors.New("Invalid bookmark - " + bookmark)
+		}
+	}
+	if start > len(documents) {
+		start = len(documents)
+	}
+	end := start + int(pageSize)
+	metadata := &pb.QueryResponseMetadata{}
+	if end < len(documents) {
+		metadata.Bookmark = strconv.Itoa(end)
+	} else {
+		end = len(documents)
+	}
+	page := documents[start:end]
+	metadata.FetchedRecordsCount = int32(len(page))
+	result, _ := json.Marshal(page)
+	return result, metadata, nil
+}
+
+// ========================================================
+// 在内存中判断文档是否满足CouchDB查询条件
+// 支持字段相等、$eq、$ne、$gt、$gte、$lt、$lte、$in、$nin、$all、$exists、$elemMatch、$or、$and
+// ========================================================
+func MatchSelector(selector map[string]interface{}, doc map[string]interface{}) bool {
+	for field, condition := range selector {
+		switch field {
+		case "$or":
+			subSelectors, _ := condition.([]interface{})
+			matched := false
+			for _, subSelector := range subSelectors {
+				sub, ok := subSelector.(map[string]interface{})
+				if ok && MatchSelector(sub, doc) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "$and":
+			subSelectors, _ := condition.([]interface{})
+			for _, subSelector := range subSelectors {
+				sub, ok := subSelector.(map[string]interface{})
+				if !ok || !MatchSelector(sub, doc) {
+					return false
+				}
+			}
+		default:
+			value, exists := doc[field]
+			if !MatchCondition(value, exists, condition) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// 判断值是否满足字段条件，条件为值本身（相等）或操作符条件
+func MatchCondition(value interface{}, exists bool, condition interface{}) bool {
+	operators, ok := condition.(map[string]interface{})
+	if !ok || !isOperatorCondition(operators) {
+		return exists && CompareQueryValues(value, condition) == 0
+	}
+	for operator, operand := range operators {
+		matched := false
+		switch operator {
+		case "$eq":
+			matched = exists && CompareQueryValues(value, operand) == 0
+		case "$ne":
+			matched = !exists || CompareQueryValues(value, operand) != 0
+		case "$gt":
+			matched = exists && isSameQueryType(value, operand) && CompareQueryValues(value, operand) > 0
+		case "$gte":
+			matched = exists && isSameQueryType(value, operand) && CompareQueryValues(value, operand) >= 0
+		case "$lt":
+			matched = exists && isSameQueryType(value, operand) && CompareQueryValues(value, operand) < 0
+		case "$lte":
+			matched = exists && isSameQueryType(value, operand) && CompareQueryValues(value, operand) <= 0
+		case "$in":
+			matched = exists && containsQueryValue(operand, value)
+		case "$nin":
+			matched = exists && !containsQueryValue(operand, value)
+		case "$all":
+			elements, isArray := value.([]interface{})
+			required, _ := operand.([]interface{})
+			matched = exists && isArray
+			for _, item := range required {
+				if matched && !containsQueryValue(elements, item) {
+					matched = false
+				}
+			}
+		case "$exists":
+			matched = operand == exists
+		case "$elemMatch":
+			elements, _ := value.([]interface{})
+			for _, element := range elements {
+				if matchElement(element, operand) {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// 数组元素是否满足$elemMatch条件，元素为对象时按字段匹配
+func matchElement(element interface{}, condition interface{}) bool {
+	operators, ok := condition.(map[string]interface{})
+	if ok && !isOperatorCondition(operators) {
+		elementDoc, isDoc := element.(map[string]interface{})
+		return isDoc && MatchSelector(operators, elementDoc)
+	}
+	return MatchCondition(element, true, condition)
+}
+
+func isOperatorCondition(condition map[string]interface{}) bool {
+	if len(condition) == 0 {
+		return false
+	}
+	for key := range condition {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func containsQueryValue(array interface{}, value interface{}) bool {
+	elements, _ := array.([]interface{})
+	for _, element := range elements {
+		if CompareQueryValues(element, value) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 按CouchDB的排序规则确定值的类型顺序：null < false < true < 数字 < 字符串 < 数组 < 对象
+func queryTypeOrder(value interface{}) int {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case bool:
+		if v {
+			return 2
+		}
+		return 1
+	case float64:
+		return 3
+	case string:
+		return 4
+	case []interface{}:
+		return 5
+	}
+	return 6
+}
+
+func isSameQueryType(a interface{}, b interface{}) bool {
+	orderA := queryTypeOrder(a)
+	orderB := queryTypeOrder(b)
+	return orderA == orderB || (orderA <= 2 && orderB <= 2 && orderA > 0 && orderB > 0)
+}
+
+// ========================================================
+// 比较两个JSON值，返回-1、0、1
+// ========================================================
+func CompareQueryValues(a interface{}, b interface{}) int {
+	orderA := queryTypeOrder(a)
+	orderB := queryTypeOrder(b)
+	if orderA != orderB {
+		if orderA < orderB {
+			return -1
+		}
+		return 1
+	}
+	switch valueA := a.(type) {
+	case float64:
+		valueB := b.(float64)
+		if valueA < valueB {
+			return -1
+		} else if valueA > valueB {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(valueA, b.(string))
+	case []interface{}:
+		valueB := b.([]interface{})
+		for i := 0; i < len(valueA) && i < len(valueB); i++ {
+			result := CompareQueryValues(valueA[i], valueB[i])
+			if result != 0 {
+				return result
+			}
+		}
+		return CompareQueryValues(float64(len(valueA)), float64(len(valueB)))
+	case map[string]interface{}:
+		valueAAsBytes, _ := json.Marshal(valueA)
+		valueBAsBytes, _ := json.Marshal(b)
+		return strings.Compare(string(valueAAsBytes), string(valueBAsBytes))
+	}
+	return 0
+}
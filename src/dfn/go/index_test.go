@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// 测试按查询条件匹配文档，与CouchDB的选择器语义一致
+func Test_MatchSelector(t *testing.T) {
+	var doc map[string]interface{}
+	json.Unmarshal([]byte(`{"docType":"process","finished":false,"currentOwner":"@org2.example.com","branches":[{"owner":"@org1.example.com","waiting":false}],"createTime":"2018-06-01"}`), &doc)
+
+	var selector map[string]interface{}
+	query := NewQuery("process").Eq("finished", false).Or(
+		Selector{"currentOwner": "@org1.example.com"},
+		Selector{}.ElemMatch("branches", Selector{"owner": "@org1.example.com", "waiting": false}),
+	)
+	selectorAsBytes, _ := json.Marshal(query.Selector)
+	json.Unmarshal(selectorAsBytes, &selector)
+	if !MatchSelector(selector, doc) {
+		fmt.Println("分支待办应该匹配")
+		t.FailNow()
+	}
+
+	selector = nil
+	json.Unmarshal([]byte(`{"docType":"process","createTime":{"$gte":"2018-07-01"}}`), &selector)
+	if MatchSelector(selector, doc) {
+		fmt.Println("创建时间不满足条件")
+		t.FailNow()
+	}
+	selector = nil
+	json.Unmarshal([]byte(`{"docType":"process","canceled":{"$exists":false},"currentOwner":{"$in":["@org2.example.com"]}}`), &selector)
+	if !MatchSelector(selector, doc) {
+		fmt.Println("$exists和$in应该匹配")
+		t.FailNow()
+	}
+}
+
+// 测试排序比较，不同类型按CouchDB的顺序排列
+func Test_CompareQueryValues(t *testing.T) {
+	if CompareQueryValues(nil, false) >= 0 || CompareQueryValues(true, 1.0) >= 0 || CompareQueryValues(2.0, "1") >= 0 {
+		fmt.Println("不同类型的顺序不正确")
+		t.FailNow()
+	}
+	if CompareQueryValues("2018-06-01", "2018-07-01") >= 0 || CompareQueryValues(10.0, 9.0) <= 0 {
+		fmt.Println("同类型的顺序不正确")
+		t.FailNow()
+	}
+}
@@ -3,14 +3,18 @@ package main
 import (
 	"bytes"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
 
@@ -20,12 +24,7 @@ func GetAllObjectsByDocType(stub shim.ChaincodeStubInterface, args []string, doc
 	var err error
 	fmt.Println("starting GetAllObjectsByDocType")
 
-	var queryBuffer bytes.Buffer
-	queryBuffer.WriteString(`{"selector":{"docType":"`)
-	queryBuffer.WriteString(docType)
-	queryBuffer.WriteString(`"}}`)
-
-	result, err = GetQueryResult(stub, queryBuffer.String())
+	result, err = ExecuteQuery(stub, GetObjectsQueryByDocType(docType))
 	if err != nil {
 		return nil, err
 	}
@@ -34,28 +33,21 @@ func GetAllObjectsByDocType(stub shim.ChaincodeStubInterface, args []string, doc
 	return result, nil
 }
 
-// GetPagingObjectsByDocType 分页查询项目
+// GetPagingObjectsByDocType 分页查询项目，args为pageSize和可选的书签bookmark
 func GetPagingObjectsByDocType(stub shim.ChaincodeStubInterface, args []string, docType string) ([]byte, error) {
 	var result []byte
 	var err error
 	fmt.Println("starting GetPagingObjectsByDocType")
 
-	limit, skip, err := SanitizePagingArgument(args[0:2])
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args)
 	if err != nil {
 		return nil, err
 	}
+	if pageSize == 0 {
+		return nil, errors.New("Incorrect number of paging arguments. Expecting 1 or 2")
+	}
 
-	var queryBuffer bytes.Buffer
-		queryBuffer.WriteString(`{"selector":{"docType":"`)
-		queryBuffer.WriteString(docType)
-		queryBuffer.WriteString(`"},"limit":`)
-		queryBuffer.WriteString(limit)
-		queryBuffer.WriteString(`,"skip":`)
-		queryBuffer.WriteString(skip)
-		queryBuffer.WriteString(`,"sort": [{"modifyTime": "desc"}]`)
-		queryBuffer.WriteString(`}`)
-
-	result, err = GetQueryResult(stub, queryBuffer.String())
+	result, err = GetPagingQueryResult(stub, GetPagingObjectsQueryByDocType(docType), pageSize, bookmark)
 	if err != nil {
 		return nil, err
 	}
@@ -64,6 +56,16 @@ func GetPagingObjectsByDocType(stub shim.ChaincodeStubInterface, args []string,
 	return result, nil
 }
 
+// 某个种类全部资产的查询语句
+func GetObjectsQueryByDocType(docType string) *Query {
+	return NewQuery(docType).UseIndex("indexDocType").ScanIndex(DocTypeIndex, docType)
+}
+
+// 某个种类资产按修改时间倒序的分页查询语句
+func GetPagingObjectsQueryByDocType(docType string) *Query {
+	return NewQuery(docType).SortBy("modifyTime", "desc").UseIndex("indexDocTypeModifyTime").ScanIndex(DocTypeIndex, docType)
+}
+
 // GetQueryResult 使用 stub.GetQueryResult 接口查询并转换结果为 bytes
 func GetQueryResult(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
 	fmt.Println("queryString is :" + queryString)
@@ -79,6 +81,143 @@ func GetQueryResult(stub shim.ChaincodeStubInterface, queryString string) ([]byt
 	return ConvQueryResult(resultsIterator)
 }
 
+// ----- PageResult ----- //
+// 书签分页查询结果
+type PageResult struct {
+	Records      json.RawMessage `json:"records"`      // 本页记录
+	FetchedCount int32           `json:"fetchedCount"` // 本页记录数，链码中过滤时为过滤后的记录数，小于pageSize时表示已是最后一页
+	Bookmark     string          `json:"bookmark"`     // 查询下一页时传入的书签
+}
+
+// GetQueryResultWithPagination 使用 stub.GetQueryResultWithPagination 接口查询，返回本页记录和分页信息
+// 分页查询只能在只读交易中使用
+func GetQueryResultWithPagination(stub shim.ChaincodeStubInterface, queryString string, pageSize int32, bookmark string) ([]byte, *pb.QueryResponseMetadata, error) {
+	fmt.Println("queryString is :" + queryString)
+
+	resultsIterator, metadata, err := stub.GetQueryResultWithPagination(queryString, pageSize, bookmark)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resultsIterator == nil || metadata == nil {
+		return nil, nil, ErrPagingQueryUnsupported
+	}
+	defer resultsIterator.Close()
+
+	result, err := ConvQueryResult(resultsIterator)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, metadata, nil
+}
+
+// ExecuteQuery 执行查询，状态库不支持富查询时按查询指定的复合键索引范围查询
+func ExecuteQuery(stub shim.ChaincodeStubInterface, query *Query) ([]byte, error) {
+	result, err := GetQueryResult(stub, query.String())
+	if IsRichQueryUnsupported(err) && query.indexName != "" {
+		return GetQueryResultByIndex(stub, query)
+	}
+	return result, err
+}
+
+// GetQueryResultByPage 按分页参数查询记录列表，pageSize为0时不分页，返回的分页信息为nil
+func GetQueryResultByPage(stub shim.ChaincodeStubInterface, query *Query, pageSize int32, bookmark string) ([]byte, *pb.QueryResponseMetadata, error) {
+	if pageSize == 0 {
+		result, err := ExecuteQuery(stub, query)
+		return result, nil, err
+	}
+	result, metadata, err := GetQueryResultWithPagination(stub, query.String(), pageSize, bookmark)
+	if IsRichQueryUnsupported(err) && query.indexName != "" {
+		return GetQueryResultByIndexWithPagination(stub, query, pageSize, bookmark)
+	}
+	return result, metadata, err
+}
+
+// GetPagingQueryResult 按分页参数查询，pageSize为0时直接返回记录列表，否则返回分页结果
+func GetPagingQueryResult(stub shim.ChaincodeStubInterface, query *Query, pageSize int32, bookmark string) ([]byte, error) {
+	result, metadata, err := GetQueryResultByPage(stub, query, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	return MarshalPageResult(result, metadata)
+}
+
+// FillPage 在链码中过滤分页结果时，按需继续读取下一页，直至本页记录数达到pageSize或没有更多记录
+// fetch按给定的pageSize和bookmark读取一页并过滤，返回保留的记录数；pageSize为0时只读取一次，返回的分页信息为nil
+// 返回的书签为最后一次读取的书签，分页信息中的记录数为本页保留的记录数
+func FillPage(pageSize int32, bookmark string, fetch func(pageSize int32, bookmark string) (int, *pb.QueryResponseMetadata, error)) (*pb.QueryResponseMetadata, error) {
+	var count int32
+	for {
+		remaining := pageSize - count
+		kept, metadata, err := fetch(remaining, bookmark)
+		if err != nil {
+			return nil, err
+		}
+		if metadata == nil {
+			return nil, nil
+		}
+		count = count + int32(kept)
+		bookmark = metadata.GetBookmark()
+		if count >= pageSize || metadata.GetFetchedRecordsCount() < remaining || bookmark == "" {
+			return &pb.QueryResponseMetadata{FetchedRecordsCount: count, Bookmark: bookmark}, nil
+		}
+	}
+}
+
+// GetFilteredQueryResultByPage 分页查询并用filter过滤记录列表，过滤后不足一页时继续查询，参见FillPage
+func GetFilteredQueryResultByPage(stub shim.ChaincodeStubInterface, query *Query, pageSize int32, bookmark string, filter func(records []byte) ([]byte, error)) ([]byte, *pb.QueryResponseMetadata, error) {
+	records := []json.RawMessage{}
+	metadata, err := FillPage(pageSize, bookmark, func(pageSize int32, bookmark string) (int, *pb.QueryResponseMetadata, error) {
+		result, metadata, err := GetQueryResultByPage(stub, query, pageSize, bookmark)
+		if err != nil {
+			return 0, nil, err
+		}
+		result, err = filter(result)
+		if err != nil {
+			return 0, nil, err
+		}
+		var page []json.RawMessage
+		err = json.Unmarshal(result, &page)
+		if err != nil {
+			return 0, nil, err
+		}
+		records = append(records, page...)
+		return len(page), metadata, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	result, _ := json.Marshal(records)
+	return result, metadata, nil
+}
+
+// GetStateByPartialCompositeKey 按复合键前缀查询，pageSize为0时不分页，返回的分页信息为nil
+func GetStateByPartialCompositeKey(stub shim.ChaincodeStubInterface, objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if pageSize == 0 {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, keys)
+		return resultsIterator, nil, err
+	}
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, keys, pageSize, bookmark)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resultsIterator == nil || metadata == nil {
+		return nil, nil, ErrPagingQueryUnsupported
+	}
+	return resultsIterator, metadata, nil
+}
+
+// MarshalPageResult 将记录列表包装为分页结果，metadata为nil时表示未分页，原样返回记录列表
+func MarshalPageResult(records []byte, metadata *pb.QueryResponseMetadata) ([]byte, error) {
+	if metadata == nil {
+		return records, nil
+	}
+	return json.Marshal(PageResult{
+		Records:      json.RawMessage(records),
+		FetchedCount: metadata.GetFetchedRecordsCount(),
+		Bookmark:     metadata.GetBookmark(),
+	})
+}
+
 // ========================================================
 // 转换查询结果 shim.StateQueryIteratorInterface 为 bytes
 // ========================================================
@@ -114,42 +253,65 @@ func ConvQueryResult(resultsIterator shim.StateQueryIteratorInterface) ([]byte,
 	return buffer.Bytes(), nil
 }
 
+// ----- HistoryRecord ----- //
+// 文档的一个历史版本
+type HistoryRecord struct {
+	TxId      string          `json:"txId"`
+	Timestamp string          `json:"timestamp"` // 交易时间，RFC3339 UTC
+	IsDelete  bool            `json:"isDelete"`  // 是否为删除操作
+	Modifier  string          `json:"modifier"`  // 修改人，取文档的lastModifier，没有时取creator
+	Value     json.RawMessage `json:"value"`     // 文档内容，删除时为null
+}
+
 // ========================================================
 // 转换查询结果 shim.HistoryQueryIteratorInterface 为 bytes
 // ========================================================
 func ConvHistoryResult(resultsIterator shim.HistoryQueryIteratorInterface) ([]byte, error) {
-	// buffer is a JSON array containing QueryResults
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
+	records := []HistoryRecord{}
 	for resultsIterator.HasNext() {
-		aKeyValue, err := resultsIterator.Next()
+		modification, err := resultsIterator.Next()
 		if err != nil {
 			return nil, err
 		}
-		// queryResultKey := aKeyValue.Key
-		queryResultValue := aKeyValue.Value
 
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		var record = HistoryRecord{}
+		record.TxId = modification.TxId
+		record.IsDelete = modification.IsDelete
+		if modification.Timestamp != nil {
+			record.Timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC().Format(time.RFC3339Nano)
 		}
-
-		buffer.WriteString(string(queryResultValue))
-
-		bArrayMemberAlreadyWritten = true
+		if !modification.IsDelete && len(modification.Value) > 0 {
+			record.Value = json.RawMessage(modification.Value)
+			var doc struct {
+				Creator      string `json:"creator"`
+				LastModifier string `json:"lastModifier"`
+			}
+			// 非JSON的值没有修改人
+			if json.Unmarshal(modification.Value, &doc) == nil {
+				record.Modifier = doc.LastModifier
+				if record.Modifier == "" {
+					record.Modifier = doc.Creator
+				}
+			} else {
+				valueAsBytes, _ := json.Marshal(string(modification.Value))
+				record.Value = json.RawMessage(valueAsBytes)
+			}
+		}
+		records = append(records, record)
 	}
-	buffer.WriteString("]")
 
-	fmt.Printf("queryResult:\n%s\n", buffer.String())
+	result, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("historyResult:\n%s\n", string(result))
 
-	return buffer.Bytes(), nil
+	return result, nil
 }
 
 // UpdateStruct 更新struct的field值
 func UpdateStruct(o interface{}, key string, value string) error {
-	protectedKeys := []string{"id", "docType", "enabled", "companyDomain", "creator", "lastModifier", "createTime", "modifyTime"}
+	protectedKeys := []string{"id", "docType", "enabled", "companyDomain", "creator", "lastModifier", "createTime", "modifyTime", "businessDate", "baseId", "version"}
 	if ContainsString(protectedKeys, key) {
 		return errors.New("You are not allowed to update field '" + key + "'!")
 	}
@@ -212,45 +374,172 @@ func SanitizePagingArgument(args []string) (string, string, error) {
 	return limit, skip, nil
 }
 
+// ========================================================
+// 检查书签分页参数，args为空时不分页，否则为pageSize和可选的bookmark
+// ========================================================
+func SanitizeBookmarkArgument(args []string) (int32, string, error) {
+	var pageSize int32
+	var bookmark string
+
+	if len(args) == 0 {
+		return pageSize, bookmark, nil
+	}
+	if len(args) > 2 {
+		return pageSize, bookmark, errors.New("Incorrect number of paging arguments. Expecting 1 or 2")
+	}
+
+	size, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil {
+		return pageSize, bookmark, errors.New("pageSize must be a numeric string")
+	}
+	if size <= 0 {
+		return pageSize, bookmark, errors.New("pageSize must be a positive integer")
+	}
+	pageSize = int32(size)
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	return pageSize, bookmark, nil
+}
+
+// MOCK测试时使用的用户
+var mockSubmitterName = "Test@org1.example.com"
+
 // ========================================================
 // 根据整数解析用户信息
 // ========================================================
 func GetSubmitterName(stub shim.ChaincodeStubInterface) (string, error) {
-	var err error
-	var commonName string
-
 	_, isMock := stub.(*shim.MockStub) 
 	if isMock {
 		// MOCK测试情况
 		// TODO 是否会被用于攻击或造假？
-		return "Test@org1.example.com", nil
+		return mockSubmitterName, nil
+	}
+
+	cert, err := GetSubmitterCert(stub)
+	if err != nil {
+		return "", err
 	}
 
+	return cert.Subject.CommonName, nil
+}
+
+// ========================================================
+// 解析提交者的证书
+// ========================================================
+func GetSubmitterCert(stub shim.ChaincodeStubInterface) (*x509.Certificate, error) {
 	creator, err := stub.GetCreator()
 	if err != nil {
 		fmt.Println(err.Error())
-		return commonName, errors.New(err.Error())
+		return nil, errors.New(err.Error())
 	}
 	certStart := bytes.Index(creator, []byte("-----BEGIN CERTIFICATE-----"))
 	if certStart == -1 {
 		fmt.Println("No certificate found")
-		return "", errors.New("No certificate found")
+		return nil, errors.New("No certificate found")
 	}
 	certText := creator[certStart:]
 	block, _ := pem.Decode(certText)
 	if block == nil {
 		fmt.Println("Error received on pem.Decode of certificate")
-		return "", errors.New("Error received on pem.Decode of certificate")
+		return nil, errors.New("Error received on pem.Decode of certificate")
 	}
 
 	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
 		fmt.Println("Error received on ParseCertificate")
-		return "", errors.New("Error received on ParseCertificate")
+		return nil, errors.New("Error received on ParseCertificate")
 	}
 	// rsaPublicKey := cert.PublicKey.(*rsa.PublicKey)
 
-	return cert.Subject.CommonName, nil
+	return cert, nil
+}
+
+// Fabric CA 在证书中存放属性的扩展OID
+var fabricCAAttrsOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// 证书中表示角色的属性名，多个角色以逗号分隔
+const RoleAttributeName = "role"
+
+// MOCK测试时使用的角色
+var mockSubmitterRoles = []string{"reviewer", "approver", "trustee-officer"}
+
+// ========================================================
+// 获取提交者的角色
+// 角色来自Fabric CA的role属性和证书的OU
+// ========================================================
+func GetSubmitterRoles(stub shim.ChaincodeStubInterface) ([]string, error) {
+	_, isMock := stub.(*shim.MockStub)
+	if isMock {
+		return mockSubmitterRoles, nil
+	}
+
+	cert, err := GetSubmitterCert(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetRolesFromCert(cert)
+}
+
+// ========================================================
+// 从证书获取角色
+// ========================================================
+func GetRolesFromCert(cert *x509.Certificate) ([]string, error) {
+	roles := []string{}
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(fabricCAAttrsOID) {
+			continue
+		}
+		var attrs struct {
+			Attrs map[string]string `json:"attrs"`
+		}
+		err := json.Unmarshal(ext.Value, &attrs)
+		if err != nil {
+			return nil, errors.New("Failed to parse certificate attributes - " + err.Error())
+		}
+		for _, role := range strings.Split(attrs.Attrs[RoleAttributeName], ",") {
+			role = strings.TrimSpace(role)
+			if role != "" {
+				roles = append(roles, role)
+			}
+		}
+	}
+	roles = append(roles, cert.Subject.OrganizationalUnit...)
+	return RemoveRepStringByMap(roles), nil
+}
+
+// ========================================================
+// 检查角色是否满足要求，未指定要求的角色时不做限制
+// ========================================================
+func HasAccessRole(accessRoles []string, roles []string) bool {
+	if len(accessRoles) == 0 {
+		return true
+	}
+	for _, role := range roles {
+		if ContainsString(accessRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// ========================================================
+// 检查提交者的角色是否满足要求
+// ========================================================
+func CheckSubmitterRole(stub shim.ChaincodeStubInterface, accessRoles []string) error {
+	if len(accessRoles) == 0 {
+		return nil
+	}
+	roles, err := GetSubmitterRoles(stub)
+	if err != nil {
+		return err
+	}
+	if !HasAccessRole(accessRoles, roles) {
+		return errors.New("Submitter's role is not allowed - " + strings.Join(accessRoles, ","))
+	}
+	return nil
 }
 
 // ========================================================
@@ -296,6 +585,16 @@ func ContainsString(sli []string, str string) bool {
 	return false
 }
 
+// 判断slice是否包含另一个slice中的任一string元素
+func ContainsAnyString(sli []string, strs []string) bool {
+	for _, str := range strs {
+		if ContainsString(sli, str) {
+			return true
+		}
+	}
+	return false
+}
+
 // 通过map主键唯一的特性过滤slice重复string元素
 func RemoveRepStringByMap(slc []string) []string {
     result := []string{}
@@ -341,6 +640,62 @@ func GetDocNameByDocTypeAndId(stub shim.ChaincodeStubInterface, docType string,
 	return attachDocName, err
 }
 
+// ========================================================
+// 获取交易时间（UTC），各背书节点结果一致
+// ========================================================
+func GetTxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+}
+
+// 链码生成的时间格式，RFC3339 UTC，固定9位小数使字符串顺序与时间顺序一致
+const TimestampLayout = "2006-01-02T15:04:05.000000000Z"
+
+// ========================================================
+// 获取交易时间字符串，用于createTime、modifyTime等链码生成的时间
+// ========================================================
+func GetTxTimeString(stub shim.ChaincodeStubInterface) (string, error) {
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return "", err
+	}
+	return txTime.Format(TimestampLayout), nil
+}
+
+// 客户端传入的业务日期支持的格式
+var BusinessDateLayouts = []string{time.RFC3339, "2006-1-2 15:04:05", "2006-1-2"}
+
+// ========================================================
+// 校验客户端传入的业务日期，允许为空
+// 业务日期只作为记录保存，不参与排序和时间判断
+// ========================================================
+func CheckBusinessDate(businessDate string) error {
+	if businessDate == "" {
+		return nil
+	}
+	for _, layout := range BusinessDateLayouts {
+		_, err := time.Parse(layout, businessDate)
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.New("Invalid business date - " + businessDate)
+}
+
+// ========================================================
+// 校验客户端传入的业务日期，返回交易时间作为修改时间
+// ========================================================
+func GetModifyTime(stub shim.ChaincodeStubInterface, businessDate string) (string, error) {
+	err := CheckBusinessDate(businessDate)
+	if err != nil {
+		return "", err
+	}
+	return GetTxTimeString(stub)
+}
+
 // 包装Event内容
 func SendEvent(stub shim.ChaincodeStubInterface, eventName string, eventBytes []byte) {
 	var buffer bytes.Buffer
@@ -355,6 +710,15 @@ func SendEvent(stub shim.ChaincodeStubInterface, eventName string, eventBytes []
 	stub.SetEvent("NewEvent", buffer.Bytes())
 }
 
+// 检查key是否已被占用，任何类型的文档占用都视为已存在
+func KeyExists(stub shim.ChaincodeStubInterface, key string) (bool, error) {
+	valueAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return false, err
+	}
+	return valueAsBytes != nil, nil
+}
+
 // PutState的包装
 func PutState(stub shim.ChaincodeStubInterface, stateID string, stateBytes []byte) error{
 	err := stub.PutState(stateID, stateBytes) //store with id as key
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 状态查询结果
+type mockStateIterator struct {
+	kvs   []*queryresult.KV
+	index int
+}
+
+func (iter *mockStateIterator) HasNext() bool {
+	return iter.index < len(iter.kvs)
+}
+
+func (iter *mockStateIterator) Next() (*queryresult.KV, error) {
+	iter.index++
+	return iter.kvs[iter.index-1], nil
+}
+
+func (iter *mockStateIterator) Close() error {
+	return nil
+}
+
+// mock 引擎不支持分页查询，按复合键前缀查询后以下一页的起始键作为书签
+type pagingMockStub struct {
+	*shim.MockStub
+}
+
+func (stub *pagingMockStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+
+	page := &mockStateIterator{}
+	metadata := &pb.QueryResponseMetadata{}
+	for resultsIterator.HasNext() {
+		aKeyValue, _ := resultsIterator.Next()
+		if bookmark != "" && aKeyValue.Key < bookmark {
+			continue
+		}
+		if int32(len(page.kvs)) == pageSize {
+			metadata.Bookmark = aKeyValue.Key
+			break
+		}
+		page.kvs = append(page.kvs, aKeyValue)
+	}
+	metadata.FetchedRecordsCount = int32(len(page.kvs))
+	return page, metadata, nil
+}
+
+// 测试书签分页参数
+func Test_SanitizeBookmarkArgument(t *testing.T) {
+	pageSize, bookmark, err := SanitizeBookmarkArgument([]string{})
+	if err != nil || pageSize != 0 || bookmark != "" {
+		fmt.Println("没有分页参数时不分页")
+		t.FailNow()
+	}
+	pageSize, bookmark, err = SanitizeBookmarkArgument([]string{"20", "g1AAAA"})
+	if err != nil || pageSize != 20 || bookmark != "g1AAAA" {
+		fmt.Println("分页参数解析不正确", pageSize, bookmark)
+		t.FailNow()
+	}
+	_, _, err = SanitizeBookmarkArgument([]string{"0"})
+	if err == nil {
+		fmt.Println("pageSize必须为正整数")
+		t.FailNow()
+	}
+	_, _, err = SanitizeBookmarkArgument([]string{"10", "", "1"})
+	if err == nil {
+		fmt.Println("分页参数最多2个")
+		t.FailNow()
+	}
+}
+
+// 测试分页结果包装
+func Test_MarshalPageResult(t *testing.T) {
+	result, _ := MarshalPageResult([]byte(`[{"id":"1"}]`), nil)
+	if string(result) != `[{"id":"1"}]` {
+		fmt.Println("未分页时应该返回记录列表", string(result))
+		t.FailNow()
+	}
+	result, _ = MarshalPageResult([]byte(`[{"id":"1"}]`), &pb.QueryResponseMetadata{FetchedRecordsCount: 1, Bookmark: "next"})
+	var page PageResult
+	json.Unmarshal(result, &page)
+	if page.FetchedCount != 1 || page.Bookmark != "next" || string(page.Records) != `[{"id":"1"}]` {
+		fmt.Println("分页结果不正确", string(result))
+		t.FailNow()
+	}
+}
+
+// 测试业务日期校验
+func Test_CheckBusinessDate(t *testing.T) {
+	for _, businessDate := range []string{"", "2018-3-19 09:43:02", "2018-03-16 15:54:00", "2018-03-16", "2018-03-16T15:54:00+08:00"} {
+		if CheckBusinessDate(businessDate) != nil {
+			fmt.Println("业务日期应该有效", businessDate)
+			t.FailNow()
+		}
+	}
+	for _, businessDate := range []string{"yesterday", "2018-13-01", "16/03/2018"} {
+		if CheckBusinessDate(businessDate) == nil {
+			fmt.Println("业务日期应该无效", businessDate)
+			t.FailNow()
+		}
+	}
+}
+
+// 测试交易时间字符串，字符串顺序与时间顺序一致
+func Test_TimestampLayout(t *testing.T) {
+	earlier := time.Date(2018, 3, 16, 15, 54, 0, 0, time.UTC).Format(TimestampLayout)
+	later := time.Date(2018, 3, 16, 15, 54, 0, 100000000, time.UTC).Format(TimestampLayout)
+	if earlier >= later {
+		fmt.Println("时间字符串顺序不正确", earlier, later)
+		t.FailNow()
+	}
+	_, err := time.Parse(time.RFC3339, later)
+	if err != nil {
+		fmt.Println("时间字符串应为RFC3339格式", later)
+		t.FailNow()
+	}
+}
+
+// 测试过滤后不足一页时继续读取
+func Test_FillPage(t *testing.T) {
+	// 10条记录，只保留偶数序号的记录，书签为下一条记录的序号
+	var kept []int
+	fetch := func(pageSize int32, bookmark string) (int, *pb.QueryResponseMetadata, error) {
+		start, _ := strconv.Atoi(bookmark)
+		end := start + int(pageSize)
+		metadata := &pb.QueryResponseMetadata{}
+		if end < 10 {
+			metadata.Bookmark = strconv.Itoa(end)
+		} else {
+			end = 10
+		}
+		metadata.FetchedRecordsCount = int32(end - start)
+		count := 0
+		for i := start; i < end; i++ {
+			if i%2 == 0 {
+				kept = append(kept, i)
+				count++
+			}
+		}
+		return count, metadata, nil
+	}
+
+	metadata, err := FillPage(3, "", fetch)
+	if err != nil || len(kept) != 3 || kept[2] != 4 || metadata.FetchedRecordsCount != 3 || metadata.Bookmark != "5" {
+		fmt.Println("第一页应填满3条记录", kept, metadata)
+		t.FailNow()
+	}
+	kept = nil
+	metadata, err = FillPage(3, metadata.Bookmark, fetch)
+	if err != nil || len(kept) != 2 || kept[0] != 6 || metadata.FetchedRecordsCount != 2 || metadata.Bookmark != "" {
+		fmt.Println("最后一页的记录数不正确", kept, metadata)
+		t.FailNow()
+	}
+	kept = nil
+	metadata, err = FillPage(0, "", func(pageSize int32, bookmark string) (int, *pb.QueryResponseMetadata, error) {
+		kept = append(kept, 0)
+		return 1, nil, nil
+	})
+	if err != nil || len(kept) != 1 || metadata != nil {
+		fmt.Println("不分页时只读取一次")
+		t.FailNow()
+	}
+}
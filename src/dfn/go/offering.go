@@ -0,0 +1,661 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- Offering ----- //
+// 债券簿记发行
+type Offering struct {
+	DocType           string   `json:"docType"`
+	Id                string   `json:"id"`
+	BondId            string   `json:"bondId"`
+	ProjectId         string   `json:"projectId"`
+	Underwriter       string   `json:"underwriter"`       // 承销商/簿记管理人机构
+	Amount            int64    `json:"amount"`            // 发售份数
+	MinPrice          int64    `json:"minPrice"`          // 最低申购价格，以最小货币单位计
+	AllocationMethod  string   `json:"allocationMethod"`  // 配售方式：proRata（比例配售）或 priority（优先配售）
+	PriorityInvestors []string `json:"priorityInvestors"` // 优先配售的投资机构
+	OpenTime          string   `json:"openTime"`          // 簿记开始时间，RFC3339
+	CloseTime         string   `json:"closeTime"`         // 簿记截止时间，RFC3339
+	Status            string   `json:"status"`            // open 或 allocated
+	ClearingPrice     int64    `json:"clearingPrice"`     // 簿记结束时确定的发行价格
+	OrderedAmount     int64    `json:"orderedAmount"`     // 有效申购总份数，簿记结束时计算
+	AllocatedAmount   int64    `json:"allocatedAmount"`   // 配售总份数
+	Creator           string   `json:"creator"`           // 创建人
+	LastModifier      string   `json:"lastModifier"`      // 最后修改人
+	CreateTime        string   `json:"createTime"`        // 创建时间
+	ModifyTime        string   `json:"modifyTime"`        // 修改时间
+	BusinessDate      string   `json:"businessDate"`      // 业务日期，客户端传入
+}
+
+// ----- SubscriptionOrder ----- //
+// 投资机构的申购订单
+type SubscriptionOrder struct {
+	DocType         string `json:"docType"`
+	Id              string `json:"id"`
+	OfferingId      string `json:"offeringId"`
+	BondId          string `json:"bondId"`
+	Investor        string `json:"investor"`        // 投资机构
+	Amount          int64  `json:"amount"`          // 申购份数
+	Price           int64  `json:"price"`           // 申购价格
+	AllocatedAmount int64  `json:"allocatedAmount"` // 配售份数
+	Status          string `json:"status"`          // submitted、allocated 或 rejected
+	SubmitTime      string `json:"submitTime"`      // 提交时间，取交易时间
+	Creator         string `json:"creator"`         // 创建人
+}
+
+// =============================================================================
+// 创建簿记发行
+// =============================================================================
+func create_offering(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	var offering Offering
+	fmt.Println("starting create_offering")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	err = json.Unmarshal([]byte(args[0]), &offering)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	creator, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	creatorOrgName, err := GetOrgFromCertCommonName(creator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//check if offering id already exists
+	exists, err := KeyExists(stub, offering.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if exists {
+		fmt.Println("This offering already exists - " + offering.Id)
+		return shim.Error("This offering already exists - " + offering.Id)
+	}
+
+	bond, err := GetBondById(stub, offering.BondId)
+	if err != nil {
+		fmt.Println("This bond does not exist - " + offering.BondId)
+		return shim.Error("This bond does not exist - " + offering.BondId)
+	}
+	if bond.Status != "issued" {
+		fmt.Println("This bond has been retired - " + offering.BondId)
+		return shim.Error("This bond has been retired - " + offering.BondId)
+	}
+
+	// 只有项目的承销商可以簿记发行
+	project, err := GetProjectById(stub, bond.ProjectId)
+	if err != nil {
+		fmt.Println("This project does not exist - " + bond.ProjectId)
+		return shim.Error("This project does not exist - " + bond.ProjectId)
+	}
+	if project.Underwriter != creatorOrgName {
+		fmt.Println("Only underwriter of the project can create offering - " + creatorOrgName)
+		return shim.Error("Only underwriter of the project can create offering - " + creatorOrgName)
+	}
+
+	err = ValidateOffering(offering)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	if offering.Amount > GetAvailableSupply(bond) {
+		fmt.Println("Amount exceeds available supply of the bond - " + offering.BondId)
+		return shim.Error("Amount exceeds available supply of the bond - " + offering.BondId)
+	}
+
+	// 客户端传入的创建时间作为业务日期
+	if offering.BusinessDate == "" {
+		offering.BusinessDate = offering.CreateTime
+	}
+	createTime, err := GetModifyTime(stub, offering.BusinessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offering.DocType = "offering"
+	offering.ProjectId = bond.ProjectId
+	offering.Underwriter = creatorOrgName
+	offering.Status = "open"
+	offering.ClearingPrice = 0
+	offering.OrderedAmount = 0
+	offering.AllocatedAmount = 0
+	offering.Creator = creator
+	offering.LastModifier = creator
+	offering.CreateTime = createTime
+	offering.ModifyTime = createTime
+
+	offeringAsBytes, _ := json.Marshal(offering)
+	err = PutState(stub, offering.Id, offeringAsBytes) //store with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 发售份数在簿记期间保留，避免多个簿记发行同时超额配售
+	bond.ReservedSupply = bond.ReservedSupply + offering.Amount
+	bond.LastModifier = creator
+	bond.ModifyTime = createTime
+	bondAsBytes, _ := json.Marshal(bond)
+	err = stub.PutState(bond.Id, bondAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end create_offering")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 校验簿记发行要素
+// =============================================================================
+func ValidateOffering(offering Offering) error {
+	if offering.Id == "" {
+		return errors.New("Offering id is required")
+	}
+	if offering.Amount <= 0 {
+		return errors.New("Amount must be a positive integer")
+	}
+	if offering.MinPrice < 0 {
+		return errors.New("Min price must be a positive integer or a zero")
+	}
+	if offering.AllocationMethod != "proRata" && offering.AllocationMethod != "priority" {
+		return errors.New("Unknown allocation method - " + offering.AllocationMethod)
+	}
+	openTime, err := time.Parse(time.RFC3339, offering.OpenTime)
+	if err != nil {
+		return errors.New("Open time must be in RFC3339 format - " + offering.OpenTime)
+	}
+	closeTime, err := time.Parse(time.RFC3339, offering.CloseTime)
+	if err != nil {
+		return errors.New("Close time must be in RFC3339 format - " + offering.CloseTime)
+	}
+	if !closeTime.After(openTime) {
+		return errors.New("Close time must be after open time")
+	}
+	return nil
+}
+
+// =============================================================================
+// Get Offering By id
+// =============================================================================
+func GetOfferingById(stub shim.ChaincodeStubInterface, id string) (Offering, error) {
+	var data Offering
+	dataAsBytes, err := stub.GetState(id) //getState retreives a key/value from the ledger
+	if err != nil {                       //this seems to always succeed, even if key didn't exist
+		return data, errors.New("Failed to find offering - " + id)
+	}
+	json.Unmarshal(dataAsBytes, &data) //un stringify it aka JSON.parse()
+
+	if data.Id != id || data.DocType != "offering" {
+		return data, errors.New("Offering does not exist - " + id)
+	}
+
+	return data, nil
+}
+
+// =============================================================================
+// 簿记发行详情
+// =============================================================================
+func get_offering_by_id(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting get_offering_by_id")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	id := args[0]
+
+	offering, err := GetOfferingById(stub, id)
+	if err != nil {
+		fmt.Println("This offering does not exist - " + id)
+		return shim.Error("This offering does not exist - " + id)
+	}
+
+	offeringAsBytes, _ := json.Marshal(offering)
+
+	fmt.Println("- end get_offering_by_id")
+	return shim.Success(offeringAsBytes)
+}
+
+// =============================================================================
+// 提交申购订单
+// 返回订单ID
+// =============================================================================
+func submit_subscription(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting submit_subscription")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	offeringId := args[0]
+	amount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || amount <= 0 {
+		return shim.Error("Amount must be a positive integer - " + args[1])
+	}
+	price, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || price <= 0 {
+		return shim.Error("Price must be a positive integer - " + args[2])
+	}
+
+	creator, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	investor, err := GetOrgFromCertCommonName(creator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offering, err := GetOfferingById(stub, offeringId)
+	if err != nil {
+		fmt.Println("This offering does not exist - " + offeringId)
+		return shim.Error("This offering does not exist - " + offeringId)
+	}
+	if offering.Status != "open" {
+		fmt.Println("This offering has been closed - " + offeringId)
+		return shim.Error("This offering has been closed - " + offeringId)
+	}
+
+	// check offering window
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	openTime, _ := time.Parse(time.RFC3339, offering.OpenTime)
+	closeTime, _ := time.Parse(time.RFC3339, offering.CloseTime)
+	if txTime.Before(openTime) || !txTime.Before(closeTime) {
+		fmt.Println("Not in the offering window - " + offeringId)
+		return shim.Error("Not in the offering window - " + offeringId)
+	}
+
+	if price < offering.MinPrice {
+		fmt.Println("Price is lower than min price - " + args[2])
+		return shim.Error("Price is lower than min price - " + args[2])
+	}
+
+	var order = SubscriptionOrder{}
+	order.DocType = "subscriptionOrder"
+	order.Id = offeringId + ":order:" + stub.GetTxID()
+	order.OfferingId = offeringId
+	order.BondId = offering.BondId
+	order.Investor = investor
+	order.Amount = amount
+	order.Price = price
+	order.Status = "submitted"
+	order.SubmitTime = txTime.Format(time.RFC3339Nano)
+	order.Creator = creator
+
+	orderAsBytes, _ := json.Marshal(order)
+	err = PutState(stub, order.Id, orderAsBytes) //store with id as key
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 订单索引，用于簿记结束时按范围查询
+	indexKey, err := stub.CreateCompositeKey("offeringOrder", []string{offeringId, order.Id})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(indexKey, []byte{0x00})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = PutIndex(stub, SubscriptionInvestorIndex, order.Investor, order.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	returnDataAsBytes, _ := json.Marshal(order.Id)
+
+	fmt.Println("- end submit_subscription")
+	return shim.Success(returnDataAsBytes)
+}
+
+// =============================================================================
+// 获取簿记发行的全部订单
+// =============================================================================
+func GetOrdersByOfferingId(stub shim.ChaincodeStubInterface, offeringId string) ([]SubscriptionOrder, error) {
+	orders, _, err := GetPagingOrdersByOfferingId(stub, offeringId, 0, "")
+	return orders, err
+}
+
+// 分页获取簿记发行的订单，pageSize为0时不分页
+func GetPagingOrdersByOfferingId(stub shim.ChaincodeStubInterface, offeringId string, pageSize int32, bookmark string) ([]SubscriptionOrder, *pb.QueryResponseMetadata, error) {
+	resultsIterator, metadata, err := GetStateByPartialCompositeKey(stub, "offeringOrder", []string{offeringId}, pageSize, bookmark)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+
+	orders := []SubscriptionOrder{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		var order SubscriptionOrder
+		orderAsBytes, err := stub.GetState(keyParts[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		err = json.Unmarshal(orderAsBytes, &order)
+		if err != nil {
+			return nil, nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, metadata, nil
+}
+
+// =============================================================================
+// 结束簿记并配售
+// 价格不低于发行价格的订单为有效订单，按簿记方式计算配售份数并记入持仓
+// =============================================================================
+func close_offering(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting close_offering")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	offeringId := args[0]
+	clearingPrice, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || clearingPrice < 0 {
+		return shim.Error("Clearing price must be a positive integer or a zero - " + args[1])
+	}
+	businessDate := args[2]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offering, err := GetOfferingById(stub, offeringId)
+	if err != nil {
+		fmt.Println("This offering does not exist - " + offeringId)
+		return shim.Error("This offering does not exist - " + offeringId)
+	}
+	if offering.Underwriter != submitterOrgName {
+		fmt.Println("Only underwriter can close the offering - " + submitterOrgName)
+		return shim.Error("Only underwriter can close the offering - " + submitterOrgName)
+	}
+	if offering.Status != "open" {
+		fmt.Println("This offering has been closed - " + offeringId)
+		return shim.Error("This offering has been closed - " + offeringId)
+	}
+	if clearingPrice < offering.MinPrice {
+		clearingPrice = offering.MinPrice
+	}
+
+	bond, err := GetBondById(stub, offering.BondId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	orders, err := GetOrdersByOfferingId(stub, offeringId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	orderedAmount, err := AllocateOrders(orders, offering, clearingPrice)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// store orders
+	var allocatedAmount int64
+	var changes []HoldingChange
+	for _, order := range orders {
+		orderAsBytes, _ := json.Marshal(order)
+		err = stub.PutState(order.Id, orderAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if order.AllocatedAmount > 0 {
+			changes = append(changes, HoldingChange{AssetId: offering.BondId, Holder: order.Investor, Amount: order.AllocatedAmount})
+			allocatedAmount = allocatedAmount + order.AllocatedAmount
+		}
+	}
+
+	// 释放簿记保留的份数，配售份数不能超过保留的份数
+	if allocatedAmount > offering.Amount || offering.Amount > bond.ReservedSupply {
+		fmt.Println("Allocated amount exceeds reserved supply of the bond - " + offering.BondId)
+		return shim.Error("Allocated amount exceeds reserved supply of the bond - " + offering.BondId)
+	}
+	bond.ReservedSupply = bond.ReservedSupply - offering.Amount
+	bond.PlacedSupply = bond.PlacedSupply + allocatedAmount
+	bond.LastModifier = submitter
+	bond.ModifyTime = modifyTime
+	bond.BusinessDate = businessDate
+	bondAsBytes, _ := json.Marshal(bond)
+	err = stub.PutState(bond.Id, bondAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offering.Status = "allocated"
+	offering.ClearingPrice = clearingPrice
+	offering.OrderedAmount = orderedAmount
+	offering.AllocatedAmount = allocatedAmount
+	offering.LastModifier = submitter
+	offering.ModifyTime = modifyTime
+	offering.BusinessDate = businessDate
+	offeringAsBytes, _ := json.Marshal(offering)
+	err = stub.PutState(offering.Id, offeringAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 配售份数记入投资机构的持仓，持仓变动事件作为本交易的事件
+	err = UpdateHoldings(stub, "allocate", changes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end close_offering")
+	return shim.Success(offeringAsBytes)
+}
+
+// =============================================================================
+// 计算配售份数，直接更新订单，返回有效申购总份数
+// proRata: 有效申购超过发售份数时按比例配售，余数按最大余数法依次分配
+// priority: 优先配售机构优先，其次价格高者优先，最后按提交时间
+// =============================================================================
+func AllocateOrders(orders []SubscriptionOrder, offering Offering, clearingPrice int64) (int64, error) {
+	var valid []int
+	var orderedAmount int64
+	for i := 0; i < len(orders); i++ {
+		orders[i].AllocatedAmount = 0
+		if orders[i].Price >= clearingPrice {
+			orders[i].Status = "allocated"
+			valid = append(valid, i)
+			orderedAmount = orderedAmount + orders[i].Amount
+		} else {
+			orders[i].Status = "rejected"
+		}
+	}
+
+	if orderedAmount <= offering.Amount {
+		for _, i := range valid {
+			orders[i].AllocatedAmount = orders[i].Amount
+		}
+		return orderedAmount, nil
+	}
+
+	switch offering.AllocationMethod {
+	case "proRata":
+		total := big.NewInt(orderedAmount)
+		supply := big.NewInt(offering.Amount)
+		remainders := make([]*big.Int, len(orders))
+		var allocated int64
+		for _, i := range valid {
+			quotient, remainder := new(big.Int).QuoRem(new(big.Int).Mul(big.NewInt(orders[i].Amount), supply), total, new(big.Int))
+			orders[i].AllocatedAmount = quotient.Int64()
+			remainders[i] = remainder
+			allocated = allocated + orders[i].AllocatedAmount
+		}
+		// 按余数从大到小分配剩余份数，余数相同时按订单ID
+		sort.SliceStable(valid, func(a, b int) bool {
+			cmp := remainders[valid[a]].Cmp(remainders[valid[b]])
+			if cmp != 0 {
+				return cmp > 0
+			}
+			return orders[valid[a]].Id < orders[valid[b]].Id
+		})
+		for k := 0; allocated < offering.Amount; k++ {
+			orders[valid[k]].AllocatedAmount++
+			allocated++
+		}
+	case "priority":
+		sort.SliceStable(valid, func(a, b int) bool {
+			orderA := orders[valid[a]]
+			orderB := orders[valid[b]]
+			priorityA := ContainsString(offering.PriorityInvestors, orderA.Investor)
+			priorityB := ContainsString(offering.PriorityInvestors, orderB.Investor)
+			if priorityA != priorityB {
+				return priorityA
+			}
+			if orderA.Price != orderB.Price {
+				return orderA.Price > orderB.Price
+			}
+			if orderA.SubmitTime != orderB.SubmitTime {
+				return orderA.SubmitTime < orderB.SubmitTime
+			}
+			return orderA.Id < orderB.Id
+		})
+		remaining := offering.Amount
+		for _, i := range valid {
+			allocated := orders[i].Amount
+			if allocated > remaining {
+				allocated = remaining
+			}
+			orders[i].AllocatedAmount = allocated
+			remaining = remaining - allocated
+		}
+	default:
+		return 0, errors.New("Unknown allocation method - " + offering.AllocationMethod)
+	}
+
+	for _, i := range valid {
+		if orders[i].AllocatedAmount == 0 {
+			orders[i].Status = "rejected"
+		}
+	}
+	return orderedAmount, nil
+}
+
+// ========================================================
+// 查询簿记发行的全部订单，只有承销商可以查询
+// ========================================================
+func query_subscriptions_by_offering(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting query_subscriptions_by_offering")
+
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	offeringId := args[0]
+
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offering, err := GetOfferingById(stub, offeringId)
+	if err != nil {
+		fmt.Println("This offering does not exist - " + offeringId)
+		return shim.Error("This offering does not exist - " + offeringId)
+	}
+	if offering.Underwriter != submitterOrgName {
+		fmt.Println("Only underwriter can query all subscriptions - " + submitterOrgName)
+		return shim.Error("Only underwriter can query all subscriptions - " + submitterOrgName)
+	}
+
+	orders, metadata, err := GetPagingOrdersByOfferingId(stub, offeringId, pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, _ := json.Marshal(orders)
+	result, err = MarshalPageResult(result, metadata)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end query_subscriptions_by_offering")
+	return shim.Success(result)
+}
+
+// ========================================================
+// 查询本机构的申购订单及配售结果
+// ========================================================
+func query_my_subscriptions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting query_my_subscriptions")
+
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 2")
+	}
+
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[0:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, err := GetPagingQueryResult(stub, GetSubscriptionsQueryByInvestor(submitterOrgName), pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end query_my_subscriptions")
+	return shim.Success(result)
+}
+
+// 投资者全部认购订单的查询语句
+func GetSubscriptionsQueryByInvestor(investor string) *Query {
+	return NewQuery("subscriptionOrder").Eq("investor", investor).UseIndex("indexMySubscriptions").ScanIndex(SubscriptionInvestorIndex, investor)
+}
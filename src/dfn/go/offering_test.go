@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 创建承销商为本机构的项目
+func MockCreateUnderwriterProject(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_project"),
+		[]byte(`{"id":"project-bankcomm-000002","projectName":"测试交行项目000002号","scale":"500万元人民币","basicAssets":"个人按揭贷款","initiator":"交通银行","underwriter":"@org1.example.com","approvalWorkflowId":"test_linear_workflow-001","createTime":"2018-3-16 09:03:45"}`),
+	})
+	return response
+}
+
+// mock 创建簿记发行
+func MockCreateOffering1(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_offering"),
+		[]byte(`{"id":"offering-bond-bankcomm-000002-A","bondId":"bond-bankcomm-000002-A","amount":30000,"minPrice":9900,"allocationMethod":"proRata","openTime":"2018-03-21T00:00:00Z","closeTime":"2099-12-31T00:00:00Z","createTime":"2018-3-21 10:00:00"}`),
+	})
+	return response
+}
+
+// mock 提交申购订单
+func MockSubmitSubscription(t *testing.T, stub *shim.MockStub, txId string, amount string, price string) pb.Response {
+	response := stub.MockInvoke(txId, [][]byte{
+		[]byte("submit_subscription"),
+		[]byte("offering-bond-bankcomm-000002-A"),
+		[]byte(amount),
+		[]byte(price),
+	})
+	return response
+}
+
+// mock 结束簿记
+func MockCloseOffering(t *testing.T, stub *shim.MockStub, clearingPrice string) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("close_offering"),
+		[]byte("offering-bond-bankcomm-000002-A"),
+		[]byte(clearingPrice),
+		[]byte("2018-3-25 10:00:00"),
+	})
+	return response
+}
+
+// 测试簿记发行及配售
+func Test_CloseOffering(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateUnderwriterProject(t, stub)
+	MockRunApprovalProcess(t, stub, true)
+	MockIssueBond1(t, stub)
+	response := MockCreateOffering1(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	// 簿记中的份数已保留，其他簿记发行不能超额发售
+	offeringArgs := [][]byte{
+		[]byte("create_offering"),
+		[]byte(`{"id":"offering-bond-bankcomm-000002-A2","bondId":"bond-bankcomm-000002-A","amount":30000,"minPrice":9900,"allocationMethod":"proRata","openTime":"2018-03-21T00:00:00Z","closeTime":"2099-12-31T00:00:00Z","createTime":"2018-3-21 10:00:00"}`),
+	}
+	response = stub.MockInvoke(GetTestTxID(), offeringArgs)
+	if response.Status != shim.ERROR {
+		fmt.Println("超过可发售份数，应该失败。")
+		t.FailNow()
+	}
+	// 簿记发行ID不能使用其他文档的ID
+	offeringArgs[1] = []byte(`{"id":"project-bankcomm-000002","bondId":"bond-bankcomm-000002-A","amount":10000,"minPrice":9900,"allocationMethod":"proRata","openTime":"2018-03-21T00:00:00Z","closeTime":"2099-12-31T00:00:00Z","createTime":"2018-3-21 10:00:00"}`)
+	response = stub.MockInvoke(GetTestTxID(), offeringArgs)
+	project, _ := GetProjectById(stub, "project-bankcomm-000002")
+	if response.Status != shim.ERROR || project.DocType != "project" {
+		fmt.Println("簿记发行ID被其他文档占用时应该失败")
+		t.FailNow()
+	}
+	var bond Bond
+	json.Unmarshal(stub.State["bond-bankcomm-000002-A"], &bond)
+	if bond.ReservedSupply != 30000 {
+		fmt.Println("簿记中的份数不正确")
+		t.FailNow()
+	}
+	response = MockRetireBond(t, stub, "30000")
+	if response.Status != shim.ERROR {
+		fmt.Println("簿记中的份数不能注销")
+		t.FailNow()
+	}
+
+	response = MockSubmitSubscription(t, stub, "tx-order-1", "20000", "9800")
+	if response.Status != shim.ERROR {
+		fmt.Println("价格低于最低申购价格，应该失败。")
+		t.FailNow()
+	}
+	MockSubmitSubscription(t, stub, "tx-order-1", "20000", "10000")
+	MockSubmitSubscription(t, stub, "tx-order-2", "40000", "9950")
+	MockSubmitSubscription(t, stub, "tx-order-3", "10000", "9900")
+	response = MockCloseOffering(t, stub, "9950")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var offering Offering
+	json.Unmarshal(response.Payload, &offering)
+	if offering.Status != "allocated" || offering.OrderedAmount != 60000 || offering.AllocatedAmount != 30000 {
+		fmt.Println("簿记结果不正确")
+		t.FailNow()
+	}
+	var order SubscriptionOrder
+	json.Unmarshal(stub.State["offering-bond-bankcomm-000002-A:order:tx-order-3"], &order)
+	if order.Status != "rejected" || order.AllocatedAmount != 0 {
+		fmt.Println("低于发行价格的订单应不配售")
+		t.FailNow()
+	}
+	holding, _ := GetHolding(stub, "bond-bankcomm-000002-A", "@org1.example.com")
+	if holding.Balance != 30000 {
+		fmt.Println("持仓不正确", holding.Balance)
+		t.FailNow()
+	}
+	bond = Bond{}
+	json.Unmarshal(stub.State["bond-bankcomm-000002-A"], &bond)
+	if bond.PlacedSupply != 30000 || bond.ReservedSupply != 0 {
+		fmt.Println("已配售份数不正确")
+		t.FailNow()
+	}
+	// 已结束的簿记不能再申购
+	response = MockSubmitSubscription(t, stub, "tx-order-4", "100", "10000")
+	if response.Status != shim.ERROR {
+		fmt.Println("簿记已结束，应该失败。")
+		t.FailNow()
+	}
+}
+
+// 测试配售计算
+func Test_AllocateOrders(t *testing.T) {
+	offering := Offering{Amount: 100, AllocationMethod: "proRata"}
+	orders := []SubscriptionOrder{
+		{Id: "a", Investor: "@org1", Amount: 100, Price: 100, SubmitTime: "1"},
+		{Id: "b", Investor: "@org2", Amount: 100, Price: 100, SubmitTime: "2"},
+		{Id: "c", Investor: "@org3", Amount: 100, Price: 100, SubmitTime: "3"},
+	}
+	AllocateOrders(orders, offering, 100)
+	if orders[0].AllocatedAmount != 34 || orders[1].AllocatedAmount != 33 || orders[2].AllocatedAmount != 33 {
+		fmt.Println("比例配售不正确", orders)
+		t.FailNow()
+	}
+
+	offering = Offering{Amount: 150, AllocationMethod: "priority", PriorityInvestors: []string{"@org3"}}
+	AllocateOrders(orders, offering, 100)
+	if orders[2].AllocatedAmount != 100 || orders[0].AllocatedAmount != 50 || orders[1].AllocatedAmount != 0 || orders[1].Status != "rejected" {
+		fmt.Println("优先配售不正确", orders)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- BondAmortization ----- //
+// 摊还计划：在指定的付息日偿还部分本金
+type BondAmortization struct {
+	Date      string `json:"date"`      // 付息日，yyyy-MM-dd
+	Principal int64  `json:"principal"` // 每份偿还的本金，以最小货币单位计
+}
+
+// ----- BondPayment ----- //
+// 债券的一期兑付，在发行时生成
+type BondPayment struct {
+	DocType      string          `json:"docType"`
+	Id           string          `json:"id"`
+	BondId       string          `json:"bondId"`
+	Seq          int             `json:"seq"`          // 期数，从1开始
+	PaymentDate  string          `json:"paymentDate"`  // 兑付日，yyyy-MM-dd
+	RecordDate   string          `json:"recordDate"`   // 债权登记日，yyyy-MM-dd，以当日日终持仓计算
+	Coupon       int64           `json:"coupon"`       // 每份利息
+	Principal    int64           `json:"principal"`    // 每份本金
+	Status       string          `json:"status"`       // scheduled、executed、partial 或 missed
+	DueAmount    int64           `json:"dueAmount"`    // 应付总额，登记支付结果时计算
+	PaidAmount   int64           `json:"paidAmount"`   // 实付总额
+	Records      []PaymentRecord `json:"records"`      // 支付登记记录
+	LastModifier string          `json:"lastModifier"` // 最后修改人
+	ModifyTime   string          `json:"modifyTime"`   // 修改时间
+	BusinessDate string          `json:"businessDate"` // 业务日期，客户端传入
+}
+
+// 支付代理机构的一次登记
+type PaymentRecord struct {
+	Status     string `json:"status"`
+	PaidAmount int64  `json:"paidAmount"`
+	Recorder   string `json:"recorder"`
+	TxId       string `json:"txId"`
+	RecordTime string `json:"recordTime"`
+}
+
+// 持有机构在一期兑付中的应收金额
+type PaymentEntitlement struct {
+	Payment   BondPayment `json:"payment"`
+	Holder    string      `json:"holder"`
+	Units     int64       `json:"units"`     // 登记日持有份数
+	Coupon    int64       `json:"coupon"`    // 应收利息
+	Principal int64       `json:"principal"` // 应收本金
+	Amount    int64       `json:"amount"`    // 应收总额
+}
+
+// 每年付息次数对应的月数
+var couponFrequencyMonths = map[int]int{1: 12, 2: 6, 4: 3, 12: 1}
+
+// 按月推算日期，目标月份没有对应的日时取该月最后一天，如1月31日加1个月为2月28日或29日
+func AddMonths(date time.Time, months int) time.Time {
+	firstDay := time.Date(date.Year(), date.Month()+time.Month(months), 1, 0, 0, 0, 0, date.Location())
+	day := date.Day()
+	lastDay := firstDay.AddDate(0, 1, -1).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(firstDay.Year(), firstDay.Month(), day, date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), date.Location())
+}
+
+// =============================================================================
+// 生成兑付计划
+// 按付息频率从发行日起逐期推算付息日，月末发行时付息日不超过当月最后一天，最后一期为到期日并偿还剩余本金；
+// 每期利息按期初剩余本金计算
+// =============================================================================
+func GenerateBondPayments(bond Bond) ([]BondPayment, error) {
+	frequency := bond.CouponFrequency
+	if frequency == 0 {
+		frequency = 1
+	}
+	months, ok := couponFrequencyMonths[frequency]
+	if !ok {
+		return nil, errors.New("Coupon frequency must be 1, 2, 4 or 12 - " + strconv.Itoa(bond.CouponFrequency))
+	}
+	if bond.RecordDays < 0 {
+		return nil, errors.New("Record days must be a positive integer or a zero")
+	}
+	issueDate, err := time.Parse(DateLayout, bond.IssueDate)
+	if err != nil {
+		return nil, errors.New("Issue date must be in format yyyy-MM-dd - " + bond.IssueDate)
+	}
+	maturityDate, err := time.Parse(DateLayout, bond.MaturityDate)
+	if err != nil {
+		return nil, errors.New("Maturity date must be in format yyyy-MM-dd - " + bond.MaturityDate)
+	}
+
+	var dates []string
+	for i := 1; ; i++ {
+		date := AddMonths(issueDate, months*i)
+		if !date.Before(maturityDate) {
+			break
+		}
+		dates = append(dates, date.Format(DateLayout))
+	}
+	dates = append(dates, bond.MaturityDate)
+
+	amortization := map[string]int64{}
+	var amortized int64
+	for _, item := range bond.Amortization {
+		if !ContainsString(dates[:len(dates)-1], item.Date) {
+			return nil, errors.New("Amortization date must be a coupon date before maturity - " + item.Date)
+		}
+		if item.Principal <= 0 {
+			return nil, errors.New("Amortization principal must be a positive integer - " + item.Date)
+		}
+		amortization[item.Date] = amortization[item.Date] + item.Principal
+		amortized = amortized + item.Principal
+	}
+	if amortized >= bond.FaceValue {
+		return nil, errors.New("Amortization must be less than face value")
+	}
+
+	var payments []BondPayment
+	remaining := bond.FaceValue
+	for i, date := range dates {
+		paymentDate, _ := time.Parse(DateLayout, date)
+		var payment = BondPayment{}
+		payment.DocType = "bondPayment"
+		payment.Seq = i + 1
+		payment.Id = GetBondPaymentId(bond.Id, payment.Seq)
+		payment.BondId = bond.Id
+		payment.PaymentDate = date
+		payment.RecordDate = paymentDate.AddDate(0, 0, -bond.RecordDays).Format(DateLayout)
+		payment.Coupon = remaining * bond.CouponRate / 10000 / int64(frequency)
+		if i == len(dates)-1 {
+			payment.Principal = remaining
+		} else {
+			payment.Principal = amortization[date]
+		}
+		payment.Status = "scheduled"
+		payment.Records = []PaymentRecord{}
+		remaining = remaining - payment.Principal
+		payments = append(payments, payment)
+	}
+	return payments, nil
+}
+
+// 兑付ID，期数补零以便按ID排序
+func GetBondPaymentId(bondId string, seq int) string {
+	return fmt.Sprintf("%s:payment:%04d", bondId, seq)
+}
+
+// =============================================================================
+// 存储兑付计划
+// =============================================================================
+func PutBondPayments(stub shim.ChaincodeStubInterface, payments []BondPayment) error {
+	for _, payment := range payments {
+		paymentAsBytes, _ := json.Marshal(payment)
+		err := stub.PutState(payment.Id, paymentAsBytes)
+		if err != nil {
+			return err
+		}
+		indexKey, err := stub.CreateCompositeKey("bondPayment", []string{payment.BondId, payment.Id})
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(indexKey, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// =============================================================================
+// Get BondPayment By id
+// =============================================================================
+func GetBondPaymentById(stub shim.ChaincodeStubInterface, id string) (BondPayment, error) {
+	var data BondPayment
+	dataAsBytes, err := stub.GetState(id) //getState retreives a key/value from the ledger
+	if err != nil {                       //this seems to always succeed, even if key didn't exist
+		return data, errors.New("Failed to find payment - " + id)
+	}
+	json.Unmarshal(dataAsBytes, &data) //un stringify it aka JSON.parse()
+
+	if data.Id != id || data.DocType != "bondPayment" {
+		return data, errors.New("Payment does not exist - " + id)
+	}
+
+	return data, nil
+}
+
+// =============================================================================
+// 获取债券的兑付计划，按期数排序
+// =============================================================================
+func GetBondPayments(stub shim.ChaincodeStubInterface, bondId string) ([]BondPayment, error) {
+	payments, _, err := GetPagingBondPayments(stub, bondId, 0, "")
+	return payments, err
+}
+
+// 分页获取债券的兑付计划，pageSize为0时不分页
+func GetPagingBondPayments(stub shim.ChaincodeStubInterface, bondId string, pageSize int32, bookmark string) ([]BondPayment, *pb.QueryResponseMetadata, error) {
+	resultsIterator, metadata, err := GetStateByPartialCompositeKey(stub, "bondPayment", []string{bondId}, pageSize, bookmark)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+
+	payments := []BondPayment{}
+	for resultsIterator.HasNext() {
+		aKeyValue, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(aKeyValue.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		payment, err := GetBondPaymentById(stub, keyParts[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, metadata, nil
+}
+
+// 债权登记日日终，持仓以此时间之前的最后一次变动为准
+func GetRecordCutoff(payment BondPayment) time.Time {
+	recordDate, _ := time.Parse(DateLayout, payment.RecordDate)
+	return recordDate.AddDate(0, 0, 1)
+}
+
+// =============================================================================
+// 计算一期兑付的应付总额
+// =============================================================================
+func GetPaymentDueAmount(stub shim.ChaincodeStubInterface, payment BondPayment) (int64, error) {
+	holdings, err := GetHoldingsAsOf(stub, payment.BondId, GetRecordCutoff(payment))
+	if err != nil {
+		return 0, err
+	}
+	var units int64
+	for _, holding := range holdings {
+		units = units + holding.Balance
+	}
+	return units * (payment.Coupon + payment.Principal), nil
+}
+
+// =============================================================================
+// 计算持有机构在一期兑付中的应收金额
+// =============================================================================
+func GetPaymentEntitlement(stub shim.ChaincodeStubInterface, payment BondPayment, holder string) (PaymentEntitlement, error) {
+	var entitlement = PaymentEntitlement{Payment: payment, Holder: holder}
+	holding, err := GetHoldingAsOf(stub, payment.BondId, holder, GetRecordCutoff(payment))
+	if err != nil {
+		return entitlement, err
+	}
+	entitlement.Units = holding.Balance
+	entitlement.Coupon = holding.Balance * payment.Coupon
+	entitlement.Principal = holding.Balance * payment.Principal
+	entitlement.Amount = entitlement.Coupon + entitlement.Principal
+	return entitlement, nil
+}
+
+// =============================================================================
+// 登记支付结果
+// =============================================================================
+func record_payment(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting record_payment")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	paymentId := args[0]
+	status := args[1]
+	businessDate := args[3]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var paidAmount int64
+	if args[2] != "" {
+		paidAmount, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil || paidAmount < 0 {
+			return shim.Error("Paid amount must be a positive integer or a zero - " + args[2])
+		}
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	payment, err := GetBondPaymentById(stub, paymentId)
+	if err != nil {
+		fmt.Println("This payment does not exist - " + paymentId)
+		return shim.Error("This payment does not exist - " + paymentId)
+	}
+	bond, err := GetBondById(stub, payment.BondId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	project, err := GetProjectById(stub, bond.ProjectId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if project.Agent != submitterOrgName {
+		fmt.Println("Only paying agent of the project can record payments - " + submitterOrgName)
+		return shim.Error("Only paying agent of the project can record payments - " + submitterOrgName)
+	}
+	if payment.Status == "executed" {
+		fmt.Println("This payment has been executed - " + paymentId)
+		return shim.Error("This payment has been executed - " + paymentId)
+	}
+
+	// 债权登记日日终之后才能登记
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if txTime.Before(GetRecordCutoff(payment)) {
+		fmt.Println("Record date has not passed - " + paymentId)
+		return shim.Error("Record date has not passed - " + paymentId)
+	}
+
+	dueAmount, err := GetPaymentDueAmount(stub, payment)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	switch status {
+	case "executed":
+		if args[2] == "" {
+			paidAmount = dueAmount
+		}
+		if paidAmount != dueAmount {
+			return shim.Error("Paid amount must equal due amount - " + strconv.FormatInt(dueAmount, 10))
+		}
+	case "partial":
+		if paidAmount <= 0 || paidAmount >= dueAmount {
+			return shim.Error("Paid amount must be between 0 and due amount - " + strconv.FormatInt(dueAmount, 10))
+		}
+	case "missed":
+		if paidAmount != 0 {
+			return shim.Error("Paid amount of missed payment must be 0")
+		}
+	default:
+		return shim.Error("Unknown payment status - " + status)
+	}
+
+	payment.Status = status
+	payment.DueAmount = dueAmount
+	payment.PaidAmount = paidAmount
+	payment.Records = append(payment.Records, PaymentRecord{
+		Status:     status,
+		PaidAmount: paidAmount,
+		Recorder:   submitter,
+		TxId:       stub.GetTxID(),
+		RecordTime: txTime.Format(time.RFC3339),
+	})
+	payment.LastModifier = submitter
+	payment.ModifyTime = modifyTime
+	payment.BusinessDate = businessDate
+
+	paymentAsBytes, _ := json.Marshal(payment)
+	err = PutState(stub, payment.Id, paymentAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end record_payment")
+	return shim.Success(paymentAsBytes)
+}
+
+// ========================================================
+// 查询债券的兑付计划
+// ========================================================
+func query_payment_schedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting query_payment_schedule")
+
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	payments, metadata, err := GetPagingBondPayments(stub, args[0], pageSize, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, _ := json.Marshal(payments)
+	result, err = MarshalPageResult(result, metadata)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end query_payment_schedule")
+	return shim.Success(result)
+}
+
+// ========================================================
+// 查询未到期的兑付
+// ========================================================
+func query_upcoming_payments(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting query_upcoming_payments")
+	result, err := QueryPaymentsByDue(stub, args, false)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("end query_upcoming_payments")
+	return shim.Success(result)
+}
+
+// ========================================================
+// 查询已逾期未足额支付的兑付
+// ========================================================
+func query_overdue_payments(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting query_overdue_payments")
+	result, err := QueryPaymentsByDue(stub, args, true)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("end query_overdue_payments")
+	return shim.Success(result)
+}
+
+// =============================================================================
+// 按兑付日筛选兑付
+// 参数为债券ID和可选的持有机构，指定持有机构时返回该机构的应收金额，
+// 否则返回兑付本身，其中应付总额按登记日持仓计算
+// 分页时持有机构可以为空字符串，分页按兑付计划进行，筛选后不足一页时继续查询
+// =============================================================================
+func QueryPaymentsByDue(stub shim.ChaincodeStubInterface, args []string, overdue bool) ([]byte, error) {
+	if len(args) < 1 || len(args) > 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 to 4")
+	}
+	bondId := args[0]
+	holder := ""
+	if len(args) >= 2 {
+		holder = args[1]
+	}
+	var pagingArgs []string
+	if len(args) > 2 {
+		pagingArgs = args[2:]
+	}
+	pageSize, bookmark, err := SanitizeBookmarkArgument(pagingArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	today := txTime.Format(DateLayout)
+
+	// 分页按兑付计划进行，筛选后不足一页时继续查询
+	selected := []BondPayment{}
+	entitlements := []PaymentEntitlement{}
+	metadata, err := FillPage(pageSize, bookmark, func(pageSize int32, bookmark string) (int, *pb.QueryResponseMetadata, error) {
+		payments, metadata, err := GetPagingBondPayments(stub, bondId, pageSize, bookmark)
+		if err != nil {
+			return 0, nil, err
+		}
+		kept := 0
+		for _, payment := range payments {
+			if payment.Status == "executed" {
+				continue
+			}
+			if overdue && payment.PaymentDate >= today || !overdue && (payment.PaymentDate < today || payment.Status != "scheduled") {
+				continue
+			}
+			if holder == "" {
+				if payment.Status == "scheduled" {
+					payment.DueAmount, err = GetPaymentDueAmount(stub, payment)
+					if err != nil {
+						return 0, nil, err
+					}
+				}
+				selected = append(selected, payment)
+				kept++
+				continue
+			}
+			entitlement, err := GetPaymentEntitlement(stub, payment, holder)
+			if err != nil {
+				return 0, nil, err
+			}
+			if entitlement.Units > 0 {
+				entitlements = append(entitlements, entitlement)
+				kept++
+			}
+		}
+		return kept, metadata, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if holder == "" {
+		result, _ := json.Marshal(selected)
+		return MarshalPageResult(result, metadata)
+	}
+	result, _ := json.Marshal(entitlements)
+	return MarshalPageResult(result, metadata)
+}
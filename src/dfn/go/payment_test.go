@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 创建支付代理机构为本机构的项目
+func MockCreateAgentProject(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_project"),
+		[]byte(`{"id":"project-bankcomm-000002","projectName":"测试交行项目000002号","scale":"500万元人民币","basicAssets":"个人按揭贷款","initiator":"交通银行","agent":"@org1.example.com","approvalWorkflowId":"test_linear_workflow-001","createTime":"2018-3-16 09:03:45"}`),
+	})
+	return response
+}
+
+// mock 写入某一时间的持仓历史
+func MockPutHoldingHistory(t *testing.T, stub *shim.MockStub, holder string, balance int64, txTime string) {
+	historyTime, _ := time.Parse(time.RFC3339, txTime)
+	stub.MockTransactionStart(GetTestTxID())
+	putHoldingHistory(stub, Holding{AssetId: "bond-bankcomm-000002-A", Holder: holder, Balance: balance}, historyTime)
+	stub.MockTransactionEnd(GetTestTxID())
+}
+
+// mock 登记支付结果
+func MockRecordPayment(t *testing.T, stub *shim.MockStub, seq int, status string, paidAmount string) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("record_payment"),
+		[]byte(GetBondPaymentId("bond-bankcomm-000002-A", seq)),
+		[]byte(status),
+		[]byte(paidAmount),
+		[]byte("2019-04-01 10:00:00"),
+	})
+	return response
+}
+
+// 测试生成兑付计划
+func Test_GenerateBondPayments(t *testing.T) {
+	bond := Bond{
+		Id:              "bond-1",
+		FaceValue:       10000,
+		CouponRate:      400,
+		IssueDate:       "2018-04-01",
+		MaturityDate:    "2020-04-01",
+		CouponFrequency: 2,
+		RecordDays:      1,
+		Amortization:    []BondAmortization{{Date: "2019-04-01", Principal: 5000}},
+	}
+	payments, err := GenerateBondPayments(bond)
+	if err != nil {
+		fmt.Println(err.Error())
+		t.FailNow()
+	}
+	if len(payments) != 4 {
+		fmt.Println("兑付期数不正确", len(payments))
+		t.FailNow()
+	}
+	if payments[0].PaymentDate != "2018-10-01" || payments[0].RecordDate != "2018-09-30" || payments[0].Coupon != 200 {
+		fmt.Println("第一期兑付不正确", payments[0])
+		t.FailNow()
+	}
+	if payments[1].Principal != 5000 || payments[2].Coupon != 100 {
+		fmt.Println("摊还后利息应按剩余本金计算", payments[1], payments[2])
+		t.FailNow()
+	}
+	if payments[3].PaymentDate != "2020-04-01" || payments[3].Principal != 5000 || payments[3].Id != "bond-1:payment:0004" {
+		fmt.Println("到期兑付不正确", payments[3])
+		t.FailNow()
+	}
+
+	bond.Amortization = []BondAmortization{{Date: "2019-05-01", Principal: 5000}}
+	_, err = GenerateBondPayments(bond)
+	if err == nil {
+		fmt.Println("摊还日必须是付息日")
+		t.FailNow()
+	}
+
+	// 月末发行时付息日取当月最后一天，不顺延到下月
+	bond = Bond{Id: "bond-2", FaceValue: 10000, CouponRate: 400, IssueDate: "2019-10-31", MaturityDate: "2020-05-31", CouponFrequency: 12}
+	payments, err = GenerateBondPayments(bond)
+	if err != nil {
+		fmt.Println(err.Error())
+		t.FailNow()
+	}
+	dates := []string{"2019-11-30", "2019-12-31", "2020-01-31", "2020-02-29", "2020-03-31", "2020-04-30", "2020-05-31"}
+	if len(payments) != len(dates) {
+		fmt.Println("兑付期数不正确", len(payments))
+		t.FailNow()
+	}
+	for i, date := range dates {
+		if payments[i].PaymentDate != date {
+			fmt.Println("月末付息日不正确", payments[i].PaymentDate)
+			t.FailNow()
+		}
+	}
+}
+
+// 测试登记支付结果及逾期查询
+func Test_RecordPayment(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateAgentProject(t, stub)
+	MockRunApprovalProcess(t, stub, true)
+	response := MockIssueBond1(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	// 第一期兑付日2019-04-01，登记日与兑付日相同
+	MockPutHoldingHistory(t, stub, "@org1.example.com", 100, "2018-04-01T08:00:00Z")
+	MockPutHoldingHistory(t, stub, "@org2.example.com", 300, "2018-04-01T08:00:00Z")
+	MockPutHoldingHistory(t, stub, "@org2.example.com", 200, "2019-04-01T23:59:59Z")
+	MockPutHoldingHistory(t, stub, "@org2.example.com", 0, "2019-04-02T00:00:00Z")
+
+	response = MockRecordPayment(t, stub, 1, "partial", "3000000")
+	if response.Status != shim.ERROR {
+		fmt.Println("部分支付金额不能超过应付总额，应该失败。")
+		t.FailNow()
+	}
+	response = MockRecordPayment(t, stub, 1, "executed", "")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var payment BondPayment
+	json.Unmarshal(response.Payload, &payment)
+	// 300份 * 10000 * 4.5%
+	if payment.DueAmount != 135000 || payment.PaidAmount != 135000 || len(payment.Records) != 1 {
+		fmt.Println("应付总额不正确", payment.DueAmount)
+		t.FailNow()
+	}
+	response = MockRecordPayment(t, stub, 1, "missed", "")
+	if response.Status != shim.ERROR {
+		fmt.Println("已支付的兑付不能再登记，应该失败。")
+		t.FailNow()
+	}
+	MockRecordPayment(t, stub, 2, "missed", "")
+
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("query_overdue_payments"),
+		[]byte("bond-bankcomm-000002-A"),
+		[]byte("@org1.example.com"),
+	})
+	var entitlements []PaymentEntitlement
+	json.Unmarshal(response.Payload, &entitlements)
+	if len(entitlements) != 2 || entitlements[0].Payment.Seq != 2 || entitlements[0].Payment.Status != "missed" {
+		fmt.Println("逾期兑付不正确", entitlements)
+		t.FailNow()
+	}
+	// 到期兑付：本金加利息
+	if entitlements[1].Principal != 1000000 || entitlements[1].Amount != 1045000 {
+		fmt.Println("应收金额不正确", entitlements[1])
+		t.FailNow()
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -18,33 +19,68 @@ type Process struct {
 	AttachDocType   string   `json:"attachDocType"`
 	AttachDocId     string   `json:"attachDocId"`
 	AttachDocName   string   `json:"attachDocName"`
-	WorkflowId      string   `json:"workflowId"`
+	WorkflowId      string   `json:"workflowId"`      // 工作流版本ID，流程发起后不随工作流修改而变化
+	WorkflowVersion int      `json:"workflowVersion"` // 工作流版本号
 	WorkflowName    string   `json:"workflowName"`
 	CurrentNodeId   string   `json:"currentNodeId"`
 	CurrentNodeName string   `json:"currentNodeName"`
 	CurrentOwner    string   `json:"currentOwner"`
+	Assignee        string   `json:"assignee"` // 拥有机构内认领的用户，证书的CN，并行时见各分支
 	Participants    []string `json:"participants"`
+	Branches        []ProcessBranch `json:"branches"` // 并行分支，仅在存在多个并行分支时使用
+	PendingApprovers []string `json:"pendingApprovers"` // 待会签机构，并行时为全部分支的汇总
+	ApprovedOrgs    []string `json:"approvedOrgs"`     // 当前会签节点已同意的机构，并行时见各分支
+	DueTime         string   `json:"dueTime"`          // 当前节点的到期时间，并行时为各分支中最早的
+	ParentProcessId string   `json:"parentProcessId"`  // 父流程ID，子流程节点启动的子流程才有
+	ParentNodeId    string   `json:"parentNodeId"`     // 启动子流程的父流程节点ID
+	SubProcessId    string   `json:"subProcessId"`     // 当前子流程节点启动的子流程ID，并行时见各分支
+	Blocked         bool     `json:"blocked"`          // 是否在等待子流程，并行时见各分支
+	SubProcessIds   []string `json:"subProcessIds"`    // 启动过的全部子流程ID
+	Variables       map[string]ProcessVariable `json:"variables"` // 流程变量，由节点表单提交
 	Finished        bool     `json:"finished"`
 	Canceled        bool     `json:"canceled"`
 	Creator         string   `json:"creator"`      // 创建人
 	LastModifier    string   `json:"lastModifier"` // 最后修改人
 	CreateTime      string   `json:"createTime"`
 	ModifyTime      string   `json:"modifyTime"`
+	BusinessDate    string   `json:"businessDate"`
+}
+
+// 并行流转中的一个分支
+type ProcessBranch struct {
+	NodeId   string `json:"nodeId"`
+	NodeName string `json:"nodeName"`
+	Owner    string `json:"owner"`
+	Waiting  bool   `json:"waiting"` // 已到达汇聚节点，等待其他分支
+	PendingApprovers []string `json:"pendingApprovers"` // 会签节点尚未同意的机构
+	ApprovedOrgs     []string `json:"approvedOrgs"`     // 会签节点已同意的机构
+	DueTime          string   `json:"dueTime"`          // 节点的到期时间，节点没有时限时为空
+	SubProcessId     string   `json:"subProcessId"`     // 子流程节点启动的子流程ID
+	Blocked          bool     `json:"blocked"`          // 是否在等待子流程
+	Assignee         string   `json:"assignee"`         // 拥有机构内认领的用户
 }
 
 type ProcessLog struct {
 	DocType      string `json:"docType"`
 	Id           string `json:"id"`
 	ProcessId    string `json:"processId"`
+	Seq          int    `json:"seq"` // 流程内日志序号，从0开始递增
 	FromNodeId   string `json:"fromNodeId"`
 	FromNodeName string `json:"fromNodeName"`
-	FromOrg      string `json:"fromOrg"`
+	FromOrg      string `json:"fromOrg"`   // 提交方机构，代理时为委托机构
+	ActingOrg    string `json:"actingOrg"` // 实际操作的机构，代理时为受托机构
+	Actor        string `json:"actor"`     // 实际操作的用户，证书的CN
 	ToNodeId     string `json:"toNodeId"`
 	ToNodeName   string `json:"toNodeName"`
 	ToOrg        string `json:"toOrg"`
 	Operation    string `json:"operation"`
+	RouteEdge    string `json:"routeEdge"` // 按路由规则选择的连线
+	RouteRule    string `json:"routeRule"` // 路由规则及其计算结果
+	NodeMapping  map[string]string `json:"nodeMapping"` // 迁移时原版本节点ID -> 目标版本节点ID
 	Remark       string `json:"remark"`
+	FormData     map[string]interface{} `json:"formData"` // 本次提交的表单数据
 	CreateTime   string `json:"createTime"`
+	BusinessDate string `json:"businessDate"`
 }
 
 // =============================================================================
@@ -79,15 +115,19 @@ func start_process(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	}
 
 	//check if workflow exists and is enabled
-	workflowDef, err := GetWorkflowDefById(stub, process.WorkflowId)
+	_, err = GetWorkflowDefById(stub, process.WorkflowId)
 	if err != nil {
 		fmt.Println("Workflow does not exist - " + process.WorkflowId)
 		return shim.Error("Workflow does not exist - " + process.WorkflowId)
 	}
-	if !workflowDef.Enabled {
+	// 使用最新的已启用版本
+	workflowDef, err := GetLatestWorkflowDef(stub, process.WorkflowId, true)
+	if err != nil {
 		fmt.Println("Workflow is disabled - " + process.WorkflowId)
 		return shim.Error("Workflow is disabled - " + process.WorkflowId)
 	}
+	process.WorkflowId = workflowDef.Id
+	process.WorkflowVersion = workflowDef.Version
 
 	//check if attachDoc exists and docType is correct
 	attachDocName, err := GetDocNameByDocTypeAndId(stub, process.AttachDocType, process.AttachDocId)
@@ -107,7 +147,10 @@ func start_process(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error(err.Error())
 	}
 
-	firstNode := workflowNodes[0]
+	firstNode, err := GetFirstNode(workflowNodes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	// check org or role
 	if firstNode.AccessOrgs != nil {
 		if !ContainsString(firstNode.AccessOrgs, creatorOrgName) {
@@ -116,7 +159,27 @@ func start_process(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		}
 	}
 
-	// TODO 补充检查角色的逻辑
+	err = CheckSubmitterRole(stub, workflowDef.AccessRoles)
+	if err == nil {
+		err = CheckSubmitterRole(stub, firstNode.AccessRoles)
+	}
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// 客户端传入的创建时间作为业务日期
+	if process.BusinessDate == "" {
+		process.BusinessDate = process.CreateTime
+	}
+	createTime, err := GetModifyTime(stub, process.BusinessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// store process
 	process.DocType = "process"
@@ -125,20 +188,22 @@ func start_process(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	process.CurrentNodeId = firstNode.Id
 	process.CurrentNodeName = firstNode.NodeName
 	process.CurrentOwner = creatorOrgName
+	process.PendingApprovers = GetPendingApprovers(firstNode)
+	process.DueTime = GetNodeDueTime(firstNode, txTime)
 	process.Canceled = false
 	process.Creator = creator
 	process.LastModifier = creator
 	process.Participants = []string{creatorOrgName}
-	process.ModifyTime = process.CreateTime
+	process.CreateTime = createTime
+	process.ModifyTime = createTime
 
-	processAsBytes, _ := json.Marshal(process)
-	err = stub.PutState(process.Id, processAsBytes) //store with id as key
+	err = PutProcess(stub, process)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	// store log
-	err = StoreProcessLog(stub, true, process.Id, "Init", "开始", "", process.CurrentNodeId, process.CurrentNodeName, process.CurrentOwner, "InitProcess", "", process.CreateTime)
+	err = StoreProcessLog(stub, true, process.Id, "Init", "开始", "", process.CurrentNodeId, process.CurrentNodeName, process.CurrentOwner, "InitProcess", "", process.BusinessDate)
 
 	if err != nil {
 		return shim.Error(err.Error())
@@ -173,8 +238,8 @@ func get_process_by_id(stub shim.ChaincodeStubInterface, args []string) pb.Respo
 	var err error
 	fmt.Println("starting get_process_by_id")
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
 	}
 
 	id := args[0]
@@ -187,10 +252,37 @@ func get_process_by_id(stub shim.ChaincodeStubInterface, args []string) pb.Respo
 
 	processAsBytes, _ := json.Marshal(process)
 
+	// 第二个参数为tree时返回流程所在的父子流程树
+	if len(args) == 2 {
+		if args[1] != "tree" {
+			return shim.Error("Unknown option - " + args[1])
+		}
+		tree, err := GetProcessTree(stub, process)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		processAsBytes, _ = json.Marshal(tree)
+	}
+
 	fmt.Println("- end get_process_by_id")
 	return shim.Success(processAsBytes)
 }
 
+// =============================================================================
+// 判断机构是否可见流程实例：参与机构和当前处理机构可见
+// =============================================================================
+func CanOrgSeeProcess(process Process, orgName string) bool {
+	if ContainsString(process.Participants, orgName) || process.CurrentOwner == orgName {
+		return true
+	}
+	for _, branch := range process.Branches {
+		if branch.Owner == orgName {
+			return true
+		}
+	}
+	return false
+}
+
 // ========================================================
 // 查询全部日志
 // ========================================================
@@ -198,13 +290,18 @@ func query_logs_by_process_id(stub shim.ChaincodeStubInterface, args []string) p
 	var err error
 	fmt.Println("starting query_logs_by_process_id")
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
 	}
 
 	processId := args[0]
 
-	_, result, err := GetLogsByProcessId(stub, processId)
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result, err := GetPagingQueryResult(stub, GetLogsQueryByProcessId(processId), pageSize, bookmark)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -221,12 +318,7 @@ func GetLogsByProcessId(stub shim.ChaincodeStubInterface, processId string) ([]P
 	var results []ProcessLog
 	fmt.Println("starting GetLogsByProcessId")
 
-	var queryBuffer bytes.Buffer
-	queryBuffer.WriteString(`{"selector":{"docType":"processLog", "processId":"`)
-	queryBuffer.WriteString(processId)
-	queryBuffer.WriteString(`"}}`)
-
-	resultAsBytes, err := GetQueryResult(stub, queryBuffer.String())
+	resultAsBytes, err := ExecuteQuery(stub, GetLogsQueryByProcessId(processId))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -241,24 +333,188 @@ func GetLogsByProcessId(stub shim.ChaincodeStubInterface, processId string) ([]P
 }
 
 // ========================================================
-// 存储日志
+// 存储流程实例，并按处理机构、参与机构和附加文档更新索引
 // ========================================================
-func StoreProcessLog(stub shim.ChaincodeStubInterface, isInit bool, processId string, fromNodeId string, fromNodeName string, fromOrg string, toNodeId string, toNodeName string, toOrg string, operation string, remark string, createTime string) error {
-	var err error
-	logsLens := "0"
-	if !isInit {
-		// query logs
+func PutProcess(stub shim.ChaincodeStubInterface, process Process) error {
+	var oldEntries []IndexEntry
+	oldProcess, err := GetProcessById(stub, process.Id)
+	if err == nil {
+		oldEntries = GetProcessIndexEntries(oldProcess)
+	}
+
+	processAsBytes, _ := json.Marshal(process)
+	err = stub.PutState(process.Id, processAsBytes) //store with id as key
+	if err != nil {
+		return err
+	}
+	return UpdateIndexes(stub, oldEntries, GetProcessIndexEntries(process))
+}
+
+// 流程实例的索引项，结束或取消的流程不再有处理机构
+func GetProcessIndexEntries(process Process) []IndexEntry {
+	entries := []IndexEntry{
+		{Name: DocTypeIndex, Attributes: []string{"process", process.Id}},
+		{Name: ProcessAttachIndex, Attributes: []string{process.AttachDocType, process.AttachDocId, process.Id}},
+	}
+	for _, participant := range process.Participants {
+		entries = append(entries, IndexEntry{Name: ProcessParticipantIndex, Attributes: []string{participant, process.Id}})
+	}
+	if !process.Finished && !process.Canceled {
+		for _, branch := range GetProcessBranches(process) {
+			entries = append(entries, IndexEntry{Name: ProcessOwnerIndex, Attributes: []string{branch.Owner, process.Id}})
+		}
+		// 待会签机构也需要在待办中查到
+		for _, approver := range process.PendingApprovers {
+			entries = append(entries, IndexEntry{Name: ProcessOwnerIndex, Attributes: []string{approver, process.Id}})
+		}
+	}
+	return entries
+}
+
+// 流程全部日志的查询语句
+func GetLogsQueryByProcessId(processId string) *Query {
+	return NewQuery("processLog").Eq("processId", processId).UseIndex("indexProcessLogs").ScanIndex(ProcessLogIndex, processId)
+}
+
+// ========================================================
+// 按日志序号倒序查找最近一条流转到机构指定节点的日志，用于退回和撤回
+// 通过复合键范围查询，不使用富查询；升级前存储的日志没有序号索引，
+// 索引中找不到时查询流程的全部日志，按日志ID中的序号排序后再查找
+// ========================================================
+func GetLatestTransferLog(stub shim.ChaincodeStubInterface, processId string, toOrg string, toNodeId string) (ProcessLog, bool, error) {
+	logIds, err := GetIdsByIndex(stub, ProcessLogIndex, []string{processId})
+	if err != nil {
+		return ProcessLog{}, false, err
+	}
+	var logs []ProcessLog
+	for _, logId := range logIds {
+		logAsBytes, err := stub.GetState(logId)
+		if err != nil {
+			return ProcessLog{}, false, err
+		}
+		if logAsBytes == nil {
+			continue
+		}
+		log := ProcessLog{}
+		json.Unmarshal(logAsBytes, &log)
+		logs = append(logs, log)
+	}
+	log, found, err := FindLatestTransferLog(stub, logs, toOrg, toNodeId)
+	if err != nil || found {
+		return log, found, err
+	}
+
+	logs, _, err = GetLogsByProcessId(stub, processId)
+	if err != nil {
+		return ProcessLog{}, false, err
+	}
+	SortProcessLogs(logs)
+	return FindLatestTransferLog(stub, logs, toOrg, toNodeId)
+}
+
+// ========================================================
+// 按日志ID中的序号排序，升级前的日志ID序号没有补零，不能按字符串排序
+// ========================================================
+func SortProcessLogs(logs []ProcessLog) {
+	seqOf := func(log ProcessLog) int {
+		seq, err := strconv.Atoi(log.Id[strings.LastIndex(log.Id, "-")+1:])
+		if err != nil {
+			return log.Seq
+		}
+		return seq
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return seqOf(logs[i]) < seqOf(logs[j]) })
+}
+
+// ========================================================
+// 在按序号排列的日志中倒序查找最近一条流转到机构指定节点的日志
+// 迁移前的日志使用原版本的节点ID，按迁移日志记录的节点映射解析为当前版本的节点
+// ========================================================
+func FindLatestTransferLog(stub shim.ChaincodeStubInterface, logs []ProcessLog, toOrg string, toNodeId string) (ProcessLog, bool, error) {
+	nodeIds := []string{toNodeId}
+	var nodeMappings []map[string]string
+	for i := len(logs) - 1; i >= 0; i-- {
+		log := logs[i]
+		if log.Operation == "MigrateProcess" {
+			nodeMappings = append(nodeMappings, log.NodeMapping)
+			for fromId, toId := range log.NodeMapping {
+				if ContainsString(nodeIds, toId) {
+					nodeIds = append(nodeIds, fromId)
+				}
+			}
+			continue
+		}
+		if log.Operation == "TransferProcess" && log.ToOrg == toOrg && ContainsString(nodeIds, log.ToNodeId) {
+			if len(nodeMappings) == 0 {
+				return log, true, nil
+			}
+			// 按迁移的先后顺序将来源节点映射到当前版本
+			fromNodeId := log.FromNodeId
+			for j := len(nodeMappings) - 1; j >= 0; j-- {
+				nextNodeId, ok := nodeMappings[j][fromNodeId]
+				if !ok {
+					return log, false, errors.New("Node mapping is missing - " + fromNodeId)
+				}
+				fromNodeId = nextNodeId
+			}
+			fromNode, err := GetWorkflowNodeById(stub, fromNodeId)
+			if err != nil {
+				return log, false, err
+			}
+			log.FromNodeId = fromNode.Id
+			log.FromNodeName = fromNode.NodeName
+			log.ToNodeId = toNodeId
+			return log, true, nil
+		}
+	}
+	return ProcessLog{}, false, nil
+}
+
+// 流程日志序号计数器的复合键类型
+const ProcessLogSeqKey = "processLogSeq"
+
+// ========================================================
+// 获取流程后续count条日志的起始序号并更新计数器
+// 交易内读取不到本交易写入的计数器，一个交易存储多条日志时需要一次取得全部序号
+// ========================================================
+func NextProcessLogSeq(stub shim.ChaincodeStubInterface, isInit bool, processId string, count int) (int, error) {
+	key, err := stub.CreateCompositeKey(ProcessLogSeqKey, []string{processId})
+	if err != nil {
+		return 0, err
+	}
+	seqAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return 0, err
+	}
+
+	seq := 0
+	if seqAsBytes != nil {
+		lastSeq, err := strconv.Atoi(string(seqAsBytes))
+		if err != nil {
+			return 0, errors.New("Invalid process log sequence - " + processId)
+		}
+		seq = lastSeq + 1
+	} else if !isInit {
+		// 没有计数器的历史流程按已有日志数继续编号
 		logs, _, err := GetLogsByProcessId(stub, processId)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		logsLens = strconv.Itoa(len(logs))
+		seq = len(logs)
 	}
 
-	// store log
+	err = stub.PutState(key, []byte(strconv.Itoa(seq+count-1)))
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// ========================================================
+// 存储日志
+// ========================================================
+func StoreProcessLog(stub shim.ChaincodeStubInterface, isInit bool, processId string, fromNodeId string, fromNodeName string, fromOrg string, toNodeId string, toNodeName string, toOrg string, operation string, remark string, businessDate string) error {
 	var log = ProcessLog{}
-	log.Id = "processLog-" + processId + "-" + logsLens
-	log.DocType = "processLog"
 	log.ProcessId = processId
 	log.FromNodeId = fromNodeId
 	log.FromNodeName = fromNodeName
@@ -268,15 +524,74 @@ func StoreProcessLog(stub shim.ChaincodeStubInterface, isInit bool, processId st
 	log.ToOrg = toOrg
 	log.Operation = operation
 	log.Remark = remark
-	log.CreateTime = createTime
+	log.BusinessDate = businessDate
+	return SaveProcessLog(stub, isInit, log)
+}
+
+// ========================================================
+// 存储日志，按流程的日志序号生成日志ID，序号补零使字符串顺序与数值顺序一致
+// ========================================================
+func SaveProcessLog(stub shim.ChaincodeStubInterface, isInit bool, log ProcessLog) error {
+	return SaveProcessLogs(stub, isInit, log)
+}
+
+// ========================================================
+// 在一个交易中存储同一流程的多条日志，序号按传入顺序递增
+// 一个交易只能发送一个event，只发送最后一条日志
+// ========================================================
+func SaveProcessLogs(stub shim.ChaincodeStubInterface, isInit bool, logs ...ProcessLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	seq, err := NextProcessLogSeq(stub, isInit, logs[0].ProcessId, len(logs))
+	if err != nil {
+		return err
+	}
 
-	logAsBytes, _ := json.Marshal(log)
-	err = stub.PutState(log.Id, logAsBytes) //store with id as key
+	createTime, err := GetTxTimeString(stub)
+	if err != nil {
+		return err
+	}
+	actor, err := GetSubmitterName(stub)
+	if err != nil {
+		return err
+	}
+	actingOrg, err := GetOrgFromCertCommonName(actor)
 	if err != nil {
 		return err
 	}
 
-	SendProcessLogEvent(stub, log, logAsBytes)
+	var lastLog ProcessLog
+	var logAsBytes []byte
+	for i, log := range logs {
+		if log.ProcessId != logs[0].ProcessId {
+			return errors.New("Process logs must belong to the same process - " + log.ProcessId)
+		}
+
+		// store log
+		log.Seq = seq + i
+		log.Id = "processLog-" + log.ProcessId + "-" + IndexSeq(log.Seq)
+		log.DocType = "processLog"
+		log.ActingOrg = actingOrg
+		log.Actor = actor
+		log.CreateTime = createTime
+
+		logAsBytes, _ = json.Marshal(log)
+		err = stub.PutState(log.Id, logAsBytes) //store with id as key
+		if err != nil {
+			return err
+		}
+		err = UpdateIndexes(stub, nil, []IndexEntry{
+			{Name: DocTypeIndex, Attributes: []string{"processLog", log.Id}},
+			{Name: ProcessLogIndex, Attributes: []string{log.ProcessId, IndexSeq(log.Seq), log.Id}},
+		})
+		if err != nil {
+			return err
+		}
+		lastLog = log
+	}
+
+	SendProcessLogEvent(stub, lastLog, logAsBytes)
 
 	return nil
 }
@@ -295,8 +610,8 @@ func transfer_process(stub shim.ChaincodeStubInterface, args []string) pb.Respon
 	var err error
 	fmt.Println("starting transfer_process")
 
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+	if len(args) < 4 || len(args) > 7 {
+		return shim.Error("Incorrect number of arguments. Expecting 4 to 7")
 	}
 
 	submitter, err := GetSubmitterName(stub)
@@ -313,7 +628,27 @@ func transfer_process(stub shim.ChaincodeStubInterface, args []string) pb.Respon
 	processId := args[0]
 	nextNodeId := args[1]
 	nextOwner := args[2]
-	modifyTime := args[3]
+	businessDate := args[3]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	branchNodeId := ""
+	formData := ""
+	remark := ""
+	if len(args) > 4 {
+		branchNodeId = args[4]
+	}
+	if len(args) > 5 {
+		formData = args[5]
+	}
+	if len(args) > 6 {
+		remark = args[6]
+	}
 
 	//check if process already exists
 	process, err := GetProcessById(stub, processId)
@@ -332,97 +667,506 @@ func transfer_process(stub shim.ChaincodeStubInterface, args []string) pb.Respon
 		return shim.Error("This process has been finished - " + processId)
 	}
 
-	// check if submitter's org is current owner's org
-	if submitterOrgName != process.CurrentOwner {
+	// 提交机构可以代理委托机构流转
+	actingOrgs, err := GetActingOrgs(stub, submitterOrgName, process.WorkflowId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// find the branch to transfer
+	branches := GetProcessBranches(process)
+	branchIndex, err := FindProcessBranch(branches, actingOrgs, branchNodeId)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	branch := branches[branchIndex]
+
+	// check if submitter's org is current owner's org or acts for it
+	if !ContainsString(actingOrgs, branch.Owner) {
 		fmt.Println("You are not allowed to transfer the process - " + submitterOrgName)
 		return shim.Error("You are not allowed to transfer the process - " + submitterOrgName)
 	}
+	if branch.Blocked {
+		fmt.Println("This process is waiting for the sub process - " + branch.SubProcessId)
+		return shim.Error("This process is waiting for the sub process - " + branch.SubProcessId)
+	}
+	if branch.Assignee != "" && branch.Assignee != submitter {
+		fmt.Println("This process has been claimed by - " + branch.Assignee)
+		return shim.Error("This process has been claimed by - " + branch.Assignee)
+	}
 
 	// transfer to next node
-	currentNode, err := GetWorkflowNodeById(stub, process.CurrentNodeId)
+	currentNode, err := GetWorkflowNodeById(stub, branch.NodeId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check submitter's role of current node
+	err = CheckSubmitterRole(stub, currentNode.AccessRoles)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// 会签节点在会签通过后自动流转
+	if IsApprovalNode(currentNode) {
+		fmt.Println("Approval node is transferred after approvals - " + currentNode.Id)
+		return shim.Error("Approval node is transferred after approvals - " + currentNode.Id)
+	}
+
+	// 校验节点表单，表单数据保存为流程变量，供前置条件和路由条件使用
+	data, err := ParseFormData(currentNode, formData)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	SetProcessVariables(&process, currentNode.Id, data, submitter, modifyTime)
+
+	// 检查离开节点的前置条件
+	unmetItems, err := CheckNodeReadiness(stub, process, currentNode)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if len(unmetItems) > 0 {
+		readinessAsBytes, _ := json.Marshal(ProcessReadiness{ProcessId: process.Id, NodeId: currentNode.Id, UnmetItems: unmetItems})
+		fmt.Println("Process is not ready to leave the node - " + string(readinessAsBytes))
+		return shim.Error("Process is not ready to leave the node - " + string(readinessAsBytes))
+	}
 
+	var toNodeIds, toNodeNames, toOwners []string
+	var routeEdges []string
+	routeRule := ""
 	if !currentNode.LastNode {
-		// check if can transfer to the node
-		if !ContainsString(currentNode.NextNodeIds, nextNodeId) {
-			fmt.Println("You are not allowed to transfer to the node - " + nextNodeId)
-			return shim.Error("You are not allowed to transfer to the node - " + nextNodeId)
+		nextNodeIds := []string{nextNodeId}
+		nextOwners := []string{nextOwner}
+		if currentNode.SplitType != "parallel" && len(currentNode.Routes) > 0 {
+			// 根据路由规则选择下一节点
+			route, rule, err := SelectRoute(stub, process, currentNode)
+			if err != nil {
+				fmt.Println(err.Error())
+				return shim.Error(err.Error())
+			}
+			if nextNodeId != "" && nextNodeId != route.NextNodeId {
+				fmt.Println("Routing rule selects the node - " + route.NextNodeId)
+				return shim.Error("Routing rule selects the node - " + route.NextNodeId)
+			}
+			nextNodeIds = []string{route.NextNodeId}
+			routeEdges = append(routeEdges, currentNode.Id+" -> "+route.NextNodeId)
+			routeRule = rule
 		}
+		if currentNode.SplitType == "parallel" {
+			// 并行分支时，下一节点ID和下一拥有人均为JSON数组
+			err = json.Unmarshal([]byte(nextNodeId), &nextNodeIds)
+			if err != nil {
+				return shim.Error("Expecting JSON array of next node ids for parallel node - " + err.Error())
+			}
+			err = json.Unmarshal([]byte(nextOwner), &nextOwners)
+			if err != nil {
+				return shim.Error("Expecting JSON array of next owners for parallel node - " + err.Error())
+			}
+			if len(nextNodeIds) != len(nextOwners) {
+				return shim.Error("The number of next node ids and next owners does not match")
+			}
+			for _, id := range currentNode.NextNodeIds {
+				if HasRouteCondition(currentNode, id) {
+					continue
+				}
+				if !ContainsString(currentNode.OptionalNextNodeIds, id) && !ContainsString(nextNodeIds, id) {
+					fmt.Println("Required parallel branch is missing - " + id)
+					return shim.Error("Required parallel branch is missing - " + id)
+				}
+			}
+			if len(RemoveRepStringByMap(nextNodeIds)) != len(nextNodeIds) {
+				return shim.Error("Duplicate next node ids for parallel node")
+			}
 
-		nextNode, err := GetWorkflowNodeById(stub, nextNodeId)
-		if err != nil {
-			return shim.Error(err.Error())
+			// 根据路由规则检查并行分支
+			required, forbidden, rule, err := EvaluateParallelRoutes(stub, process, currentNode)
+			if err != nil {
+				fmt.Println(err.Error())
+				return shim.Error(err.Error())
+			}
+			for _, id := range required {
+				if !ContainsString(nextNodeIds, id) {
+					fmt.Println("Routing rule requires the branch - " + id)
+					return shim.Error("Routing rule requires the branch - " + id)
+				}
+			}
+			for _, id := range forbidden {
+				if ContainsString(nextNodeIds, id) {
+					fmt.Println("Routing rule skips the branch - " + id)
+					return shim.Error("Routing rule skips the branch - " + id)
+				}
+			}
+			for _, id := range nextNodeIds {
+				routeEdges = append(routeEdges, currentNode.Id+" -> "+id)
+			}
+			routeRule = rule
 		}
 
-		// check org or role
-		if nextNode.AccessOrgs != nil {
-			if !ContainsString(nextNode.AccessOrgs, nextOwner) {
-				fmt.Println("You are not allowed to transfer to next owner - " + nextOwner)
-				return shim.Error("You are not allowed to transfer to next owner - " + nextOwner)
+		var newBranches []ProcessBranch
+		for i := 0; i < len(nextNodeIds); i++ {
+			// check if can transfer to the node
+			if !ContainsString(currentNode.NextNodeIds, nextNodeIds[i]) {
+				fmt.Println("You are not allowed to transfer to the node - " + nextNodeIds[i])
+				return shim.Error("You are not allowed to transfer to the node - " + nextNodeIds[i])
 			}
-		}
 
-		// TODO 补充检查角色的逻辑
+			nextNode, err := GetWorkflowNodeById(stub, nextNodeIds[i])
+			if err != nil {
+				return shim.Error(err.Error())
+			}
 
-		// store process
-		process.CurrentNodeId = nextNode.Id
-		process.CurrentNodeName = nextNode.NodeName
-		process.CurrentOwner = nextOwner
+			// check org or role
+			if nextNode.AccessOrgs != nil {
+				if !ContainsString(nextNode.AccessOrgs, nextOwners[i]) {
+					fmt.Println("You are not allowed to transfer to next owner - " + nextOwners[i])
+					return shim.Error("You are not allowed to transfer to next owner - " + nextOwners[i])
+				}
+			}
+
+			newBranches = append(newBranches, NewProcessBranch(nextNode, nextOwners[i], txTime))
+			toNodeIds = append(toNodeIds, nextNode.Id)
+			toNodeNames = append(toNodeNames, nextNode.NodeName)
+			toOwners = append(toOwners, nextOwners[i])
+		}
+
+		// replace current branch with new branches, keep arrival order
+		branches = append(append(branches[:branchIndex:branchIndex], branches[branchIndex+1:]...), newBranches...)
+		branches, err = MergeProcessBranches(stub, branches)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		SetProcessBranches(&process, branches)
 
 	} else {
+		if len(branches) > 1 {
+			fmt.Println("Parallel branches must be joined before finishing the process - " + processId)
+			return shim.Error("Parallel branches must be joined before finishing the process - " + processId)
+		}
 		// finish the process
 		// store process
 		process.Finished = true
 		process.CurrentNodeId = "Finish"
 		process.CurrentNodeName = "结束"
 		process.CurrentOwner = ""
+		process.Assignee = ""
+		process.DueTime = ""
+		process.SubProcessId = ""
+		toNodeIds = []string{process.CurrentNodeId}
+		toNodeNames = []string{process.CurrentNodeName}
+		toOwners = []string{process.CurrentOwner}
 	}
 
 	process.LastModifier = submitter
 	process.ModifyTime = modifyTime
+	process.BusinessDate = businessDate
 	if !ContainsString(process.Participants, submitterOrgName) {
 		process.Participants = append(process.Participants, submitterOrgName)
 	}
 
-	processAsBytes, _ := json.Marshal(process)
-	err = stub.PutState(process.Id, processAsBytes) //store with id as key
+	// 到达子流程节点时启动子流程
+	err = StartSubProcesses(stub, &process, submitter, businessDate)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	err = PutProcess(stub, process)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	// store log
-	err = StoreProcessLog(stub, false, processId, currentNode.Id, currentNode.NodeName, submitterOrgName, process.CurrentNodeId, process.CurrentNodeName, process.CurrentOwner, "TransferProcess", "", modifyTime)
+	// 并行分支时，日志的接收方字段以逗号分隔
+	var log = ProcessLog{}
+	log.ProcessId = processId
+	log.FromNodeId = currentNode.Id
+	log.FromNodeName = currentNode.NodeName
+	log.FromOrg = branch.Owner
+	log.ToNodeId = strings.Join(toNodeIds, ",")
+	log.ToNodeName = strings.Join(toNodeNames, ",")
+	log.ToOrg = strings.Join(toOwners, ",")
+	log.Operation = "TransferProcess"
+	log.RouteEdge = strings.Join(routeEdges, ",")
+	log.RouteRule = routeRule
+	log.Remark = remark
+	log.FormData = data
+	log.BusinessDate = businessDate
+	err = SaveProcessLog(stub, false, log)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 子流程办结时继续处理父流程
+	if process.Finished {
+		err = CompleteSubProcess(stub, process, submitter, modifyTime, businessDate)
+		if err != nil {
+			fmt.Println(err.Error())
+			return shim.Error(err.Error())
+		}
+	}
 
 	fmt.Println("- end transfer_process")
 	return shim.Success(nil)
 }
 
 // =============================================================================
-// 流程回退
+// 由链码自动流转分支，用于会签通过和子流程办结
+// 按路由条件或唯一的下一节点流转，下一节点的拥有人为当前分支的拥有人，最后一个节点时办结流程
 // =============================================================================
-func return_process(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var err error
-	fmt.Println("starting return_process")
-
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+func AutoTransferBranch(stub shim.ChaincodeStubInterface, process *Process, branches []ProcessBranch, branchIndex int, currentNode WorkflowNode, log *ProcessLog, txTime time.Time) error {
+	branch := branches[branchIndex]
+	if currentNode.LastNode {
+		if len(branches) > 1 {
+			return errors.New("Parallel branches must be joined before finishing the process - " + process.Id)
+		}
+		process.Finished = true
+		process.CurrentNodeId = "Finish"
+		process.CurrentNodeName = "结束"
+		process.CurrentOwner = ""
+		process.Assignee = ""
+		process.PendingApprovers = nil
+		process.ApprovedOrgs = nil
+		process.DueTime = ""
+		process.SubProcessId = ""
+		process.Blocked = false
+		log.ToNodeId = process.CurrentNodeId
+		log.ToNodeName = process.CurrentNodeName
+		return nil
+	}
+
+	nextNodeId := ""
+	if len(currentNode.Routes) > 0 {
+		route, rule, err := SelectRoute(stub, *process, currentNode)
+		if err != nil {
+			return err
+		}
+		nextNodeId = route.NextNodeId
+		log.RouteEdge = currentNode.Id + " -> " + route.NextNodeId
+		log.RouteRule = rule
+	} else {
+		nextNodeId = currentNode.NextNodeIds[0]
 	}
-
-	submitter, err := GetSubmitterName(stub)
+	nextNode, err := GetWorkflowNodeById(stub, nextNodeId)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
+	}
+	if nextNode.AccessOrgs != nil && !ContainsString(nextNode.AccessOrgs, branch.Owner) {
+		return errors.New("You are not allowed to transfer to next owner - " + branch.Owner)
 	}
 
-	// check submitter's org and role
-	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	branches = append(append(branches[:branchIndex:branchIndex], branches[branchIndex+1:]...), NewProcessBranch(nextNode, branch.Owner, txTime))
+	branches, err = MergeProcessBranches(stub, branches)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
-
+	SetProcessBranches(process, branches)
+	log.ToNodeId = nextNode.Id
+	log.ToNodeName = nextNode.NodeName
+	log.ToOrg = branch.Owner
+	return nil
+}
+
+// =============================================================================
+// 获取流程实例当前的全部分支，非并行状态下返回只包含当前节点的分支
+// =============================================================================
+func GetProcessBranches(process Process) []ProcessBranch {
+	if len(process.Branches) > 0 {
+		return append([]ProcessBranch{}, process.Branches...)
+	}
+	return []ProcessBranch{{
+		NodeId:           process.CurrentNodeId,
+		NodeName:         process.CurrentNodeName,
+		Owner:            process.CurrentOwner,
+		PendingApprovers: process.PendingApprovers,
+		ApprovedOrgs:     process.ApprovedOrgs,
+		DueTime:          process.DueTime,
+		SubProcessId:     process.SubProcessId,
+		Blocked:          process.Blocked,
+		Assignee:         process.Assignee,
+	}}
+}
+
+// =============================================================================
+// 流程到达节点时的分支，汇聚节点需要等待其他分支，会签节点需要等待会签
+// 等待汇聚的分支不计时，合并后按合并时间计算到期时间
+// =============================================================================
+func NewProcessBranch(node WorkflowNode, owner string, enterTime time.Time) ProcessBranch {
+	branch := ProcessBranch{
+		NodeId:           node.Id,
+		NodeName:         node.NodeName,
+		Owner:            owner,
+		Waiting:          node.JoinType == "all",
+		PendingApprovers: GetPendingApprovers(node),
+	}
+	if !branch.Waiting {
+		branch.DueTime = GetNodeDueTime(node, enterTime)
+	}
+	return branch
+}
+
+// =============================================================================
+// 更新流程实例的分支，只剩一个分支时恢复为非并行状态
+// =============================================================================
+func SetProcessBranches(process *Process, branches []ProcessBranch) {
+	if len(branches) == 1 {
+		process.Branches = nil
+		process.CurrentNodeId = branches[0].NodeId
+		process.CurrentNodeName = branches[0].NodeName
+		process.CurrentOwner = branches[0].Owner
+		process.PendingApprovers = branches[0].PendingApprovers
+		process.ApprovedOrgs = branches[0].ApprovedOrgs
+		process.DueTime = branches[0].DueTime
+		process.SubProcessId = branches[0].SubProcessId
+		process.Blocked = branches[0].Blocked
+		process.Assignee = branches[0].Assignee
+		return
+	}
+	process.Branches = branches
+	process.CurrentNodeId = "Parallel"
+	process.CurrentNodeName = "并行"
+	process.CurrentOwner = ""
+	process.PendingApprovers = nil
+	process.ApprovedOrgs = nil
+	process.DueTime = ""
+	process.SubProcessId = ""
+	process.Blocked = false
+	process.Assignee = ""
+	for _, branch := range branches {
+		if !branch.Waiting {
+			process.PendingApprovers = append(process.PendingApprovers, branch.PendingApprovers...)
+		}
+		if !branch.Waiting && branch.DueTime != "" && (process.DueTime == "" || branch.DueTime < process.DueTime) {
+			process.DueTime = branch.DueTime
+		}
+	}
+	process.PendingApprovers = RemoveRepStringByMap(process.PendingApprovers)
+}
+
+// =============================================================================
+// 查找要流转的分支
+// 指定了节点ID时按节点查找，否则查找提交机构（包括其代理的机构）拥有的唯一分支
+// =============================================================================
+func FindProcessBranch(branches []ProcessBranch, orgNames []string, nodeId string) (int, error) {
+	found := -1
+	for i := 0; i < len(branches); i++ {
+		if branches[i].Waiting {
+			continue
+		}
+		if nodeId != "" {
+			if branches[i].NodeId == nodeId {
+				return i, nil
+			}
+			continue
+		}
+		if ContainsString(orgNames, branches[i].Owner) || len(branches) == 1 {
+			if found != -1 {
+				return -1, errors.New("More than one branch is owned by " + strings.Join(orgNames, ",") + ", please specify the node id")
+			}
+			found = i
+		}
+	}
+	if found == -1 {
+		return -1, errors.New("Can not find the branch to transfer - " + nodeId)
+	}
+	return found, nil
+}
+
+// =============================================================================
+// 合并到达汇聚节点的分支
+// 其他分支均无法再到达汇聚节点时，等待中的分支合并为一个分支继续流转
+// =============================================================================
+func MergeProcessBranches(stub shim.ChaincodeStubInterface, branches []ProcessBranch) ([]ProcessBranch, error) {
+	for i := 0; i < len(branches); i++ {
+		if !branches[i].Waiting {
+			continue
+		}
+		joinNodeId := branches[i].NodeId
+		ready := true
+		for j := 0; j < len(branches); j++ {
+			if branches[j].NodeId == joinNodeId && branches[j].Waiting {
+				continue
+			}
+			reachable, err := CanReachNode(stub, branches[j].NodeId, joinNodeId)
+			if err != nil {
+				return nil, err
+			}
+			if reachable {
+				ready = false
+				break
+			}
+		}
+		if !ready {
+			continue
+		}
+
+		// 最后到达的分支决定汇聚节点的拥有人
+		merged := ProcessBranch{}
+		var others []ProcessBranch
+		for j := 0; j < len(branches); j++ {
+			if branches[j].NodeId == joinNodeId && branches[j].Waiting {
+				merged = branches[j]
+			} else {
+				others = append(others, branches[j])
+			}
+		}
+		merged.Waiting = false
+		joinNode, err := GetWorkflowNodeById(stub, joinNodeId)
+		if err != nil {
+			return nil, err
+		}
+		txTime, err := GetTxTime(stub)
+		if err != nil {
+			return nil, err
+		}
+		merged.DueTime = GetNodeDueTime(joinNode, txTime)
+		return MergeProcessBranches(stub, append(others, merged))
+	}
+	return branches, nil
+}
+
+// =============================================================================
+// 流程回退
+// =============================================================================
+func return_process(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting return_process")
+
+	if len(args) < 2 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 2 to 4")
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// check submitter's org and role
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	processId := args[0]
-	modifyTime := args[1]
+	businessDate := args[1]
+	formData := ""
+	remark := ""
+	if len(args) > 2 {
+		formData = args[2]
+	}
+	if len(args) > 3 {
+		remark = args[3]
+	}
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	//check if process already exists
 	process, err := GetProcessById(stub, processId)
@@ -441,11 +1185,28 @@ func return_process(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error("This process has been finished - " + processId)
 	}
 
-	// check if submitter's org is current owner's org
-	if submitterOrgName != process.CurrentOwner {
+	// check if submitter's org is current owner's org or acts for it
+	actingOrgs, err := GetActingOrgs(stub, submitterOrgName, process.WorkflowId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !ContainsString(actingOrgs, process.CurrentOwner) {
 		fmt.Println("You are not allowed to return the process - " + submitterOrgName)
 		return shim.Error("You are not allowed to return the process - " + submitterOrgName)
 	}
+	if process.Blocked {
+		fmt.Println("This process is waiting for the sub process - " + process.SubProcessId)
+		return shim.Error("This process is waiting for the sub process - " + process.SubProcessId)
+	}
+	if process.Assignee != "" && process.Assignee != submitter {
+		fmt.Println("This process has been claimed by - " + process.Assignee)
+		return shim.Error("This process has been claimed by - " + process.Assignee)
+	}
+
+	if len(process.Branches) > 0 {
+		fmt.Println("The process has parallel branches - " + processId)
+		return shim.Error("The process has parallel branches - " + processId)
+	}
 
 	// get current node
 	currentNode, err := GetWorkflowNodeById(stub, process.CurrentNodeId)
@@ -458,60 +1219,88 @@ func return_process(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error("The process can not be returned again - " + processId)
 	}
 
-	// 根据流转日志对流程进行回退
-	var queryBuffer bytes.Buffer
-	queryBuffer.WriteString(`{"selector":{"docType":"processLog","processId":"`)
-	queryBuffer.WriteString(processId)
-	queryBuffer.WriteString(`","operation":"TransferProcess","toOrg":"`)
-	queryBuffer.WriteString(submitterOrgName)
-	queryBuffer.WriteString(`","toNodeId":"`)
-	queryBuffer.WriteString(currentNode.Id)
-	queryBuffer.WriteString(`"}}`)
-	resultAsBytes, err := GetQueryResult(stub, queryBuffer.String())
+	// 退回时同样可以提交当前节点的表单
+	data, err := ParseFormData(currentNode, formData)
 	if err != nil {
 		fmt.Println(err.Error())
 		return shim.Error(err.Error())
 	}
+	SetProcessVariables(&process, currentNode.Id, data, submitter, modifyTime)
 
-	var logs []ProcessLog
-	err = json.Unmarshal(resultAsBytes, &logs) //un stringify it aka JSON.parse()
+	if currentNode.JoinType == "all" {
+		fmt.Println("The process can not be returned from a join node - " + processId)
+		return shim.Error("The process can not be returned from a join node - " + processId)
+	}
+
+	// check submitter's role of current node
+	err = CheckSubmitterRole(stub, currentNode.AccessRoles)
 	if err != nil {
 		fmt.Println(err.Error())
+		return shim.Error(err.Error())
 	}
 
-	if logs == nil {
+	// 根据流转日志对流程进行回退
+	ownerOrgName := process.CurrentOwner
+	targetLog, found, err := GetLatestTransferLog(stub, processId, ownerOrgName, currentNode.Id)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	if !found {
 		fmt.Println("Can not find process logs to return -" + processId)
 		return shim.Error("Can not find process logs to return -" + processId)
 	}
 
-	targetLog := logs[0]
-	idPrefix := "processLog-" + processId + "-"
-	logId, _ := strconv.Atoi(strings.TrimPrefix(targetLog.Id, idPrefix))
-	if len(logs) > 1 {
-		for i := 1; i < len(logs); i++ {
-			newLogId, _ := strconv.Atoi(strings.TrimPrefix(logs[i].Id, idPrefix))
-			if newLogId > logId {
-				targetLog = logs[i]
-				logId = newLogId
-			}
-		}
+	// 退回到会签节点时重新会签
+	targetNode, err := GetWorkflowNodeById(stub, targetLog.FromNodeId)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
 	// store process
 	process.CurrentNodeId = targetLog.FromNodeId
 	process.CurrentNodeName = targetLog.FromNodeName
 	process.CurrentOwner = targetLog.FromOrg
+	process.Assignee = ""
+	process.PendingApprovers = GetPendingApprovers(targetNode)
+	process.ApprovedOrgs = nil
+	process.DueTime = GetNodeDueTime(targetNode, txTime)
+	process.SubProcessId = ""
+	process.Blocked = false
 	process.LastModifier = submitter
 	process.ModifyTime = modifyTime
+	process.BusinessDate = businessDate
 
-	processAsBytes, _ := json.Marshal(process)
-	err = stub.PutState(process.Id, processAsBytes) //store with id as key
+	// 退回到子流程节点时重新启动子流程
+	err = StartSubProcesses(stub, &process, submitter, businessDate)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	err = PutProcess(stub, process)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	// store log
-	err = StoreProcessLog(stub, false, processId, currentNode.Id, currentNode.NodeName, submitterOrgName, process.CurrentNodeId, process.CurrentNodeName, process.CurrentOwner, "ReturnProcess", "", modifyTime)
+	err = SaveProcessLog(stub, false, ProcessLog{
+		ProcessId:    processId,
+		FromNodeId:   currentNode.Id,
+		FromNodeName: currentNode.NodeName,
+		FromOrg:      ownerOrgName,
+		ToNodeId:     process.CurrentNodeId,
+		ToNodeName:   process.CurrentNodeName,
+		ToOrg:        process.CurrentOwner,
+		Operation:    "ReturnProcess",
+		Remark:       remark,
+		FormData:     data,
+		BusinessDate: businessDate,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	fmt.Println("- end return_process")
 	return shim.Success(nil)
@@ -540,7 +1329,15 @@ func withdraw_process(stub shim.ChaincodeStubInterface, args []string) pb.Respon
 	}
 
 	processId := args[0]
-	modifyTime := args[1]
+	businessDate := args[1]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	//check if process already exists
 	process, err := GetProcessById(stub, processId)
@@ -556,6 +1353,22 @@ func withdraw_process(stub shim.ChaincodeStubInterface, args []string) pb.Respon
 
 	// TODO 添加其他检查条件
 
+	if len(process.Branches) > 0 {
+		fmt.Println("The process has parallel branches - " + processId)
+		return shim.Error("The process has parallel branches - " + processId)
+	}
+
+	if process.Blocked {
+		fmt.Println("This process is waiting for the sub process - " + process.SubProcessId)
+		return shim.Error("This process is waiting for the sub process - " + process.SubProcessId)
+	}
+
+	// 子流程办结后父流程已继续流转
+	if process.Finished && process.ParentProcessId != "" {
+		fmt.Println("The finished sub process can not be withdrawed - " + processId)
+		return shim.Error("The finished sub process can not be withdrawed - " + processId)
+	}
+
 	// get current node
 	currentNode, err := GetWorkflowNodeById(stub, process.CurrentNodeId)
 	if err != nil {
@@ -567,51 +1380,40 @@ func withdraw_process(stub shim.ChaincodeStubInterface, args []string) pb.Respon
 		return shim.Error("The process can not be withdrawed again - " + processId)
 	}
 
-	// 根据流转日志对流程进行回退
-	var queryBuffer bytes.Buffer
-	queryBuffer.WriteString(`{"selector":{"docType":"processLog","processId":"`)
-	queryBuffer.WriteString(processId)
-	queryBuffer.WriteString(`","operation":"TransferProcess","toOrg":"`)
-	queryBuffer.WriteString(process.CurrentOwner)
-	queryBuffer.WriteString(`","toNodeId":"`)
-	queryBuffer.WriteString(currentNode.Id)
-	queryBuffer.WriteString(`"}}`)
-	resultAsBytes, err := GetQueryResult(stub, queryBuffer.String())
-	if err != nil {
-		fmt.Println(err.Error())
-		return shim.Error(err.Error())
+	if currentNode.JoinType == "all" {
+		fmt.Println("The process can not be withdrawed from a join node - " + processId)
+		return shim.Error("The process can not be withdrawed from a join node - " + processId)
 	}
 
-	var logs []ProcessLog
-	err = json.Unmarshal(resultAsBytes, &logs) //un stringify it aka JSON.parse()
+	// 根据流转日志对流程进行回退
+	targetLog, found, err := GetLatestTransferLog(stub, processId, process.CurrentOwner, currentNode.Id)
 	if err != nil {
 		fmt.Println(err.Error())
+		return shim.Error(err.Error())
 	}
 
-	if logs == nil {
+	if !found {
 		fmt.Println("Can not find process logs to return -" + processId)
 		return shim.Error("Can not find process logs to return -" + processId)
 	}
 
-	targetLog := logs[0]
-	idPrefix := "processLog-" + processId + "-"
-	logId, _ := strconv.Atoi(strings.TrimPrefix(targetLog.Id, idPrefix))
-	if len(logs) > 1 {
-		for i := 1; i < len(logs); i++ {
-			newLogId, _ := strconv.Atoi(strings.TrimPrefix(logs[i].Id, idPrefix))
-			if newLogId > logId {
-				targetLog = logs[i]
-				logId = newLogId
-			}
-		}
-	}
-
 	// check if submitter's org can withdraw the process
 	if targetLog.FromOrg != submitterOrgName {
 		fmt.Println("You are not allowed to withdraw the process - " + submitterOrgName)
 		return shim.Error("You are not allowed to withdraw the process - " + submitterOrgName)
 	}
 
+	// check submitter's role of the node to withdraw to
+	targetNode, err := GetWorkflowNodeById(stub, targetLog.FromNodeId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = CheckSubmitterRole(stub, targetNode.AccessRoles)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
 	// store process
 	if process.Finished {
 		process.Finished = false
@@ -619,17 +1421,33 @@ func withdraw_process(stub shim.ChaincodeStubInterface, args []string) pb.Respon
 	process.CurrentNodeId = targetLog.FromNodeId
 	process.CurrentNodeName = targetLog.FromNodeName
 	process.CurrentOwner = submitterOrgName
+	process.Assignee = ""
+	process.PendingApprovers = GetPendingApprovers(targetNode)
+	process.ApprovedOrgs = nil
+	process.DueTime = GetNodeDueTime(targetNode, txTime)
+	process.SubProcessId = ""
+	process.Blocked = false
 	process.LastModifier = submitter
 	process.ModifyTime = modifyTime
+	process.BusinessDate = businessDate
 
-	processAsBytes, _ := json.Marshal(process)
-	err = stub.PutState(process.Id, processAsBytes) //store with id as key
+	// 撤回到子流程节点时重新启动子流程
+	err = StartSubProcesses(stub, &process, submitter, businessDate)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	err = PutProcess(stub, process)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	// store log
-	err = StoreProcessLog(stub, false, processId, currentNode.Id, currentNode.NodeName, targetLog.ToOrg, process.CurrentNodeId, process.CurrentNodeName, process.CurrentOwner, "WithdrawProcess", "", modifyTime)
+	err = StoreProcessLog(stub, false, processId, currentNode.Id, currentNode.NodeName, targetLog.ToOrg, process.CurrentNodeId, process.CurrentNodeName, process.CurrentOwner, "WithdrawProcess", "", businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	fmt.Println("- end withdraw_process")
 	return shim.Success(nil)
@@ -658,7 +1476,11 @@ func cancel_process(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	}
 
 	processId := args[0]
-	modifyTime := args[1]
+	businessDate := args[1]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	//check if process already exists
 	process, err := GetProcessById(stub, processId)
@@ -690,24 +1512,245 @@ func cancel_process(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error("You are not allowed to cancel the process - " + submitterOrgName)
 	}
 
+	// check submitter's role of the workflow
+	workflowDef, err := GetWorkflowDefById(stub, process.WorkflowId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = CheckSubmitterRole(stub, workflowDef.AccessRoles)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
 	// cancel process
 	process.Canceled = true
 	process.LastModifier = submitter
 	process.ModifyTime = modifyTime
+	process.BusinessDate = businessDate
 
-	processAsBytes, _ := json.Marshal(process)
-	err = stub.PutState(process.Id, processAsBytes) //store with id as key
+	err = PutProcess(stub, process)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 同时取消正在运行的子流程
+	err = CancelSubProcesses(stub, process, "", submitter, modifyTime, businessDate)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
 	// store logs
-	err = StoreProcessLog(stub, false, processId, process.CurrentNodeId, process.CurrentNodeName, process.CurrentOwner, "Canceled", "取消", "", "CancelProcess", "", modifyTime)
+	err = StoreProcessLog(stub, false, processId, process.CurrentNodeId, process.CurrentNodeName, process.CurrentOwner, "Canceled", "取消", "", "CancelProcess", "", businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 子流程取消时按子流程节点的设置处理父流程
+	err = CompleteSubProcess(stub, process, submitter, modifyTime, businessDate)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
 
 	fmt.Println("- end cancel_process")
 	return shim.Success(nil)
 }
 
+// =============================================================================
+// 迁移流程到工作流的新版本
+// 参数：流程ID、目标版本ID、节点映射（JSON对象，当前节点ID -> 目标版本节点ID）、业务日期
+// 只有工作流创建机构可以迁移，并行流程的每个分支节点都需要映射
+// =============================================================================
+func migrate_process(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	var nodeMapping map[string]string
+	fmt.Println("starting migrate_process")
+
+	if len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 4")
+	}
+
+	processId := args[0]
+	targetWorkflowId := args[1]
+	err = json.Unmarshal([]byte(args[2]), &nodeMapping)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	businessDate := args[3]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	process, err := GetProcessById(stub, processId)
+	if err != nil {
+		fmt.Println("This process does not exists - " + processId)
+		return shim.Error("This process does not exists - " + processId)
+	}
+	if process.Canceled {
+		fmt.Println("This process has been canceled - " + processId)
+		return shim.Error("This process has been canceled - " + processId)
+	}
+	if process.Finished {
+		fmt.Println("This process has been finished - " + processId)
+		return shim.Error("This process has been finished - " + processId)
+	}
+
+	// 目标版本必须是同一工作流的更高版本且已启用
+	workflowDef, err := GetWorkflowDefById(stub, process.WorkflowId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	targetDef, err := GetWorkflowDefById(stub, targetWorkflowId)
+	if err != nil {
+		fmt.Println("Workflow does not exist - " + targetWorkflowId)
+		return shim.Error("Workflow does not exist - " + targetWorkflowId)
+	}
+	if targetDef.BaseId != workflowDef.BaseId || targetDef.Version <= workflowDef.Version {
+		fmt.Println("Target workflow is not a newer version - " + targetWorkflowId)
+		return shim.Error("Target workflow is not a newer version - " + targetWorkflowId)
+	}
+	if !targetDef.Enabled {
+		fmt.Println("Workflow is disabled - " + targetWorkflowId)
+		return shim.Error("Workflow is disabled - " + targetWorkflowId)
+	}
+
+	// check if submitter's org is workflow creator's org
+	creatorOrgName, err := GetOrgFromCertCommonName(targetDef.Creator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if submitterOrgName != creatorOrgName {
+		fmt.Println("You are not allowed to migrate the process - " + submitterOrgName)
+		return shim.Error("You are not allowed to migrate the process - " + submitterOrgName)
+	}
+
+	// 等待子流程时不能迁移
+	for _, branch := range GetProcessBranches(process) {
+		if branch.Blocked {
+			fmt.Println("This process is waiting for the sub process - " + branch.SubProcessId)
+			return shim.Error("This process is waiting for the sub process - " + branch.SubProcessId)
+		}
+	}
+
+	// 按映射替换各分支的当前节点
+	fromNodeId := process.CurrentNodeId
+	fromNodeName := process.CurrentNodeName
+	branches := GetProcessBranches(process)
+	var targetNodeIds []string
+	for i := range branches {
+		targetNodeId, ok := nodeMapping[branches[i].NodeId]
+		if !ok {
+			fmt.Println("Node mapping is missing - " + branches[i].NodeId)
+			return shim.Error("Node mapping is missing - " + branches[i].NodeId)
+		}
+		if ContainsString(targetNodeIds, targetNodeId) {
+			fmt.Println("Duplicate target node - " + targetNodeId)
+			return shim.Error("Duplicate target node - " + targetNodeId)
+		}
+		targetNode, err := GetWorkflowNodeById(stub, targetNodeId)
+		if err != nil || targetNode.WorkflowId != targetDef.Id {
+			fmt.Println("Target node does not belong to the workflow - " + targetNodeId)
+			return shim.Error("Target node does not belong to the workflow - " + targetNodeId)
+		}
+		targetNodeIds = append(targetNodeIds, targetNodeId)
+		branches[i].NodeId = targetNode.Id
+		branches[i].NodeName = targetNode.NodeName
+		branches[i].PendingApprovers = GetPendingApprovers(targetNode)
+		branches[i].ApprovedOrgs = nil
+		if !branches[i].Waiting {
+			branches[i].DueTime = GetNodeDueTime(targetNode, txTime)
+		}
+	}
+	SetProcessBranches(&process, branches)
+
+	// 记录全部节点的映射，退回和撤回时据此解析迁移前的日志
+	logMapping, err := CompleteNodeMapping(stub, workflowDef.Id, targetDef.Id, nodeMapping)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	process.WorkflowId = targetDef.Id
+	process.WorkflowVersion = targetDef.Version
+	process.WorkflowName = targetDef.WorkflowName
+	process.LastModifier = submitter
+	process.ModifyTime = modifyTime
+	process.BusinessDate = businessDate
+
+	err = PutProcess(stub, process)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// store logs
+	remark := workflowDef.Id + " -> " + targetDef.Id
+	err = SaveProcessLog(stub, false, ProcessLog{
+		ProcessId:    processId,
+		FromNodeId:   fromNodeId,
+		FromNodeName: fromNodeName,
+		FromOrg:      submitterOrgName,
+		ToNodeId:     process.CurrentNodeId,
+		ToNodeName:   process.CurrentNodeName,
+		ToOrg:        process.CurrentOwner,
+		Operation:    "MigrateProcess",
+		NodeMapping:  logMapping,
+		Remark:       remark,
+		BusinessDate: businessDate,
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end migrate_process")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 补全迁移的节点映射，传入的映射必须指向目标版本的节点，
+// 未指定的节点按节点ID的后缀对应到目标版本中的同名节点，没有同名节点时不映射
+// =============================================================================
+func CompleteNodeMapping(stub shim.ChaincodeStubInterface, fromWorkflowId string, toWorkflowId string, nodeMapping map[string]string) (map[string]string, error) {
+	result := map[string]string{}
+	for fromNodeId, toNodeId := range nodeMapping {
+		toNode, err := GetWorkflowNodeById(stub, toNodeId)
+		if err != nil || toNode.WorkflowId != toWorkflowId {
+			return nil, errors.New("Target node does not belong to the workflow - " + toNodeId)
+		}
+		result[fromNodeId] = toNodeId
+	}
+
+	fromNodes, _, err := GetAllNodesByWorkflowId(stub, fromWorkflowId)
+	if err != nil {
+		return nil, err
+	}
+	for _, fromNode := range fromNodes {
+		if _, ok := result[fromNode.Id]; ok {
+			continue
+		}
+		toNode, err := GetWorkflowNodeById(stub, toWorkflowId+strings.TrimPrefix(fromNode.Id, fromWorkflowId))
+		if err == nil && toNode.WorkflowId == toWorkflowId {
+			result[fromNode.Id] = toNode.Id
+		}
+	}
+	return result, nil
+}
+
 // =============================================================================
 // 查询待办流程
 // =============================================================================
@@ -716,21 +1759,23 @@ func query_todo_process(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 	var err error
 	fmt.Println("starting query_todo_process")
 
-	/* 暂时无法处理分页条件
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
-	}
-	*/
-	if len(args) != 0 {
-		return shim.Error("Incorrect number of arguments. Expecting 0")
+	if len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 3")
 	}
 
-	/*
-		limit, skip, err := SanitizePagingArgument(args[0:2])
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-	*/
+	// 第一个参数可以是认领过滤条件，默认不过滤
+	assigneeFilter := "all"
+	if len(args) > 0 && ContainsString(assigneeFilters, args[0]) {
+		assigneeFilter = args[0]
+		args = args[1:]
+	}
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 2 after the filter")
+	}
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	submitter, err := GetSubmitterName(stub)
 	if err != nil {
@@ -741,21 +1786,35 @@ func query_todo_process(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 		return shim.Error(err.Error())
 	}
 
-	var queryBuffer bytes.Buffer
-	/*
-		queryBuffer.WriteString(`{"selector":{"docType":"process","finished":false,"canceled":false,"currentOwner":"`)
-		queryBuffer.WriteString(submitterOrgName)
-		queryBuffer.WriteString(`"},"limit":`)
-		queryBuffer.WriteString(limit)
-		queryBuffer.WriteString(`,"skip":`)
-		queryBuffer.WriteString(skip)
-		queryBuffer.WriteString(`"}`)
-	*/
-	queryBuffer.WriteString(`{"selector":{"docType":"process","finished":false,"canceled":false,"currentOwner":"`)
-	queryBuffer.WriteString(submitterOrgName)
-	queryBuffer.WriteString(`"}}`)
+	// 委托给提交机构的代理委托，委托机构的待办也一并查询
+	delegations, err := GetActiveDelegations(stub, submitterOrgName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	orgNames := append([]string{submitterOrgName}, GetDelegatingOrgs(delegations, "")...)
+
+	roles, err := GetSubmitterRoles(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	result, err = GetQueryResult(stub, queryBuffer.String())
+	// 并行状态下按分支的拥有人查询，过滤掉提交者角色无法处理的流程，不足一页时继续查询
+	result, metadata, err := GetFilteredQueryResultByPage(stub, GetTodoProcessQuery(orgNames...), pageSize, bookmark, func(records []byte) ([]byte, error) {
+		var processes []Process
+		err := json.Unmarshal(records, &processes)
+		if err != nil {
+			return nil, err
+		}
+		processes, err = FilterProcessesByRoles(stub, processes, submitterOrgName, delegations, roles)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(FilterProcessesByAssignee(processes, submitter, orgNames, assigneeFilter))
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, err = MarshalPageResult(result, metadata)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -765,6 +1824,20 @@ func query_todo_process(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 	return shim.Success(result)
 }
 
+// 机构待办流程的查询语句，包括当前节点、并行分支和待会签的待办
+// 传入多个机构时查询其中任一机构的待办
+func GetTodoProcessQuery(orgNames ...string) *Query {
+	query := NewQuery("process").Eq("finished", false).Eq("canceled", false).Or(
+		Selector{"currentOwner": Selector{"$in": orgNames}},
+		Selector{}.ElemMatch("branches", Selector{"owner": Selector{"$in": orgNames}, "waiting": false}),
+		Selector{}.ElemMatch("pendingApprovers", Selector{"$in": orgNames}),
+	).UseIndex("indexTodoProcess")
+	for _, orgName := range orgNames {
+		query.ScanIndex(ProcessOwnerIndex, orgName)
+	}
+	return query
+}
+
 // =============================================================================
 // 查询已办流程
 // =============================================================================
@@ -773,21 +1846,14 @@ func query_done_process(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 	var err error
 	fmt.Println("starting query_done_process")
 
-	/* 暂时无法处理分页条件
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
-	}
-	*/
-	if len(args) != 0 {
-		return shim.Error("Incorrect number of arguments. Expecting 0")
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 2")
 	}
 
-	/*
-		limit, skip, err := SanitizePagingArgument(args[0:2])
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-	*/
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	submitter, err := GetSubmitterName(stub)
 	if err != nil {
@@ -798,21 +1864,7 @@ func query_done_process(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 		return shim.Error(err.Error())
 	}
 
-	var queryBuffer bytes.Buffer
-	/*
-		queryBuffer.WriteString(`{"selector":{"docType":"process","participants":{"$elemMatch":{"$eq":"`)
-		queryBuffer.WriteString(submitterOrgName)
-		queryBuffer.WriteString(`"}}},"limit":`)
-		queryBuffer.WriteString(limit)
-		queryBuffer.WriteString(`,"skip":`)
-		queryBuffer.WriteString(skip)
-		queryBuffer.WriteString(`}`)
-	*/
-	queryBuffer.WriteString(`{"selector":{"docType":"process","participants":{"$elemMatch":{"$eq":"`)
-	queryBuffer.WriteString(submitterOrgName)
-	queryBuffer.WriteString(`"}}}}`)
-
-	result, err = GetQueryResult(stub, queryBuffer.String())
+	result, err = GetPagingQueryResult(stub, GetDoneProcessQuery(submitterOrgName), pageSize, bookmark)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -821,3 +1873,53 @@ func query_done_process(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 
 	return shim.Success(result)
 }
+
+// 机构参与过的流程的查询语句
+func GetDoneProcessQuery(orgName string) *Query {
+	return NewQuery("process").ElemMatch("participants", Selector{"$eq": orgName}).
+		UseIndex("indexDoneProcess").ScanIndex(ProcessParticipantIndex, orgName)
+}
+
+// =============================================================================
+// 按角色过滤待办流程，保留机构拥有或待机构会签、且角色满足节点要求的流程
+// 代理的流程需要在委托的工作流范围内
+// =============================================================================
+func FilterProcessesByRoles(stub shim.ChaincodeStubInterface, processes []Process, orgName string, delegations []Delegation, roles []string) ([]Process, error) {
+	results := []Process{}
+	nodes := map[string]WorkflowNode{}
+	baseIds := map[string]string{}
+	for _, process := range processes {
+		orgNames := []string{orgName}
+		if len(delegations) > 0 {
+			baseId, cached := baseIds[process.WorkflowId]
+			if !cached {
+				workflowDef, err := GetWorkflowDefById(stub, process.WorkflowId)
+				if err != nil {
+					return nil, err
+				}
+				baseId = workflowDef.BaseId
+				baseIds[process.WorkflowId] = baseId
+			}
+			orgNames = append(orgNames, GetDelegatingOrgs(delegations, baseId)...)
+		}
+		for _, branch := range GetProcessBranches(process) {
+			if branch.Waiting || branch.Blocked || !(ContainsString(orgNames, branch.Owner) || ContainsAnyString(branch.PendingApprovers, orgNames)) {
+				continue
+			}
+			node, cached := nodes[branch.NodeId]
+			if !cached {
+				var err error
+				node, err = GetWorkflowNodeById(stub, branch.NodeId)
+				if err != nil {
+					return nil, err
+				}
+				nodes[branch.NodeId] = node
+			}
+			if HasAccessRole(node.AccessRoles, roles) {
+				results = append(results, process)
+				break
+			}
+		}
+	}
+	return results, nil
+}
@@ -27,10 +27,12 @@ type Project struct {
 	Underwriter        string `json:"underwriter"`        // 承销商/薄记管理人机构
 	Lawyer             string `json:"lawyer"`             // 律师
 	Accountant         string `json:"accountant"`         // 会计师
+	ApprovalWorkflowId string `json:"approvalWorkflowId"` // 指定的发行审批工作流ID，发行债券时只认可该工作流的流程
 	Creator            string `json:"creator"`            // 创建人
 	LastModifier       string `json:"lastModifier"`       // 最后修改人
 	CreateTime         string `json:"createTime"`         // 创建时间
 	ModifyTime         string `json:"modifyTime"`         // 修改时间
+	BusinessDate       string `json:"businessDate"`       // 业务日期，客户端传入
 }
 
 // =============================================================================
@@ -64,10 +66,24 @@ func create_project(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error("This project already exists - " + project.Id)
 	}
 
+	// 客户端传入的创建时间作为业务日期
+	if project.BusinessDate == "" {
+		project.BusinessDate = project.CreateTime
+	}
+	err = CheckBusinessDate(project.BusinessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	createTime, err := GetTxTimeString(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	project.DocType = "project"
 	project.Creator = creator
 	project.LastModifier = creator
-	project.ModifyTime = project.CreateTime
+	project.CreateTime = createTime
+	project.ModifyTime = createTime
 
 	fmt.Println(project)
 
@@ -78,6 +94,10 @@ func create_project(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	err = PutIndex(stub, DocTypeIndex, "project", project.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	fmt.Println("- end create_project")
 	return shim.Success(nil)
@@ -108,6 +128,44 @@ func get_project_by_id(stub shim.ChaincodeStubInterface, args []string) pb.Respo
 	return shim.Success(projectAsBytes)
 }
 
+// =============================================================================
+// 判断机构是否可见项目
+// 创建机构、担任项目角色的机构以及附加在项目上的流程实例的参与机构可见
+// =============================================================================
+func CanOrgSeeProject(stub shim.ChaincodeStubInterface, project Project, orgName string) (bool, error) {
+	creatorOrgName, _ := GetOrgFromCertCommonName(project.Creator)
+	if creatorOrgName == orgName {
+		return true, nil
+	}
+	roleOrgs := []string{project.Initiator, project.Trustee, project.Depositary, project.Agent, project.AssetService,
+		project.Assessor, project.CreditRater, project.LiquiditySupporter, project.Underwriter, project.Lawyer, project.Accountant}
+	if ContainsString(roleOrgs, orgName) {
+		return true, nil
+	}
+
+	resultAsBytes, err := ExecuteQuery(stub, GetProcessesQueryByAttachDoc("project", project.Id))
+	if err != nil {
+		return false, err
+	}
+	var processes []Process
+	err = json.Unmarshal(resultAsBytes, &processes)
+	if err != nil {
+		return false, err
+	}
+	for _, process := range processes {
+		if CanOrgSeeProcess(process, orgName) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 挂接在文档上的流程实例的查询语句
+func GetProcessesQueryByAttachDoc(attachDocType string, attachDocId string) *Query {
+	return NewQuery("process").Eq("attachDocType", attachDocType).Eq("attachDocId", attachDocId).
+		UseIndex("indexProcessAttach").ScanIndex(ProcessAttachIndex, attachDocType, attachDocId)
+}
+
 // =============================================================================
 // Get Project By id
 // =============================================================================
@@ -133,8 +191,18 @@ func query_all_projects(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 	var err error
 	fmt.Println("starting query_all_projects")
 
-	if len(args) != 0 {
-		return shim.Error("Incorrect number of arguments. Expecting 0")
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 2")
+	}
+
+	// 传入分页参数时按书签分页
+	if len(args) > 0 {
+		result, err := GetPagingObjectsByDocType(stub, args, "project")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		fmt.Println("end query_all_projects")
+		return shim.Success(result)
 	}
 
 	result, err := GetAllObjectsByDocType(stub, args, "project")
@@ -153,8 +221,8 @@ func query_paging_projects(stub shim.ChaincodeStubInterface, args []string) pb.R
 	var err error
 	fmt.Println("starting query_paging_projects")
 
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
 	}
 
 	result, err := GetPagingObjectsByDocType(stub, args, "project")
@@ -198,6 +266,10 @@ func remove_project(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	err = DelIndex(stub, DocTypeIndex, "project", id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	fmt.Println("end remove_project")
 	return shim.Success(nil)
 }
@@ -218,7 +290,11 @@ func modify_project(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	}
 
 	id := args[0]
-	modifyTime := args[1]
+	businessDate := args[1]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	submitter, err := GetSubmitterName(stub)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -233,6 +309,14 @@ func modify_project(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	for i := 2; i < len(args); i = i + 2 {
 		key := args[i]
 		value := args[i+1]
+		// 发行审批工作流只能由创建人机构指定一次
+		if key == "approvalWorkflowId" {
+			err = CheckApprovalWorkflowModifiable(project, submitter)
+			if err != nil {
+				fmt.Println(err.Error())
+				return shim.Error(err.Error())
+			}
+		}
 		err = UpdateStruct(&project, key, value)
 		if err != nil {
 			return shim.Error(err.Error())
@@ -242,6 +326,7 @@ func modify_project(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	// append Modifiers
 	project.LastModifier = submitter
 	project.ModifyTime = modifyTime
+	project.BusinessDate = businessDate
 
 	//store project
 	projectAsBytes, _ := json.Marshal(project)
@@ -253,3 +338,24 @@ func modify_project(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	fmt.Println("end modify_project")
 	return shim.Success(nil)
 }
+
+// =============================================================================
+// 检查能否指定项目的发行审批工作流：只能由创建人机构在未指定时设置
+// =============================================================================
+func CheckApprovalWorkflowModifiable(project Project, submitter string) error {
+	if project.ApprovalWorkflowId != "" {
+		return errors.New("Approval workflow of the project has been designated - " + project.Id)
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return err
+	}
+	creatorOrgName, err := GetOrgFromCertCommonName(project.Creator)
+	if err != nil {
+		return err
+	}
+	if submitterOrgName != creatorOrgName {
+		return errors.New("Only the creator's org can designate the approval workflow - " + submitterOrgName)
+	}
+	return nil
+}
@@ -22,7 +22,7 @@ func MockCreateProject1(t *testing.T, stub *shim.MockStub) pb.Response {
 func MockCreateProject2(t *testing.T, stub *shim.MockStub) pb.Response {
 	response := stub.MockInvoke(GetTestTxID(), [][]byte{
 		[]byte("create_project"), 
-		[]byte(`{"id":"project-bankcomm-000002","projectName":"测试交行项目000002号","scale":"500万元人民币","basicAssets":"个人按揭贷款","initiator":"交通银行","trustee":"交银国信","depositary":"兴业银行","agent":"中债登","assetService":"上海融孚律师事务所","assessor":"深圳市世联资产评估有限公司","creditRater":"中债资信","liquiditySupporter":"中证信用增进股份有限公司","underwriter":"招商证券","lawyer":"北京市金杜律师事务所","accountant":"普华永道","createTime":"2018-3-16 09:03:45"}`),
+		[]byte(`{"id":"project-bankcomm-000002","projectName":"测试交行项目000002号","scale":"500万元人民币","basicAssets":"个人按揭贷款","initiator":"交通银行","trustee":"交银国信","depositary":"兴业银行","agent":"中债登","assetService":"上海融孚律师事务所","assessor":"深圳市世联资产评估有限公司","creditRater":"中债资信","liquiditySupporter":"中证信用增进股份有限公司","underwriter":"招商证券","lawyer":"北京市金杜律师事务所","accountant":"普华永道","approvalWorkflowId":"test_linear_workflow-001","createTime":"2018-3-16 09:03:45"}`),
 	})
 	return response
 }
@@ -107,7 +107,7 @@ func Test_GetProjectById(t *testing.T) {
 }
 
 func Test_QueryAllProject(t *testing.T) {
-	// 由于mock引擎还没有实现GetQueryResult，测试将直接失败
+	// mock引擎不支持富查询，按复合键索引查询
 	stub := GetMockStub()
 	MockInit(t, stub)
 	MockCreateProject1(t, stub)
@@ -115,13 +115,13 @@ func Test_QueryAllProject(t *testing.T) {
 	response := MockQueryAllProject(t, stub)
 	if response.Status != shim.OK {
 		fmt.Println(response.GetMessage())
-		// t.FailNow()
+		t.FailNow()
 	}
     var result []interface{}
 	json.Unmarshal(response.Payload, &result)
 	if len(result) != 2 {
 		fmt.Println("应有2条")
-		// t.FailNow()
+		t.FailNow()
 	}
 }
 
@@ -157,7 +157,12 @@ func Test_ModifyProject(t *testing.T) {
 	}
 	var result Project
 	json.Unmarshal(response.Payload, &result)
-	if result.ModifyTime != "2018-03-16 15:54:00" {
+	if result.BusinessDate != "2018-03-16 15:54:00" {
+		fmt.Println("BusinessDate is incorrect")
+		t.FailNow()
+	}
+	// 修改时间为交易时间，晚于创建时间
+	if result.ModifyTime < result.CreateTime {
 		fmt.Println("ModifyTime is incorrect")
 		t.FailNow()
 	}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ----- Selector ----- //
+// CouchDB 查询条件，字段名到值或操作符条件的映射
+// 值统一由json序列化，id、机构名中的引号等特殊字符不会改变查询结构
+type Selector map[string]interface{}
+
+// Eq 字段等于指定值
+func (s Selector) Eq(field string, value interface{}) Selector {
+	return s.Where(field, "$eq", value)
+}
+
+// Where 字段满足操作符条件，如 $gt、$in，同一字段的多个操作符合并在一起
+func (s Selector) Where(field string, operator string, value interface{}) Selector {
+	existing, ok := s[field]
+	if !ok {
+		if operator == "$eq" {
+			s[field] = value
+		} else {
+			s[field] = Selector{operator: value}
+		}
+		return s
+	}
+	condition, ok := existing.(Selector)
+	if !ok {
+		condition = Selector{"$eq": existing}
+	}
+	condition[operator] = value
+	s[field] = condition
+	return s
+}
+
+// ElemMatch 数组字段中存在满足条件的元素
+func (s Selector) ElemMatch(field string, elem Selector) Selector {
+	return s.Where(field, "$elemMatch", elem)
+}
+
+// Or 满足任一条件
+func (s Selector) Or(selectors ...Selector) Selector {
+	s["$or"] = selectors
+	return s
+}
+
+// ----- Query ----- //
+// CouchDB 查询语句
+type Query struct {
+	Selector Selector            `json:"selector"`
+	Sort     []map[string]string `json:"sort,omitempty"`
+	Index    []string            `json:"use_index,omitempty"`
+
+	// 不支持富查询时用于范围查询的复合键索引及前缀
+	indexName  string
+	indexScans [][]string
+}
+
+// NewQuery 按docType查询
+func NewQuery(docType string) *Query {
+	return &Query{Selector: Selector{"docType": docType}}
+}
+
+// Eq 字段等于指定值
+func (q *Query) Eq(field string, value interface{}) *Query {
+	q.Selector.Eq(field, value)
+	return q
+}
+
+// Where 字段满足操作符条件
+func (q *Query) Where(field string, operator string, value interface{}) *Query {
+	q.Selector.Where(field, operator, value)
+	return q
+}
+
+// ElemMatch 数组字段中存在满足条件的元素
+func (q *Query) ElemMatch(field string, elem Selector) *Query {
+	q.Selector.ElemMatch(field, elem)
+	return q
+}
+
+// Or 满足任一条件
+func (q *Query) Or(selectors ...Selector) *Query {
+	q.Selector.Or(selectors...)
+	return q
+}
+
+// SortBy 按字段排序，direction为asc或desc
+func (q *Query) SortBy(field string, direction string) *Query {
+	q.Sort = append(q.Sort, map[string]string{field: direction})
+	return q
+}
+
+// UseIndex 指定查询使用的索引，ddoc和索引名相同
+func (q *Query) UseIndex(ddoc string) *Query {
+	q.Index = []string{"_design/" + ddoc, ddoc}
+	return q
+}
+
+// ScanIndex 指定状态库不支持富查询时使用的复合键索引，keys为索引前缀
+// 多次调用时按各前缀分别范围查询并合并结果，索引名以最后一次为准
+func (q *Query) ScanIndex(indexName string, keys ...string) *Query {
+	q.indexName = indexName
+	q.indexScans = append(q.indexScans, keys)
+	return q
+}
+
+// String 序列化为查询字符串
+func (q *Query) String() string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(q)
+	return strings.TrimSpace(buffer.String())
+}
+
+// ----- RichQueryRequest ----- //
+// 通用富查询请求
+type RichQueryRequest struct {
+	DocType    string           `json:"docType"`
+	Conditions []QueryCondition `json:"conditions"` // 全部条件同时满足
+	Sort       []QuerySort      `json:"sort"`
+}
+
+// ----- QueryCondition ----- //
+type QueryCondition struct {
+	Field    string      `json:"field"`
+	Operator string      `json:"operator"`
+	Value    interface{} `json:"value"`
+}
+
+// ----- QuerySort ----- //
+type QuerySort struct {
+	Field     string `json:"field"`
+	Direction string `json:"direction"` // asc或desc
+}
+
+// 通用富查询允许的字段，按docType配置
+var RichQueryFields = map[string][]string{
+	"project": {"id", "projectName", "initiator", "trustee", "depositary", "agent", "assetService", "assessor",
+		"creditRater", "liquiditySupporter", "underwriter", "lawyer", "accountant", "creator", "lastModifier", "createTime", "modifyTime"},
+	"process": {"id", "attachDocType", "attachDocId", "workflowId", "currentNodeId", "currentOwner", "participants",
+		"finished", "canceled", "creator", "lastModifier", "createTime", "modifyTime"},
+	"processLog": {"id", "processId", "fromNodeId", "fromOrg", "toNodeId", "toOrg", "operation", "createTime"},
+}
+
+// 通用富查询允许的排序字段及使用的索引，CouchDB排序要求索引包含排序字段
+var RichQuerySortIndexes = map[string]string{
+	"createTime": "indexDocTypeCreateTime",
+	"modifyTime": "indexDocTypeModifyTime",
+}
+
+// 通用富查询允许的操作符
+var RichQueryOperators = []string{"$eq", "$ne", "$gt", "$gte", "$lt", "$lte", "$in", "$nin", "$all", "$exists"}
+
+// ========================================================
+// 校验通用富查询请求并生成查询语句
+// ========================================================
+func BuildRichQuery(request RichQueryRequest) (*Query, error) {
+	fields, ok := RichQueryFields[request.DocType]
+	if !ok {
+		return nil, errors.New("DocType is not queryable - " + request.DocType)
+	}
+	if len(request.Conditions) == 0 {
+		return nil, errors.New("At least one condition is required")
+	}
+
+	query := NewQuery(request.DocType).ScanIndex(DocTypeIndex, request.DocType)
+	for _, condition := range request.Conditions {
+		if !ContainsString(fields, condition.Field) {
+			return nil, errors.New("Field is not queryable - " + condition.Field)
+		}
+		if !ContainsString(RichQueryOperators, condition.Operator) {
+			return nil, errors.New("Operator is not supported - " + condition.Operator)
+		}
+		switch value := condition.Value.(type) {
+		case []interface{}:
+			if condition.Operator != "$in" && condition.Operator != "$nin" && condition.Operator != "$all" {
+				return nil, errors.New("Operator does not accept an array - " + condition.Operator)
+			}
+			for _, item := range value {
+				if !isScalarQueryValue(item) {
+					return nil, errors.New("Array value must contain scalars - " + condition.Field)
+				}
+			}
+		case bool:
+			if condition.Operator == "$in" || condition.Operator == "$nin" || condition.Operator == "$all" {
+				return nil, errors.New("Operator requires an array - " + condition.Operator)
+			}
+		default:
+			if condition.Operator == "$in" || condition.Operator == "$nin" || condition.Operator == "$all" {
+				return nil, errors.New("Operator requires an array - " + condition.Operator)
+			}
+			if condition.Operator == "$exists" || !isScalarQueryValue(value) {
+				return nil, errors.New("Invalid value for field - " + condition.Field)
+			}
+		}
+		query.Where(condition.Field, condition.Operator, condition.Value)
+	}
+
+	if len(request.Sort) > 1 {
+		return nil, errors.New("Only one sort field is supported")
+	}
+	index := "indexDocType"
+	for _, sort := range request.Sort {
+		sortIndex, ok := RichQuerySortIndexes[sort.Field]
+		if !ok || !ContainsString(fields, sort.Field) {
+			return nil, errors.New("Field is not sortable - " + sort.Field)
+		}
+		if sort.Direction != "asc" && sort.Direction != "desc" {
+			return nil, errors.New("Sort direction must be asc or desc - " + sort.Direction)
+		}
+		query.SortBy(sort.Field, sort.Direction)
+		index = sortIndex
+	}
+	query.UseIndex(index)
+	return query, nil
+}
+
+// 查询条件的值只能是字符串、数字或布尔值
+func isScalarQueryValue(value interface{}) bool {
+	switch value.(type) {
+	case string, float64, bool:
+		return true
+	}
+	return false
+}
+
+// =============================================================================
+// 通用富查询，按docType白名单中的字段和操作符过滤项目、流程实例和流转日志
+// 只返回提交者机构可见的记录
+// =============================================================================
+func rich_query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting rich_query")
+
+	if len(args) < 1 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 3")
+	}
+
+	var request RichQueryRequest
+	err := json.Unmarshal([]byte(args[0]), &request)
+	if err != nil {
+		return shim.Error("Invalid query request - " + err.Error())
+	}
+	query, err := BuildRichQuery(request)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args[1:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 过滤掉提交者机构不可见的记录，不足一页时继续查询
+	result, metadata, err := GetFilteredQueryResultByPage(stub, query, pageSize, bookmark, func(records []byte) ([]byte, error) {
+		return FilterVisibleRecords(stub, request.DocType, records, submitterOrgName)
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, err = MarshalPageResult(result, metadata)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end rich_query")
+	return shim.Success(result)
+}
+
+// =============================================================================
+// 过滤掉机构不可见的记录，流转日志按其流程实例是否可见判断
+// =============================================================================
+func FilterVisibleRecords(stub shim.ChaincodeStubInterface, docType string, records []byte, orgName string) ([]byte, error) {
+	switch docType {
+	case "project":
+		var projects []Project
+		err := json.Unmarshal(records, &projects)
+		if err != nil {
+			return nil, err
+		}
+		visibleProjects := []Project{}
+		for _, project := range projects {
+			visible, err := CanOrgSeeProject(stub, project, orgName)
+			if err != nil {
+				return nil, err
+			}
+			if visible {
+				visibleProjects = append(visibleProjects, project)
+			}
+		}
+		return json.Marshal(visibleProjects)
+	case "process":
+		var processes []Process
+		err := json.Unmarshal(records, &processes)
+		if err != nil {
+			return nil, err
+		}
+		visibleProcesses := []Process{}
+		for _, process := range processes {
+			if CanOrgSeeProcess(process, orgName) {
+				visibleProcesses = append(visibleProcesses, process)
+			}
+		}
+		return json.Marshal(visibleProcesses)
+	case "processLog":
+		var logs []ProcessLog
+		err := json.Unmarshal(records, &logs)
+		if err != nil {
+			return nil, err
+		}
+		visibleLogs := []ProcessLog{}
+		visibleProcesses := map[string]bool{}
+		for _, log := range logs {
+			visible, checked := visibleProcesses[log.ProcessId]
+			if !checked {
+				process, err := GetProcessById(stub, log.ProcessId)
+				visible = err == nil && CanOrgSeeProcess(process, orgName)
+				visibleProcesses[log.ProcessId] = visible
+			}
+			if visible {
+				visibleLogs = append(visibleLogs, log)
+			}
+		}
+		return json.Marshal(visibleLogs)
+	}
+	return nil, errors.New("DocType is not queryable - " + docType)
+}
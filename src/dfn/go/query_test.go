@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// 测试查询语句生成，特殊字符不能改变查询结构
+func Test_QueryBuilder(t *testing.T) {
+	query := NewQuery("processLog").Eq("processId", `p1","docType":"project`).Eq("operation", "TransferProcess")
+	if query.String() != `{"selector":{"docType":"processLog","operation":"TransferProcess","processId":"p1\",\"docType\":\"project"}}` {
+		fmt.Println("查询语句不正确", query.String())
+		t.FailNow()
+	}
+
+	query = NewQuery("process").Eq("finished", false).Or(
+		Selector{"currentOwner": "@org1.example.com"},
+		Selector{}.ElemMatch("branches", Selector{"owner": "@org1.example.com", "waiting": false}),
+	).SortBy("modifyTime", "desc").UseIndex("indexTodoProcess")
+	if query.String() != `{"selector":{"$or":[{"currentOwner":"@org1.example.com"},{"branches":{"$elemMatch":{"owner":"@org1.example.com","waiting":false}}}],"docType":"process","finished":false},"sort":[{"modifyTime":"desc"}],"use_index":["_design/indexTodoProcess","indexTodoProcess"]}` {
+		fmt.Println("查询语句不正确", query.String())
+		t.FailNow()
+	}
+
+	// 同一字段的多个条件合并
+	query = NewQuery("project").Eq("createTime", "2018").Where("createTime", "$lt", "2019")
+	if query.String() != `{"selector":{"createTime":{"$eq":"2018","$lt":"2019"},"docType":"project"}}` {
+		fmt.Println("同一字段的条件应该合并", query.String())
+		t.FailNow()
+	}
+}
+
+// 测试通用富查询的字段和操作符白名单
+func Test_BuildRichQuery(t *testing.T) {
+	var request RichQueryRequest
+	json.Unmarshal([]byte(`{"docType":"process","conditions":[{"field":"currentOwner","operator":"$eq","value":"@org1.example.com"},{"field":"finished","operator":"$eq","value":false}],"sort":[{"field":"modifyTime","direction":"desc"}]}`), &request)
+	query, err := BuildRichQuery(request)
+	if err != nil || query.String() != `{"selector":{"currentOwner":"@org1.example.com","docType":"process","finished":false},"sort":[{"modifyTime":"desc"}],"use_index":["_design/indexDocTypeModifyTime","indexDocTypeModifyTime"]}` {
+		fmt.Println("富查询语句不正确", err)
+		t.FailNow()
+	}
+
+	invalidRequests := []string{
+		`{"docType":"rsaKey","conditions":[{"field":"id","operator":"$eq","value":"1"}]}`,
+		`{"docType":"process","conditions":[{"field":"branches","operator":"$eq","value":"1"}]}`,
+		`{"docType":"process","conditions":[{"field":"id","operator":"$regex","value":".*"}]}`,
+		`{"docType":"process","conditions":[{"field":"id","operator":"$in","value":"1"}]}`,
+		`{"docType":"process","conditions":[{"field":"id","operator":"$eq","value":{"$gt":null}}]}`,
+		`{"docType":"process","conditions":[{"field":"id","operator":"$eq","value":"1"}],"sort":[{"field":"id","direction":"up"}]}`,
+		`{"docType":"process","conditions":[]}`,
+		`{"docType":"process","conditions":[{"field":"id","operator":"$eq","value":"1"}],"sort":[{"field":"currentOwner","direction":"asc"}]}`,
+		`{"docType":"processLog","conditions":[{"field":"id","operator":"$eq","value":"1"}],"sort":[{"field":"modifyTime","direction":"asc"}]}`,
+		`{"docType":"process","conditions":[{"field":"id","operator":"$eq","value":"1"}],"sort":[{"field":"createTime","direction":"asc"},{"field":"modifyTime","direction":"asc"}]}`,
+	}
+	for _, invalidRequest := range invalidRequests {
+		request = RichQueryRequest{}
+		json.Unmarshal([]byte(invalidRequest), &request)
+		_, err = BuildRichQuery(request)
+		if err == nil {
+			fmt.Println("不允许的查询应该失败", invalidRequest)
+			t.FailNow()
+		}
+	}
+}
+
+// 测试流转日志按流程实例的可见范围过滤
+func Test_FilterVisibleRecords(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateProject2(t, stub)
+	MockRunApprovalProcess(t, stub, true)
+
+	logs := []ProcessLog{
+		{DocType: "processLog", Id: "processLog-test_process_approval:project-bankcomm-000002-1", ProcessId: "test_process_approval:project-bankcomm-000002"},
+		{DocType: "processLog", Id: "processLog-other-1", ProcessId: "other"},
+	}
+	logsAsBytes, _ := json.Marshal(logs)
+	result, err := FilterVisibleRecords(stub, "processLog", logsAsBytes, "@org1.example.com")
+	json.Unmarshal(result, &logs)
+	if err != nil || len(logs) != 1 {
+		fmt.Println("只应返回可见流程的日志", string(result))
+		t.FailNow()
+	}
+	result, _ = FilterVisibleRecords(stub, "processLog", logsAsBytes, "@org2.example.com")
+	json.Unmarshal(result, &logs)
+	if len(logs) != 0 {
+		fmt.Println("非参与机构不应看到日志", string(result))
+		t.FailNow()
+	}
+
+	// mock引擎不支持富查询，按索引范围查询：发起和三次流转共4条日志
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("rich_query"),
+		[]byte(`{"docType":"processLog","conditions":[{"field":"processId","operator":"$eq","value":"test_process_approval:project-bankcomm-000002"}]}`),
+	})
+	json.Unmarshal(response.Payload, &logs)
+	if response.Status != shim.OK || len(logs) != 4 {
+		fmt.Println("富查询结果不正确", response.Message)
+		t.FailNow()
+	}
+}
+
+// ----- couchDBIndex ----- //
+// META-INF/statedb/couchdb/indexes 中的索引定义
+type couchDBIndex struct {
+	Index struct {
+		Fields []string `json:"fields"`
+	} `json:"index"`
+	Ddoc string `json:"ddoc"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// 链码发出的全部查询语句
+func allChaincodeQueries() map[string]*Query {
+	queries := map[string]*Query{
+		"GetObjectsQueryByDocType":           GetObjectsQueryByDocType("project"),
+		"GetPagingObjectsQueryByDocType":     GetPagingObjectsQueryByDocType("project"),
+		"GetBondsQueryByProjectId":           GetBondsQueryByProjectId("project-bankcomm-000001"),
+		"GetTriggerEvaluationsQueryByBondId": GetTriggerEvaluationsQueryByBondId("bond-001"),
+		"GetDisasterEventsQuery":             GetDisasterEventsQuery("earthquake", "confirmed"),
+		"GetDisasterEventsQuery(peril)":      GetDisasterEventsQuery("earthquake", ""),
+		"GetDisasterEventsQuery(status)":     GetDisasterEventsQuery("", "confirmed"),
+		"GetDisasterEventsQuery(all)":        GetDisasterEventsQuery("", ""),
+		"GetSubscriptionsQueryByInvestor":    GetSubscriptionsQueryByInvestor("@org1.example.com"),
+		"GetLogsQueryByProcessId":            GetLogsQueryByProcessId("process-001"),
+		"GetTodoProcessQuery":                GetTodoProcessQuery("@org1.example.com"),
+		"GetTodoProcessQuery(delegated)":     GetTodoProcessQuery("@org1.example.com", "@org2.example.com"),
+		"GetDoneProcessQuery":                GetDoneProcessQuery("@org1.example.com"),
+		"GetOverdueProcessQuery":             GetOverdueProcessQuery("@org1.example.com", "2018-03-16T00:00:00.000000000Z"),
+		"GetProcessesQueryByAttachDoc":       GetProcessesQueryByAttachDoc("project", "project-bankcomm-000001"),
+		"GetEncryptedDataQueryByStateId":     GetEncryptedDataQueryByStateId("state-001"),
+		"GetAccessableWorkflowsQuery":        GetAccessableWorkflowsQuery("@org1.example.com"),
+		"GetNodesQueryByWorkflowId":          GetNodesQueryByWorkflowId("workflow-001"),
+		"GetDelegationsQueryByFromOrg":       GetDelegationsQueryByFromOrg("@org1.example.com"),
+		"GetDelegationsQueryByToOrg":         GetDelegationsQueryByToOrg("@org1.example.com"),
+		"GetAttachmentsQueryByDoc":           GetAttachmentsQueryByDoc("project", "project-bankcomm-000001"),
+		"GetAttachmentsQueryByHash":          GetAttachmentsQueryByHash("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"),
+	}
+	// 通用富查询的每种文档类型和排序字段
+	for docType, fields := range RichQueryFields {
+		sorts := []string{""}
+		for field := range RichQuerySortIndexes {
+			if ContainsString(fields, field) {
+				sorts = append(sorts, field)
+			}
+		}
+		for _, sortField := range sorts {
+			request := RichQueryRequest{DocType: docType, Conditions: []QueryCondition{{Field: "id", Operator: "$eq", Value: "1"}}}
+			if sortField != "" {
+				request.Sort = []QuerySort{{Field: sortField, Direction: "desc"}}
+			}
+			query, err := BuildRichQuery(request)
+			if err == nil {
+				queries["BuildRichQuery("+docType+","+sortField+")"] = query
+			}
+		}
+	}
+	return queries
+}
+
+// 检查索引能否用于查询，返回不能使用的原因
+// CouchDB要求索引的每个字段都在查询条件或排序字段中，排序字段按索引顺序排在相等条件的字段之后
+func checkQueryIndex(queryString string, indexes map[string]couchDBIndex) string {
+	var query struct {
+		Selector map[string]interface{} `json:"selector"`
+		Sort     []map[string]string    `json:"sort"`
+		Index    []string               `json:"use_index"`
+	}
+	err := json.Unmarshal([]byte(queryString), &query)
+	if err != nil {
+		return "查询语句不是合法的JSON"
+	}
+	if len(query.Index) != 2 || query.Index[0] != "_design/"+query.Index[1] {
+		return "没有指定use_index"
+	}
+	index, ok := indexes[query.Index[1]]
+	if !ok {
+		return "索引不存在 - " + query.Index[1]
+	}
+
+	var sortFields []string
+	direction := ""
+	for _, sort := range query.Sort {
+		for field, sortDirection := range sort {
+			if direction != "" && direction != sortDirection {
+				return "排序方向必须一致"
+			}
+			direction = sortDirection
+			sortFields = append(sortFields, field)
+		}
+	}
+
+	equalFields := map[string]bool{}
+	for field, condition := range query.Selector {
+		if strings.HasPrefix(field, "$") {
+			continue
+		}
+		operators, isOperator := condition.(map[string]interface{})
+		if !isOperator {
+			equalFields[field] = true
+		} else if _, ok := operators["$eq"]; ok {
+			equalFields[field] = true
+		}
+	}
+	for _, field := range index.Index.Fields {
+		condition, inSelector := query.Selector[field]
+		if operators, ok := condition.(map[string]interface{}); ok && operators["$exists"] == false {
+			inSelector = false
+		}
+		if !inSelector && !ContainsString(sortFields, field) {
+			return "查询条件不包含索引字段 - " + field
+		}
+	}
+
+	if len(sortFields) > 0 {
+		fields := index.Index.Fields
+		for len(fields) > 0 && fields[0] != sortFields[0] && equalFields[fields[0]] {
+			fields = fields[1:]
+		}
+		if len(fields) < len(sortFields) {
+			return "索引不包含排序字段"
+		}
+		for i, field := range sortFields {
+			if fields[i] != field {
+				return "排序字段与索引顺序不一致 - " + field
+			}
+		}
+	}
+	return ""
+}
+
+// 测试链码发出的每个查询都有匹配的CouchDB索引
+func Test_CouchDBIndexes(t *testing.T) {
+	files, _ := filepath.Glob("META-INF/statedb/couchdb/indexes/*.json")
+	if len(files) == 0 {
+		fmt.Println("没有找到索引定义")
+		t.FailNow()
+	}
+	indexes := map[string]couchDBIndex{}
+	for _, file := range files {
+		indexAsBytes, _ := ioutil.ReadFile(file)
+		var index couchDBIndex
+		err := json.Unmarshal(indexAsBytes, &index)
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		if err != nil || index.Ddoc != name || index.Name != name || index.Type != "json" || len(index.Index.Fields) == 0 {
+			fmt.Println("索引定义不正确", file)
+			t.FailNow()
+		}
+		indexes[name] = index
+	}
+
+	// 索引字段在$or中时索引不可用
+	todoIndex := couchDBIndex{}
+	todoIndex.Index.Fields = []string{"docType", "finished", "canceled", "currentOwner"}
+	if checkQueryIndex(GetTodoProcessQuery("@org1.example.com").String(), map[string]couchDBIndex{"indexTodoProcess": todoIndex}) == "" {
+		fmt.Println("$or中的字段不能使用索引")
+		t.FailNow()
+	}
+
+	for name, query := range allChaincodeQueries() {
+		reason := checkQueryIndex(query.String(), indexes)
+		if reason != "" {
+			fmt.Println("查询没有匹配的索引", name, reason, query.String())
+			t.FailNow()
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -9,6 +11,7 @@ import (
 
 // =============================================================================
 // Read - read a generic variable from ledger
+// 按文档类型检查可见范围，机构不可见的文档不能读取
 // =============================================================================
 func read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var key, jsonResp string
@@ -26,12 +29,26 @@ func read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error(jsonResp)
 	}
 
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	visible, err := CanOrgSeeValue(stub, valAsbytes, submitterOrgName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !visible {
+		fmt.Println("This key is not visible to your org - " + key)
+		return shim.Error("This key is not visible to your org - " + key)
+	}
+
 	fmt.Println("- end read")
 	return shim.Success(valAsbytes) //send it onward
 }
 
 // =============================================================================
 // Get history of asset
+// 按当前值的文档类型检查可见范围，已删除的键按删除前的最后一个版本检查
 // =============================================================================
 func get_history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
@@ -41,14 +58,30 @@ func get_history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	key := args[0]
 	fmt.Printf("- start getHistory: %s\n", key)
 
-	// Get History
-	resultsIterator, err := stub.GetHistoryForKey(key)
+	submitterOrgName, err := GetOrgFromCert(stub)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer resultsIterator.Close()
+	valueAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if valueAsBytes == nil {
+		valueAsBytes, err = GetLastValueForKey(stub, key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	visible, err := CanOrgSeeValue(stub, valueAsBytes, submitterOrgName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !visible {
+		fmt.Println("This key is not visible to your org - " + key)
+		return shim.Error("This key is not visible to your org - " + key)
+	}
 
-	results, err := ConvHistoryResult(resultsIterator)
+	results, err := GetHistoryForKey(stub, key)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -56,3 +89,216 @@ func get_history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	return shim.Success(results)
 }
+
+// =============================================================================
+// 获取一个键的全部历史版本
+// =============================================================================
+func GetHistoryForKey(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
+	resultsIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	return ConvHistoryResult(resultsIterator)
+}
+
+// =============================================================================
+// 键被删除前的最后一个版本，没有时返回nil
+// =============================================================================
+func GetLastValueForKey(stub shim.ChaincodeStubInterface, key string) ([]byte, error) {
+	resultsIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var value []byte
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !modification.IsDelete && len(modification.Value) > 0 {
+			value = modification.Value
+		}
+	}
+	return value, nil
+}
+
+// =============================================================================
+// 判断机构是否可见账本中的一个值，按文档类型使用对应的可见范围
+// 项目、流程实例、流转日志、工作流及其节点、附件、申购订单、代理委托有可见范围，
+// 债券、发行、兑付、持有、巨灾债券触发、预言机及灾害事件、机构公钥和密文对全部机构公开，
+// 其他文档、索引和计数器等非JSON的值不可见，不存在的键返回空
+// =============================================================================
+func CanOrgSeeValue(stub shim.ChaincodeStubInterface, valueAsBytes []byte, orgName string) (bool, error) {
+	var doc struct {
+		DocType string `json:"docType"`
+	}
+	if valueAsBytes == nil {
+		return true, nil
+	}
+	if json.Unmarshal(valueAsBytes, &doc) != nil {
+		return false, nil
+	}
+
+	switch doc.DocType {
+	case "bond", "offering", "bondPayment", "holding", "catBondTrigger", "triggerEvaluation", "oracleConfig", "disasterEvent", "orgPublicKey", "encryptedData":
+		return true, nil
+	case "project":
+		var project Project
+		json.Unmarshal(valueAsBytes, &project)
+		return CanOrgSeeProject(stub, project, orgName)
+	case "process":
+		var process Process
+		json.Unmarshal(valueAsBytes, &process)
+		return CanOrgSeeProcess(process, orgName), nil
+	case "processLog":
+		var log ProcessLog
+		json.Unmarshal(valueAsBytes, &log)
+		return CanOrgSeeLinkDoc(stub, "process", log.ProcessId, orgName)
+	case "workflow":
+		var workflowDef WorkflowDef
+		json.Unmarshal(valueAsBytes, &workflowDef)
+		return CanOrgSeeWorkflow(workflowDef, orgName), nil
+	case "workflowNode":
+		var node WorkflowNode
+		json.Unmarshal(valueAsBytes, &node)
+		workflowDef, err := GetWorkflowDefById(stub, node.WorkflowId)
+		if err != nil {
+			return false, err
+		}
+		return CanOrgSeeWorkflow(workflowDef, orgName), nil
+	case "attachment":
+		var attachment Attachment
+		json.Unmarshal(valueAsBytes, &attachment)
+		return CanOrgSeeLinkDoc(stub, attachment.LinkDocType, attachment.LinkDocId, orgName)
+	case "subscriptionOrder":
+		// 投资机构和承销商可见
+		var order SubscriptionOrder
+		json.Unmarshal(valueAsBytes, &order)
+		if order.Investor == orgName {
+			return true, nil
+		}
+		offering, err := GetOfferingById(stub, order.OfferingId)
+		if err != nil {
+			return false, errors.New("This offering does not exist - " + order.OfferingId)
+		}
+		return offering.Underwriter == orgName, nil
+	case "delegation":
+		var delegation Delegation
+		json.Unmarshal(valueAsBytes, &delegation)
+		return delegation.FromOrg == orgName || delegation.ToOrg == orgName, nil
+	}
+	return false, nil
+}
+
+// =============================================================================
+// 项目的历史版本，只有可见该项目的机构可以查询
+// =============================================================================
+func get_project_history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting get_project_history")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	id := args[0]
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	project, err := GetProjectById(stub, id)
+	if err != nil {
+		fmt.Println("This project does not exist - " + id)
+		return shim.Error("This project does not exist - " + id)
+	}
+	visible, err := CanOrgSeeProject(stub, project, submitterOrgName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !visible {
+		fmt.Println("This project is not visible to your org - " + id)
+		return shim.Error("This project is not visible to your org - " + id)
+	}
+
+	results, err := GetHistoryForKey(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end get_project_history")
+	return shim.Success(results)
+}
+
+// =============================================================================
+// 流程实例的历史版本，只有可见该流程实例的机构可以查询
+// =============================================================================
+func get_process_history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting get_process_history")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	id := args[0]
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	process, err := GetProcessById(stub, id)
+	if err != nil {
+		fmt.Println("This process does not exist - " + id)
+		return shim.Error("This process does not exist - " + id)
+	}
+	if !CanOrgSeeProcess(process, submitterOrgName) {
+		fmt.Println("This process is not visible to your org - " + id)
+		return shim.Error("This process is not visible to your org - " + id)
+	}
+
+	results, err := GetHistoryForKey(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end get_process_history")
+	return shim.Success(results)
+}
+
+// =============================================================================
+// 工作流定义的历史版本，只有可见该工作流的机构可以查询
+// =============================================================================
+func get_workflow_history(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting get_workflow_history")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	id := args[0]
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	workflowDef, err := GetWorkflowDefById(stub, id)
+	if err != nil {
+		fmt.Println("This workflow does not exist - " + id)
+		return shim.Error("This workflow does not exist - " + id)
+	}
+	if !CanOrgSeeWorkflow(workflowDef, submitterOrgName) {
+		fmt.Println("This workflow is not visible to your org - " + id)
+		return shim.Error("This workflow is not visible to your org - " + id)
+	}
+
+	results, err := GetHistoryForKey(stub, id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end get_workflow_history")
+	return shim.Success(results)
+}
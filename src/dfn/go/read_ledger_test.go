@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+// mock 历史查询结果，mock引擎不支持GetHistoryForKey
+type mockHistoryIterator struct {
+	modifications []*queryresult.KeyModification
+	index         int
+}
+
+func (iter *mockHistoryIterator) HasNext() bool {
+	return iter.index < len(iter.modifications)
+}
+
+func (iter *mockHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	iter.index++
+	return iter.modifications[iter.index-1], nil
+}
+
+func (iter *mockHistoryIterator) Close() error {
+	return nil
+}
+
+// 测试历史结果转换
+func Test_ConvHistoryResult(t *testing.T) {
+	iter := &mockHistoryIterator{modifications: []*queryresult.KeyModification{
+		{TxId: "tx1", Value: []byte(`{"id":"project-1","creator":"Test@org1.example.com"}`), Timestamp: &timestamp.Timestamp{Seconds: 1521165825}},
+		{TxId: "tx2", Value: []byte(`{"id":"project-1","creator":"Test@org1.example.com","lastModifier":"Admin@org1.example.com"}`), Timestamp: &timestamp.Timestamp{Seconds: 1521165826, Nanos: 500}},
+		{TxId: "tx3", IsDelete: true, Timestamp: &timestamp.Timestamp{Seconds: 1521165827}},
+	}}
+	result, err := ConvHistoryResult(iter)
+	if err != nil {
+		fmt.Println(err.Error())
+		t.FailNow()
+	}
+	var records []HistoryRecord
+	json.Unmarshal(result, &records)
+	if len(records) != 3 {
+		fmt.Println("历史版本数不正确")
+		t.FailNow()
+	}
+	if records[0].TxId != "tx1" || records[0].Timestamp != "2018-03-16T02:03:45Z" || records[0].Modifier != "Test@org1.example.com" {
+		fmt.Println("第一个版本不正确", records[0])
+		t.FailNow()
+	}
+	if records[1].Modifier != "Admin@org1.example.com" || records[1].Timestamp != "2018-03-16T02:03:46.0000005Z" {
+		fmt.Println("第二个版本不正确", records[1])
+		t.FailNow()
+	}
+	if !records[2].IsDelete || string(records[2].Value) != "null" {
+		fmt.Println("删除版本不正确", records[2])
+		t.FailNow()
+	}
+}
+
+// 测试历史查询的可见范围
+func Test_GetProcessHistory(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateProject2(t, stub)
+	MockRunApprovalProcess(t, stub, true)
+
+	name := mockSubmitterName
+	mockSubmitterName = "Test@org2.example.com"
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("get_process_history"),
+		[]byte("test_process_approval:project-bankcomm-000002"),
+	})
+	mockSubmitterName = name
+	if response.Status != shim.ERROR || response.Message != "This process is not visible to your org - test_process_approval:project-bankcomm-000002" {
+		fmt.Println("非参与机构不能查询流程历史", response.Message)
+		t.FailNow()
+	}
+
+	// 参与机构通过可见检查，mock引擎不支持历史查询
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("get_process_history"),
+		[]byte("test_process_approval:project-bankcomm-000002"),
+	})
+	if response.Message != "not implemented" {
+		fmt.Println("参与机构应该可以查询流程历史", response.Message)
+		t.FailNow()
+	}
+}
+
+// 测试读取键值的可见范围
+func Test_ReadVisibility(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateProject2(t, stub)
+	MockRunApprovalProcess(t, stub, true)
+	processId := "test_process_approval:project-bankcomm-000002"
+	logId := "processLog-" + processId + "-" + IndexSeq(1)
+
+	name := mockSubmitterName
+	mockSubmitterName = "Test@org2.example.com"
+	for _, key := range []string{processId, logId} {
+		response := stub.MockInvoke(GetTestTxID(), [][]byte{[]byte("read"), []byte(key)})
+		if response.Status != shim.ERROR || response.Message != "This key is not visible to your org - "+key {
+			fmt.Println("非参与机构不能读取", key, response.Message)
+			t.FailNow()
+		}
+	}
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{[]byte("get_history"), []byte(processId)})
+	if response.Status != shim.ERROR || response.Message != "This key is not visible to your org - "+processId {
+		fmt.Println("非参与机构不能查询历史", response.Message)
+		t.FailNow()
+	}
+	// 不存在的键返回空
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{[]byte("read"), []byte("no-such-key")})
+	if response.Status != shim.OK || response.Payload != nil {
+		fmt.Println("不存在的键应返回空", response.Message)
+		t.FailNow()
+	}
+	mockSubmitterName = name
+
+	// 参与机构可以读取
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{[]byte("read"), []byte(logId)})
+	var log ProcessLog
+	json.Unmarshal(response.Payload, &log)
+	if response.Status != shim.OK || log.ProcessId != processId {
+		fmt.Println("参与机构应该可以读取流转日志", response.Message)
+		t.FailNow()
+	}
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{[]byte("get_history"), []byte(processId)})
+	if response.Message != "not implemented" {
+		fmt.Println("参与机构应该可以查询历史", response.Message)
+		t.FailNow()
+	}
+}
+
+// 测试未列出的文档类型和非JSON的值默认不可见
+func Test_CanOrgSeeValue(t *testing.T) {
+	stub := GetMockStub()
+	cases := []struct {
+		value   []byte
+		visible bool
+	}{
+		{nil, true},
+		{[]byte(`{"docType":"bond","id":"bond-1"}`), true},
+		{[]byte(`{"docType":"orgPublicKey"}`), true},
+		{[]byte(`{"docType":"unknown"}`), false},
+		{[]byte(`{"id":"no-doc-type"}`), false},
+		{[]byte("3"), false},
+		{[]byte{0x00}, false},
+	}
+	for _, c := range cases {
+		visible, err := CanOrgSeeValue(stub, c.value, "@org2.example.com")
+		if err != nil || visible != c.visible {
+			fmt.Println("可见范围不正确", string(c.value))
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 节点的流转前置条件：节点的requiredAttachmentTypes为必须登记的附件类型，
+// 附件关联到流程或流程的附加文档均可；requiredFields为附加文档中或流程变量中必须不为空的字段，
+// 前置条件未全部满足时不能通过transfer_process离开该节点
+
+// 未满足的前置条件
+type ReadinessItem struct {
+	Type    string `json:"type"`    // 条件类型：attachment 或 field
+	Name    string `json:"name"`    // 附件类型或字段名
+	Message string `json:"message"` // 说明
+}
+
+// 流程离开节点的前置条件检查结果
+type ProcessReadiness struct {
+	ProcessId  string          `json:"processId"`
+	NodeId     string          `json:"nodeId"`
+	Ready      bool            `json:"ready"`      // 前置条件是否全部满足
+	UnmetItems []ReadinessItem `json:"unmetItems"` // 未满足的前置条件
+}
+
+// =============================================================================
+// 校验节点前置条件的设置
+// 会签节点和子流程节点自动流转，不能设置前置条件
+// =============================================================================
+func ValidateReadinessNode(node WorkflowNode) error {
+	if len(node.RequiredAttachmentTypes) == 0 && len(node.RequiredFields) == 0 {
+		return nil
+	}
+	if IsApprovalNode(node) || IsSubProcessNode(node) {
+		return errors.New("Auto transferred node can not have required items - " + node.Id)
+	}
+	for _, fileType := range node.RequiredAttachmentTypes {
+		if fileType == "" {
+			return errors.New("Required attachment type can not be empty - " + node.Id)
+		}
+	}
+	for _, field := range node.RequiredFields {
+		if field == "" {
+			return errors.New("Required field can not be empty - " + node.Id)
+		}
+	}
+	if len(RemoveRepStringByMap(node.RequiredAttachmentTypes)) != len(node.RequiredAttachmentTypes) ||
+		len(RemoveRepStringByMap(node.RequiredFields)) != len(node.RequiredFields) {
+		return errors.New("Duplicate required items - " + node.Id)
+	}
+	return nil
+}
+
+// =============================================================================
+// 检查流程离开节点的前置条件，返回未满足的条件，全部满足时返回空列表
+// =============================================================================
+func CheckNodeReadiness(stub shim.ChaincodeStubInterface, process Process, node WorkflowNode) ([]ReadinessItem, error) {
+	items := []ReadinessItem{}
+
+	if len(node.RequiredAttachmentTypes) > 0 {
+		fileTypes, err := GetAttachmentTypes(stub, process)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileType := range node.RequiredAttachmentTypes {
+			if !ContainsString(fileTypes, fileType) {
+				items = append(items, ReadinessItem{Type: "attachment", Name: fileType, Message: "未登记附件：" + fileType})
+			}
+		}
+	}
+
+	if len(node.RequiredFields) > 0 {
+		fields, err := GetProcessFields(stub, process)
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range node.RequiredFields {
+			if GetFieldValue(fields, field) == "" {
+				items = append(items, ReadinessItem{Type: "field", Name: field, Message: "字段为空：" + field})
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// 流程及其附加文档已登记的附件类型
+func GetAttachmentTypes(stub shim.ChaincodeStubInterface, process Process) ([]string, error) {
+	var fileTypes []string
+	queries := []*Query{
+		GetAttachmentsQueryByDoc("process", process.Id),
+		GetAttachmentsQueryByDoc(process.AttachDocType, process.AttachDocId),
+	}
+	for _, query := range queries {
+		resultAsBytes, err := ExecuteQuery(stub, query)
+		if err != nil {
+			return nil, err
+		}
+		var attachments []Attachment
+		err = json.Unmarshal(resultAsBytes, &attachments)
+		if err != nil {
+			return nil, err
+		}
+		for _, attachment := range attachments {
+			fileTypes = append(fileTypes, attachment.FileType)
+		}
+	}
+	return fileTypes, nil
+}
+
+// =============================================================================
+// 检查流程能否离开当前节点，不写入账本
+// 参数：流程ID、分支所在节点ID（可选，有多个分支时指定）
+// =============================================================================
+func check_process_readiness(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting check_process_readiness")
+
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	processId := args[0]
+	branchNodeId := ""
+	if len(args) == 2 {
+		branchNodeId = args[1]
+	}
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	process, err := GetProcessById(stub, processId)
+	if err != nil {
+		fmt.Println("This process does not exists - " + processId)
+		return shim.Error("This process does not exists - " + processId)
+	}
+	if !CanOrgSeeProcess(process, submitterOrgName) {
+		fmt.Println("You are not allowed to see the process - " + processId)
+		return shim.Error("You are not allowed to see the process - " + processId)
+	}
+	if process.Canceled || process.Finished {
+		fmt.Println("This process has been finished or canceled - " + processId)
+		return shim.Error("This process has been finished or canceled - " + processId)
+	}
+
+	// 与transfer_process相同的方式查找分支
+	actingOrgs, err := GetActingOrgs(stub, submitterOrgName, process.WorkflowId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	branches := GetProcessBranches(process)
+	branchIndex, err := FindProcessBranch(branches, actingOrgs, branchNodeId)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	node, err := GetWorkflowNodeById(stub, branches[branchIndex].NodeId)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	items, err := CheckNodeReadiness(stub, process, node)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	readiness := ProcessReadiness{ProcessId: process.Id, NodeId: node.Id, Ready: len(items) == 0, UnmetItems: items}
+	readinessAsBytes, _ := json.Marshal(readiness)
+
+	fmt.Println("- end check_process_readiness")
+	return shim.Success(readinessAsBytes)
+}
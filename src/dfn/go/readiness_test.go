@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 创建第一个节点有前置条件的线性工作流
+func MockCreateReadinessWorkflow(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_linear_workflow"),
+		[]byte(`{"id":"test_readiness_workflow-001","workflowName":"发行前检查","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`{"nodeName":"发起行","accessOrgs":["@org1.example.com"],"requiredAttachmentTypes":["ratingReport"],"requiredFields":["trustee","depositary"]}`),
+		[]byte(`{"nodeName":"发行机构","accessOrgs":["@org1.example.com"]}`),
+	})
+	return response
+}
+
+// mock 检查流程能否离开当前节点
+func MockCheckProcessReadiness(t *testing.T, stub *shim.MockStub, processId string) ProcessReadiness {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("check_process_readiness"),
+		[]byte(processId),
+	})
+	var readiness ProcessReadiness
+	json.Unmarshal(response.Payload, &readiness)
+	return readiness
+}
+
+// 测试节点前置条件的设置
+func Test_ValidateReadinessNode(t *testing.T) {
+	node := WorkflowNode{Id: "node", RequiredAttachmentTypes: []string{"ratingReport"}, RequiredFields: []string{"trustee"}}
+	if ValidateReadinessNode(node) != nil {
+		fmt.Println("前置条件应校验通过")
+		t.FailNow()
+	}
+	node.RequiredFields = []string{"trustee", "trustee"}
+	if ValidateReadinessNode(node) == nil {
+		fmt.Println("前置条件不能重复")
+		t.FailNow()
+	}
+	node.RequiredFields = nil
+	node.ApprovalOrgs = []string{"@org1.example.com"}
+	if ValidateReadinessNode(node) == nil {
+		fmt.Println("会签节点不能设置前置条件")
+		t.FailNow()
+	}
+}
+
+// 测试前置条件未满足时不能流转
+func Test_ProcessReadiness(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	response := MockCreateReadinessWorkflow(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	MockCreateProject2(t, stub)
+	var project Project
+	json.Unmarshal(stub.State["project-bankcomm-000002"], &project)
+	project.Depositary = ""
+	stub.State["project-bankcomm-000002"], _ = json.Marshal(project)
+	stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("start_process"),
+		[]byte(`{"id":"test_process_011","workflowId":"test_readiness_workflow-001","attachDocType":"project","attachDocId":"project-bankcomm-000002","createTime":"2018-3-19 09:43:02"}`),
+	})
+
+	readiness := MockCheckProcessReadiness(t, stub, "test_process_011")
+	if readiness.Ready || len(readiness.UnmetItems) != 2 || readiness.UnmetItems[0].Name != "ratingReport" || readiness.UnmetItems[1].Name != "depositary" {
+		fmt.Println("应返回未登记的附件和为空的字段")
+		t.FailNow()
+	}
+	response = MockTransferTo(t, stub, "test_process_011", "test_readiness_workflow-001:node-2")
+	if response.Status != shim.ERROR || !strings.Contains(response.GetMessage(), `"name":"ratingReport"`) {
+		fmt.Println("前置条件未满足时不能流转，并返回未满足的条件")
+		t.FailNow()
+	}
+
+	// 附件关联到流程也满足条件
+	response = MockRegisterAttachment(t, stub, "Test@org1.example.com", `{"id":"attachment-004","fileName":"评级报告.pdf","fileHash":"`+testFileHash+`","fileType":"ratingReport","linkDocType":"process","linkDocId":"test_process_011"}`)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	project.Depositary = "兴业银行"
+	stub.State["project-bankcomm-000002"], _ = json.Marshal(project)
+	readiness = MockCheckProcessReadiness(t, stub, "test_process_011")
+	if !readiness.Ready || len(readiness.UnmetItems) != 0 {
+		fmt.Println("前置条件应全部满足")
+		t.FailNow()
+	}
+	response = MockTransferTo(t, stub, "test_process_011", "test_readiness_workflow-001:node-2")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+}
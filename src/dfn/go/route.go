@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ----- 路由条件 ----- //
+type RouteCondition struct {
+	Field    string `json:"field"`    // 附加文档的字段名，支持以"."分隔的嵌套字段，"variables."开头时为流程变量
+	Operator string `json:"operator"` // 比较运算符
+	Value    string `json:"value"`    // 比较值
+}
+
+// 节点的一条路由，Condition为空时为默认路由
+type WorkflowRoute struct {
+	NextNodeId string          `json:"nextNodeId"`
+	Condition  *RouteCondition `json:"condition"`
+}
+
+// 支持的运算符
+var routeOperators = []string{"eq", "ne", "gt", "gte", "lt", "lte", "empty", "notEmpty", "contains", "in"}
+
+// =============================================================================
+// 校验路由条件
+// =============================================================================
+func ValidateRouteCondition(condition RouteCondition) error {
+	if condition.Field == "" {
+		return errors.New("Field of route condition is required")
+	}
+	if !ContainsString(routeOperators, condition.Operator) {
+		return errors.New("Unknown operator of route condition - " + condition.Operator)
+	}
+	switch condition.Operator {
+	case "gt", "gte", "lt", "lte":
+		_, err := ParseAmount(condition.Value)
+		if err != nil {
+			return errors.New("Value of route condition must be a number - " + condition.Value)
+		}
+	}
+	return nil
+}
+
+// =============================================================================
+// 计算路由条件
+// =============================================================================
+func EvaluateRouteCondition(condition RouteCondition, actual string) (bool, error) {
+	switch condition.Operator {
+	case "eq":
+		return actual == condition.Value, nil
+	case "ne":
+		return actual != condition.Value, nil
+	case "empty":
+		return strings.TrimSpace(actual) == "", nil
+	case "notEmpty":
+		return strings.TrimSpace(actual) != "", nil
+	case "contains":
+		return strings.Contains(actual, condition.Value), nil
+	case "in":
+		return ContainsString(strings.Split(condition.Value, ","), actual), nil
+	case "gt", "gte", "lt", "lte":
+		expected, err := ParseAmount(condition.Value)
+		if err != nil {
+			return false, err
+		}
+		value, err := ParseAmount(actual)
+		if err != nil {
+			// 无法解析为数字时条件不成立
+			return false, nil
+		}
+		switch condition.Operator {
+		case "gt":
+			return value > expected, nil
+		case "gte":
+			return value >= expected, nil
+		case "lt":
+			return value < expected, nil
+		default:
+			return value <= expected, nil
+		}
+	}
+	return false, errors.New("Unknown operator of route condition - " + condition.Operator)
+}
+
+// =============================================================================
+// 解析金额字符串，如"10亿元人民币"、"500万"、"1,000.5"
+// 只取开头的数字部分，紧跟的"万"、"亿"作为单位
+// =============================================================================
+func ParseAmount(str string) (float64, error) {
+	str = strings.Replace(strings.TrimSpace(str), ",", "", -1)
+	end := 0
+	for end < len(str) {
+		c := str[end]
+		if (c >= '0' && c <= '9') || c == '.' || (end == 0 && c == '-') {
+			end++
+			continue
+		}
+		break
+	}
+	number, err := strconv.ParseFloat(str[:end], 64)
+	if err != nil {
+		return 0, errors.New("Can not parse number - " + str)
+	}
+	unit := str[end:]
+	switch {
+	case strings.HasPrefix(unit, "万"):
+		number = number * 10000
+	case strings.HasPrefix(unit, "亿"):
+		number = number * 100000000
+	}
+	return number, nil
+}
+
+// =============================================================================
+// 获取流程附加文档的字段
+// =============================================================================
+func GetAttachDocFields(stub shim.ChaincodeStubInterface, process Process) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	docAsBytes, err := stub.GetState(process.AttachDocId)
+	if err != nil {
+		return nil, err
+	}
+	if docAsBytes == nil {
+		return nil, errors.New("Attach doc does not exist - " + process.AttachDocId)
+	}
+	err = json.Unmarshal(docAsBytes, &fields)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// =============================================================================
+// 获取路由条件可用的字段：附加文档的字段，以及"variables"下的流程变量
+// =============================================================================
+func GetProcessFields(stub shim.ChaincodeStubInterface, process Process) (map[string]interface{}, error) {
+	fields, err := GetAttachDocFields(stub, process)
+	if err != nil {
+		return nil, err
+	}
+	fields["variables"] = GetVariableValues(process)
+	return fields, nil
+}
+
+// =============================================================================
+// 获取字段值，不存在时返回空字符串
+// =============================================================================
+func GetFieldValue(fields map[string]interface{}, field string) string {
+	var value interface{} = fields
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		valueAsBytes, _ := json.Marshal(v)
+		return string(valueAsBytes)
+	}
+}
+
+// 计算一条路由，返回是否成立和规则描述
+func evaluateRoute(fields map[string]interface{}, route WorkflowRoute) (bool, string, error) {
+	if route.Condition == nil {
+		return true, "default", nil
+	}
+	actual := GetFieldValue(fields, route.Condition.Field)
+	matched, err := EvaluateRouteCondition(*route.Condition, actual)
+	if err != nil {
+		return false, "", err
+	}
+	rule := fmt.Sprintf("%s %s %s (actual: %s) => %t", route.Condition.Field, route.Condition.Operator, route.Condition.Value, actual, matched)
+	return matched, rule, nil
+}
+
+// =============================================================================
+// 单选分支：按顺序选择第一条成立的路由，条件路由均不成立时使用默认路由
+// =============================================================================
+func SelectRoute(stub shim.ChaincodeStubInterface, process Process, node WorkflowNode) (WorkflowRoute, string, error) {
+	fields, err := GetProcessFields(stub, process)
+	if err != nil {
+		return WorkflowRoute{}, "", err
+	}
+
+	var rules []string
+	var defaultRoute *WorkflowRoute
+	for i := 0; i < len(node.Routes); i++ {
+		route := node.Routes[i]
+		if route.Condition == nil {
+			if defaultRoute == nil {
+				defaultRoute = &node.Routes[i]
+			}
+			continue
+		}
+		matched, rule, err := evaluateRoute(fields, route)
+		if err != nil {
+			return WorkflowRoute{}, "", err
+		}
+		rules = append(rules, rule)
+		if matched {
+			return route, strings.Join(rules, "; "), nil
+		}
+	}
+	if defaultRoute != nil {
+		rules = append(rules, "default")
+		return *defaultRoute, strings.Join(rules, "; "), nil
+	}
+	return WorkflowRoute{}, "", errors.New("No route matched from node - " + node.Id)
+}
+
+// =============================================================================
+// 并行分支：条件成立的分支必须流转，条件不成立的分支不能流转
+// =============================================================================
+func EvaluateParallelRoutes(stub shim.ChaincodeStubInterface, process Process, node WorkflowNode) ([]string, []string, string, error) {
+	var required, forbidden, rules []string
+	if len(node.Routes) == 0 {
+		return required, forbidden, "", nil
+	}
+	fields, err := GetProcessFields(stub, process)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	for _, route := range node.Routes {
+		if route.Condition == nil {
+			continue
+		}
+		matched, rule, err := evaluateRoute(fields, route)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		rules = append(rules, route.NextNodeId+": "+rule)
+		if matched {
+			required = append(required, route.NextNodeId)
+		} else {
+			forbidden = append(forbidden, route.NextNodeId)
+		}
+	}
+	return required, forbidden, strings.Join(rules, "; "), nil
+}
+
+// =============================================================================
+// 判断到某下一节点的路由是否带有条件
+// =============================================================================
+func HasRouteCondition(node WorkflowNode, nextNodeId string) bool {
+	for _, route := range node.Routes {
+		if route.NextNodeId == nextNodeId && route.Condition != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 测试金额解析
+func Test_ParseAmount(t *testing.T) {
+	cases := map[string]float64{
+		"10亿元人民币":  1000000000,
+		"500万元人民币": 5000000,
+		"1,000.5":  1000.5,
+		"-3":       -3,
+	}
+	for str, expected := range cases {
+		value, err := ParseAmount(str)
+		if err != nil || value != expected {
+			fmt.Println("解析不正确 - " + str)
+			t.FailNow()
+		}
+	}
+	_, err := ParseAmount("人民币")
+	if err == nil {
+		fmt.Println("非数字应报错")
+		t.FailNow()
+	}
+}
+
+// 测试路由条件计算
+func Test_EvaluateRouteCondition(t *testing.T) {
+	matched, _ := EvaluateRouteCondition(RouteCondition{Field: "scale", Operator: "gt", Value: "1亿"}, "10亿元人民币")
+	if !matched {
+		fmt.Println("10亿应大于1亿")
+		t.FailNow()
+	}
+	matched, _ = EvaluateRouteCondition(RouteCondition{Field: "scale", Operator: "gt", Value: "1亿"}, "500万元人民币")
+	if matched {
+		fmt.Println("500万不应大于1亿")
+		t.FailNow()
+	}
+	matched, _ = EvaluateRouteCondition(RouteCondition{Field: "assessor", Operator: "empty"}, " ")
+	if !matched {
+		fmt.Println("空字符串应为empty")
+		t.FailNow()
+	}
+	err := ValidateRouteCondition(RouteCondition{Field: "scale", Operator: "gt", Value: "abc"})
+	if err == nil {
+		fmt.Println("非数字比较值应报错")
+		t.FailNow()
+	}
+	err = ValidateRouteCondition(RouteCondition{Field: "scale", Operator: "like", Value: "abc"})
+	if err == nil {
+		fmt.Println("未知运算符应报错")
+		t.FailNow()
+	}
+}
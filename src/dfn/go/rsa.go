@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"bytes"
 	"crypto/x509"
 	"crypto/rand"
 	"crypto/rsa"
@@ -25,6 +24,7 @@ type EncryptedData struct {
 	LastModifier   string   `json:"lastModifier"` // 最后修改人
 	CreateTime     string   `json:"createTime"`   // 创建时间
 	ModifyTime     string   `json:"modifyTime"`   // 修改时间
+	BusinessDate   string   `json:"businessDate"` // 业务日期，客户端传入
 }
 
 type OrgPublicKey struct {
@@ -35,6 +35,7 @@ type OrgPublicKey struct {
 	Version        int      `json:"version"`
 	CreateTime     string   `json:"createTime"`   // 创建时间
 	ModifyTime     string   `json:"modifyTime"`   // 修改时间
+	BusinessDate   string   `json:"businessDate"` // 业务日期，客户端传入
 }
 
 // 加密数据
@@ -46,13 +47,17 @@ func encrypt_data(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	var organizations []string
 	stateID := args[0]
-	modifyTime := args[2]
+	businessDate := args[2]
 
 	err := json.Unmarshal([]byte(args[1]), &organizations)
 	if err != nil {
 		fmt.Println(err.Error())
 		return shim.Error(err.Error())
 	}
+	err = CheckBusinessDate(businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	tMap, err := stub.GetTransient()
 	if err != nil {
@@ -81,7 +86,7 @@ func encrypt_data(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	}
 
 	// 加密并存储
-	err = EncryptAndStoreByOrgs(stub, stateID, originData, organizations, modifyTime)
+	err = EncryptAndStoreByOrgs(stub, stateID, originData, organizations, businessDate)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -122,24 +127,33 @@ func save_org_public_key(stub shim.ChaincodeStubInterface, args []string) pb.Res
 	}
 
 	publicKey := args[0]
-	modifyTime := args[1]
+	businessDate := args[1]
 	organization, err := GetOrgFromCert(stub)
 	if err != nil {
 		shim.Error(err.Error())
 	}
+	err = CheckBusinessDate(businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	SaveOrgPublicKey(stub, organization, publicKey, modifyTime)
+	SaveOrgPublicKey(stub, organization, publicKey, businessDate)
 
 	return shim.Success(nil)
 }
 
 // 使用公钥加密某机构数据
-func EncryptAndStore(stub shim.ChaincodeStubInterface, stateID string, originData []byte, organization string, modifyTime string) error {
+func EncryptAndStore(stub shim.ChaincodeStubInterface, stateID string, originData []byte, organization string, businessDate string) error {
 	orgPubKey, err := GetOrgPublicKey(stub, organization)
 	if err != nil {
 		return err
 	}
 
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return err
+	}
+
 	base64EncStr, err := Encrypt64(originData, []byte(orgPubKey.PublicKey))
 	if err != nil {
 		return err
@@ -172,16 +186,20 @@ func EncryptAndStore(stub shim.ChaincodeStubInterface, stateID string, originDat
 	}
 	encryptedData.LastModifier = creator
 	encryptedData.ModifyTime = modifyTime
+	encryptedData.BusinessDate = businessDate
 
 	encryptedDataAsBytes, _ := json.Marshal(encryptedData)
 	err = stub.PutState(storeID, encryptedDataAsBytes)
-	return err
+	if err != nil {
+		return err
+	}
+	return PutIndex(stub, EncryptedDataIndex, stateID, organization, storeID)
 }
 
 // 对列出的机构进行数据加密
-func EncryptAndStoreByOrgs(stub shim.ChaincodeStubInterface, stateID string, originData []byte, organizations []string, modifyTime string) error {
+func EncryptAndStoreByOrgs(stub shim.ChaincodeStubInterface, stateID string, originData []byte, organizations []string, businessDate string) error {
 	for i := 0; i < len(organizations); i++ {
-		err := EncryptAndStore(stub, stateID, originData, organizations[i], modifyTime)
+		err := EncryptAndStore(stub, stateID, originData, organizations[i], businessDate)
 		if err != nil {
 			return err
 		}
@@ -261,12 +279,7 @@ func GetEncryptData(stub shim.ChaincodeStubInterface, stateID string) (Encrypted
 
 // 获取加密数据机构清单
 func GetEncryptTargetOrgs(stub shim.ChaincodeStubInterface, stateID string) ([]string, error) {	
-	var queryBuffer bytes.Buffer
-		queryBuffer.WriteString(`{"selector":{"docType":"encryptedData","stateId":"`)
-		queryBuffer.WriteString(stateID)
-		queryBuffer.WriteString(`"}}`)
-
-	result, err := GetQueryResult(stub, queryBuffer.String())
+	result, err := ExecuteQuery(stub, GetEncryptedDataQueryByStateId(stateID))
 	var encryptedDatas []EncryptedData
 	err = json.Unmarshal(result, &encryptedDatas)
 	if err != nil {
@@ -280,6 +293,11 @@ func GetEncryptTargetOrgs(stub shim.ChaincodeStubInterface, stateID string) ([]s
 	return organizations, nil
 }
 
+// 状态全部加密数据的查询语句
+func GetEncryptedDataQueryByStateId(stateID string) *Query {
+	return NewQuery("encryptedData").Eq("stateId", stateID).UseIndex("indexEncryptedData").ScanIndex(EncryptedDataIndex, stateID)
+}
+
 // 获取加密数据并解密
 func GetEncryptDataAndDecrypt(stub shim.ChaincodeStubInterface, stateID string, privateKey []byte) ([]byte, error) {
 	encData, err := GetEncryptData(stub, stateID)
@@ -316,7 +334,8 @@ func GetOrgPublicKey(stub shim.ChaincodeStubInterface, organization string) (Org
 }
 
 // 存储机构公钥
-func SaveOrgPublicKey(stub shim.ChaincodeStubInterface, organization string, publicKey string, modifyTime string) {
+func SaveOrgPublicKey(stub shim.ChaincodeStubInterface, organization string, publicKey string, businessDate string) {
+	modifyTime, _ := GetTxTimeString(stub)
 	storeID := GetOrgPublicKeyId(organization)
 	orgPublicKey, err :=  GetOrgPublicKey(stub, organization)
 	if err == nil && orgPublicKey.Id == storeID {
@@ -328,6 +347,7 @@ func SaveOrgPublicKey(stub shim.ChaincodeStubInterface, organization string, pub
 		} 
 		orgPublicKey.PublicKey = publicKey
 		orgPublicKey.ModifyTime = modifyTime
+		orgPublicKey.BusinessDate = businessDate
 		orgPublicKey.Version = orgPublicKey.Version + 1
 	} else {
 		// 数据不存在，新增
@@ -340,6 +360,7 @@ func SaveOrgPublicKey(stub shim.ChaincodeStubInterface, organization string, pub
 		orgPublicKey.Version = 1
 		orgPublicKey.CreateTime = modifyTime
 		orgPublicKey.ModifyTime = modifyTime
+		orgPublicKey.BusinessDate = businessDate
 	}
 	fmt.Println("saving public key")
 	orgPublicKeyAsBytes, _ := json.Marshal(orgPublicKey)
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// 节点时限：节点的slaHours大于0时，流程到达节点后按交易时间计算到期时间dueTime，
+// 到期未流转的流程由节点的督办机构supervisorOrg接管
+
+// =============================================================================
+// 校验节点时限的设置
+// =============================================================================
+func ValidateSlaNode(node WorkflowNode) error {
+	if node.SlaHours < 0 {
+		return errors.New("SLA hours can not be negative - " + node.Id)
+	}
+	if node.SupervisorOrg != "" && node.SlaHours == 0 {
+		return errors.New("Supervisor org requires slaHours - " + node.Id)
+	}
+	return nil
+}
+
+// =============================================================================
+// 流程在enterTime到达节点时的到期时间，节点没有时限时返回空字符串
+// =============================================================================
+func GetNodeDueTime(node WorkflowNode, enterTime time.Time) string {
+	if node.SlaHours <= 0 {
+		return ""
+	}
+	return enterTime.Add(time.Duration(node.SlaHours) * time.Hour).Format(TimestampLayout)
+}
+
+// =============================================================================
+// 分支在now时是否已超时，等待汇聚的分支不计时
+// now为TimestampLayout格式，与dueTime按字符串比较
+// =============================================================================
+func IsBranchOverdue(branch ProcessBranch, now string) bool {
+	return !branch.Waiting && branch.DueTime != "" && branch.DueTime < now
+}
+
+// =============================================================================
+// 查询超时流程
+// 参数：拥有机构（可选，为空时为提交者机构）、分页参数pageSize和bookmark（可选）
+// 只返回提交者机构参与过的流程，或提交者机构为超时节点督办机构的流程
+// =============================================================================
+func query_overdue_process(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var result []byte
+	var err error
+	fmt.Println("starting query_overdue_process")
+
+	if len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 3")
+	}
+
+	submitterOrgName, err := GetOrgFromCert(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ownerOrgName := submitterOrgName
+	if len(args) > 0 && args[0] != "" {
+		ownerOrgName = args[0]
+	}
+	var pagingArgs []string
+	if len(args) > 1 {
+		pagingArgs = args[1:]
+	}
+	pageSize, bookmark, err := SanitizeBookmarkArgument(pagingArgs)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	now, err := GetTxTimeString(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// 过滤掉提交者机构不可见的流程，不足一页时继续查询
+	nodes := map[string]WorkflowNode{}
+	result, metadata, err := GetFilteredQueryResultByPage(stub, GetOverdueProcessQuery(ownerOrgName, now), pageSize, bookmark, func(records []byte) ([]byte, error) {
+		var processes []Process
+		err := json.Unmarshal(records, &processes)
+		if err != nil {
+			return nil, err
+		}
+		results := []Process{}
+		for _, process := range processes {
+			visible := CanOrgSeeProcess(process, submitterOrgName)
+			for _, branch := range GetProcessBranches(process) {
+				if visible || branch.Owner != ownerOrgName || !IsBranchOverdue(branch, now) {
+					continue
+				}
+				node, cached := nodes[branch.NodeId]
+				if !cached {
+					node, err = GetWorkflowNodeById(stub, branch.NodeId)
+					if err != nil {
+						return nil, err
+					}
+					nodes[branch.NodeId] = node
+				}
+				visible = node.SupervisorOrg == submitterOrgName
+			}
+			if visible {
+				results = append(results, process)
+			}
+		}
+		return json.Marshal(results)
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, err = MarshalPageResult(result, metadata)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("end query_overdue_process")
+	return shim.Success(result)
+}
+
+// 机构超时流程的查询语句，包括当前节点和并行分支
+func GetOverdueProcessQuery(orgName string, now string) *Query {
+	overdue := Selector{"$gt": "", "$lt": now}
+	return NewQuery("process").Eq("finished", false).Eq("canceled", false).Or(
+		Selector{"currentOwner": orgName, "dueTime": overdue},
+		Selector{}.ElemMatch("branches", Selector{"owner": orgName, "waiting": false, "dueTime": overdue}),
+	).UseIndex("indexTodoProcess").ScanIndex(ProcessOwnerIndex, orgName)
+}
+
+// =============================================================================
+// 督办机构接管超时流程
+// 参数：流程实例ID、备注、业务日期、并行时的分支节点ID（可选）
+// 接管后分支的拥有机构为督办机构，不再计时
+// =============================================================================
+func escalate_process(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	fmt.Println("starting escalate_process")
+
+	if len(args) != 3 && len(args) != 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 3 or 4")
+	}
+
+	submitter, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	submitterOrgName, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	processId := args[0]
+	remark := args[1]
+	businessDate := args[2]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	branchNodeId := ""
+	if len(args) == 4 {
+		branchNodeId = args[3]
+	}
+
+	process, err := GetProcessById(stub, processId)
+	if err != nil {
+		fmt.Println("This process does not exists - " + processId)
+		return shim.Error("This process does not exists - " + processId)
+	}
+	if process.Canceled {
+		fmt.Println("This process has been canceled - " + processId)
+		return shim.Error("This process has been canceled - " + processId)
+	}
+	if process.Finished {
+		fmt.Println("This process has been finished - " + processId)
+		return shim.Error("This process has been finished - " + processId)
+	}
+
+	// find the overdue branch supervised by submitter's org
+	now, err := GetTxTimeString(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	branches := GetProcessBranches(process)
+	branchIndex := -1
+	var currentNode WorkflowNode
+	for i := 0; i < len(branches); i++ {
+		if (branchNodeId != "" && branches[i].NodeId != branchNodeId) || !IsBranchOverdue(branches[i], now) {
+			continue
+		}
+		node, err := GetWorkflowNodeById(stub, branches[i].NodeId)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if node.SupervisorOrg != submitterOrgName {
+			continue
+		}
+		if branchIndex != -1 {
+			fmt.Println("More than one branch is overdue, please specify the node id - " + processId)
+			return shim.Error("More than one branch is overdue, please specify the node id - " + processId)
+		}
+		branchIndex = i
+		currentNode = node
+	}
+	if branchIndex == -1 {
+		fmt.Println("No overdue branch can be escalated by " + submitterOrgName + " - " + processId)
+		return shim.Error("No overdue branch can be escalated by " + submitterOrgName + " - " + processId)
+	}
+
+	branch := branches[branchIndex]
+	fromOrgName := branch.Owner
+	branch.Owner = submitterOrgName
+	branch.Assignee = ""
+	branch.DueTime = ""
+	branches[branchIndex] = branch
+	SetProcessBranches(&process, branches)
+
+	process.LastModifier = submitter
+	process.ModifyTime = modifyTime
+	process.BusinessDate = businessDate
+	if !ContainsString(process.Participants, submitterOrgName) {
+		process.Participants = append(process.Participants, submitterOrgName)
+	}
+
+	err = PutProcess(stub, process)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// store log
+	err = StoreProcessLog(stub, false, processId, currentNode.Id, currentNode.NodeName, fromOrgName, currentNode.Id, currentNode.NodeName, submitterOrgName, "EscalateProcess", remark, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end escalate_process")
+	return shim.Success(nil)
+}
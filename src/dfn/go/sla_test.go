@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 创建一个第二个节点限时24小时、由org2督办的线性工作流
+func MockCreateSlaWorkflow(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_linear_workflow"),
+		[]byte(`{"id":"test_sla_workflow-001","workflowName":"测试时限流程001","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`{"nodeName":"发起行","accessOrgs":["@org1.example.com"]}`),
+		[]byte(`{"nodeName":"尽调机构","accessOrgs":["@org1.example.com","@org2.example.com"],"slaHours":24,"supervisorOrg":"@org2.example.com"}`),
+		[]byte(`{"nodeName":"发行机构","accessOrgs":["@org1.example.com","@org2.example.com"]}`),
+	})
+	return response
+}
+
+// mock 以指定机构的身份查询超时流程
+func MockQueryOverdueProcess(t *testing.T, stub *shim.MockStub, submitter string, ownerOrg string) []Process {
+	name := mockSubmitterName
+	mockSubmitterName = submitter
+	defer func() { mockSubmitterName = name }()
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("query_overdue_process"),
+		[]byte(ownerOrg),
+	})
+	var processes []Process
+	json.Unmarshal(response.Payload, &processes)
+	return processes
+}
+
+// mock 以指定机构的身份接管超时流程
+func MockEscalateProcess(t *testing.T, stub *shim.MockStub, submitter string) pb.Response {
+	name := mockSubmitterName
+	mockSubmitterName = submitter
+	defer func() { mockSubmitterName = name }()
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("escalate_process"),
+		[]byte("test_process_007"),
+		[]byte("超时接管"),
+		[]byte("2018-03-16 15:54:00"),
+	})
+	return response
+}
+
+// 测试节点时限的设置
+func Test_ValidateSlaNode(t *testing.T) {
+	node := WorkflowNode{Id: "node", SlaHours: 24, SupervisorOrg: "@org2.example.com"}
+	if ValidateSlaNode(node) != nil {
+		fmt.Println("节点时限应校验通过")
+		t.FailNow()
+	}
+	node.SlaHours = 0
+	if ValidateSlaNode(node) == nil {
+		fmt.Println("督办机构需要设置时限")
+		t.FailNow()
+	}
+	node.SlaHours = -1
+	if ValidateSlaNode(node) == nil {
+		fmt.Println("时限不能为负数")
+		t.FailNow()
+	}
+	enterTime := time.Date(2018, 3, 16, 8, 0, 0, 0, time.UTC)
+	if GetNodeDueTime(WorkflowNode{SlaHours: 24}, enterTime) != "2018-03-17T08:00:00.000000000Z" || GetNodeDueTime(WorkflowNode{}, enterTime) != "" {
+		fmt.Println("到期时间不正确")
+		t.FailNow()
+	}
+}
+
+// 测试超时查询和督办机构接管
+func Test_EscalateProcess(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	response := MockCreateSlaWorkflow(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	MockCreateProject2(t, stub)
+	stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("start_process"),
+		[]byte(`{"id":"test_process_007","workflowId":"test_sla_workflow-001","attachDocType":"project","attachDocId":"project-bankcomm-000002","createTime":"2018-3-19 09:43:02"}`),
+	})
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("transfer_process"),
+		[]byte("test_process_007"),
+		[]byte("test_sla_workflow-001:node-2"),
+		[]byte("@org1.example.com"),
+		[]byte("2018-03-16 15:54:00"),
+	})
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var process Process
+	json.Unmarshal(stub.State["test_process_007"], &process)
+	dueTime, err := time.Parse(TimestampLayout, process.DueTime)
+	if err != nil || dueTime.Sub(time.Now()) < 23*time.Hour {
+		fmt.Println("到达限时节点时应计算到期时间 - " + process.DueTime)
+		t.FailNow()
+	}
+
+	// 未超时时不能接管
+	if len(MockQueryOverdueProcess(t, stub, "Test@org1.example.com", "")) != 0 {
+		fmt.Println("未超时的流程不应查到")
+		t.FailNow()
+	}
+	response = MockEscalateProcess(t, stub, "Test@org2.example.com")
+	if response.Status != shim.ERROR {
+		fmt.Println("未超时的流程不能接管")
+		t.FailNow()
+	}
+
+	// 模拟超时
+	process.DueTime = "2018-03-17T00:00:00.000000000Z"
+	stub.State["test_process_007"], _ = json.Marshal(process)
+	if len(MockQueryOverdueProcess(t, stub, "Test@org1.example.com", "")) != 1 {
+		fmt.Println("拥有机构应查到超时流程")
+		t.FailNow()
+	}
+	if len(MockQueryOverdueProcess(t, stub, "Test@org2.example.com", "@org1.example.com")) != 1 {
+		fmt.Println("督办机构应查到超时流程")
+		t.FailNow()
+	}
+	if len(MockQueryOverdueProcess(t, stub, "Test@org3.example.com", "@org1.example.com")) != 0 {
+		fmt.Println("无关机构不应查到超时流程")
+		t.FailNow()
+	}
+
+	// 只有督办机构可以接管
+	response = MockEscalateProcess(t, stub, "Test@org3.example.com")
+	if response.Status != shim.ERROR {
+		fmt.Println("非督办机构不能接管")
+		t.FailNow()
+	}
+	response = MockEscalateProcess(t, stub, "Test@org2.example.com")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	process = Process{}
+	json.Unmarshal(stub.State["test_process_007"], &process)
+	if process.CurrentOwner != "@org2.example.com" || process.DueTime != "" {
+		fmt.Println("接管后拥有机构应为督办机构且不再计时")
+		t.FailNow()
+	}
+	var log ProcessLog
+	json.Unmarshal(stub.State["processLog-test_process_007-"+IndexSeq(2)], &log)
+	if log.Operation != "EscalateProcess" || log.FromOrg != "@org1.example.com" || log.ToOrg != "@org2.example.com" {
+		fmt.Println("接管应记录日志")
+		t.FailNow()
+	}
+	if len(MockQueryOverdueProcess(t, stub, "Test@org1.example.com", "")) != 0 {
+		fmt.Println("接管后不应再查到超时流程")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// 子流程节点：节点的subWorkflowId不为空时，流程到达该节点后在同一附加文档上启动子流程，
+// 父流程在该节点阻塞，子流程办结后自动流转到下一节点，下一节点的拥有人为子流程节点的拥有人；
+// 子流程取消时按节点的subCanceledAction处理
+
+// 子流程的树形结构，用于查询父子流程
+type ProcessTree struct {
+	Process
+	SubProcesses []ProcessTree `json:"subProcesses"`
+}
+
+// =============================================================================
+// 是否为子流程节点
+// =============================================================================
+func IsSubProcessNode(node WorkflowNode) bool {
+	return node.SubWorkflowId != ""
+}
+
+// =============================================================================
+// 子流程取消时父流程的处理方式，未设置时取消父流程
+// cancel：取消父流程；continue：视为子流程办结，继续流转；release：解除阻塞，由节点拥有人手工处理
+// =============================================================================
+func GetSubCanceledAction(node WorkflowNode) string {
+	if node.SubCanceledAction == "" {
+		return "cancel"
+	}
+	return node.SubCanceledAction
+}
+
+// =============================================================================
+// 校验子流程节点的设置
+// 子流程节点不能是第一个节点、会签节点或并行节点，自动流转时只能有一个下一节点或按路由条件选择下一节点
+// =============================================================================
+func ValidateSubProcessNode(node WorkflowNode, firstNode bool, nextCount int, conditional bool) error {
+	if !IsSubProcessNode(node) {
+		if node.SubCanceledAction != "" {
+			return errors.New("Sub canceled action requires subWorkflowId - " + node.Id)
+		}
+		return nil
+	}
+	if firstNode {
+		return errors.New("First node can not be a sub process node - " + node.Id)
+	}
+	if IsApprovalNode(node) {
+		return errors.New("Sub process node can not be an approval node - " + node.Id)
+	}
+	if node.SplitType == "parallel" {
+		return errors.New("Sub process node can not split into parallel branches - " + node.Id)
+	}
+	if nextCount > 1 && !conditional {
+		return errors.New("Sub process node must have a single next node or routes - " + node.Id)
+	}
+	action := GetSubCanceledAction(node)
+	if action != "cancel" && action != "continue" && action != "release" {
+		return errors.New("Sub canceled action must be cancel, continue or release - " + node.Id)
+	}
+	return nil
+}
+
+// =============================================================================
+// 为到达子流程节点的分支启动子流程，已启动过子流程的分支不再启动
+// =============================================================================
+func StartSubProcesses(stub shim.ChaincodeStubInterface, process *Process, submitter string, businessDate string) error {
+	if process.Finished || process.Canceled {
+		return nil
+	}
+	branches := GetProcessBranches(*process)
+	started := false
+	for i := range branches {
+		if branches[i].Waiting || branches[i].SubProcessId != "" {
+			continue
+		}
+		node, err := GetWorkflowNodeById(stub, branches[i].NodeId)
+		if err != nil {
+			return err
+		}
+		if !IsSubProcessNode(node) {
+			continue
+		}
+		subProcess, err := StartSubProcess(stub, *process, node, branches[i].Owner, submitter, businessDate)
+		if err != nil {
+			return err
+		}
+		branches[i].SubProcessId = subProcess.Id
+		branches[i].Blocked = true
+		process.SubProcessIds = append(process.SubProcessIds, subProcess.Id)
+		started = true
+	}
+	if started {
+		SetProcessBranches(process, branches)
+	}
+	return nil
+}
+
+// =============================================================================
+// 在父流程的附加文档上启动子流程，子流程的拥有人为子流程节点的拥有人
+// =============================================================================
+func StartSubProcess(stub shim.ChaincodeStubInterface, parent Process, node WorkflowNode, owner string, submitter string, businessDate string) (Process, error) {
+	var subProcess Process
+	workflowDef, err := GetLatestWorkflowDef(stub, node.SubWorkflowId, true)
+	if err != nil {
+		return subProcess, errors.New("Sub workflow is disabled - " + node.SubWorkflowId)
+	}
+	workflowNodes, _, err := GetAllNodesByWorkflowId(stub, workflowDef.Id)
+	if err != nil {
+		return subProcess, err
+	}
+	firstNode, err := GetFirstNode(workflowNodes)
+	if err != nil {
+		return subProcess, err
+	}
+	if firstNode.AccessOrgs != nil && !ContainsString(firstNode.AccessOrgs, owner) {
+		return subProcess, errors.New("Owner's org are not allowed to start sub process - " + owner)
+	}
+
+	subProcess.Id = parent.Id + ":sub-" + strconv.Itoa(len(parent.SubProcessIds)+1)
+	_, err = GetProcessById(stub, subProcess.Id)
+	if err == nil {
+		return subProcess, errors.New("This process already exists - " + subProcess.Id)
+	}
+	txTime, err := GetTxTime(stub)
+	if err != nil {
+		return subProcess, err
+	}
+	createTime, err := GetTxTimeString(stub)
+	if err != nil {
+		return subProcess, err
+	}
+
+	subProcess.DocType = "process"
+	subProcess.AttachDocType = parent.AttachDocType
+	subProcess.AttachDocId = parent.AttachDocId
+	subProcess.AttachDocName = parent.AttachDocName
+	subProcess.WorkflowId = workflowDef.Id
+	subProcess.WorkflowVersion = workflowDef.Version
+	subProcess.WorkflowName = workflowDef.WorkflowName
+	subProcess.ParentProcessId = parent.Id
+	subProcess.ParentNodeId = node.Id
+	subProcess.CurrentNodeId = firstNode.Id
+	subProcess.CurrentNodeName = firstNode.NodeName
+	subProcess.CurrentOwner = owner
+	subProcess.PendingApprovers = GetPendingApprovers(firstNode)
+	subProcess.DueTime = GetNodeDueTime(firstNode, txTime)
+	subProcess.Participants = []string{owner}
+	subProcess.Creator = submitter
+	subProcess.LastModifier = submitter
+	subProcess.CreateTime = createTime
+	subProcess.ModifyTime = createTime
+	subProcess.BusinessDate = businessDate
+
+	err = PutProcess(stub, subProcess)
+	if err != nil {
+		return subProcess, err
+	}
+	err = StoreProcessLog(stub, true, subProcess.Id, "Init", "开始", "", subProcess.CurrentNodeId, subProcess.CurrentNodeName, subProcess.CurrentOwner, "InitProcess", "父流程："+parent.Id, businessDate)
+	if err != nil {
+		return subProcess, err
+	}
+	return subProcess, nil
+}
+
+// =============================================================================
+// 子流程办结或取消后处理父流程
+// 父流程继续流转、取消或解除阻塞，父流程因此办结或取消时继续处理上一级流程
+// =============================================================================
+func CompleteSubProcess(stub shim.ChaincodeStubInterface, subProcess Process, submitter string, modifyTime string, businessDate string) error {
+	if subProcess.ParentProcessId == "" {
+		return nil
+	}
+	parent, err := GetProcessById(stub, subProcess.ParentProcessId)
+	if err != nil {
+		return err
+	}
+	if parent.Finished || parent.Canceled {
+		return nil
+	}
+	branches := GetProcessBranches(parent)
+	branchIndex := -1
+	for i := range branches {
+		if branches[i].Blocked && branches[i].SubProcessId == subProcess.Id {
+			branchIndex = i
+		}
+	}
+	if branchIndex == -1 {
+		return nil
+	}
+	branch := branches[branchIndex]
+	currentNode, err := GetWorkflowNodeById(stub, branch.NodeId)
+	if err != nil {
+		return err
+	}
+
+	log := ProcessLog{
+		ProcessId:    parent.Id,
+		FromNodeId:   currentNode.Id,
+		FromNodeName: currentNode.NodeName,
+		FromOrg:      branch.Owner,
+		BusinessDate: businessDate,
+	}
+	action := "continue"
+	log.Remark = "子流程办结：" + subProcess.Id
+	if subProcess.Canceled {
+		action = GetSubCanceledAction(currentNode)
+		log.Remark = "子流程取消：" + subProcess.Id
+	}
+	switch action {
+	case "release":
+		branch.Blocked = false
+		branches[branchIndex] = branch
+		SetProcessBranches(&parent, branches)
+		log.ToNodeId = currentNode.Id
+		log.ToNodeName = currentNode.NodeName
+		log.ToOrg = branch.Owner
+		log.Operation = "ReleaseProcess"
+	case "cancel":
+		parent.Canceled = true
+		log.ToNodeId = "Canceled"
+		log.ToNodeName = "取消"
+		log.Operation = "CancelProcess"
+		err = CancelSubProcesses(stub, parent, subProcess.Id, submitter, modifyTime, businessDate)
+		if err != nil {
+			return err
+		}
+	default:
+		txTime, err := GetTxTime(stub)
+		if err != nil {
+			return err
+		}
+		log.Operation = "TransferProcess"
+		err = AutoTransferBranch(stub, &parent, branches, branchIndex, currentNode, &log, txTime)
+		if err != nil {
+			return err
+		}
+		err = StartSubProcesses(stub, &parent, submitter, businessDate)
+		if err != nil {
+			return err
+		}
+	}
+
+	parent.LastModifier = submitter
+	parent.ModifyTime = modifyTime
+	parent.BusinessDate = businessDate
+	err = PutProcess(stub, parent)
+	if err != nil {
+		return err
+	}
+	err = SaveProcessLog(stub, false, log)
+	if err != nil {
+		return err
+	}
+	if parent.Finished || parent.Canceled {
+		return CompleteSubProcess(stub, parent, submitter, modifyTime, businessDate)
+	}
+	return nil
+}
+
+// =============================================================================
+// 取消流程时取消正在运行的子流程，exceptId为已取消的子流程
+// =============================================================================
+func CancelSubProcesses(stub shim.ChaincodeStubInterface, process Process, exceptId string, submitter string, modifyTime string, businessDate string) error {
+	for _, branch := range GetProcessBranches(process) {
+		if !branch.Blocked || branch.SubProcessId == exceptId {
+			continue
+		}
+		subProcess, err := GetProcessById(stub, branch.SubProcessId)
+		if err != nil {
+			return err
+		}
+		if subProcess.Finished || subProcess.Canceled {
+			continue
+		}
+		subProcess.Canceled = true
+		subProcess.LastModifier = submitter
+		subProcess.ModifyTime = modifyTime
+		subProcess.BusinessDate = businessDate
+		err = PutProcess(stub, subProcess)
+		if err != nil {
+			return err
+		}
+		err = StoreProcessLog(stub, false, subProcess.Id, subProcess.CurrentNodeId, subProcess.CurrentNodeName, subProcess.CurrentOwner, "Canceled", "取消", "", "CancelProcess", "父流程取消："+process.Id, businessDate)
+		if err != nil {
+			return err
+		}
+		err = CancelSubProcesses(stub, subProcess, "", submitter, modifyTime, businessDate)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// =============================================================================
+// 流程所在的父子流程树，从最上层的父流程开始
+// =============================================================================
+func GetProcessTree(stub shim.ChaincodeStubInterface, process Process) (ProcessTree, error) {
+	for process.ParentProcessId != "" {
+		parent, err := GetProcessById(stub, process.ParentProcessId)
+		if err != nil {
+			return ProcessTree{}, err
+		}
+		process = parent
+	}
+	return BuildProcessTree(stub, process)
+}
+
+// 按子流程ID递归构建子流程树
+func BuildProcessTree(stub shim.ChaincodeStubInterface, process Process) (ProcessTree, error) {
+	tree := ProcessTree{Process: process, SubProcesses: []ProcessTree{}}
+	for _, id := range process.SubProcessIds {
+		subProcess, err := GetProcessById(stub, id)
+		if err != nil {
+			return tree, err
+		}
+		subTree, err := BuildProcessTree(stub, subProcess)
+		if err != nil {
+			return tree, err
+		}
+		tree.SubProcesses = append(tree.SubProcesses, subTree)
+	}
+	return tree, nil
+}
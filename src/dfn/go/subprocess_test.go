@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mock 创建子流程使用的线性工作流
+func MockCreateSubWorkflow(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_linear_workflow"),
+		[]byte(`{"id":"test_sub_workflow-001","workflowName":"法律尽调","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`{"nodeName":"尽调发起","accessOrgs":["@org1.example.com"]}`),
+		[]byte(`{"nodeName":"尽调复核","accessOrgs":["@org1.example.com"]}`),
+	})
+	return response
+}
+
+// mock 创建第二个节点为子流程节点的线性工作流
+func MockCreateParentWorkflow(t *testing.T, stub *shim.MockStub, id string, canceledAction string) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_linear_workflow"),
+		[]byte(`{"id":"` + id + `","workflowName":"发行审批","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`{"nodeName":"发起行","accessOrgs":["@org1.example.com"]}`),
+		[]byte(`{"nodeName":"法律尽调","accessOrgs":["@org1.example.com"],"subWorkflowId":"test_sub_workflow-001","subCanceledAction":"` + canceledAction + `"}`),
+		[]byte(`{"nodeName":"发行机构","accessOrgs":["@org1.example.com"]}`),
+	})
+	return response
+}
+
+// mock 启动父流程并流转到子流程节点
+func MockStartParentProcess(t *testing.T, stub *shim.MockStub, processId string, workflowId string) pb.Response {
+	stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("start_process"),
+		[]byte(`{"id":"` + processId + `","workflowId":"` + workflowId + `","attachDocType":"project","attachDocId":"project-bankcomm-000002","createTime":"2018-3-19 09:43:02"}`),
+	})
+	return MockTransferTo(t, stub, processId, workflowId+":node-2")
+}
+
+// mock 流转到指定节点，拥有人为org1
+func MockTransferTo(t *testing.T, stub *shim.MockStub, processId string, nodeId string) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("transfer_process"),
+		[]byte(processId),
+		[]byte(nodeId),
+		[]byte("@org1.example.com"),
+		[]byte("2018-03-16 15:54:00"),
+	})
+	return response
+}
+
+// 测试子流程节点的设置
+func Test_ValidateSubProcessNode(t *testing.T) {
+	node := WorkflowNode{Id: "node", SubWorkflowId: "test_sub_workflow-001"}
+	if ValidateSubProcessNode(node, false, 1, false) != nil || GetSubCanceledAction(node) != "cancel" {
+		fmt.Println("子流程节点应校验通过，默认取消父流程")
+		t.FailNow()
+	}
+	if ValidateSubProcessNode(node, true, 1, false) == nil {
+		fmt.Println("第一个节点不能是子流程节点")
+		t.FailNow()
+	}
+	node.SubCanceledAction = "ignore"
+	if ValidateSubProcessNode(node, false, 1, false) == nil {
+		fmt.Println("子流程取消的处理方式不正确应报错")
+		t.FailNow()
+	}
+	node.SubCanceledAction = "release"
+	node.ApprovalOrgs = []string{"@org1.example.com"}
+	if ValidateSubProcessNode(node, false, 1, false) == nil {
+		fmt.Println("会签节点不能是子流程节点")
+		t.FailNow()
+	}
+}
+
+// 测试子流程办结后父流程继续流转
+func Test_SubProcess(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateSubWorkflow(t, stub)
+	response := MockCreateParentWorkflow(t, stub, "test_parent_workflow-001", "")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	MockCreateProject2(t, stub)
+	response = MockStartParentProcess(t, stub, "test_process_008", "test_parent_workflow-001")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+
+	var parent Process
+	json.Unmarshal(stub.State["test_process_008"], &parent)
+	var child Process
+	json.Unmarshal(stub.State["test_process_008:sub-1"], &child)
+	if !parent.Blocked || parent.SubProcessId != child.Id || child.ParentProcessId != parent.Id || child.AttachDocId != parent.AttachDocId || child.CurrentOwner != "@org1.example.com" {
+		fmt.Println("到达子流程节点时应启动子流程并阻塞父流程")
+		t.FailNow()
+	}
+
+	// 父流程等待子流程时不能流转，待办中只有子流程
+	response = MockTransferTo(t, stub, "test_process_008", "test_parent_workflow-001:node-3")
+	if response.Status != shim.ERROR {
+		fmt.Println("等待子流程时不能流转")
+		t.FailNow()
+	}
+	response = MockQueryTodoProcess(t, stub)
+	var todos []Process
+	json.Unmarshal(response.Payload, &todos)
+	if len(todos) != 1 || todos[0].Id != child.Id {
+		fmt.Println("待办中应只有子流程")
+		t.FailNow()
+	}
+
+	// 子流程办结后父流程自动流转
+	MockTransferTo(t, stub, child.Id, "test_sub_workflow-001:node-2")
+	response = MockTransferTo(t, stub, child.Id, "")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	parent = Process{}
+	json.Unmarshal(stub.State["test_process_008"], &parent)
+	if parent.Blocked || parent.CurrentNodeId != "test_parent_workflow-001:node-3" {
+		fmt.Println("子流程办结后父流程应流转到下一节点")
+		t.FailNow()
+	}
+	var log ProcessLog
+	json.Unmarshal(stub.State["processLog-test_process_008-"+IndexSeq(2)], &log)
+	if log.Operation != "TransferProcess" || log.ToNodeId != parent.CurrentNodeId {
+		fmt.Println("父流程应记录自动流转日志")
+		t.FailNow()
+	}
+
+	// 从子流程查询父子流程树
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("get_process_by_id"),
+		[]byte(child.Id),
+		[]byte("tree"),
+	})
+	var tree ProcessTree
+	json.Unmarshal(response.Payload, &tree)
+	if tree.Id != parent.Id || len(tree.SubProcesses) != 1 || tree.SubProcesses[0].Id != child.Id || !tree.SubProcesses[0].Finished {
+		fmt.Println("应返回从父流程开始的流程树")
+		t.FailNow()
+	}
+}
+
+// 测试子流程取消时父流程的处理
+func Test_CancelSubProcess(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateSubWorkflow(t, stub)
+	MockCreateParentWorkflow(t, stub, "test_parent_workflow-001", "")
+	MockCreateParentWorkflow(t, stub, "test_parent_workflow-002", "release")
+	MockCreateProject2(t, stub)
+	MockStartParentProcess(t, stub, "test_process_008", "test_parent_workflow-001")
+	MockStartParentProcess(t, stub, "test_process_009", "test_parent_workflow-002")
+
+	cancelArgs := [][]byte{
+		[]byte("cancel_process"),
+		[]byte("test_process_008:sub-1"),
+		[]byte("2018-03-16 15:54:00"),
+	}
+	response := stub.MockInvoke(GetTestTxID(), cancelArgs)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var parent Process
+	json.Unmarshal(stub.State["test_process_008"], &parent)
+	if !parent.Canceled {
+		fmt.Println("默认取消父流程")
+		t.FailNow()
+	}
+
+	// 解除阻塞后由节点拥有人手工流转
+	cancelArgs[1] = []byte("test_process_009:sub-1")
+	response = stub.MockInvoke(GetTestTxID(), cancelArgs)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	parent = Process{}
+	json.Unmarshal(stub.State["test_process_009"], &parent)
+	if parent.Canceled || parent.Blocked || parent.CurrentNodeId != "test_parent_workflow-002:node-2" {
+		fmt.Println("子流程取消后父流程应解除阻塞")
+		t.FailNow()
+	}
+	response = MockTransferTo(t, stub, "test_process_009", "test_parent_workflow-002:node-3")
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+
+	// 取消父流程时同时取消子流程
+	MockStartParentProcess(t, stub, "test_process_010", "test_parent_workflow-002")
+	cancelArgs[1] = []byte("test_process_010")
+	response = stub.MockInvoke(GetTestTxID(), cancelArgs)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	var child Process
+	json.Unmarshal(stub.State["test_process_010:sub-1"], &child)
+	if !child.Canceled {
+		fmt.Println("取消父流程时应取消子流程")
+		t.FailNow()
+	}
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -14,15 +14,19 @@ import (
 type WorkflowDef struct {
 	DocType      string `json:"docType"`
 	Id           string `json:"id"`
+	BaseId       string `json:"baseId"`  // 工作流ID，同一工作流的各版本相同
+	Version      int    `json:"version"` // 版本号，从1开始，第一个版本的ID即为工作流ID
 	SubDocType   string `json:"subDocType"`
 	WorkflowName string `json:"workflowName"`
 	AccessRoles  []string `json:"accessRoles"`
 	AccessOrgs   []string `json:"accessOrgs"`
+	AllowCycles  bool   `json:"allowCycles"` // 图流程是否允许出现环路
 	Enabled      bool   `json:"enabled"`
 	Creator      string `json:"creator"`      // 创建人
 	LastModifier string `json:"lastModifier"` // 最后修改人
 	CreateTime   string `json:"createTime"`         // 创建时间
 	ModifyTime   string `json:"modifyTime"`         // 修改时间
+	BusinessDate string `json:"businessDate"`       // 业务日期，客户端传入
 }
 
 type WorkflowNode struct {
@@ -36,6 +40,27 @@ type WorkflowNode struct {
 	NextNodeIds []string `json:"nextNodeIds"`
 	FirstNode   bool     `json:"firstNode"`
 	LastNode    bool     `json:"lastNode"`
+	SplitType   string   `json:"splitType"` // 分支类型：exclusive（单选，默认）或 parallel（并行）
+	JoinType    string   `json:"joinType"`  // 汇聚类型：any（任一到达，默认）或 all（等待全部并行分支）
+	OptionalNextNodeIds []string `json:"optionalNextNodeIds"` // 并行分支中可跳过的下一节点
+	Routes      []WorkflowRoute `json:"routes"` // 带条件的路由，由链码根据附加文档选择下一节点
+	ApprovalOrgs   []string `json:"approvalOrgs"`   // 会签机构，不为空时为会签节点
+	ApprovalQuorum int      `json:"approvalQuorum"` // 会签通过需要的同意机构数，为0时需要全部会签机构同意
+	SlaHours       int      `json:"slaHours"`       // 节点处理时限（小时），为0时不限时
+	SupervisorOrg  string   `json:"supervisorOrg"`  // 督办机构，可以接管超时的流程
+	SubWorkflowId     string `json:"subWorkflowId"`     // 子流程的工作流ID，不为空时为子流程节点
+	SubCanceledAction string `json:"subCanceledAction"` // 子流程取消时父流程的处理方式：cancel（默认）、continue 或 release
+	RequiredAttachmentTypes []string `json:"requiredAttachmentTypes"` // 离开节点前必须登记的附件类型
+	RequiredFields          []string `json:"requiredFields"`          // 离开节点前附加文档中必须不为空的字段
+	FormSchema              *FormSchema `json:"formSchema"`           // 节点表单的JSON Schema，流转或退回时按其校验表单数据
+}
+
+// 图流程的边，From/To 为节点在创建参数中的 id
+type WorkflowEdge struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Optional bool   `json:"optional"` // 并行分支时可跳过
+	Condition *RouteCondition `json:"condition"` // 路由条件
 }
 
 type Workflow struct {
@@ -47,6 +72,7 @@ type Workflow struct {
 // 创建线性流程
 // 第一个参数为工作流定义
 // 之后为线性顺序的节点列表
+// 工作流ID已存在时，由创建机构以新的节点发布新版本
 // =============================================================================
 func create_linear_workflow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
@@ -68,12 +94,33 @@ func create_linear_workflow(stub shim.ChaincodeStubInterface, args []string) pb.
 		return shim.Error(err.Error())
 	}
 
-	//check if already exists
+	err = ValidateWorkflowId(workflowDef.Id)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// 工作流已存在时由创建机构发布新版本，节点按本次参数重新生成
 	workflowDefInStore, err := GetWorkflowDefById(stub, workflowDef.Id)
-	if err == nil {
-		fmt.Println("This workflowDef already exists - " + workflowDef.Id)
-		fmt.Println(workflowDefInStore)
-		return shim.Error("This workflowDef already exists - " + workflowDef.Id)
+	if err == nil && workflowDefInStore.DocType == "workflow" {
+		err = PrepareWorkflowVersion(stub, &workflowDef, creator)
+		if err != nil {
+			fmt.Println(err.Error())
+			return shim.Error(err.Error())
+		}
+	} else {
+		// 新建的工作流为第一个版本
+		workflowDef.BaseId = workflowDef.Id
+		workflowDef.Version = 1
+	}
+
+	// 客户端传入的创建时间作为业务日期
+	if workflowDef.BusinessDate == "" {
+		workflowDef.BusinessDate = workflowDef.CreateTime
+	}
+	createTime, err := GetModifyTime(stub, workflowDef.BusinessDate)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
 	workflowDef.DocType = "workflow"
@@ -81,11 +128,12 @@ func create_linear_workflow(stub shim.ChaincodeStubInterface, args []string) pb.
 	workflowDef.Enabled = true
 	workflowDef.Creator = creator
 	workflowDef.LastModifier = creator
-	workflowDef.ModifyTime = workflowDef.CreateTime
+	workflowDef.CreateTime = createTime
+	workflowDef.ModifyTime = createTime
 
 	// 获取流程节点
 	var workflowNode WorkflowNode
-	var workflowNodeAsBytes []byte
+	var workflowNodes []WorkflowNode
 
 	for i := 1; i < len(args); i++ {
 		workflowNode = WorkflowNode{}
@@ -105,22 +153,51 @@ func create_linear_workflow(stub shim.ChaincodeStubInterface, args []string) pb.
 		if i == len(args)-1 {
 			workflowNode.LastNode = true
 		}
+		err = ValidateApprovalNode(workflowNode, 1, false)
+		if err == nil {
+			err = ValidateSlaNode(workflowNode)
+		}
+		if err == nil {
+			err = ValidateSubProcessNode(workflowNode, workflowNode.FirstNode, 1, false)
+		}
+		if err == nil {
+			err = ValidateReadinessNode(workflowNode)
+		}
+		if err == nil {
+			err = ValidateFormSchema(workflowNode)
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			return shim.Error(err.Error())
+		}
 		if !workflowNode.FirstNode {
 			workflowNode.PrevNodeIds = []string{workflowDef.Id + ":node-" + strconv.Itoa(i-1)}
 		}
 		if !workflowNode.LastNode {
 			workflowNode.NextNodeIds = []string{workflowDef.Id + ":node-" + strconv.Itoa(i+1)}
 		}
-		workflowNodeAsBytes, _ = json.Marshal(workflowNode)
+		workflowNodes = append(workflowNodes, workflowNode)
+	}
+
+	err = CheckWorkflowKeysFree(stub, workflowDef.Id, workflowNodes)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	for i := 0; i < len(workflowNodes); i++ {
+		workflowNodeAsBytes, _ := json.Marshal(workflowNodes[i])
 		fmt.Println("store node:" + string(workflowNodeAsBytes))
-		err = stub.PutState(workflowNode.Id, workflowNodeAsBytes) //store with id as key
+		err = stub.PutState(workflowNodes[i].Id, workflowNodeAsBytes) //store with id as key
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = PutIndex(stub, WorkflowNodeIndex, workflowDef.Id, IndexSeq(i+1), workflowNodes[i].Id)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
 	}
 
-	workflowDefAsBytes, _ := json.Marshal(workflowDef)
-	err = stub.PutState(workflowDef.Id, workflowDefAsBytes) //store with id as key
+	err = PutWorkflowDef(stub, workflowDef)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -129,6 +206,443 @@ func create_linear_workflow(stub shim.ChaincodeStubInterface, args []string) pb.
 	return shim.Success(nil)
 }
 
+// =============================================================================
+// 创建图流程（支持分支、并行、汇聚）
+// 第一个参数为工作流定义
+// 第二个参数为节点列表（JSON数组），节点id在流程内唯一
+// 第三个参数为边列表（JSON数组）
+// 工作流ID已存在时，由创建机构以新的节点和边发布新版本
+// =============================================================================
+func create_graph_workflow(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	var workflowDef WorkflowDef
+	var workflowNodes []WorkflowNode
+	var workflowEdges []WorkflowEdge
+	fmt.Println("starting create_graph_workflow")
+
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	creator, err := GetSubmitterName(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// 获取流程定义
+	err = json.Unmarshal([]byte(args[0]), &workflowDef)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	err = json.Unmarshal([]byte(args[1]), &workflowNodes)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	err = json.Unmarshal([]byte(args[2]), &workflowEdges)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	err = ValidateWorkflowId(workflowDef.Id)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// 工作流已存在时由创建机构发布新版本，节点按本次参数重新生成
+	workflowDefInStore, err := GetWorkflowDefById(stub, workflowDef.Id)
+	if err == nil && workflowDefInStore.DocType == "workflow" {
+		err = PrepareWorkflowVersion(stub, &workflowDef, creator)
+		if err != nil {
+			fmt.Println(err.Error())
+			return shim.Error(err.Error())
+		}
+	} else {
+		// 新建的工作流为第一个版本
+		workflowDef.BaseId = workflowDef.Id
+		workflowDef.Version = 1
+	}
+
+	// 校验并生成节点
+	workflowNodes, err = BuildWorkflowGraph(workflowDef.Id, workflowNodes, workflowEdges, workflowDef.AllowCycles)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// 客户端传入的创建时间作为业务日期
+	if workflowDef.BusinessDate == "" {
+		workflowDef.BusinessDate = workflowDef.CreateTime
+	}
+	createTime, err := GetModifyTime(stub, workflowDef.BusinessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	workflowDef.DocType = "workflow"
+	workflowDef.SubDocType = "graph"
+	workflowDef.Enabled = true
+	workflowDef.Creator = creator
+	workflowDef.LastModifier = creator
+	workflowDef.CreateTime = createTime
+	workflowDef.ModifyTime = createTime
+
+	err = CheckWorkflowKeysFree(stub, workflowDef.Id, workflowNodes)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	for i := 0; i < len(workflowNodes); i++ {
+		if workflowNodes[i].FirstNode {
+			workflowDef.AccessRoles = workflowNodes[i].AccessRoles
+			workflowDef.AccessOrgs = workflowNodes[i].AccessOrgs
+		}
+		workflowNodeAsBytes, _ := json.Marshal(workflowNodes[i])
+		fmt.Println("store node:" + string(workflowNodeAsBytes))
+		err = stub.PutState(workflowNodes[i].Id, workflowNodeAsBytes) //store with id as key
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = PutIndex(stub, WorkflowNodeIndex, workflowDef.Id, IndexSeq(i), workflowNodes[i].Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = PutWorkflowDef(stub, workflowDef)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end create_graph_workflow")
+	return shim.Success(nil)
+}
+
+// =============================================================================
+// 校验图流程并生成节点
+// 要求：唯一的开始节点、所有节点均可从开始节点到达、所有节点均可到达结束节点，
+// 并行分支在结束之前汇聚，未设置allowCycles时不允许环路
+// =============================================================================
+func BuildWorkflowGraph(workflowId string, nodes []WorkflowNode, edges []WorkflowEdge, allowCycles bool) ([]WorkflowNode, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("Workflow graph has no nodes")
+	}
+
+	// 节点id -> 下标
+	indexes := map[string]int{}
+	for i := 0; i < len(nodes); i++ {
+		key := nodes[i].Id
+		if key == "" {
+			return nil, errors.New("Node id is required in workflow graph")
+		}
+		if _, exists := indexes[key]; exists {
+			return nil, errors.New("Duplicate node id in workflow graph - " + key)
+		}
+		switch nodes[i].SplitType {
+		case "", "exclusive", "parallel":
+		default:
+			return nil, errors.New("Unknown splitType of node - " + key)
+		}
+		switch nodes[i].JoinType {
+		case "", "any", "all":
+		default:
+			return nil, errors.New("Unknown joinType of node - " + key)
+		}
+		indexes[key] = i
+	}
+
+	nexts := make([][]int, len(nodes))
+	prevs := make([][]int, len(nodes))
+	optionals := make([][]int, len(nodes))
+	conditions := make([][]*RouteCondition, len(nodes))
+	conditional := make([]bool, len(nodes))
+	for _, edge := range edges {
+		from, ok := indexes[edge.From]
+		if !ok {
+			return nil, errors.New("Edge refers to unknown node - " + edge.From)
+		}
+		to, ok := indexes[edge.To]
+		if !ok {
+			return nil, errors.New("Edge refers to unknown node - " + edge.To)
+		}
+		for _, n := range nexts[from] {
+			if n == to {
+				return nil, errors.New("Duplicate edge in workflow graph - " + edge.From + " -> " + edge.To)
+			}
+		}
+		nexts[from] = append(nexts[from], to)
+		prevs[to] = append(prevs[to], from)
+		if edge.Optional {
+			optionals[from] = append(optionals[from], to)
+		}
+		if edge.Condition != nil {
+			err := ValidateRouteCondition(*edge.Condition)
+			if err != nil {
+				return nil, err
+			}
+			conditional[from] = true
+		}
+		conditions[from] = append(conditions[from], edge.Condition)
+	}
+
+	// 单选分支最多只能有一条默认路由
+	for i := 0; i < len(nodes); i++ {
+		if !conditional[i] || nodes[i].SplitType == "parallel" {
+			continue
+		}
+		defaults := 0
+		for _, condition := range conditions[i] {
+			if condition == nil {
+				defaults++
+			}
+		}
+		if defaults > 1 {
+			return nil, errors.New("Conditional node can have only one default route - " + nodes[i].Id)
+		}
+	}
+
+	// 唯一的开始节点
+	start := -1
+	for i := 0; i < len(nodes); i++ {
+		if len(prevs[i]) == 0 {
+			if start != -1 {
+				return nil, errors.New("Workflow graph must have a single start node")
+			}
+			start = i
+		}
+	}
+	if start == -1 {
+		return nil, errors.New("Workflow graph has no start node")
+	}
+
+	// 所有节点均可从开始节点到达
+	reached := walkWorkflowGraph([]int{start}, nexts)
+	for i := 0; i < len(nodes); i++ {
+		if !reached[i] {
+			return nil, errors.New("Node is not reachable from start node - " + nodes[i].Id)
+		}
+	}
+
+	// 所有节点均可到达结束节点
+	var ends []int
+	for i := 0; i < len(nodes); i++ {
+		if len(nexts[i]) == 0 {
+			ends = append(ends, i)
+		}
+	}
+	if len(ends) == 0 {
+		return nil, errors.New("Workflow graph has no end node")
+	}
+	reached = walkWorkflowGraph(ends, prevs)
+	for i := 0; i < len(nodes); i++ {
+		if !reached[i] {
+			return nil, errors.New("Node can not reach an end node - " + nodes[i].Id)
+		}
+	}
+
+	// 并行分支在到达结束节点之前必须汇聚，否则流程无法办结
+	err := checkParallelJoins(nodes, nexts)
+	if err != nil {
+		return nil, err
+	}
+
+	// 会签节点、节点时限、子流程节点、前置条件和表单的设置
+	for i := 0; i < len(nodes); i++ {
+		err := ValidateApprovalNode(nodes[i], len(nexts[i]), conditional[i])
+		if err == nil {
+			err = ValidateSlaNode(nodes[i])
+		}
+		if err == nil {
+			err = ValidateSubProcessNode(nodes[i], i == start, len(nexts[i]), conditional[i])
+		}
+		if err == nil {
+			err = ValidateReadinessNode(nodes[i])
+		}
+		if err == nil {
+			err = ValidateFormSchema(nodes[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !allowCycles && hasWorkflowGraphCycle(nexts) {
+		return nil, errors.New("Workflow graph contains a cycle")
+	}
+
+	nodeIds := make([]string, len(nodes))
+	for i := 0; i < len(nodes); i++ {
+		nodeIds[i] = workflowId + ":node-" + nodes[i].Id
+	}
+
+	results := make([]WorkflowNode, len(nodes))
+	for i := 0; i < len(nodes); i++ {
+		node := nodes[i]
+		node.DocType = "workflowNode"
+		node.WorkflowId = workflowId
+		node.Id = nodeIds[i]
+		node.FirstNode = i == start
+		node.LastNode = len(nexts[i]) == 0
+		node.PrevNodeIds = nil
+		node.NextNodeIds = nil
+		node.OptionalNextNodeIds = nil
+		for _, p := range prevs[i] {
+			node.PrevNodeIds = append(node.PrevNodeIds, nodeIds[p])
+		}
+		for _, n := range nexts[i] {
+			node.NextNodeIds = append(node.NextNodeIds, nodeIds[n])
+		}
+		for _, o := range optionals[i] {
+			node.OptionalNextNodeIds = append(node.OptionalNextNodeIds, nodeIds[o])
+		}
+		node.Routes = nil
+		if conditional[i] {
+			for j, n := range nexts[i] {
+				node.Routes = append(node.Routes, WorkflowRoute{NextNodeId: nodeIds[n], Condition: conditions[i][j]})
+			}
+		}
+		results[i] = node
+	}
+
+	return results, nil
+}
+
+// 从指定节点出发遍历图，返回可到达的节点
+func walkWorkflowGraph(starts []int, adjacency [][]int) []bool {
+	reached := make([]bool, len(adjacency))
+	queue := append([]int{}, starts...)
+	for _, s := range starts {
+		reached[s] = true
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, n := range adjacency[current] {
+			if !reached[n] {
+				reached[n] = true
+				queue = append(queue, n)
+			}
+		}
+	}
+	return reached
+}
+
+// 检查并行分支的汇聚：每个并行节点的所有分支都可以到达的汇聚节点为公共汇聚节点，
+// 各分支在经过公共汇聚节点之前不能到达结束节点
+func checkParallelJoins(nodes []WorkflowNode, nexts [][]int) error {
+	for i := 0; i < len(nodes); i++ {
+		if nodes[i].SplitType != "parallel" || len(nexts[i]) < 2 {
+			continue
+		}
+		var reaches [][]bool
+		for _, n := range nexts[i] {
+			reaches = append(reaches, walkWorkflowGraph([]int{n}, nexts))
+		}
+		joins := make([]bool, len(nodes))
+		for j := 0; j < len(nodes); j++ {
+			if nodes[j].JoinType != "all" {
+				continue
+			}
+			joins[j] = true
+			for _, reached := range reaches {
+				if !reached[j] {
+					joins[j] = false
+					break
+				}
+			}
+		}
+
+		// 从各分支出发，不经过公共汇聚节点遍历
+		visited := make([]bool, len(nodes))
+		var queue []int
+		for _, n := range nexts[i] {
+			if !joins[n] && !visited[n] {
+				visited[n] = true
+				queue = append(queue, n)
+			}
+		}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			if len(nexts[current]) == 0 {
+				return errors.New("Parallel branches must join before reaching an end node - " + nodes[i].Id + " -> " + nodes[current].Id)
+			}
+			for _, n := range nexts[current] {
+				if !joins[n] && !visited[n] {
+					visited[n] = true
+					queue = append(queue, n)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 检查图中是否存在环路
+func hasWorkflowGraphCycle(nexts [][]int) bool {
+	// 0: 未访问 1: 访问中 2: 已完成
+	states := make([]int, len(nexts))
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		states[i] = 1
+		for _, n := range nexts[i] {
+			if states[n] == 1 {
+				return true
+			}
+			if states[n] == 0 && visit(n) {
+				return true
+			}
+		}
+		states[i] = 2
+		return false
+	}
+	for i := 0; i < len(nexts); i++ {
+		if states[i] == 0 && visit(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// =============================================================================
+// 获取流程的开始节点
+// =============================================================================
+func GetFirstNode(workflowNodes []WorkflowNode) (WorkflowNode, error) {
+	for i := 0; i < len(workflowNodes); i++ {
+		if workflowNodes[i].FirstNode {
+			return workflowNodes[i], nil
+		}
+	}
+	return WorkflowNode{}, errors.New("Can not find the first node of workflow")
+}
+
+// =============================================================================
+// 判断从某节点出发是否能到达目标节点
+// =============================================================================
+func CanReachNode(stub shim.ChaincodeStubInterface, fromNodeId string, targetNodeId string) (bool, error) {
+	visited := map[string]bool{fromNodeId: true}
+	queue := []string{fromNodeId}
+	for len(queue) > 0 {
+		current, err := GetWorkflowNodeById(stub, queue[0])
+		if err != nil {
+			return false, err
+		}
+		queue = queue[1:]
+		for _, n := range current.NextNodeIds {
+			if n == targetNodeId {
+				return true, nil
+			}
+			if !visited[n] {
+				visited[n] = true
+				queue = append(queue, n)
+			}
+		}
+	}
+	return false, nil
+}
+
 // =============================================================================
 // Get WorkflowDef By id
 // =============================================================================
@@ -143,10 +657,178 @@ func GetWorkflowDefById(stub shim.ChaincodeStubInterface, id string) (WorkflowDe
 	if data.Id != id {
 		return data, errors.New("WorkflowDef does not exist - " + id)
 	}
+	// 版本化之前创建的工作流视为第一个版本
+	if data.Version == 0 {
+		data.BaseId = data.Id
+		data.Version = 1
+	}
 
 	return data, nil
 }
 
+// 工作流版本的ID，第一个版本使用工作流ID
+func GetWorkflowVersionId(baseId string, version int) string {
+	if version <= 1 {
+		return baseId
+	}
+	return baseId + ":v" + strconv.Itoa(version)
+}
+
+// =============================================================================
+// 查询工作流的全部版本，按版本号升序，id可以是任一版本的ID
+// =============================================================================
+func GetWorkflowVersions(stub shim.ChaincodeStubInterface, id string) ([]WorkflowDef, error) {
+	workflowDef, err := GetWorkflowDefById(stub, id)
+	if err != nil {
+		return nil, err
+	}
+	baseDef, err := GetWorkflowDefById(stub, workflowDef.BaseId)
+	if err != nil {
+		return nil, err
+	}
+
+	versionIds, err := GetIdsByIndex(stub, WorkflowVersionIndex, []string{baseDef.Id})
+	if err != nil {
+		return nil, err
+	}
+	versions := []WorkflowDef{baseDef}
+	for _, versionId := range versionIds {
+		if versionId == baseDef.Id {
+			continue
+		}
+		version, err := GetWorkflowDefById(stub, versionId)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// =============================================================================
+// 获取工作流的最新版本，enabledOnly为true时返回最新的已启用版本
+// =============================================================================
+func GetLatestWorkflowDef(stub shim.ChaincodeStubInterface, id string, enabledOnly bool) (WorkflowDef, error) {
+	versions, err := GetWorkflowVersions(stub, id)
+	if err != nil {
+		return WorkflowDef{}, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !enabledOnly || versions[i].Enabled {
+			return versions[i], nil
+		}
+	}
+	return WorkflowDef{}, errors.New("Workflow is disabled - " + id)
+}
+
+// =============================================================================
+// 为工作流定义分配下一个版本号和版本ID，只有创建机构可以生成新版本
+// =============================================================================
+func PrepareWorkflowVersion(stub shim.ChaincodeStubInterface, workflowDef *WorkflowDef, submitter string) error {
+	latest, err := GetLatestWorkflowDef(stub, workflowDef.Id, false)
+	if err != nil {
+		return err
+	}
+
+	creatorOrg, err := GetOrgFromCertCommonName(latest.Creator)
+	if err != nil {
+		return err
+	}
+	submitterOrg, err := GetOrgFromCertCommonName(submitter)
+	if err != nil {
+		return err
+	}
+	if creatorOrg != submitterOrg {
+		return errors.New("Only creator can add a version of the workflow - " + latest.BaseId)
+	}
+
+	workflowDef.BaseId = latest.BaseId
+	workflowDef.Version = latest.Version + 1
+	workflowDef.Id = GetWorkflowVersionId(latest.BaseId, workflowDef.Version)
+	return nil
+}
+
+// =============================================================================
+// 校验用户传入的工作流ID，版本ID和节点ID由系统在其后追加":v"和":node-"生成
+// =============================================================================
+func ValidateWorkflowId(id string) error {
+	if id == "" {
+		return errors.New("Workflow id is required")
+	}
+	if strings.Contains(id, ":v") || strings.Contains(id, ":node-") {
+		return errors.New("Workflow id can not contain :v or :node- - " + id)
+	}
+	return nil
+}
+
+// =============================================================================
+// 检查工作流定义及其节点的ID未被占用，避免覆盖账本上已有的数据
+// =============================================================================
+func CheckWorkflowKeysFree(stub shim.ChaincodeStubInterface, workflowId string, nodes []WorkflowNode) error {
+	keys := []string{workflowId}
+	for _, node := range nodes {
+		keys = append(keys, node.Id)
+	}
+	for _, key := range keys {
+		exists, err := KeyExists(stub, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errors.New("This id is already used - " + key)
+		}
+	}
+	return nil
+}
+
+// =============================================================================
+// 存储工作流定义，并更新文档类型和版本索引
+// =============================================================================
+func PutWorkflowDef(stub shim.ChaincodeStubInterface, workflowDef WorkflowDef) error {
+	workflowDefAsBytes, _ := json.Marshal(workflowDef)
+	err := stub.PutState(workflowDef.Id, workflowDefAsBytes) //store with id as key
+	if err != nil {
+		return err
+	}
+	err = PutIndex(stub, DocTypeIndex, "workflow", workflowDef.Id)
+	if err != nil {
+		return err
+	}
+	return PutIndex(stub, WorkflowVersionIndex, workflowDef.BaseId, IndexSeq(workflowDef.Version), workflowDef.Id)
+}
+
+// =============================================================================
+// 复制工作流节点到新版本，节点ID及节点之间的引用改为新版本的ID
+// =============================================================================
+func CopyWorkflowNodes(nodes []WorkflowNode, fromWorkflowId string, toWorkflowId string) []WorkflowNode {
+	renameNode := func(nodeId string) string {
+		return toWorkflowId + strings.TrimPrefix(nodeId, fromWorkflowId)
+	}
+	renameNodes := func(nodeIds []string) []string {
+		var results []string
+		for _, nodeId := range nodeIds {
+			results = append(results, renameNode(nodeId))
+		}
+		return results
+	}
+
+	results := make([]WorkflowNode, len(nodes))
+	for i, node := range nodes {
+		node.Id = renameNode(node.Id)
+		node.WorkflowId = toWorkflowId
+		node.PrevNodeIds = renameNodes(node.PrevNodeIds)
+		node.NextNodeIds = renameNodes(node.NextNodeIds)
+		node.OptionalNextNodeIds = renameNodes(node.OptionalNextNodeIds)
+		var routes []WorkflowRoute
+		for _, route := range node.Routes {
+			routes = append(routes, WorkflowRoute{NextNodeId: renameNode(route.NextNodeId), Condition: route.Condition})
+		}
+		node.Routes = routes
+		results[i] = node
+	}
+	return results
+}
+
 // =============================================================================
 // Get WorkflowNode By id
 // =============================================================================
@@ -172,13 +854,18 @@ func query_all_workflows(stub shim.ChaincodeStubInterface, args []string) pb.Res
 	var err error
 	fmt.Println("starting query_all_workflows")
 
-	/* 暂时无法处理分页
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 2")
 	}
-	*/
-	if len(args) != 0 {
-		return shim.Error("Incorrect number of arguments. Expecting 0")
+
+	// 传入分页参数时按书签分页
+	if len(args) > 0 {
+		result, err := GetPagingObjectsByDocType(stub, args, "workflow")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		fmt.Println("end query_all_workflows")
+		return shim.Success(result)
 	}
 
 	result, err := GetAllObjectsByDocType(stub, args, "workflow")
@@ -196,8 +883,13 @@ func query_all_workflows(stub shim.ChaincodeStubInterface, args []string) pb.Res
 func query_accessable_workflows(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	fmt.Println("starting query_accessable_workflows")
-	if len(args) != 0 {
-		return shim.Error("Incorrect number of arguments. Expecting 0")
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 2")
+	}
+
+	pageSize, bookmark, err := SanitizeBookmarkArgument(args)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
 	submitter, err := GetSubmitterName(stub)
@@ -209,14 +901,35 @@ func query_accessable_workflows(stub shim.ChaincodeStubInterface, args []string)
 		return shim.Error(err.Error())
 	}
 
-	// 目前只处理了accessOrgs匹配的情况
-	// TODO 添加角色匹配的工作流
-	var queryBuffer bytes.Buffer
-	queryBuffer.WriteString(`{"selector":{"docType":"workflow","enabled":true,"accessOrgs":{"$elemMatch":{"$eq":"`)
-	queryBuffer.WriteString(submitterOrgName)
-	queryBuffer.WriteString(`"}}}}`)
+	roles, err := GetSubmitterRoles(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	result, err := GetQueryResult(stub, queryBuffer.String())
+	// 按accessOrgs查询后，再过滤accessRoles，过滤后不足一页时继续查询
+	result, metadata, err := GetFilteredQueryResultByPage(stub, GetAccessableWorkflowsQuery(submitterOrgName), pageSize, bookmark, func(records []byte) ([]byte, error) {
+		var workflowDefs []WorkflowDef
+		err := json.Unmarshal(records, &workflowDefs)
+		if err != nil {
+			return nil, err
+		}
+		// 同一工作流只返回最新的已启用版本
+		accessableDefs := []WorkflowDef{}
+		for _, workflowDef := range workflowDefs {
+			latest, err := GetLatestWorkflowDef(stub, workflowDef.Id, true)
+			if err != nil || latest.Id != workflowDef.Id {
+				continue
+			}
+			if HasAccessRole(latest.AccessRoles, roles) {
+				accessableDefs = append(accessableDefs, latest)
+			}
+		}
+		return json.Marshal(accessableDefs)
+	})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	result, err = MarshalPageResult(result, metadata)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -225,6 +938,12 @@ func query_accessable_workflows(stub shim.ChaincodeStubInterface, args []string)
 	return shim.Success(result)
 }
 
+// 机构可发起的已启用工作流的查询语句
+func GetAccessableWorkflowsQuery(orgName string) *Query {
+	return NewQuery("workflow").Eq("enabled", true).ElemMatch("accessOrgs", Selector{"$eq": orgName}).
+		UseIndex("indexAccessableWorkflows").ScanIndex(DocTypeIndex, "workflow")
+}
+
 // ========================================================
 // 查询流程全部节点
 // ========================================================
@@ -233,12 +952,7 @@ func GetAllNodesByWorkflowId(stub shim.ChaincodeStubInterface, workflowId string
 	var results []WorkflowNode
 	fmt.Println("starting queryAllNodesByWorkflowId")
 
-	var queryBuffer bytes.Buffer
-	queryBuffer.WriteString(`{"selector":{"docType":"workflowNode", "workflowId":"`)
-	queryBuffer.WriteString(workflowId)
-	queryBuffer.WriteString(`"}}`)
-
-	resultAsBytes, err := GetQueryResult(stub, queryBuffer.String())
+	resultAsBytes, err := ExecuteQuery(stub, GetNodesQueryByWorkflowId(workflowId))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -252,6 +966,11 @@ func GetAllNodesByWorkflowId(stub shim.ChaincodeStubInterface, workflowId string
 	return results, resultAsBytes, nil
 }
 
+// 工作流全部节点的查询语句
+func GetNodesQueryByWorkflowId(workflowId string) *Query {
+	return NewQuery("workflowNode").Eq("workflowId", workflowId).UseIndex("indexWorkflowNodes").ScanIndex(WorkflowNodeIndex, workflowId)
+}
+
 // =============================================================================
 // 流程详情
 // =============================================================================
@@ -286,6 +1005,36 @@ func get_workflow_by_id(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 	return shim.Success(workflowAsBytes)
 }
 
+// =============================================================================
+// 查询工作流的全部版本，按版本号升序
+// =============================================================================
+func query_workflow_versions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("starting query_workflow_versions")
+
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	id := args[0]
+	versions, err := GetWorkflowVersions(stub, id)
+	if err != nil {
+		fmt.Println("This workflow does not exist - " + id)
+		return shim.Error("This workflow does not exist - " + id)
+	}
+	versionsAsBytes, _ := json.Marshal(versions)
+
+	fmt.Println("- end query_workflow_versions")
+	return shim.Success(versionsAsBytes)
+}
+
+// =============================================================================
+// 判断机构是否可见工作流：创建机构和可使用该工作流的机构可见
+// =============================================================================
+func CanOrgSeeWorkflow(workflowDef WorkflowDef, orgName string) bool {
+	creatorOrgName, _ := GetOrgFromCertCommonName(workflowDef.Creator)
+	return creatorOrgName == orgName || ContainsString(workflowDef.AccessOrgs, orgName)
+}
+
 // =============================================================================
 // 禁用/启用流程
 // =============================================================================
@@ -303,7 +1052,11 @@ func enable_or_disable_workflow(stub shim.ChaincodeStubInterface, args []string)
 		return shim.Error(err.Error())
 	}
 
-	modifyTime := args[2]
+	businessDate := args[2]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	submitter, err := GetSubmitterName(stub)
 	if err != nil {
@@ -338,6 +1091,7 @@ func enable_or_disable_workflow(stub shim.ChaincodeStubInterface, args []string)
 
 	workflowDef.Enabled = enabled
 	workflowDef.ModifyTime = modifyTime
+	workflowDef.BusinessDate = businessDate
 
 	//store
 	workflowDefAsBytes, _ := json.Marshal(workflowDef)
@@ -352,6 +1106,8 @@ func enable_or_disable_workflow(stub shim.ChaincodeStubInterface, args []string)
 
 // =============================================================================
 // 更新流程信息
+// 已有版本不修改，以最新版本为基础生成新版本并复制节点，
+// 已发起的流程仍使用原版本，可通过migrate_process迁移
 // =============================================================================
 func modify_workflow_def(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
@@ -366,17 +1122,26 @@ func modify_workflow_def(stub shim.ChaincodeStubInterface, args []string) pb.Res
 	}
 
 	id := args[0]
-	modifyTime := args[1]
+	businessDate := args[1]
+	modifyTime, err := GetModifyTime(stub, businessDate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	submitter, err := GetSubmitterName(stub)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	workflowDef, err := GetWorkflowDefById(stub, id)
+	workflowDef, err := GetLatestWorkflowDef(stub, id, false)
 	if err != nil {
 		fmt.Println("This workflow def does not exist - " + id)
 		return shim.Error("This workflow def does not exist - " + id)
 	}
+	workflowNodes, _, err := GetAllNodesByWorkflowId(stub, workflowDef.Id)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fromWorkflowId := workflowDef.Id
 
 	for i := 2; i < len(args); i = i + 2 {
 		key := args[i]
@@ -387,13 +1152,37 @@ func modify_workflow_def(stub shim.ChaincodeStubInterface, args []string) pb.Res
 		}
 	}
 
-	// append Modifiers
+	// 生成新版本
+	err = PrepareWorkflowVersion(stub, &workflowDef, submitter)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	workflowDef.Creator = submitter
 	workflowDef.LastModifier = submitter
+	workflowDef.CreateTime = modifyTime
 	workflowDef.ModifyTime = modifyTime
+	workflowDef.BusinessDate = businessDate
 
-	//store
-	workflowDefAsBytes, _ := json.Marshal(workflowDef)
-	err = stub.PutState(id, workflowDefAsBytes) //store with id as key
+	workflowNodes = CopyWorkflowNodes(workflowNodes, fromWorkflowId, workflowDef.Id)
+	err = CheckWorkflowKeysFree(stub, workflowDef.Id, workflowNodes)
+	if err != nil {
+		fmt.Println(err.Error())
+		return shim.Error(err.Error())
+	}
+	for i := 0; i < len(workflowNodes); i++ {
+		workflowNodeAsBytes, _ := json.Marshal(workflowNodes[i])
+		err = stub.PutState(workflowNodes[i].Id, workflowNodeAsBytes) //store with id as key
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = PutIndex(stub, WorkflowNodeIndex, workflowDef.Id, IndexSeq(i), workflowNodes[i].Id)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	err = PutWorkflowDef(stub, workflowDef)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
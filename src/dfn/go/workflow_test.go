@@ -97,69 +97,111 @@ func Test_CreateLinearWorkflow(t *testing.T) {
 		fmt.Println(string(response.Message))
 		t.FailNow()
 	}
-	// 重复id将报错
-	response = MockCreateLinearWorkflow1(t, stub)
+	// 创建机构使用已有id发布新版本，节点按新的参数生成
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_linear_workflow"),
+		[]byte(`{"id":"test_linear_workflow-001","workflowName":"测试线性流程001","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`{"nodeName":"发起行","accessOrgs":["@org1.example.com"]}`),
+		[]byte(`{"nodeName":"发行机构","accessOrgs":["@org1.example.com"]}`),
+	})
+	if response.Status != shim.OK {
+		fmt.Println(string(response.Message))
+		t.FailNow()
+	}
+	var def WorkflowDef
+	json.Unmarshal(stub.State["test_linear_workflow-001:v2"], &def)
+	var node WorkflowNode
+	json.Unmarshal(stub.State["test_linear_workflow-001:v2:node-2"], &node)
+	if def.Version != 2 || def.BaseId != "test_linear_workflow-001" || !node.LastNode || node.NodeName != "发行机构" {
+		fmt.Println("New version is incorrect")
+		t.FailNow()
+	}
+	// 其他机构不可使用已有id
+	response = MockInvokeAsUser(t, stub, "Test@org2.example.com", "create_linear_workflow",
+		`{"id":"test_linear_workflow-001","workflowName":"测试线性流程001","createTime":"2018-3-16 16:08:51"}`,
+		`{"nodeName":"发起行","accessOrgs":["@org2.example.com"]}`)
 	if response.Status != shim.ERROR {
 		fmt.Println("应该不可重复添加ID")
 		t.FailNow()
 	}
+	// 版本ID由系统生成，不可传入
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_linear_workflow"),
+		[]byte(`{"id":"test_linear_workflow-001:v2","workflowName":"测试线性流程001","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`{"nodeName":"发起行","accessOrgs":["@org1.example.com"]}`),
+	})
+	if response.Status != shim.ERROR {
+		fmt.Println("工作流ID不可包含:v")
+		t.FailNow()
+	}
+	// 节点ID已被占用时报错，不覆盖已有数据
+	stub.State["test_linear_workflow-003:node-1"] = []byte(`{"docType":"project","id":"test_linear_workflow-003:node-1"}`)
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_linear_workflow"),
+		[]byte(`{"id":"test_linear_workflow-003","workflowName":"测试线性流程003","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`{"nodeName":"发起行","accessOrgs":["@org1.example.com"]}`),
+	})
+	if response.Status != shim.ERROR {
+		fmt.Println("节点ID已被占用时应报错")
+		t.FailNow()
+	}
 }
 
 func Test_GetWorkflowById(t *testing.T) {
-	// 由于mock引擎还没有实现GetQueryResult，测试将直接失败
+	// mock引擎不支持富查询，按复合键索引查询
 	stub := GetMockStub()
 	MockInit(t, stub)
 	MockCreateLinearWorkflow1(t, stub)
 	response := MockGetWorkflowByID(t, stub)
 	if response.Status != shim.OK {
 		fmt.Println(response.GetMessage())
-		// t.FailNow()
+		t.FailNow()
 	}
 	var result Workflow
 	json.Unmarshal(response.Payload, &result)
 	if result.WorkflowDef.WorkflowName != "测试线性流程001" {
 		fmt.Println("WorkflowName is incorrect")
-		// t.FailNow()
+		t.FailNow()
 	}
 	if len(result.WorkflowNodes) != 3 {
 		fmt.Println("WorkflowNodes is incorrect")
-		// t.FailNow()
+		t.FailNow()
 	}
 }
 
 func Test_QueryAllWorkflow(t *testing.T) {
-	// 由于mock引擎还没有实现GetQueryResult，测试将直接失败
+	// mock引擎不支持富查询，按复合键索引查询
 	stub := GetMockStub()
 	MockInit(t, stub)
 	MockCreateLinearWorkflow1(t, stub)
 	response := MockQueryAllWorkflow(t, stub)
 	if response.Status != shim.OK {
 		fmt.Println(response.GetMessage())
-		// t.FailNow()
+		t.FailNow()
 	}
     var result []interface{}
 	json.Unmarshal(response.Payload, &result)
 	if len(result) != 1 {
 		fmt.Println("应有1条")
-		// t.FailNow()
+		t.FailNow()
 	}
 }
 
 func Test_QueryAccessableWorkflow(t *testing.T) {
-	// 由于mock引擎还没有实现GetQueryResult，测试将直接失败
+	// mock引擎不支持富查询，按复合键索引查询
 	stub := GetMockStub()
 	MockInit(t, stub)
 	MockCreateLinearWorkflow1(t, stub)
 	response := MockQueryAccessableWorkflow(t, stub)
 	if response.Status != shim.OK {
 		fmt.Println(response.GetMessage())
-		// t.FailNow()
+		t.FailNow()
 	}
     var result []interface{}
 	json.Unmarshal(response.Payload, &result)
 	if len(result) != 1 {
 		fmt.Println("应有1条")
-		// t.FailNow()
+		t.FailNow()
 	}
 }
 
@@ -207,10 +249,32 @@ func Test_ModifyWorkflow(t *testing.T) {
 		fmt.Println(response.GetMessage())
 		t.FailNow()
 	}
-	state := stub.State["test_linear_workflow-001"]
+	// 修改生成新版本，原版本不变
+	var origin WorkflowDef
+	json.Unmarshal(stub.State["test_linear_workflow-001"], &origin)
+	if origin.WorkflowName != "测试线性流程001" || origin.Version != 1 {
+		fmt.Println("Origin version should not be modified")
+		t.FailNow()
+	}
+	state := stub.State["test_linear_workflow-001:v2"]
 	var result WorkflowDef
 	json.Unmarshal(state, &result)
-	if result.ModifyTime != "2018-03-16 15:54:00" {
+	if result.Version != 2 || result.BaseId != "test_linear_workflow-001" {
+		fmt.Println("Version is incorrect")
+		t.FailNow()
+	}
+	var node WorkflowNode
+	json.Unmarshal(stub.State["test_linear_workflow-001:v2:node-2"], &node)
+	if node.WorkflowId != "test_linear_workflow-001:v2" || len(node.NextNodeIds) != 1 || node.NextNodeIds[0] != "test_linear_workflow-001:v2:node-3" {
+		fmt.Println("Nodes of new version are incorrect")
+		t.FailNow()
+	}
+	if result.BusinessDate != "2018-03-16 15:54:00" {
+		fmt.Println("BusinessDate is incorrect")
+		t.FailNow()
+	}
+	// 修改时间为交易时间，晚于创建时间
+	if result.ModifyTime < result.CreateTime {
 		fmt.Println("ModifyTime is incorrect")
 		t.FailNow()
 	}
@@ -218,4 +282,198 @@ func Test_ModifyWorkflow(t *testing.T) {
 		fmt.Println("WorkflowName is incorrect")
 		t.FailNow()
 	}
-}
\ No newline at end of file
+}
+
+// 测试工作流版本
+func Test_WorkflowVersions(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	MockCreateLinearWorkflow1(t, stub)
+	MockModifyWorkflowDef(t, stub)
+	response := MockModifyWorkflowDef(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(response.GetMessage())
+		t.FailNow()
+	}
+	// 任一版本ID均可查询全部版本
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("query_workflow_versions"),
+		[]byte("test_linear_workflow-001:v2"),
+	})
+	var versions []WorkflowDef
+	json.Unmarshal(response.Payload, &versions)
+	if len(versions) != 3 || versions[0].Id != "test_linear_workflow-001" || versions[2].Id != "test_linear_workflow-001:v3" {
+		fmt.Println("Versions are incorrect")
+		t.FailNow()
+	}
+	// 可用流程只返回最新的已启用版本
+	response = MockQueryAccessableWorkflow(t, stub)
+	var defs []WorkflowDef
+	json.Unmarshal(response.Payload, &defs)
+	if len(defs) != 1 || defs[0].Id != "test_linear_workflow-001:v3" {
+		fmt.Println("Accessable workflows are incorrect")
+		t.FailNow()
+	}
+	// 分页时过滤后不足一页继续读取
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{[]byte("query_accessable_workflows"), []byte("1"), []byte("")})
+	var page PageResult
+	json.Unmarshal(response.Payload, &page)
+	defs = nil
+	json.Unmarshal(page.Records, &defs)
+	if len(defs) != 1 || defs[0].Id != "test_linear_workflow-001:v3" || page.FetchedCount != 1 {
+		fmt.Println("Accessable workflows page is incorrect", string(response.Payload))
+		t.FailNow()
+	}
+	// 新版本的ID已被占用时报错
+	stub.State["test_linear_workflow-001:v4"] = []byte(`{"docType":"project","id":"test_linear_workflow-001:v4"}`)
+	response = MockModifyWorkflowDef(t, stub)
+	if response.Status != shim.ERROR {
+		fmt.Println("版本ID已被占用时应报错")
+		t.FailNow()
+	}
+}
+
+// mock 创建一个带并行分支的图工作流
+func MockCreateGraphWorkflow1(t *testing.T, stub *shim.MockStub) pb.Response {
+	response := stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_graph_workflow"),
+		[]byte(`{"id":"test_graph_workflow-001","workflowName":"测试图流程001","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`[{"id":"start","nodeName":"发起行","accessOrgs":["@org1.example.com"],"splitType":"parallel"},{"id":"lawyer","nodeName":"律师","accessOrgs":["@org1.example.com"]},{"id":"rater","nodeName":"评级机构","accessOrgs":["@org1.example.com"]},{"id":"join","nodeName":"受托机构","accessOrgs":["@org1.example.com"],"joinType":"all"},{"id":"end","nodeName":"发行机构","accessOrgs":["@org1.example.com"]}]`),
+		[]byte(`[{"from":"start","to":"lawyer"},{"from":"start","to":"rater"},{"from":"lawyer","to":"join"},{"from":"rater","to":"join"},{"from":"join","to":"end"}]`),
+	})
+	return response
+}
+
+// 测试创建图工作流
+func Test_CreateGraphWorkflow(t *testing.T) {
+	stub := GetMockStub()
+	MockInit(t, stub)
+	response := MockCreateGraphWorkflow1(t, stub)
+	if response.Status != shim.OK {
+		fmt.Println(string(response.Message))
+		t.FailNow()
+	}
+	var def WorkflowDef
+	json.Unmarshal(stub.State["test_graph_workflow-001"], &def)
+	if def.SubDocType != "graph" {
+		fmt.Println("SubDocType is incorrect")
+		t.FailNow()
+	}
+	var node WorkflowNode
+	json.Unmarshal(stub.State["test_graph_workflow-001:node-join"], &node)
+	if len(node.PrevNodeIds) != 2 || node.JoinType != "all" {
+		fmt.Println("Join node is incorrect")
+		t.FailNow()
+	}
+	// 创建机构使用已有id发布新版本，节点和边按新的参数校验生成
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_graph_workflow"),
+		[]byte(`{"id":"test_graph_workflow-001","workflowName":"测试图流程001","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`[{"id":"start","nodeName":"发起行","accessOrgs":["@org1.example.com"]},{"id":"end","nodeName":"发行机构","accessOrgs":["@org1.example.com"]}]`),
+		[]byte(`[{"from":"start","to":"end"}]`),
+	})
+	if response.Status != shim.OK {
+		fmt.Println(string(response.Message))
+		t.FailNow()
+	}
+	json.Unmarshal(stub.State["test_graph_workflow-001:v2:node-start"], &node)
+	if len(node.NextNodeIds) != 1 || node.NextNodeIds[0] != "test_graph_workflow-001:v2:node-end" {
+		fmt.Println("Nodes of new version are incorrect")
+		t.FailNow()
+	}
+	// 新版本同样需要通过图校验
+	response = stub.MockInvoke(GetTestTxID(), [][]byte{
+		[]byte("create_graph_workflow"),
+		[]byte(`{"id":"test_graph_workflow-001","workflowName":"测试图流程001","createTime":"2018-3-16 16:08:51"}`),
+		[]byte(`[{"id":"start","nodeName":"发起行","accessOrgs":["@org1.example.com"]},{"id":"end","nodeName":"发行机构","accessOrgs":["@org1.example.com"]}]`),
+		[]byte(`[{"from":"start","to":"end"},{"from":"end","to":"start"}]`),
+	})
+	if response.Status != shim.ERROR {
+		fmt.Println("新版本的环路应报错")
+		t.FailNow()
+	}
+	// 其他机构不可使用已有id
+	response = MockInvokeAsUser(t, stub, "Test@org2.example.com", "create_graph_workflow",
+		`{"id":"test_graph_workflow-001","workflowName":"测试图流程001","createTime":"2018-3-16 16:08:51"}`,
+		`[{"id":"start","nodeName":"发起行","accessOrgs":["@org2.example.com"]}]`, `[]`)
+	if response.Status != shim.ERROR {
+		fmt.Println("应该不可重复添加ID")
+		t.FailNow()
+	}
+}
+
+// 测试图工作流校验
+func Test_BuildWorkflowGraph(t *testing.T) {
+	nodes := []WorkflowNode{{Id: "a"}, {Id: "b"}, {Id: "c"}}
+
+	// 多个开始节点
+	_, err := BuildWorkflowGraph("wf", nodes, []WorkflowEdge{{From: "a", To: "c"}, {From: "b", To: "c"}}, false)
+	if err == nil {
+		fmt.Println("多个开始节点应报错")
+		t.FailNow()
+	}
+	// 孤立节点
+	_, err = BuildWorkflowGraph("wf", nodes, []WorkflowEdge{{From: "a", To: "b"}, {From: "c", To: "c"}}, true)
+	if err == nil {
+		fmt.Println("孤立节点应报错")
+		t.FailNow()
+	}
+	// 环路
+	edges := []WorkflowEdge{{From: "a", To: "b"}, {From: "b", To: "a"}, {From: "b", To: "c"}}
+	nodes = []WorkflowNode{{Id: "s"}, {Id: "a"}, {Id: "b"}, {Id: "c"}}
+	edges = append(edges, WorkflowEdge{From: "s", To: "a"})
+	_, err = BuildWorkflowGraph("wf", nodes, edges, false)
+	if err == nil {
+		fmt.Println("未允许环路时应报错")
+		t.FailNow()
+	}
+	results, err := BuildWorkflowGraph("wf", nodes, edges, true)
+	if err != nil {
+		fmt.Println(err.Error())
+		t.FailNow()
+	}
+	if !results[0].FirstNode || !results[3].LastNode || results[3].Id != "wf:node-c" {
+		fmt.Println("节点生成不正确")
+		t.FailNow()
+	}
+	// 无法到达结束节点
+	nodes = []WorkflowNode{{Id: "s"}, {Id: "a"}, {Id: "b"}, {Id: "c"}}
+	edges = []WorkflowEdge{{From: "s", To: "a"}, {From: "s", To: "c"}, {From: "a", To: "b"}, {From: "b", To: "a"}}
+	_, err = BuildWorkflowGraph("wf", nodes, edges, true)
+	if err == nil {
+		fmt.Println("无法到达结束节点应报错")
+		t.FailNow()
+	}
+	// 并行分支到达不同的结束节点
+	nodes = []WorkflowNode{{Id: "s", SplitType: "parallel"}, {Id: "a"}, {Id: "b"}}
+	edges = []WorkflowEdge{{From: "s", To: "a"}, {From: "s", To: "b"}}
+	_, err = BuildWorkflowGraph("wf", nodes, edges, false)
+	if err == nil {
+		fmt.Println("并行分支未汇聚应报错")
+		t.FailNow()
+	}
+	// 并行分支分别汇聚后到达不同的结束节点
+	nodes = []WorkflowNode{{Id: "s", SplitType: "parallel"}, {Id: "a"}, {Id: "b"}, {Id: "ja", JoinType: "all"}, {Id: "jb", JoinType: "all"}}
+	edges = []WorkflowEdge{{From: "s", To: "a"}, {From: "s", To: "b"}, {From: "a", To: "ja"}, {From: "b", To: "jb"}}
+	_, err = BuildWorkflowGraph("wf", nodes, edges, false)
+	if err == nil {
+		fmt.Println("并行分支没有公共汇聚节点应报错")
+		t.FailNow()
+	}
+	// 分支中的单选可以绕过汇聚节点
+	nodes = []WorkflowNode{{Id: "s", SplitType: "parallel"}, {Id: "a"}, {Id: "b"}, {Id: "j", JoinType: "all"}, {Id: "e"}}
+	edges = []WorkflowEdge{{From: "s", To: "a"}, {From: "s", To: "b"}, {From: "a", To: "j"}, {From: "a", To: "e"}, {From: "b", To: "j"}, {From: "j", To: "e"}}
+	_, err = BuildWorkflowGraph("wf", nodes, edges, false)
+	if err == nil {
+		fmt.Println("分支绕过汇聚节点应报错")
+		t.FailNow()
+	}
+	// 嵌套的并行分支逐级汇聚
+	nodes = []WorkflowNode{{Id: "s", SplitType: "parallel"}, {Id: "a", SplitType: "parallel"}, {Id: "b"}, {Id: "c"}, {Id: "d"}, {Id: "j1", JoinType: "all"}, {Id: "j2", JoinType: "all"}, {Id: "e"}}
+	edges = []WorkflowEdge{{From: "s", To: "a"}, {From: "s", To: "b"}, {From: "a", To: "c"}, {From: "a", To: "d"}, {From: "c", To: "j1"}, {From: "d", To: "j1"}, {From: "j1", To: "j2"}, {From: "b", To: "j2"}, {From: "j2", To: "e"}}
+	_, err = BuildWorkflowGraph("wf", nodes, edges, false)
+	if err != nil {
+		fmt.Println(err.Error())
+		t.FailNow()
+	}
+}